@@ -0,0 +1,113 @@
+package irtt
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL is an access control list of source IP prefixes. Deny prefixes take
+// precedence over Allow prefixes, and if Allow is not empty, sources that match
+// none of its prefixes are denied.
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// empty returns true if the ACL has no prefixes.
+func (a *ACL) empty() bool {
+	return len(a.Allow) == 0 && len(a.Deny) == 0
+}
+
+// denies returns the reason ip is denied by the ACL, or an empty string if it's
+// allowed.
+func (a *ACL) denies(ip net.IP) string {
+	for _, n := range a.Deny {
+		if n.Contains(ip) {
+			return fmt.Sprintf("%s in deny %s", ip, n)
+		}
+	}
+	if len(a.Allow) == 0 {
+		return ""
+	}
+	for _, n := range a.Allow {
+		if n.Contains(ip) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s not in allow list", ip)
+}
+
+// ParseACLPrefix parses an IP prefix in CIDR notation for an ACL, or an IP
+// address, which is a prefix with the full length. IPv4-mapped IPv6 prefixes
+// are converted to IPv4 prefixes, so they match IPv4 sources.
+func ParseACLPrefix(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, Errorf(InvalidACLPrefix, "invalid IP address %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, Errorf(InvalidACLPrefix, "invalid IP prefix %s", s)
+	}
+	if ones, _ := n.Mask.Size(); len(n.IP) == net.IPv6len && ones >= 96 {
+		if ip4 := n.IP.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 32)}, nil
+		}
+	}
+	return n, nil
+}
+
+// ACLPolicy selects what the server does with open requests from sources
+// denied by the ACLs.
+type ACLPolicy int
+
+// ACLPolicy constants.
+const (
+	// ACLClose parses packets from denied sources, and sends a close reply to
+	// opens. Other packets are dropped.
+	ACLClose ACLPolicy = iota
+
+	// ACLDrop drops all packets from denied sources before parsing them.
+	ACLDrop
+)
+
+var aps = [...]string{"close", "drop"}
+
+func (ap ACLPolicy) String() string {
+	if int(ap) < 0 || int(ap) >= len(aps) {
+		return fmt.Sprintf("ACLPolicy:%d", ap)
+	}
+	return aps[ap]
+}
+
+// ParseACLPolicy returns an ACLPolicy from a string.
+func ParseACLPolicy(s string) (ACLPolicy, error) {
+	for i, v := range aps {
+		if s == v {
+			return ACLPolicy(i), nil
+		}
+	}
+	return ACLClose, Errorf(InvalidACLPolicy, "invalid ACLPolicy string: %s", s)
+}
+
+// denied returns the reason ip is denied by the server's ACL, or the ACL for
+// the listener, or an empty string if it's allowed. It must be called with mtx
+// held.
+func (l *listener) denied(ip net.IP) string {
+	if d := l.ACL.denies(ip); d != "" {
+		return d
+	}
+	if len(l.ListenerACLs) > 0 {
+		if a, ok := l.ListenerACLs[l.laddr]; ok {
+			return a.denies(ip)
+		}
+	}
+	return ""
+}
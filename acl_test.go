@@ -0,0 +1,113 @@
+package irtt
+
+import (
+	"net"
+	"testing"
+)
+
+// testACL returns an ACL with the allow and deny prefixes.
+func testACL(t *testing.T, allow, deny []string) *ACL {
+	a := &ACL{}
+	for _, s := range allow {
+		n, err := ParseACLPrefix(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Allow = append(a.Allow, n)
+	}
+	for _, s := range deny {
+		n, err := ParseACLPrefix(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Deny = append(a.Deny, n)
+	}
+	return a
+}
+
+// TestACLDenies tests deny precedence, empty allow lists and IPv4-mapped IPv6
+// sources.
+func TestACLDenies(t *testing.T) {
+	tests := []struct {
+		allow  []string
+		deny   []string
+		ip     string
+		denied bool
+	}{
+		// empty ACL allows all
+		{nil, nil, "192.0.2.1", false},
+		{nil, nil, "2001:db8::1", false},
+		// empty allow list allows all but denied
+		{nil, []string{"192.0.2.0/24"}, "192.0.2.1", true},
+		{nil, []string{"192.0.2.0/24"}, "198.51.100.1", false},
+		{nil, []string{"2001:db8::/32"}, "2001:db8:1::1", true},
+		{nil, []string{"2001:db8::/32"}, "192.0.2.1", false},
+		// allow list denies all others
+		{[]string{"192.0.2.0/24"}, nil, "192.0.2.255", false},
+		{[]string{"192.0.2.0/24"}, nil, "192.0.3.0", true},
+		{[]string{"192.0.2.0/24"}, nil, "2001:db8::1", true},
+		{[]string{"2001:db8::/32", "192.0.2.1"}, nil, "192.0.2.1", false},
+		{[]string{"2001:db8::/32", "192.0.2.1"}, nil, "192.0.2.2", true},
+		// deny takes precedence over allow
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, "192.0.2.1",
+			false},
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, "192.0.2.129",
+			true},
+		{[]string{"192.0.2.1"}, []string{"192.0.2.1"}, "192.0.2.1", true},
+		{[]string{"2001:db8::/32"}, []string{"2001:db8::1"}, "2001:db8::1",
+			true},
+		// IPv4-mapped IPv6 sources match IPv4 prefixes
+		{nil, []string{"192.0.2.0/24"}, "::ffff:192.0.2.1", true},
+		{[]string{"192.0.2.0/24"}, nil, "::ffff:192.0.2.1", false},
+		{[]string{"192.0.2.0/24"}, nil, "::ffff:198.51.100.1", true},
+		// and IPv4-mapped IPv6 prefixes match IPv4 sources
+		{nil, []string{"::ffff:192.0.2.0/120"}, "192.0.2.1", true},
+		{nil, []string{"::ffff:192.0.2.0/120"}, "::ffff:192.0.2.1", true},
+		{nil, []string{"::ffff:192.0.2.1"}, "192.0.2.1", true},
+		{[]string{"::ffff:0:0/96"}, nil, "198.51.100.1", false},
+		{[]string{"::ffff:0:0/96"}, nil, "2001:db8::1", true},
+	}
+	for _, tc := range tests {
+		a := testACL(t, tc.allow, tc.deny)
+		d := a.denies(net.ParseIP(tc.ip))
+		if (d != "") != tc.denied {
+			t.Errorf("allow %v deny %v: %s denied %t (%q), expected %t",
+				tc.allow, tc.deny, tc.ip, d != "", d, tc.denied)
+		}
+	}
+}
+
+// TestParseACLPrefix tests parsing prefixes and addresses.
+func TestParseACLPrefix(t *testing.T) {
+	tests := []struct {
+		s      string
+		expect string
+	}{
+		{"192.0.2.0/24", "192.0.2.0/24"},
+		{"192.0.2.1/24", "192.0.2.0/24"},
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"::ffff:192.0.2.1", "192.0.2.1/32"},
+		{"::ffff:192.0.2.0/120", "192.0.2.0/24"},
+		{"::ffff:0:0/96", "0.0.0.0/0"},
+		{"::/0", "::/0"},
+		{"0.0.0.0/0", "0.0.0.0/0"},
+	}
+	for _, tc := range tests {
+		n, err := ParseACLPrefix(tc.s)
+		if err != nil {
+			t.Errorf("%s: %s", tc.s, err)
+			continue
+		}
+		if n.String() != tc.expect {
+			t.Errorf("%s parsed as %s, expected %s", tc.s, n, tc.expect)
+		}
+	}
+	for _, s := range []string{"", "nope", "192.0.2.0/33", "192.0.2/24",
+		"2001:db8::/129", "192.0.2.1@x", "192.0.2.0/"} {
+		if _, err := ParseACLPrefix(s); !isErrorCode(InvalidACLPrefix, err) {
+			t.Errorf("%q: expected InvalidACLPrefix, got %v", s, err)
+		}
+	}
+}
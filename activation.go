@@ -0,0 +1,79 @@
+package irtt
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// first file descriptor passed with socket activation (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// ActivationConns returns the UDP sockets passed to the process with systemd
+// style socket activation, through the LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES environment variables, which are then unset so they aren't
+// inherited by child processes. If no sockets were passed to this process, nil
+// is returned. All passed sockets must be UDP sockets. The returned conns may
+// be used for ServerConfig.Conns.
+func ActivationConns() (conns []*net.UDPConn, err error) {
+	pid := os.Getenv("LISTEN_PID")
+	nfds := os.Getenv("LISTEN_FDS")
+	if pid == "" || nfds == "" {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if p, perr := strconv.Atoi(pid); perr != nil || p != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(nfds)
+	if err != nil || n < 0 {
+		err = Errorf(InvalidListenFDs, "invalid LISTEN_FDS value %s", nfds)
+		return
+	}
+	defer func() {
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			conns = nil
+		}
+	}()
+	for i := 0; i < n; i++ {
+		name := "fd" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		var c *net.UDPConn
+		if c, err = fileUDPConn(uintptr(listenFDsStart+i), name); err != nil {
+			return
+		}
+		conns = append(conns, c)
+	}
+	return
+}
+
+// fileUDPConn returns a UDPConn for a file descriptor. The descriptor is
+// duplicated by the net package, and the original is closed.
+func fileUDPConn(fd uintptr, name string) (*net.UDPConn, error) {
+	f := os.NewFile(fd, name)
+	if f == nil {
+		return nil, Errorf(InvalidListenFDs, "invalid file descriptor %d for %s",
+			fd, name)
+	}
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, Errorf(NonUDPListenFD, "socket %s is not a UDP socket (%s)",
+			name, err)
+	}
+	c, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, Errorf(NonUDPListenFD, "socket %s is not a UDP socket", name)
+	}
+	return c, nil
+}
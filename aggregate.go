@@ -0,0 +1,220 @@
+package irtt
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AggregateHandler reduces repeated events before passing them to another
+// Handler. Events with the same Code, remote address and error Code (for
+// events with an Error in their Detail, like Drop) are merged over each
+// window, so only the first is passed on immediately, and the rest are passed
+// on as one event with a Count at the end of the window. Events for each Code
+// are also limited to a rate, with bursts of up to one second, and events over
+// the rate are counted in one event for each Code at the end of the window (or
+// each second if the window is 0). The first event with each error Code in a
+// window is always passed on. Events with no remote address are passed on
+// unchanged.
+type AggregateHandler struct {
+	Handler Handler
+	window  time.Duration
+	rate    float64
+	entries map[aggKey]*aggEntry
+	order   []*aggEntry
+	codes   map[Code]*aggCode
+	errs    map[Code]bool
+	timer   *time.Timer
+	now     func() time.Time
+	mtx     sync.Mutex
+}
+
+// aggKey identifies identical events.
+type aggKey struct {
+	code    Code
+	errCode Code
+	raddr   string
+}
+
+// aggEntry is the first of a set of identical events in a window, and the
+// number of them not yet passed on.
+type aggEntry struct {
+	e       *Event
+	errCode Code
+	n       int
+}
+
+// aggCode is the rate limit state for a Code.
+type aggCode struct {
+	tokens     float64
+	updated    time.Time
+	suppressed int
+}
+
+// NewAggregateHandler returns a new AggregateHandler that passes events to h,
+// merging identical events over window, or not if window is 0, and limiting
+// events for each Code to rate per second, or not if rate is 0.
+func NewAggregateHandler(h Handler, window time.Duration,
+	rate float64) *AggregateHandler {
+	a := &AggregateHandler{
+		Handler: h,
+		entries: make(map[aggKey]*aggEntry),
+		codes:   make(map[Code]*aggCode),
+		errs:    make(map[Code]bool),
+		now:     time.Now,
+	}
+	a.SetLimits(window, rate)
+	return a
+}
+
+// SetLimits flushes any pending events and sets a new window and rate.
+func (a *AggregateHandler) SetLimits(window time.Duration, rate float64) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.flush()
+	a.window = window
+	a.rate = rate
+	a.codes = make(map[Code]*aggCode)
+}
+
+// OnEvent merges or limits an event, or passes it on.
+func (a *AggregateHandler) OnEvent(e *Event) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if e.RemoteAddr == nil || (a.window == 0 && a.rate == 0) {
+		a.Handler.OnEvent(e)
+		return
+	}
+	ec := errorCode(e)
+	k := aggKey{e.Code, ec, e.RemoteAddr.String()}
+	if en, ok := a.entries[k]; ok {
+		en.n++
+		return
+	}
+	var en *aggEntry
+	if a.window > 0 {
+		en = &aggEntry{e: freeze(e), errCode: ec}
+		a.entries[k] = en
+		a.order = append(a.order, en)
+		a.schedule()
+	}
+	if a.allow(e.Code, ec, a.now()) {
+		a.Handler.OnEvent(e)
+	} else if en != nil {
+		en.n++
+	} else {
+		a.codes[e.Code].suppressed++
+		a.schedule()
+	}
+}
+
+// Flush passes on any pending events immediately.
+func (a *AggregateHandler) Flush() {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.flush()
+}
+
+// allow returns true if an event with code and error code ec is within the
+// rate for code, or is the first with its error code in the window. It must be
+// called with mtx held.
+func (a *AggregateHandler) allow(code, ec Code, now time.Time) bool {
+	if a.rate == 0 {
+		return true
+	}
+	c := a.codes[code]
+	if c == nil {
+		c = &aggCode{tokens: a.rate, updated: now}
+		a.codes[code] = c
+	} else {
+		c.tokens = refill(c.tokens, a.rate, now.Sub(c.updated).Seconds())
+		c.updated = now
+	}
+	if ec == 0 && code.IsError() {
+		ec = code
+	}
+	if ec != 0 && !a.errs[ec] {
+		a.errs[ec] = true
+		a.schedule()
+		c.tokens--
+		return true
+	}
+	if c.tokens < 0 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+// schedule starts the timer to flush at the end of the window, if it's not
+// already started. It must be called with mtx held.
+func (a *AggregateHandler) schedule() {
+	if a.timer != nil {
+		return
+	}
+	d := a.window
+	if d == 0 {
+		d = time.Second
+	}
+	a.timer = time.AfterFunc(d, a.Flush)
+}
+
+// flush passes on the merged events, and events counting those suppressed for
+// each Code, then starts a new window. It must be called with mtx held.
+func (a *AggregateHandler) flush() {
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	now := a.now()
+	for _, en := range a.order {
+		if en.n == 0 {
+			continue
+		}
+		if !a.allow(en.e.Code, en.errCode, now) {
+			a.codes[en.e.Code].suppressed += en.n
+			continue
+		}
+		e := *en.e
+		e.Count = en.n
+		a.Handler.OnEvent(&e)
+	}
+	codes := make([]Code, 0, len(a.codes))
+	for code, c := range a.codes {
+		if c.suppressed > 0 {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	for _, code := range codes {
+		c := a.codes[code]
+		a.Handler.OnEvent(Eventf(code, nil, nil,
+			"suppressed %d event(s) over rate limit of %g/s", c.suppressed,
+			a.rate))
+		c.suppressed = 0
+	}
+	a.entries = make(map[aggKey]*aggEntry)
+	a.order = nil
+	a.errs = make(map[Code]bool)
+}
+
+// errorCode returns the Code of the first Error in an event's Detail, or 0 if
+// it has none.
+func errorCode(e *Event) Code {
+	for _, d := range e.Detail {
+		if err, ok := d.(*Error); ok {
+			return err.Code
+		}
+	}
+	return 0
+}
+
+// freeze returns a copy of an event with its message formatted, so it may be
+// kept after any Detail that refers to reused buffers has changed.
+func freeze(e *Event) *Event {
+	f := *e
+	f.format = "%s"
+	f.Detail = []interface{}{fmt.Sprintf(e.format, e.Detail...)}
+	return &f
+}
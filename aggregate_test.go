@@ -0,0 +1,194 @@
+package irtt
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAggregateHandler returns an AggregateHandler that uses clock and passes
+// events to a testHandler. Tests end windows with Flush, before the timer
+// does.
+func testAggregateHandler(window time.Duration, rate float64,
+	clock *testClock) (*AggregateHandler, *testHandler) {
+	h := &testHandler{}
+	a := NewAggregateHandler(h, window, rate)
+	a.now = clock.now
+	return a, h
+}
+
+// testDropEvent returns a Drop event from the source with port, for an error
+// with code.
+func testDropEvent(port int, code Code) *Event {
+	raddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}
+	return Eventf(Drop, nil, raddr, "dropped packet (%s)",
+		Errorf(code, "error %d", code))
+}
+
+// TestAggregateHandlerMerge tests merging identical events in a window, with a
+// Count for the merged events.
+func TestAggregateHandlerMerge(t *testing.T) {
+	a, h := testAggregateHandler(time.Hour, 0, newTestClock())
+	for i := 0; i < 5; i++ {
+		a.OnEvent(testDropEvent(1000, ShortInterval))
+	}
+	for i := 0; i < 3; i++ {
+		a.OnEvent(testDropEvent(1000, LargeRequest))
+	}
+	a.OnEvent(testDropEvent(2000, ShortInterval))
+	a.OnEvent(testDropEvent(2000, ShortInterval))
+	a.OnEvent(Eventf(ListenerStart, nil, nil, "no remote address"))
+	a.OnEvent(Eventf(ListenerStart, nil, nil, "no remote address"))
+
+	// the first of each, and all with no remote address, are passed on
+	// immediately
+	if n := len(h.events); n != 5 {
+		t.Fatalf("%d events passed on immediately, expected 5", n)
+	}
+	for _, e := range h.events {
+		if e.Count != 0 {
+			t.Errorf("event %s passed on immediately with Count %d", e, e.Count)
+		}
+	}
+
+	// the rest are passed on with a Count at the end of the window, in order
+	h.events = nil
+	a.Flush()
+	tests := []struct {
+		port  int
+		code  Code
+		count int
+	}{
+		{1000, ShortInterval, 4},
+		{1000, LargeRequest, 2},
+		{2000, ShortInterval, 1},
+	}
+	if len(h.events) != len(tests) {
+		t.Fatalf("%d merged events, expected %d", len(h.events), len(tests))
+	}
+	for i, tc := range tests {
+		e := h.events[i]
+		if e.Code != Drop || e.RemoteAddr.Port != tc.port ||
+			!strings.Contains(e.String(), "["+tc.code.String()+"]") ||
+			e.Count != tc.count {
+			t.Errorf("merged event %d is %s from %s, Count %d, expected %s "+
+				"from port %d, Count %d", i, e, e.RemoteAddr, e.Count, tc.code,
+				tc.port, tc.count)
+		}
+	}
+
+	// a new window passes on the first again, and flushes nothing if there
+	// were no more
+	h.events = nil
+	a.OnEvent(testDropEvent(1000, ShortInterval))
+	a.Flush()
+	if len(h.events) != 1 || h.events[0].Count != 0 {
+		t.Errorf("new window passed on %d events, expected 1", len(h.events))
+	}
+}
+
+// TestAggregateHandlerRate tests that events over the rate for each Code are
+// counted in one event per Code, and that buckets refill.
+func TestAggregateHandlerRate(t *testing.T) {
+	tests := []struct {
+		window     time.Duration
+		rate       float64
+		events     int
+		passed     int
+		suppressed int
+	}{
+		// bursts are up to one second at the rate, plus one
+		{0, 2, 10, 3, 7},
+		{0, 10, 10, 10, 0},
+		{0, 10, 100, 11, 89},
+		{0, 0, 100, 100, 0},
+		// merged events over the rate are also suppressed
+		{time.Hour, 2, 10, 3, 7},
+	}
+	for _, tc := range tests {
+		a, h := testAggregateHandler(tc.window, tc.rate, newTestClock())
+		for i := 0; i < tc.events; i++ {
+			raddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000 + i%4}
+			a.OnEvent(Eventf(NewConn, nil, raddr, "new connection"))
+		}
+		a.OnEvent(Eventf(CloseConn, nil, &net.UDPAddr{}, "close"))
+		a.Flush()
+		passed, suppressed := 0, 0
+		for _, e := range h.events {
+			switch {
+			case e.Code == NewConn && e.RemoteAddr != nil:
+				passed++
+				if e.Count > 0 {
+					passed += e.Count - 1
+				}
+			case e.Code == NewConn:
+				if e.Detail[0].(int) <= 0 {
+					t.Errorf("window %s rate %g: suppressed event %s",
+						tc.window, tc.rate, e)
+				}
+				suppressed += e.Detail[0].(int)
+			}
+		}
+		if passed != tc.passed || suppressed != tc.suppressed {
+			t.Errorf("window %s rate %g, %d events: %d passed and %d "+
+				"suppressed, expected %d and %d", tc.window, tc.rate,
+				tc.events, passed, suppressed, tc.passed, tc.suppressed)
+		}
+		if h.count(CloseConn) != 1 {
+			t.Errorf("window %s rate %g: other Code was limited", tc.window,
+				tc.rate)
+		}
+	}
+
+	// buckets refill at the rate
+	clock := newTestClock()
+	a, h := testAggregateHandler(0, 2, clock)
+	e := Eventf(NewConn, nil, &net.UDPAddr{}, "new connection")
+	for i := 0; i < 3; i++ {
+		a.OnEvent(e)
+	}
+	clock.advance(time.Second)
+	for i := 0; i < 3; i++ {
+		a.OnEvent(e)
+	}
+	a.Flush()
+	passed := 0
+	for _, e := range h.events {
+		if e.RemoteAddr != nil {
+			passed++
+		}
+	}
+	if passed != 5 || len(h.events) != 6 {
+		t.Errorf("%d of %d events passed on after refill, expected 5 of 6",
+			passed, len(h.events))
+	}
+}
+
+// TestAggregateHandlerFirstError tests that the first event with each error
+// Code in a window is passed on, even when over the rate.
+func TestAggregateHandlerFirstError(t *testing.T) {
+	a, h := testAggregateHandler(time.Hour, 1, newTestClock())
+	for port := 1000; port < 1010; port++ {
+		a.OnEvent(testDropEvent(port, ShortInterval))
+	}
+	// over the rate, but the first of their error codes
+	a.OnEvent(testDropEvent(2000, LargeRequest))
+	a.OnEvent(Eventf(AccessDenied, nil, &net.UDPAddr{Port: 3000}, "denied"))
+	if n := len(h.events); n != 4 {
+		t.Errorf("%d events passed on, expected 4", n)
+	}
+	if h.count(AccessDenied) != 1 {
+		t.Error("first error event with no Error in Detail not passed on")
+	}
+	// the first of each error code in the next window is passed on again,
+	// with the clock stopped so the bucket stays empty
+	a.Flush()
+	h.events = nil
+	a.OnEvent(testDropEvent(1000, ShortInterval))
+	a.OnEvent(testDropEvent(1001, ShortInterval))
+	a.OnEvent(testDropEvent(2000, LargeRequest))
+	if n := len(h.events); n != 2 {
+		t.Errorf("%d events passed on in the next window, expected 2", n)
+	}
+}
@@ -0,0 +1,342 @@
+package irtt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// anonMode is how private data is treated in JSON output.
+type anonMode int
+
+// anonModes
+const (
+	anonNone anonMode = iota
+	anonOmit
+	anonHash
+	anonPrefix
+)
+
+var anms = [...]string{"none", "omit", "hash", "prefix"}
+
+func (m anonMode) String() string {
+	if int(m) < 0 || int(m) >= len(anms) {
+		return fmt.Sprintf("anonMode:%d", m)
+	}
+	return anms[m]
+}
+
+// parseAnonMode returns an anonMode from its string.
+func parseAnonMode(s string) (anonMode, error) {
+	for i, v := range anms {
+		if v == s {
+			return anonMode(i), nil
+		}
+	}
+	return anonNone, fmt.Errorf("invalid anonymization mode %s", s)
+}
+
+// anonymizer removes or replaces private data in results, which are the
+// hostname in the system info, and the local and remote addresses in the
+// config. When rewriting JSON, IP addresses in other strings, such as errors
+// and events, are also replaced, as are hostnames already seen in addresses.
+// HMAC keys are never written to JSON, so need no treatment. Depending on the
+// mode, private data is:
+//
+//   - omit: removed
+//   - hash: replaced with consistent pseudonyms, IPv4 addresses in 10.0.0.0/8,
+//     IPv6 addresses in fd00::/8 and hostnames as host-xxxxxxxx
+//   - prefix: IP addresses truncated to /24 (IPv4) or /48 (IPv6), and hostnames
+//     removed
+//
+// Loopback and unspecified IP addresses, and ports, are kept as is, except in
+// omit mode. Pseudonyms are consistent for the same key.
+type anonymizer struct {
+	mode  anonMode
+	key   []byte
+	hosts map[string]bool
+}
+
+// ipLike matches substrings that may be IP addresses, which are checked by
+// scrub.
+var ipLike = regexp.MustCompile(`[0-9A-Fa-f:.]*[:.][0-9A-Fa-f:.]*`)
+
+// newAnonymizer returns a new anonymizer. If key is empty, a random key is
+// used, so pseudonyms are only consistent for the anonymizer's lifetime.
+func newAnonymizer(mode anonMode, key []byte) (*anonymizer, error) {
+	if len(key) == 0 {
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &anonymizer{mode, key, make(map[string]bool)}, nil
+}
+
+// hash returns the HMAC of b with the key.
+func (a *anonymizer) hash(b []byte) []byte {
+	h := hmac.New(sha256.New, a.key)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// hostname returns the anonymized form of a hostname.
+func (a *anonymizer) hostname(s string) string {
+	if s == "" || a.mode == anonNone {
+		return s
+	}
+	if a.mode == anonHash {
+		return "host-" + hex.EncodeToString(a.hash([]byte(s))[:4])
+	}
+	return ""
+}
+
+// ip returns the anonymized form of an IP address.
+func (a *anonymizer) ip(ip net.IP) string {
+	if a.mode == anonOmit {
+		return ""
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return ip.String()
+	}
+	ip4 := ip.To4()
+	switch a.mode {
+	case anonHash:
+		h := a.hash(ip.To16())
+		if ip4 != nil {
+			return net.IPv4(10, h[0], h[1], h[2]).String()
+		}
+		p := make(net.IP, net.IPv6len)
+		p[0] = 0xfd
+		copy(p[1:], h)
+		return p.String()
+	case anonPrefix:
+		if ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+	return ip.String()
+}
+
+// addr returns the anonymized form of an address, which may be a hostname or
+// IP, with or without a port. If the host is removed, the whole address is.
+func (a *anonymizer) addr(s string) string {
+	if s == "" || a.mode == anonNone {
+		return s
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host = s
+		port = ""
+	}
+	if host == "" {
+		return s
+	}
+	var ahost string
+	if ip := net.ParseIP(strings.SplitN(host, "%", 2)[0]); ip != nil {
+		ahost = a.ip(ip)
+	} else {
+		a.hosts[host] = true
+		ahost = a.hostname(host)
+	}
+	if ahost == "" || port == "" {
+		return ahost
+	}
+	return net.JoinHostPort(ahost, port)
+}
+
+// systemInfo returns an anonymized copy of a SystemInfo.
+func (a *anonymizer) systemInfo(si *SystemInfo) *SystemInfo {
+	asi := *si
+	asi.Hostname = a.hostname(si.Hostname)
+	return &asi
+}
+
+// config returns an anonymized copy of a ClientConfig, including the supplied
+// config.
+func (a *anonymizer) config(cfg *ClientConfig) *ClientConfig {
+	acfg := *cfg
+	acfg.LocalAddress = a.addr(cfg.LocalAddress)
+	acfg.RemoteAddress = a.addr(cfg.RemoteAddress)
+	if cfg.Supplied != nil {
+		acfg.Supplied = a.config(cfg.Supplied)
+	}
+	return &acfg
+}
+
+// value returns the anonymized form of a string value for a JSON key.
+func (a *anonymizer) value(key string, s string) string {
+	switch key {
+	case "hostname":
+		if s != "" {
+			a.hosts[s] = true
+		}
+		return a.hostname(s)
+	case "local_address", "remote_address":
+		return a.addr(s)
+	}
+	return a.scrub(s)
+}
+
+// scrub returns a string with any IP addresses, with or without a port, and
+// any hostnames already seen replaced by their anonymized forms, or by
+// "omitted" in omit mode.
+func (a *anonymizer) scrub(s string) string {
+	if a.mode == anonNone {
+		return s
+	}
+	repl := func(anon string) string {
+		if anon == "" {
+			return "omitted"
+		}
+		return anon
+	}
+	s = ipLike.ReplaceAllStringFunc(s, func(c string) string {
+		t := strings.TrimRight(c, ".:")
+		if ip := net.ParseIP(t); ip != nil {
+			return repl(a.ip(ip)) + c[len(t):]
+		}
+		if i := strings.LastIndexByte(t, ':'); i > 0 {
+			if ip := net.ParseIP(t[:i]).To4(); ip != nil {
+				return repl(a.ip(ip)) + c[i:]
+			}
+		}
+		return c
+	})
+	for h := range a.hosts {
+		s = replaceHost(s, h, repl(a.hostname(h)))
+	}
+	return s
+}
+
+// replaceHost returns s with occurrences of hostname h replaced by r, where
+// they're not part of a longer hostname.
+func replaceHost(s, h, r string) string {
+	isHostChar := func(c byte) bool {
+		return c == '-' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' ||
+			c >= 'a' && c <= 'z'
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, h)
+		if i < 0 {
+			break
+		}
+		j := i + len(h)
+		if (i > 0 && (isHostChar(s[i-1]) || s[i-1] == '.')) ||
+			(j < len(s) && isHostChar(s[j])) ||
+			(j+1 < len(s) && s[j] == '.' && isHostChar(s[j+1])) {
+			b.WriteString(s[:i+1])
+			s = s[i+1:]
+			continue
+		}
+		b.WriteString(s[:i])
+		b.WriteString(r)
+		s = s[j:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// rewrite anonymizes JSON from in to out, preserving the order of fields.
+// Input with more than one top-level value, such as JSON Lines, is written
+// with one value per line, otherwise output is indented as in JSON results.
+func (a *anonymizer) rewrite(in io.Reader, out io.Writer) error {
+	d := json.NewDecoder(in)
+	d.UseNumber()
+	w := bufio.NewWriter(out)
+	var buf, ibuf bytes.Buffer
+	lines := false
+	for n := 0; ; n++ {
+		buf.Reset()
+		if err := a.rewriteValue(d, &buf, ""); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if n == 0 {
+			lines = d.More()
+		}
+		b := buf.Bytes()
+		if !lines {
+			ibuf.Reset()
+			if err := json.Indent(&ibuf, b, "", "    "); err != nil {
+				return err
+			}
+			b = ibuf.Bytes()
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// rewriteValue reads the next JSON value from the decoder and writes its
+// anonymized form, where key is the key of the value in its object, if any.
+func (a *anonymizer) rewriteValue(d *json.Decoder, w *bytes.Buffer,
+	key string) error {
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	switch v := t.(type) {
+	case json.Delim:
+		w.WriteRune(rune(v))
+		for i := 0; d.More(); i++ {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			k := ""
+			if v == '{' {
+				kt, err := d.Token()
+				if err != nil {
+					return err
+				}
+				k = kt.(string)
+				b, _ := json.Marshal(k)
+				w.Write(b)
+				w.WriteByte(':')
+			}
+			if err := a.rewriteValue(d, w, k); err != nil {
+				return noEOF(err)
+			}
+		}
+		end, err := d.Token()
+		if err != nil {
+			return noEOF(err)
+		}
+		w.WriteRune(rune(end.(json.Delim)))
+	case string:
+		b, err := json.Marshal(a.value(key, v))
+		if err != nil {
+			return err
+		}
+		w.Write(b)
+	case json.Number:
+		w.WriteString(v.String())
+	case bool:
+		fmt.Fprintf(w, "%t", v)
+	case nil:
+		w.WriteString("null")
+	}
+	return nil
+}
+
+// noEOF returns io.ErrUnexpectedEOF for io.EOF, or err otherwise.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,258 @@
+package irtt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testAnonKey = []byte("test key")
+
+// testAnonymizer returns an anonymizer with a fixed key.
+func testAnonymizer(t *testing.T, mode anonMode) *anonymizer {
+	a, err := newAnonymizer(mode, testAnonKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// TestAnonymizerAddr tests anonymizing addresses in each mode.
+func TestAnonymizerAddr(t *testing.T) {
+	tests := []struct {
+		mode   anonMode
+		addr   string
+		expect string
+	}{
+		{anonNone, "192.0.2.1:2112", "192.0.2.1:2112"},
+		{anonOmit, "192.0.2.1:2112", ""},
+		{anonOmit, "example.com", ""},
+		{anonOmit, "127.0.0.1:2112", ""},
+		{anonPrefix, "192.0.2.1:2112", "192.0.2.0:2112"},
+		{anonPrefix, "[2001:db8:1:2::1]:2112", "[2001:db8:1::]:2112"},
+		{anonPrefix, "2001:db8:1:2::1", "2001:db8:1::"},
+		{anonPrefix, "example.com:2112", ""},
+		{anonPrefix, "127.0.0.1:2112", "127.0.0.1:2112"},
+		{anonPrefix, "[::1]:2112", "[::1]:2112"},
+		{anonPrefix, ":2112", ":2112"},
+		{anonHash, "0.0.0.0:0", "0.0.0.0:0"},
+		{anonHash, "", ""},
+	}
+	for _, tc := range tests {
+		a := testAnonymizer(t, tc.mode)
+		if s := a.addr(tc.addr); s != tc.expect {
+			t.Errorf("%s: %q anonymized as %q, expected %q", tc.mode, tc.addr,
+				s, tc.expect)
+		}
+	}
+}
+
+// TestAnonymizerHash tests that hash mode pseudonyms are in the documented
+// ranges, and consistent for the same key.
+func TestAnonymizerHash(t *testing.T) {
+	a := testAnonymizer(t, anonHash)
+	b := testAnonymizer(t, anonHash)
+	for _, addr := range []string{"192.0.2.1:2112", "[2001:db8::1]:2112",
+		"example.com:2112"} {
+		s := a.addr(addr)
+		if s2 := b.addr(addr); s2 != s {
+			t.Errorf("%s anonymized inconsistently as %s and %s", addr, s, s2)
+		}
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			t.Errorf("%s anonymized as %s: %s", addr, s, err)
+			continue
+		}
+		if port != "2112" {
+			t.Errorf("%s anonymized with port %s", addr, port)
+		}
+		ip := net.ParseIP(host)
+		switch {
+		case strings.HasPrefix(addr, "example"):
+			if !strings.HasPrefix(host, "host-") || len(host) != 13 {
+				t.Errorf("%s anonymized as %s", addr, s)
+			}
+		case ip == nil:
+			t.Errorf("%s anonymized as %s, not an IP", addr, s)
+		case ip.To4() != nil:
+			if ip.To4()[0] != 10 {
+				t.Errorf("%s anonymized as %s, not in 10.0.0.0/8", addr, s)
+			}
+		default:
+			if ip[0] != 0xfd {
+				t.Errorf("%s anonymized as %s, not in fd00::/8", addr, s)
+			}
+		}
+	}
+	c, err := newAnonymizer(anonHash, []byte("other key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.addr("192.0.2.1") == c.addr("192.0.2.1") {
+		t.Error("same pseudonym for different keys")
+	}
+}
+
+// TestAnonymizerScrub tests replacing IP addresses and seen hostnames in
+// strings.
+func TestAnonymizerScrub(t *testing.T) {
+	a := testAnonymizer(t, anonPrefix)
+	a.addr("server.example.com:2112")
+	tests := []struct {
+		s      string
+		expect string
+	}{
+		{"write udp 192.0.2.10:5000->198.51.100.7:2112: refused",
+			"write udp 192.0.2.0:5000->198.51.100.0:2112: refused"},
+		{"read udp [2001:db8:1:2::1]:2112: timeout",
+			"read udp [2001:db8:1::]:2112: timeout"},
+		{"from 2001:db8:1:2::1%eth0.", "from 2001:db8:1::%eth0."},
+		{"address 192.0.2.10.", "address 192.0.2.0."},
+		{"loopback 127.0.0.1:2112 and ::1", "loopback 127.0.0.1:2112 and ::1"},
+		{"lookup server.example.com: no such host",
+			"lookup omitted: no such host"},
+		{"www.server.example.com server.example.com.au server.example.com",
+			"www.server.example.com server.example.com.au omitted"},
+		{"version 0.9.2 at 12:30:45, mac 00:11:22:33:44:55, 1.5ms",
+			"version 0.9.2 at 12:30:45, mac 00:11:22:33:44:55, 1.5ms"},
+		{"dead:beef and face.b00c", "dead:beef and face.b00c"},
+	}
+	for _, tc := range tests {
+		if s := a.scrub(tc.s); s != tc.expect {
+			t.Errorf("%q scrubbed as %q, expected %q", tc.s, s, tc.expect)
+		}
+	}
+	o := testAnonymizer(t, anonOmit)
+	if s := o.scrub("to 192.0.2.1:2112"); s != "to omitted:2112" {
+		t.Errorf("omit mode scrubbed as %q", s)
+	}
+	n := testAnonymizer(t, anonNone)
+	if s := n.scrub("to 192.0.2.1:2112"); s != "to 192.0.2.1:2112" {
+		t.Errorf("none mode scrubbed as %q", s)
+	}
+}
+
+// testAnonJSON is a result with private data in the system info, config,
+// errors and events.
+const testAnonJSON = `{
+    "version": {"irtt": "0.9.2"},
+    "system_info": {"os": "linux", "hostname": "myhost"},
+    "config": {
+        "local_address": "192.0.2.10:5000",
+        "remote_address": "server.example.com:2112",
+        "duration": 1000000000
+    },
+    "send_err": {
+        "Code": -1,
+        "LocalAddr": {"IP": "192.0.2.10", "Port": 5000, "Zone": ""},
+        "RemoteAddr": {"IP": "2001:db8:1:2::1", "Port": 2112, "Zone": ""},
+        "Detail": ["write udp 192.0.2.10:5000->[2001:db8:1:2::1]:2112", 1.5]
+    },
+    "events": ["myhost lost server.example.com", "myhostname"],
+    "round_trips": []
+}`
+
+// TestAnonymizerRewrite tests rewriting JSON, preserving field order and
+// numbers, and JSON Lines.
+func TestAnonymizerRewrite(t *testing.T) {
+	a := testAnonymizer(t, anonPrefix)
+	var b bytes.Buffer
+	if err := a.rewrite(strings.NewReader(testAnonJSON), &b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, s := range []string{"192.0.2.10", "2001:db8:1:2::1", "myhost\"",
+		"myhost ", "server.example.com"} {
+		if strings.Contains(out, s) {
+			t.Errorf("rewritten JSON contains %q:\n%s", s, out)
+		}
+	}
+	for _, s := range []string{`"local_address": "192.0.2.0:5000"`,
+		`"remote_address": ""`, `"hostname": ""`, `"IP": "2001:db8:1::"`,
+		`"myhostname"`, `"duration": 1000000000`, `1.5`,
+		`"write udp 192.0.2.0:5000-\u003e[2001:db8:1::]:2112"`,
+		`"omitted lost omitted"`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("rewritten JSON doesn't contain %s:\n%s", s, out)
+		}
+	}
+	keys := []string{`"version"`, `"system_info"`, `"config"`, `"send_err"`,
+		`"events"`, `"round_trips"`}
+	for i := 1; i < len(keys); i++ {
+		if strings.Index(out, keys[i-1]) > strings.Index(out, keys[i]) {
+			t.Errorf("field order not preserved:\n%s", out)
+			break
+		}
+	}
+	var v interface{}
+	if err := json.Unmarshal(b.Bytes(), &v); err != nil {
+		t.Errorf("rewritten JSON is invalid: %s", err)
+	}
+
+	// JSON Lines are written one value per line
+	in := `{"config":{"remote_address":"192.0.2.1:2112"}}` + "\n" +
+		`{"round_trip":{"seqno":0}}` + "\n" + `{"event":"from 192.0.2.1"}` + "\n"
+	b.Reset()
+	if err := a.rewrite(strings.NewReader(in), &b); err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"config":{"remote_address":"192.0.2.0:2112"}}` + "\n" +
+		`{"round_trip":{"seqno":0}}` + "\n" + `{"event":"from 192.0.2.0"}` + "\n"
+	if b.String() != expect {
+		t.Errorf("JSON Lines rewritten as\n%s\nexpected\n%s", b.String(), expect)
+	}
+
+	// truncated input is an error
+	err := a.rewrite(strings.NewReader(`{"config":{"remote_address":`),
+		io.Discard)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated input returned %v", err)
+	}
+}
+
+// TestRunAnonymize tests the anonymize command with gzipped input and output.
+func TestRunAnonymize(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.json.gz")
+	out := filepath.Join(dir, "out.json.gz")
+	out2 := filepath.Join(dir, "out2.json.gz")
+	var b bytes.Buffer
+	gzw := gzip.NewWriter(&b)
+	gzw.Write([]byte(testAnonJSON))
+	gzw.Close()
+	if err := os.WriteFile(in, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runAnonymize([]string{"-o", out, "--mode=hash", "--key=test key", in})
+	runAnonymize([]string{"-o", out2, "--mode=hash", "--key=test key", in})
+	read := func(name string) string {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ob, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(ob)
+	}
+	s := read(out)
+	if strings.Contains(s, "192.0.2.10") || strings.Contains(s, "myhost\"") ||
+		!strings.Contains(s, `"hostname": "host-`) {
+		t.Errorf("anonymized output:\n%s", s)
+	}
+	if s2 := read(out2); s2 != s {
+		t.Errorf("output with the same key differs:\n%s\n%s", s, s2)
+	}
+}
@@ -0,0 +1,236 @@
+package irtt
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// banList bans sources whose dropped packets exceed a rate, so their packets
+// are dropped before they're parsed. Each ban lasts twice as long as the
+// previous one for the source, up to maxBanTime, until the source has gone
+// banForget without a ban. Bans may also be added and removed with ctl.
+type banList struct {
+	rate      float64
+	banTime   time.Duration
+	handler   Handler
+	sources   map[string]*banState
+	nbanned   atomic.Int64
+	lastSweep time.Time
+	now       func() time.Time
+	mtx       sync.Mutex
+}
+
+// banState is the state of a banned source, or one with recent drops. The
+// drops token bucket holds banBurst at the drop rate, and the source is banned
+// when it goes negative.
+type banState struct {
+	ip      net.IP
+	drops   float64
+	updated time.Time
+	until   time.Time
+	bans    int
+}
+
+func newBanList(rate float64, banTime time.Duration, h Handler) *banList {
+	bl := &banList{handler: h, sources: make(map[string]*banState),
+		now: time.Now}
+	bl.setRate(rate, banTime)
+	return bl
+}
+
+// setRate sets the drop rate, or 0 to not ban sources for drops, and the
+// duration of first bans. Existing bans are kept.
+func (bl *banList) setRate(rate float64, banTime time.Duration) {
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	bl.rate = rate
+	bl.banTime = banTime
+}
+
+// burst returns the capacity of the drops token bucket. It must be called with
+// mtx held.
+func (bl *banList) burst() float64 {
+	return bl.rate * banBurst.Seconds()
+}
+
+// state returns the state for ip, creating it if necessary and refilling its
+// drops token bucket. It must be called with mtx held.
+func (bl *banList) state(ip net.IP, now time.Time) *banState {
+	k := string(ip.To16())
+	st := bl.sources[k]
+	if st == nil {
+		st = &banState{ip: append(net.IP(nil), ip...), drops: bl.burst(),
+			updated: now}
+		bl.sources[k] = st
+		return st
+	}
+	dt := now.Sub(st.updated).Seconds()
+	st.drops = math.Min(st.drops+bl.rate*dt, bl.burst())
+	st.updated = now
+	return st
+}
+
+// isBanned returns true if the source is banned at now.
+func (st *banState) isBanned(now time.Time) bool {
+	return now.Before(st.until)
+}
+
+// banned returns true if ip is banned. Only an atomic load is needed when no
+// sources are banned.
+func (bl *banList) banned(ip net.IP) bool {
+	if bl.nbanned.Load() == 0 {
+		return false
+	}
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	now := bl.now()
+	if now.Sub(bl.lastSweep) > banSweepInterval {
+		bl.sweep(now)
+	}
+	st := bl.sources[string(ip.To16())]
+	return st != nil && st.isBanned(now)
+}
+
+// banCodes are the codes of drops that count towards bans. Only drops the
+// source is responsible for are counted, so not those for the server-wide
+// limits, or InvalidConnToken and AddressMismatch, which legitimate clients
+// cause after a server restart or a NAT rebinding.
+var banCodes = map[Code]bool{
+	BadHMAC:           true,
+	NoHMAC:            true,
+	UnexpectedHMAC:    true,
+	ShortInterval:     true,
+	LargeRequest:      true,
+	SourcePacketLimit: true,
+	SourceByteLimit:   true,
+	SourceOpenLimit:   true,
+}
+
+// drop counts a packet from ip that was dropped with err, and bans ip if it's
+// over the drop rate. Only errors with one of banCodes are counted.
+func (bl *banList) drop(ip net.IP, err error) {
+	if e, ok := err.(*Error); !ok || ip == nil || !banCodes[e.Code] {
+		return
+	}
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	if bl.rate == 0 {
+		return
+	}
+	now := bl.now()
+	if now.Sub(bl.lastSweep) > banSweepInterval {
+		bl.sweep(now)
+	}
+	st := bl.state(ip, now)
+	if st.isBanned(now) {
+		return
+	}
+	if st.drops--; st.drops < 0 {
+		bl.ban(st, 0, now, fmt.Sprintf("over drop rate of %g/s", bl.rate))
+	}
+}
+
+// ban bans a source for d, or for the next backoff duration if d is 0. It must
+// be called with mtx held.
+func (bl *banList) ban(st *banState, d time.Duration, now time.Time,
+	reason string) {
+	if d == 0 {
+		d = bl.banTime
+		for i := 0; i < st.bans && d < maxBanTime; i++ {
+			d *= 2
+		}
+		if d > maxBanTime {
+			d = maxBanTime
+		}
+	}
+	if !st.isBanned(now) {
+		bl.nbanned.Add(1)
+	}
+	st.bans++
+	st.until = now.Add(d)
+	st.drops = bl.burst()
+	st.updated = now
+	bl.eventf(SourceBanned, "banned %s for %s (%s, ban %d)", st.ip, d, reason,
+		st.bans)
+}
+
+// sweep unbans sources whose bans have expired, and removes the state for
+// sources that are no longer banned, once they've gone banForget since their
+// last ban, or long enough for their drops bucket to be full if they were
+// never banned. It must be called with mtx held.
+func (bl *banList) sweep(now time.Time) {
+	for k, st := range bl.sources {
+		if st.isBanned(now) {
+			continue
+		}
+		if !st.until.IsZero() {
+			bl.nbanned.Add(-1)
+			bl.eventf(SourceUnbanned, "unbanned %s after ban %d expired", st.ip,
+				st.bans)
+			st.until = time.Time{}
+			st.updated = now
+			continue
+		}
+		idle := now.Sub(st.updated)
+		if (st.bans == 0 && idle > banBurst) || idle > banForget {
+			delete(bl.sources, k)
+		}
+	}
+	bl.lastSweep = now
+}
+
+// add bans ip for d, or for the next backoff duration if d is 0.
+func (bl *banList) add(ip net.IP, d time.Duration) time.Duration {
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	now := bl.now()
+	st := bl.state(ip, now)
+	bl.ban(st, d, now, "by control command")
+	return st.until.Sub(now)
+}
+
+// remove unbans ip and forgets its previous bans, and returns false if it
+// wasn't banned.
+func (bl *banList) remove(ip net.IP) bool {
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	k := string(ip.To16())
+	st := bl.sources[k]
+	if st == nil || !st.isBanned(bl.now()) {
+		return false
+	}
+	delete(bl.sources, k)
+	bl.nbanned.Add(-1)
+	bl.eventf(SourceUnbanned, "unbanned %s by control command", ip)
+	return true
+}
+
+// list returns the banned sources, with the longest remaining bans first.
+func (bl *banList) list() []ctlBan {
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	now := bl.now()
+	bl.sweep(now)
+	bans := []ctlBan{}
+	for _, st := range bl.sources {
+		if st.isBanned(now) {
+			bans = append(bans, ctlBan{st.ip.String(), st.until.Sub(now),
+				st.bans})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Remaining > bans[j].Remaining
+	})
+	return bans
+}
+
+func (bl *banList) eventf(code Code, format string, detail ...interface{}) {
+	if bl.handler != nil {
+		bl.handler.OnEvent(Eventf(code, nil, nil, format, detail...))
+	}
+}
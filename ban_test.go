@@ -0,0 +1,215 @@
+package irtt
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when it's advanced.
+type testClock struct {
+	t   time.Time
+	mtx sync.Mutex
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Unix(1500000000, 0)}
+}
+
+func (c *testClock) now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// testHandler records events.
+type testHandler struct {
+	events []*Event
+	mtx    sync.Mutex
+}
+
+func (h *testHandler) OnEvent(e *Event) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.events = append(h.events, e)
+}
+
+// count returns the number of events recorded with code.
+func (h *testHandler) count(code Code) (n int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, e := range h.events {
+		if e.Code == code {
+			n++
+		}
+	}
+	return
+}
+
+// testBanList returns a banList that uses clock.
+func testBanList(rate float64, banTime time.Duration, h Handler,
+	clock *testClock) *banList {
+	bl := newBanList(rate, banTime, h)
+	bl.now = clock.now
+	return bl
+}
+
+// TestBanListDropRate tests that sources are banned only when their drops go
+// over the rate, averaged over banBurst.
+func TestBanListDropRate(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	err := Errorf(ShortInterval, "short interval")
+	tests := []struct {
+		rate   float64
+		drops  int
+		dt     time.Duration
+		banned bool
+	}{
+		{0, 1000, 0, false},
+		{1, 10, 0, false},
+		{1, 11, 0, true},
+		{0.5, 5, 0, false},
+		{0.5, 6, 0, true},
+		{10, 100, 0, false},
+		{10, 101, 0, true},
+		// one drop per second refills as fast as it's used
+		{1, 100, time.Second, false},
+		{1, 100, 900 * time.Millisecond, true},
+	}
+	for _, tc := range tests {
+		clock := newTestClock()
+		bl := testBanList(tc.rate, time.Minute, nil, clock)
+		for i := 0; i < tc.drops; i++ {
+			clock.advance(tc.dt)
+			bl.drop(ip, err)
+		}
+		if b := bl.banned(ip); b != tc.banned {
+			t.Errorf("rate %g, %d drops every %s: banned %t, expected %t",
+				tc.rate, tc.drops, tc.dt, b, tc.banned)
+		}
+		if b := bl.banned(net.ParseIP("192.0.2.2")); b {
+			t.Errorf("rate %g, %d drops every %s: other source banned",
+				tc.rate, tc.drops, tc.dt)
+		}
+	}
+}
+
+// TestBanListErrors tests that only drops the source is responsible for are
+// counted.
+func TestBanListErrors(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	tests := []struct {
+		err    error
+		banned bool
+	}{
+		{Errorf(ShortInterval, "short interval"), true},
+		{Errorf(BadHMAC, "bad HMAC"), true},
+		{Errorf(LargeRequest, "request too large"), true},
+		{Errorf(SourcePacketLimit, "over packet limit"), true},
+		{Errorf(SourceOpenLimit, "over open rate limit"), true},
+		{Errorf(OpenRateLimited, "over open rate limit"), false},
+		{Errorf(InvalidConnToken, "invalid conn token"), false},
+		{Errorf(AddressMismatch, "address mismatch"), false},
+		{Errorf(BitrateLimit, "over bitrate limit"), false},
+		{Errorf(AccessDenied, "access denied"), false},
+		{fmt.Errorf("no code"), false},
+	}
+	for _, tc := range tests {
+		bl := testBanList(1, time.Minute, nil, newTestClock())
+		for i := 0; i < 100; i++ {
+			bl.drop(ip, tc.err)
+		}
+		if b := bl.banned(ip); b != tc.banned {
+			t.Errorf("%v: banned %t, expected %t", tc.err, b, tc.banned)
+		}
+	}
+	bl := testBanList(1, time.Minute, nil, newTestClock())
+	for i := 0; i < 100; i++ {
+		bl.drop(nil, Errorf(ShortInterval, "short interval"))
+	}
+	if len(bl.sources) != 0 {
+		t.Errorf("drops with no IP kept state for %d sources", len(bl.sources))
+	}
+}
+
+// TestBanListBackoff tests that each ban of a source lasts twice as long as
+// the previous one, up to maxBanTime, and that bans are forgotten after
+// banForget.
+func TestBanListBackoff(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	err := Errorf(ShortInterval, "short interval")
+	clock := newTestClock()
+	h := &testHandler{}
+	banTime := 2 * time.Hour
+	bl := testBanList(1, banTime, h, clock)
+	ban := func() time.Duration {
+		for i := 0; i <= int(banBurst.Seconds()); i++ {
+			bl.drop(ip, err)
+		}
+		bans := bl.list()
+		if len(bans) != 1 {
+			t.Fatalf("%d bans, expected 1", len(bans))
+		}
+		return bans[0].Remaining
+	}
+	for i, expect := range []time.Duration{2 * time.Hour, 4 * time.Hour,
+		8 * time.Hour, 16 * time.Hour, 24 * time.Hour, 24 * time.Hour} {
+		d := ban()
+		if d != expect {
+			t.Errorf("ban %d for %s, expected %s", i+1, d, expect)
+		}
+		if !bl.banned(ip) {
+			t.Errorf("ban %d: not banned", i+1)
+		}
+		// drops while banned don't extend the ban
+		bl.drop(ip, err)
+		clock.advance(d - time.Second)
+		if !bl.banned(ip) {
+			t.Errorf("ban %d: not banned before it expired", i+1)
+		}
+		clock.advance(2 * time.Second)
+		if bl.banned(ip) {
+			t.Errorf("ban %d: still banned after it expired", i+1)
+		}
+	}
+	if n := bl.nbanned.Load(); n != 0 {
+		t.Errorf("%d banned after all bans expired", n)
+	}
+	if b, u := h.count(SourceBanned), h.count(SourceUnbanned); b != 6 || u != 6 {
+		t.Errorf("%d SourceBanned and %d SourceUnbanned events, expected 6",
+			b, u)
+	}
+
+	// after banForget, the next ban is for banTime again
+	clock.advance(banForget + banSweepInterval)
+	bl.list()
+	if d := ban(); d != banTime {
+		t.Errorf("ban after banForget for %s, expected %s", d, banTime)
+	}
+
+	// control command bans use the given time, or the backoff, and count as
+	// previous bans, and removal forgets previous bans
+	if d := bl.add(ip, time.Minute); d != time.Minute {
+		t.Errorf("added ban for %s, expected %s", d, time.Minute)
+	}
+	if d := bl.add(ip, 0); d != 4*banTime {
+		t.Errorf("added backoff ban for %s, expected %s", d, 4*banTime)
+	}
+	if !bl.remove(ip) || bl.banned(ip) {
+		t.Error("ban not removed")
+	}
+	if bl.remove(ip) {
+		t.Error("removed ban that doesn't exist")
+	}
+	if d := ban(); d != banTime {
+		t.Errorf("ban after removal for %s, expected %s", d, banTime)
+	}
+}
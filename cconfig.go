@@ -3,6 +3,7 @@ package irtt
 import (
 	"encoding/json"
 	"net"
+	"time"
 )
 
 // ClientConfig defines the Client configuration.
@@ -14,21 +15,28 @@ type ClientConfig struct {
 	OpenTimeouts  Durations
 	NoTest        bool
 	Params
-	Stream       bool
-	StreamBufLen int
-	Loose        bool
-	IPVersion    IPVersion
-	DF           DF
-	TTL          int
-	Timer        Timer
-	TimeSource   TimeSource
-	Waiter       Waiter
-	Filler       Filler
-	FillOne      bool
-	HMACKey      []byte
-	Handler      ClientHandler
-	ThreadLock   bool
-	Supplied     *ClientConfig
+	Stream          bool
+	StreamBufLen    int
+	StreamWindow    time.Duration
+	SummaryInterval time.Duration
+	SummaryPackets  uint
+	Incremental     bool
+	Loose           bool
+	IPVersion       IPVersion
+	DF              DF
+	TTL             int
+	Timer           Timer
+	Scheduler       Scheduler
+	TimeSource      TimeSource
+	Waiter          Waiter
+	Filler          Filler
+	FillOne         bool
+	Percentiles     Percentiles
+	HMACKey         []byte
+	Handler         ClientHandler
+	ThreadLock      bool
+	Profile         string
+	Supplied        *ClientConfig
 }
 
 // NewClientConfig returns a new ClientConfig with the default settings.
@@ -45,14 +53,16 @@ func NewClientConfig() *ClientConfig {
 			Clock:           DefaultClock,
 			DSCP:            DefaultDSCP,
 		},
-		Loose:      DefaultLoose,
-		IPVersion:  DefaultIPVersion,
-		DF:         DefaultDF,
-		TTL:        DefaultTTL,
-		Timer:      DefaultTimer,
-		TimeSource: DefaultTimeSource,
-		Waiter:     DefaultWait,
-		ThreadLock: DefaultThreadLock,
+		StreamWindow: DefaultStreamWindow,
+		Loose:        DefaultLoose,
+		IPVersion:    DefaultIPVersion,
+		DF:           DefaultDF,
+		TTL:          DefaultTTL,
+		Timer:        DefaultTimer,
+		Scheduler:    DefaultScheduler,
+		TimeSource:   DefaultTimeSource,
+		Waiter:       DefaultWait,
+		ThreadLock:   DefaultThreadLock,
 	}
 }
 
@@ -64,6 +74,10 @@ func (c *ClientConfig) validate() error {
 	if c.Duration <= 0 {
 		return Errorf(DurationNonPositive, "duration (%s) must be > 0", c.Duration)
 	}
+	if c.Stream && c.StreamWindow <= 0 {
+		return Errorf(StreamWindowNonPositive, "stream window (%s) must be > 0",
+			c.StreamWindow)
+	}
 	if len(c.ServerFill) > maxServerFillLen {
 		return Errorf(ServerFillTooLong,
 			"server fill string (%s) must be less than %d characters",
@@ -80,39 +94,51 @@ func (c *ClientConfig) MarshalJSON() ([]byte, error) {
 	}
 
 	j := &struct {
-		LocalAddress  string `json:"local_address"`
-		RemoteAddress string `json:"remote_address"`
-		OpenTimeouts  string `json:"open_timeouts"`
-		Params        `json:"params"`
-		Loose         bool          `json:"loose"`
-		IPVersion     IPVersion     `json:"ip_version"`
-		DF            DF            `json:"df"`
-		TTL           int           `json:"ttl"`
-		Timer         string        `json:"timer"`
-		TimeSource    string        `json:"time_source"`
-		Waiter        string        `json:"waiter"`
-		Filler        string        `json:"filler"`
-		FillOne       bool          `json:"fill_one"`
-		ServerFill    string        `json:"server_fill"`
-		ThreadLock    bool          `json:"thread_lock"`
-		Supplied      *ClientConfig `json:"supplied,omitempty"`
+		LocalAddress    string `json:"local_address"`
+		RemoteAddress   string `json:"remote_address"`
+		OpenTimeouts    string `json:"open_timeouts"`
+		Params          `json:"params"`
+		Loose           bool          `json:"loose"`
+		IPVersion       IPVersion     `json:"ip_version"`
+		DF              DF            `json:"df"`
+		TTL             int           `json:"ttl"`
+		Timer           string        `json:"timer"`
+		Scheduler       string        `json:"scheduler"`
+		TimeSource      string        `json:"time_source"`
+		Waiter          string        `json:"waiter"`
+		Filler          string        `json:"filler"`
+		FillOne         bool          `json:"fill_one"`
+		ServerFill      string        `json:"server_fill"`
+		Percentiles     Percentiles   `json:"percentiles,omitempty"`
+		SummaryInterval time.Duration `json:"summary_interval,omitempty"`
+		SummaryPackets  uint          `json:"summary_packets,omitempty"`
+		Incremental     bool          `json:"incremental,omitempty"`
+		ThreadLock      bool          `json:"thread_lock"`
+		Profile         string        `json:"profile,omitempty"`
+		Supplied        *ClientConfig `json:"supplied,omitempty"`
 	}{
-		LocalAddress:  c.LocalAddress,
-		RemoteAddress: c.RemoteAddress,
-		OpenTimeouts:  c.OpenTimeouts.String(),
-		Params:        c.Params,
-		Loose:         c.Loose,
-		IPVersion:     c.IPVersion,
-		DF:            c.DF,
-		TTL:           c.TTL,
-		Timer:         c.Timer.String(),
-		TimeSource:    c.TimeSource.String(),
-		Waiter:        c.Waiter.String(),
-		Filler:        fstr,
-		FillOne:       c.FillOne,
-		ServerFill:    c.ServerFill,
-		ThreadLock:    c.ThreadLock,
-		Supplied:      c.Supplied,
+		LocalAddress:    c.LocalAddress,
+		RemoteAddress:   c.RemoteAddress,
+		OpenTimeouts:    c.OpenTimeouts.String(),
+		Params:          c.Params,
+		Loose:           c.Loose,
+		IPVersion:       c.IPVersion,
+		DF:              c.DF,
+		TTL:             c.TTL,
+		Timer:           c.Timer.String(),
+		Scheduler:       c.Scheduler.String(),
+		TimeSource:      c.TimeSource.String(),
+		Waiter:          c.Waiter.String(),
+		Filler:          fstr,
+		FillOne:         c.FillOne,
+		ServerFill:      c.ServerFill,
+		Percentiles:     c.Percentiles,
+		SummaryInterval: c.SummaryInterval,
+		SummaryPackets:  c.SummaryPackets,
+		Incremental:     c.Incremental,
+		ThreadLock:      c.ThreadLock,
+		Profile:         c.Profile,
+		Supplied:        c.Supplied,
 	}
 	return json.Marshal(j)
 }
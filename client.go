@@ -8,6 +8,7 @@ import (
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,6 +21,8 @@ type Client struct {
 	closed  bool
 	closedM sync.Mutex
 	initCh  chan (bool)
+	sclose  atomic.Uint32
+	stop    context.CancelFunc
 }
 
 // NewClient returns a new client.
@@ -100,23 +103,55 @@ func (c *Client) Run(ctx context.Context) (r *Result, err error) {
 		}
 	}
 
+	// enable receipt of TOS
+	if c.ReceivedTOS {
+		if terr := c.conn.setReceiveTOS(); terr != nil {
+			err = Errorf(NoReceiveTOSSupport, "unable to receive TOS (%s)", terr)
+			return
+		}
+	}
+
 	// count maximum number of round trips
 	maxRoundTrips := pcount(c.Duration, c.Interval)
 
-	// set RoundTripData buffer capacity
+	// set RoundTripData buffer capacity, which in incremental mode must be at
+	// least the size of the received window, for lost packet attribution
 	var bufCap uint
-	if c.Stream {
+	wrap := c.Stream || c.Incremental
+	if wrap {
 		bufCap = uint(c.StreamBufLen)
+		if c.Incremental && bufCap < receivedWindowLen {
+			bufCap = receivedWindowLen
+		}
 	} else {
 		bufCap = maxRoundTrips
 	}
 
 	// create recorder
-	c.rec = newRecorder(maxRoundTrips, bufCap, c.TimeSource, c.Handler)
+	c.rec = newRecorder(maxRoundTrips, bufCap, wrap, TOS(c.DSCP),
+		c.TimeSource, c.Handler)
+	if c.Stream {
+		c.rec.StreamStats = newStreamStats(c.StreamWindow, c.Percentiles)
+	} else if c.Incremental {
+		c.rec.finalStats = &finalStats{}
+	}
+	if rh, ok := c.Handler.(RoundTripHandler); ok && wrap {
+		c.rec.rtHandler = rh
+	}
+	if ih, ok := c.Handler.(IntervalHandler); ok &&
+		(c.SummaryInterval > 0 || c.SummaryPackets > 0) {
+		c.rec.intervalStats = newIntervalStats(c.SummaryInterval,
+			c.SummaryPackets, c.Percentiles, ih)
+	}
 
 	// wait group for goroutine completion
 	wg := sync.WaitGroup{}
 
+	// send context, canceled to stop sending if the server shuts down
+	sctx, stop := context.WithCancel(ctx)
+	defer stop()
+	c.stop = stop
+
 	// start receive
 	var rerr error
 	wg.Add(1)
@@ -135,7 +170,10 @@ func (c *Client) Run(ctx context.Context) (r *Result, err error) {
 	go func() {
 		defer wg.Done()
 		defer c.close()
-		serr = c.send(ctx)
+		serr = c.send(sctx)
+		if serr != nil && c.sclose.Load() != 0 && ctx.Err() == nil {
+			serr = nil
+		}
 		if serr == nil {
 			err = c.wait(ctx)
 		}
@@ -147,7 +185,12 @@ func (c *Client) Run(ctx context.Context) (r *Result, err error) {
 	// wait for send and receive to complete
 	wg.Wait()
 
+	// finalize remaining round trips and report final interval summary
+	c.rec.recordEnd(c.TimeSource.Now(Monotonic))
+
 	r = newResult(c.rec, c.ClientConfig, serr, rerr)
+	r.ServerClose = CloseReason(c.sclose.Load())
+	r.ServerShutdown = r.ServerClose == CloseShutdown
 	return
 }
 
@@ -267,6 +310,12 @@ func (c *Client) checkParameters() (err error) {
 			return
 		}
 	}
+	if c.ReceivedTOS != c.Supplied.ReceivedTOS {
+		paramEvent(ServerRestriction, "server doesn't support received TOS")
+		if err != nil {
+			return
+		}
+	}
 	if c.ServerFill != c.Supplied.ServerFill {
 		paramEvent(ServerRestriction,
 			"server restricted fill from %s to %s", c.Supplied.ServerFill,
@@ -296,6 +345,7 @@ func (c *Client) send(ctx context.Context) error {
 	}
 	p.addFields(fechoRequest, true)
 	p.zeroReceivedStats(c.ReceivedStats)
+	p.zeroReceivedTOS(c.ReceivedTOS)
 	p.stampZeroes(c.StampAt, c.Clock)
 	p.setSeqno(seqno)
 
@@ -303,6 +353,16 @@ func (c *Client) send(ctx context.Context) error {
 	c.Length = p.setLen(c.Length)
 	c.initCh <- true
 
+	// set the length of the first packet from the schedule, and record
+	// scheduled send times, except for isochronous schedules
+	_, plen := c.Scheduler.Next(seqno, &c.Params, 0, 0)
+	c.setLen(p, plen)
+	_, iso := c.Scheduler.(*IsochronousScheduler)
+	tsched := time.Duration(0)
+	if iso {
+		tsched = InvalidDuration
+	}
+
 	// fill the first packet, if necessary
 	if c.Filler != nil {
 		err := p.readPayload(c.Filler)
@@ -327,7 +387,7 @@ func (c *Client) send(ctx context.Context) error {
 	// keep sending until the duration has passed
 	for {
 		// send to network and record times right before and after
-		tsend := c.rec.recordPreSend(seqno)
+		tsend := c.rec.recordPreSend(seqno, tsched)
 		var err error
 		if clientDropsPercent == 0 || rand.Float32() > clientDropsPercent {
 			err = c.conn.send(p)
@@ -338,7 +398,7 @@ func (c *Client) send(ctx context.Context) error {
 
 		// return on error
 		if err != nil {
-			if !c.Stream {
+			if !c.Stream && !c.Incremental {
 				c.rec.removeLastRoundTrip()
 			}
 			return err
@@ -347,11 +407,24 @@ func (c *Client) send(ctx context.Context) error {
 		// record send call
 		c.rec.recordPostSend(seqno, tsend, p.tsent, uint64(p.length()))
 
+		// get the next send time and length from the schedule (before
+		// preparing the packet, so its length can be set)
+		seqno++
+		at, plen := c.Scheduler.Next(seqno, &c.Params,
+			p.tsent.Sub(c.rec.Start), c.TimeSource.Now(Monotonic).Sub(c.rec.Start))
+		if at == ScheduleEnd {
+			break
+		}
+		tnext := c.rec.Start.Add(at)
+		if !iso {
+			tsched = at
+		}
+
 		// prepare next packet (before sleep, so the next send time is as
 		// precise as possible)
-		seqno++
 		p.setSeqno(seqno)
-		if c.Filler != nil && !c.FillOne {
+		lchg := c.setLen(p, plen)
+		if c.Filler != nil && (!c.FillOne || lchg) {
 			err := p.readPayload(c.Filler)
 			if err != nil {
 				return err
@@ -359,27 +432,20 @@ func (c *Client) send(ctx context.Context) error {
 		}
 		p.updateHMAC()
 
-		// set the current base interval we're at
-		tnext := c.rec.Start.Add(c.Interval *
-			(c.TimeSource.Now(Monotonic).Sub(c.rec.Start) / c.Interval))
-
-		// if we're under half-way to the next interval, sleep until the next
-		// interval, but if we're over half-way, sleep until the interval after
-		// that
-		if p.tsent.Sub(c.rec.Start)%c.Interval < c.Interval/2 {
-			tnext = tnext.Add(c.Interval)
-		} else {
-			tnext = tnext.Add(2 * c.Interval)
-		}
-
 		// break if tnext is after the end of the test
 		if !end.IsZero() && !tnext.Before(end) {
 			break
 		}
 
-		// calculate sleep duration
+		// calculate sleep duration, and send immediately if we're late
 		tsleep := c.TimeSource.Now(Monotonic)
 		dsleep := tnext.Sub(tsleep)
+		if dsleep <= 0 {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			continue
+		}
 
 		// sleep
 		t, err = c.Timer.Sleep(ctx, c.TimeSource, tsleep, dsleep)
@@ -394,6 +460,16 @@ func (c *Client) send(ctx context.Context) error {
 	return nil
 }
 
+// setLen sets the length of a test packet to the scheduled length, limited to
+// the negotiated length, and returns true if the length changed.
+func (c *Client) setLen(p *packet, plen int) bool {
+	if plen > c.Length {
+		plen = c.Length
+	}
+	l := p.length()
+	return p.setLen(plen) != l
+}
+
 // receive receives packets from the server (called in goroutine from Run)
 func (c *Client) receive() error {
 	if c.ThreadLock {
@@ -405,6 +481,7 @@ func (c *Client) receive() error {
 	}
 
 	p := c.conn.newPacket()
+	_, iso := c.Scheduler.(*IsochronousScheduler)
 
 	for {
 		// read a packet
@@ -418,11 +495,19 @@ func (c *Client) receive() error {
 			return Errorf(UnexpectedOpenFlag, "unexpected open flag set")
 		}
 
+		// stop sending if the server closed the conn, e.g. because it's
+		// shutting down, but keep receiving until the final packets are in
+		if r, ok := p.closeReason(); ok {
+			c.serverClose(r)
+			continue
+		}
+
 		// add expected echo reply fields
 		p.addFields(fechoReply, false)
 
-		// return an error if reply packet was too small
-		if p.length() < c.Length {
+		// return an error if reply packet was too small (replies echo the
+		// request length, so only isochronous schedules expect c.Length)
+		if iso && p.length() < c.Length {
 			return Errorf(ShortReply, "received short reply (%d bytes)",
 				p.length())
 		}
@@ -430,9 +515,18 @@ func (c *Client) receive() error {
 		// add expected received stats fields
 		p.addReceivedStatsFields(c.ReceivedStats)
 
+		// add expected received TOS field
+		p.addReceivedTOSField(c.ReceivedTOS)
+
 		// add expected timestamp fields
 		p.addTimestampFields(c.StampAt, c.Clock)
 
+		// return an error if reply packet was too small for its fields
+		if p.length() < p.sumLens() {
+			return Errorf(ShortReply, "received short reply (%d bytes)",
+				p.length())
+		}
+
 		// get timestamps and return an error if the timestamp setting is
 		// different (server doesn't support timestamps)
 		at := p.stampAt()
@@ -460,6 +554,20 @@ func (c *Client) receive() error {
 	}
 }
 
+// serverClose stops the test after the server sent a close, e.g. because it's
+// shutting down. Packets that were not sent are not counted as lost.
+func (c *Client) serverClose(r CloseReason) {
+	if !c.sclose.CompareAndSwap(0, uint32(r)) {
+		return
+	}
+	if r == CloseShutdown {
+		c.eventf(ServerShutdown, "server shutting down, stopping test")
+	} else {
+		c.eventf(ServerClose, "server closed connection (%s), stopping test", r)
+	}
+	c.stop()
+}
+
 // wait waits for final packets
 func (c *Client) wait(ctx context.Context) (err error) {
 	// return if all packets have been received
@@ -29,6 +29,7 @@ func _() {
 	_ = x[ParamOverflow - -19]
 	_ = x[InvalidParamValue - -20]
 	_ = x[ProtocolVersionMismatch - -21]
+	_ = x[ReceiveTOSNotSupported - -22]
 	_ = x[NoMatchingInterfaces - -1024]
 	_ = x[NoMatchingInterfacesUp - -1025]
 	_ = x[UnspecifiedWithSpecifiedAddresses - -1026]
@@ -40,6 +41,21 @@ func _() {
 	_ = x[AddressMismatch - -1032]
 	_ = x[SyslogNotSupported - -1033]
 	_ = x[InvalidSyslogURI - -1034]
+	_ = x[InvalidListenFDs - -1035]
+	_ = x[NonUDPListenFD - -1036]
+	_ = x[UpgradeFailed - -1037]
+	_ = x[ReloadFailed - -1038]
+	_ = x[InvalidSourceLimit - -1039]
+	_ = x[SourcePacketLimit - -1040]
+	_ = x[SourceByteLimit - -1041]
+	_ = x[InvalidBitratePolicy - -1042]
+	_ = x[BitrateLimit - -1043]
+	_ = x[OpenRateLimited - -1044]
+	_ = x[InvalidConnLimitPolicy - -1045]
+	_ = x[InvalidACLPrefix - -1046]
+	_ = x[InvalidACLPolicy - -1047]
+	_ = x[AccessDenied - -1048]
+	_ = x[SourceOpenLimit - -1049]
 	_ = x[InvalidWinAvgWindow - -2048]
 	_ = x[InvalidExpAvgAlpha - -2049]
 	_ = x[AllocateResultsPanic - -2050]
@@ -71,6 +87,13 @@ func _() {
 	_ = x[OpenTimeoutTooShort - -2076]
 	_ = x[ServerFillTooLong - -2077]
 	_ = x[UnexpectedInitChannelClose - -2078]
+	_ = x[NoSuchScheduler - -2079]
+	_ = x[InvalidSchedulerArgs - -2080]
+	_ = x[InvalidTrace - -2081]
+	_ = x[InvalidPercentile - -2082]
+	_ = x[StreamWindowNonPositive - -2083]
+	_ = x[InvalidLostString - -2084]
+	_ = x[NoSuchColumn - -2085]
 	_ = x[MultipleAddresses-1024]
 	_ = x[ServerStart-1025]
 	_ = x[ServerStop-1026]
@@ -86,6 +109,29 @@ func _() {
 	_ = x[NoReceiveDstAddrSupport-1036]
 	_ = x[RemoveNoConn-1037]
 	_ = x[InvalidServerFill-1038]
+	_ = x[NoReceiveTOSSupport-1039]
+	_ = x[MetricsStart-1040]
+	_ = x[MetricsError-1041]
+	_ = x[ControlStart-1042]
+	_ = x[ControlError-1043]
+	_ = x[ControlCommand-1044]
+	_ = x[ShuttingDown-1045]
+	_ = x[ShutdownCloseConn-1046]
+	_ = x[UpgradeStart-1047]
+	_ = x[UpgradeResume-1048]
+	_ = x[UpgradeError-1049]
+	_ = x[ConfigReload-1050]
+	_ = x[ConfigReloadError-1051]
+	_ = x[ListenerRemove-1052]
+	_ = x[SourceConnLimit-1053]
+	_ = x[BitrateRestriction-1054]
+	_ = x[BitrateConnLimit-1055]
+	_ = x[OpenExpired-1056]
+	_ = x[ConnTableFull-1057]
+	_ = x[ConnEvicted-1058]
+	_ = x[AccessDeniedClose-1059]
+	_ = x[SourceBanned-1060]
+	_ = x[SourceUnbanned-1061]
 	_ = x[Connecting-2048]
 	_ = x[MultipleServerAddresses-2049]
 	_ = x[Connected-2050]
@@ -93,39 +139,41 @@ func _() {
 	_ = x[ServerRestriction-2052]
 	_ = x[NoTest-2053]
 	_ = x[ConnectedClosed-2054]
+	_ = x[ServerShutdown-2055]
+	_ = x[ServerClose-2056]
 }
 
 const (
-	_Code_name_0 = "UnexpectedInitChannelCloseServerFillTooLongOpenTimeoutTooShortInvalidReceivedStatsStringInvalidReceivedStatsIntInvalidServerRestrictionOpenTimeoutServerClosedConnTokenZeroDurationNonPositiveIntervalNonPositiveNoSuchWaiterNoSuchTimeSourceNoSuchTimerNoSuchFillerNoSuchAveragerInvalidWaitDurationInvalidWaitFactorInvalidWaitStringInvalidSleepFactorUnexpectedSequenceNumberClockMismatchStampAtMismatchShortReplyExpectedReplyFlagTTLErrorDFErrorUnexpectedOpenFlagAllocateResultsPanicInvalidExpAvgAlphaInvalidWinAvgWindow"
-	_Code_name_1 = "InvalidSyslogURISyslogNotSupportedAddressMismatchLargeRequestShortIntervalInvalidConnTokenNoSuitableAddressFoundUnexpectedReplyFlagUnspecifiedWithSpecifiedAddressesNoMatchingInterfacesUpNoMatchingInterfaces"
-	_Code_name_2 = "ProtocolVersionMismatchInvalidParamValueParamOverflowShortParamBufferInvalidFlagBitsSetDFNotSupportedInconsistentClocksNonexclusiveMidpointTStampUnexpectedHMACBadHMACNoHMACBadMagicInvalidClockIntInvalidClockStringInvalidAllowStampStringInvalidStampAtIntInvalidStampAtStringFieldsCapacityTooLargeFieldsLengthTooLargeInvalidDFStringShortWrite"
-	_Code_name_3 = "MultipleAddressesServerStartServerStopListenerStartListenerStopListenerErrorDropNewConnOpenCloseCloseConnNoDSCPSupportExceededDurationNoReceiveDstAddrSupportRemoveNoConnInvalidServerFill"
-	_Code_name_4 = "ConnectingMultipleServerAddressesConnectedWaitForPacketsServerRestrictionNoTestConnectedClosed"
+	_Code_name_0 = "NoSuchColumnInvalidLostStringStreamWindowNonPositiveInvalidPercentileInvalidTraceInvalidSchedulerArgsNoSuchSchedulerUnexpectedInitChannelCloseServerFillTooLongOpenTimeoutTooShortInvalidReceivedStatsStringInvalidReceivedStatsIntInvalidServerRestrictionOpenTimeoutServerClosedConnTokenZeroDurationNonPositiveIntervalNonPositiveNoSuchWaiterNoSuchTimeSourceNoSuchTimerNoSuchFillerNoSuchAveragerInvalidWaitDurationInvalidWaitFactorInvalidWaitStringInvalidSleepFactorUnexpectedSequenceNumberClockMismatchStampAtMismatchShortReplyExpectedReplyFlagTTLErrorDFErrorUnexpectedOpenFlagAllocateResultsPanicInvalidExpAvgAlphaInvalidWinAvgWindow"
+	_Code_name_1 = "SourceOpenLimitAccessDeniedInvalidACLPolicyInvalidACLPrefixInvalidConnLimitPolicyOpenRateLimitedBitrateLimitInvalidBitratePolicySourceByteLimitSourcePacketLimitInvalidSourceLimitReloadFailedUpgradeFailedNonUDPListenFDInvalidListenFDsInvalidSyslogURISyslogNotSupportedAddressMismatchLargeRequestShortIntervalInvalidConnTokenNoSuitableAddressFoundUnexpectedReplyFlagUnspecifiedWithSpecifiedAddressesNoMatchingInterfacesUpNoMatchingInterfaces"
+	_Code_name_2 = "ReceiveTOSNotSupportedProtocolVersionMismatchInvalidParamValueParamOverflowShortParamBufferInvalidFlagBitsSetDFNotSupportedInconsistentClocksNonexclusiveMidpointTStampUnexpectedHMACBadHMACNoHMACBadMagicInvalidClockIntInvalidClockStringInvalidAllowStampStringInvalidStampAtIntInvalidStampAtStringFieldsCapacityTooLargeFieldsLengthTooLargeInvalidDFStringShortWrite"
+	_Code_name_3 = "MultipleAddressesServerStartServerStopListenerStartListenerStopListenerErrorDropNewConnOpenCloseCloseConnNoDSCPSupportExceededDurationNoReceiveDstAddrSupportRemoveNoConnInvalidServerFillNoReceiveTOSSupportMetricsStartMetricsErrorControlStartControlErrorControlCommandShuttingDownShutdownCloseConnUpgradeStartUpgradeResumeUpgradeErrorConfigReloadConfigReloadErrorListenerRemoveSourceConnLimitBitrateRestrictionBitrateConnLimitOpenExpiredConnTableFullConnEvictedAccessDeniedCloseSourceBannedSourceUnbanned"
+	_Code_name_4 = "ConnectingMultipleServerAddressesConnectedWaitForPacketsServerRestrictionNoTestConnectedClosedServerShutdownServerClose"
 )
 
 var (
-	_Code_index_0 = [...]uint16{0, 26, 43, 62, 88, 111, 135, 146, 158, 171, 190, 209, 221, 237, 248, 260, 274, 293, 310, 327, 345, 369, 382, 397, 407, 424, 432, 439, 457, 477, 495, 514}
-	_Code_index_1 = [...]uint8{0, 16, 34, 49, 61, 74, 90, 112, 131, 164, 186, 206}
-	_Code_index_2 = [...]uint16{0, 23, 40, 53, 69, 87, 101, 119, 145, 159, 166, 172, 180, 195, 213, 236, 253, 273, 295, 315, 330, 340}
-	_Code_index_3 = [...]uint8{0, 17, 28, 38, 51, 63, 76, 80, 87, 96, 105, 118, 134, 157, 169, 186}
-	_Code_index_4 = [...]uint8{0, 10, 33, 42, 56, 73, 79, 94}
+	_Code_index_0 = [...]uint16{0, 12, 29, 52, 69, 81, 101, 116, 142, 159, 178, 204, 227, 251, 262, 274, 287, 306, 325, 337, 353, 364, 376, 390, 409, 426, 443, 461, 485, 498, 513, 523, 540, 548, 555, 573, 593, 611, 630}
+	_Code_index_1 = [...]uint16{0, 15, 27, 43, 59, 81, 96, 108, 128, 143, 160, 178, 190, 203, 217, 233, 249, 267, 282, 294, 307, 323, 345, 364, 397, 419, 439}
+	_Code_index_2 = [...]uint16{0, 22, 45, 62, 75, 91, 109, 123, 141, 167, 181, 188, 194, 202, 217, 235, 258, 275, 295, 317, 337, 352, 362}
+	_Code_index_3 = [...]uint16{0, 17, 28, 38, 51, 63, 76, 80, 87, 96, 105, 118, 134, 157, 169, 186, 205, 217, 229, 241, 253, 267, 279, 296, 308, 321, 333, 345, 362, 376, 391, 409, 425, 436, 449, 460, 477, 489, 503}
+	_Code_index_4 = [...]uint8{0, 10, 33, 42, 56, 73, 79, 94, 108, 119}
 )
 
 func (i Code) String() string {
 	switch {
-	case -2078 <= i && i <= -2048:
-		i -= -2078
+	case -2085 <= i && i <= -2048:
+		i -= -2085
 		return _Code_name_0[_Code_index_0[i]:_Code_index_0[i+1]]
-	case -1034 <= i && i <= -1024:
-		i -= -1034
+	case -1049 <= i && i <= -1024:
+		i -= -1049
 		return _Code_name_1[_Code_index_1[i]:_Code_index_1[i+1]]
-	case -21 <= i && i <= -1:
-		i -= -21
+	case -22 <= i && i <= -1:
+		i -= -22
 		return _Code_name_2[_Code_index_2[i]:_Code_index_2[i+1]]
-	case 1024 <= i && i <= 1038:
+	case 1024 <= i && i <= 1061:
 		i -= 1024
 		return _Code_name_3[_Code_index_3[i]:_Code_index_3[i+1]]
-	case 2048 <= i && i <= 2054:
+	case 2048 <= i && i <= 2056:
 		i -= 2048
 		return _Code_name_4[_Code_index_4[i]:_Code_index_4[i+1]]
 	default:
@@ -24,6 +24,8 @@ type nconn struct {
 	dscpSupport bool
 	ttl         int
 	df          DF
+	recvTOS     bool
+	oob         []byte
 	timeSource  TimeSource
 }
 
@@ -86,6 +88,30 @@ func (n *nconn) setReceiveDstAddr(b bool) (err error) {
 	return
 }
 
+// setReceiveTOS enables receipt of the TOS byte (IPv4) or Traffic Class
+// (IPv6) for each packet, which is read from the socket control messages.
+func (n *nconn) setReceiveTOS() (err error) {
+	if n.recvTOS {
+		return
+	}
+	if err = setSockoptReceiveTOS(n.conn, n.ipVer); err == nil {
+		n.recvTOS = true
+		n.oob = make([]byte, oobLen)
+	}
+	return
+}
+
+// readMsg reads a packet along with its control messages, returning the
+// received TOS value, if available. It is only used after setReceiveTOS.
+func (n *nconn) readMsg(b []byte) (nr int, oob []byte, raddr *net.UDPAddr,
+	tos TOS, err error) {
+	var oobn int
+	nr, oobn, _, raddr, err = n.conn.ReadMsgUDP(b, n.oob)
+	oob = n.oob[:oobn]
+	tos = parseTOS(oob)
+	return
+}
+
 func (n *nconn) setDF(df DF) (err error) {
 	if n.df == df {
 		return
@@ -225,6 +251,11 @@ func (c *cconn) open(ctx context.Context) (err error) {
 			c.ctoken = orp.ctoken()
 			if orp.flags()&flClose != 0 {
 				c.close()
+				// the server closed a conn the client didn't ask to close
+				// (e.g. for a version mismatch, or because it's shutting down)
+				if !c.cfg.NoTest {
+					rerr = Errorf(ServerClosed, "server closed connection")
+				}
 			}
 			return
 		}
@@ -288,7 +319,12 @@ func (c *cconn) send(p *packet) (err error) {
 
 func (c *cconn) receive(p *packet) (err error) {
 	var n int
-	n, err = c.conn.Read(p.readTo())
+	if c.recvTOS {
+		n, _, _, p.tos, err = c.readMsg(p.readTo())
+	} else {
+		n, err = c.conn.Read(p.readTo())
+		p.tos = InvalidTOS
+	}
 	p.trcvd = c.timeSource.Now(BothClocks)
 	p.tsent = Time{}
 	p.dscp = 0
@@ -303,8 +339,10 @@ func (c *cconn) receive(p *packet) (err error) {
 		return
 	}
 	if p.flags()&flClose != 0 {
-		err = Errorf(ServerClosed, "server closed connection")
-		c.close()
+		if _, ok := p.closeReason(); !ok {
+			err = Errorf(ServerClosed, "server closed connection")
+			c.close()
+		}
 	}
 	return
 }
@@ -364,8 +402,33 @@ func listen(laddr *net.UDPAddr, setSrcIP bool, ts TimeSource) (l *lconn, err err
 	if conn, err = net.ListenUDP(ipVer.udpNetwork(), laddr); err != nil {
 		return
 	}
-	l = &lconn{nconn: &nconn{}, setSrcIP: setSrcIP && laddr.IP.IsUnspecified()}
-	l.init(conn, ipVer, ts)
+	l = newLconn(conn, setSrcIP, ts)
+	return
+}
+
+// newLconn creates an lconn from a UDP conn that's already bound, such as
+// one passed with socket activation.
+func newLconn(conn *net.UDPConn, setSrcIP bool, ts TimeSource) *lconn {
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	l := &lconn{nconn: &nconn{}, setSrcIP: setSrcIP && laddr.IP.IsUnspecified()}
+	l.init(conn, IPVersionFromUDPAddr(laddr), ts)
+	return l
+}
+
+// wrapAll creates lconns for UDP conns that are already bound, with the given
+// IP version. Conns for other IP versions are closed.
+func wrapAll(ipVer IPVersion, conns []*net.UDPConn, setSrcIP bool,
+	ts TimeSource) (lconns []*lconn, err error) {
+	for _, c := range conns {
+		if IPVersionFromUDPAddr(c.LocalAddr().(*net.UDPAddr))&ipVer == 0 {
+			c.Close()
+			continue
+		}
+		lconns = append(lconns, newLconn(c, setSrcIP, ts))
+	}
+	if len(lconns) == 0 {
+		err = Errorf(NoSuitableAddressFound, "no suitable %s socket found", ipVer)
+	}
 	return
 }
 
@@ -422,7 +485,23 @@ func (l *lconn) send(p *packet) (err error) {
 
 func (l *lconn) receive(p *packet) (err error) {
 	var n int
-	if !l.setSrcIP {
+	if n, err = l.read(p); err != nil {
+		return
+	}
+	return l.parse(p, n)
+}
+
+// read reads a packet without parsing it, returning its length.
+func (l *lconn) read(p *packet) (n int, err error) {
+	p.tos = InvalidTOS
+	if l.recvTOS {
+		var oob []byte
+		n, oob, p.raddr, p.tos, err = l.readMsg(p.readTo())
+		p.dstIP = nil
+		if l.setSrcIP && len(oob) > 0 {
+			p.dstIP = l.parseDstIP(oob)
+		}
+	} else if !l.setSrcIP {
 		n, p.raddr, err = l.conn.ReadFromUDP(p.readTo())
 		p.dstIP = nil
 	} else if l.ip4conn != nil {
@@ -454,9 +533,11 @@ func (l *lconn) receive(p *packet) (err error) {
 	p.dscp = 0
 	p.trcvd = l.timeSource.Now(BothClocks)
 	p.tsent = Time{}
-	if err != nil {
-		return
-	}
+	return
+}
+
+// parse parses and validates a packet of length n that was read with read.
+func (l *lconn) parse(p *packet, n int) (err error) {
 	if err = p.readReset(n); err != nil {
 		return
 	}
@@ -467,6 +548,23 @@ func (l *lconn) receive(p *packet) (err error) {
 	return
 }
 
+// parseDstIP returns the destination IP from the given control messages, or
+// nil if it's not present.
+func (l *lconn) parseDstIP(oob []byte) net.IP {
+	if l.ip4conn != nil {
+		cm := ipv4.ControlMessage{}
+		if cm.Parse(oob) == nil {
+			return cm.Dst
+		}
+	} else {
+		cm := ipv6.ControlMessage{}
+		if cm.Parse(oob) == nil {
+			return cm.Dst
+		}
+	}
+	return nil
+}
+
 // parseIfaceListenAddr parses an interface listen address into an interface
 // name and service. ok is false if the string does not use the syntax
 // %iface:service, where :service is optional.
@@ -0,0 +1,284 @@
+package irtt
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rtColumn is a column of per-round-trip delimited output.
+type rtColumn struct {
+	name  string
+	value func(rt *RoundTrip) string
+}
+
+// statsColumn is a column of summary stats delimited output.
+type statsColumn struct {
+	name  string
+	value func(s *Stats) string
+}
+
+// durString returns a duration in nanoseconds, or an empty string if invalid.
+func durString(d time.Duration) string {
+	if d == InvalidDuration {
+		return ""
+	}
+	return strconv.FormatInt(int64(d), 10)
+}
+
+// wallString returns the wall clock value of a Time in nanoseconds, or an
+// empty string if zero.
+func wallString(t Time) string {
+	if t.IsWallZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.Wall, 10)
+}
+
+// rtColumns are all of the available per-round-trip columns.
+var rtColumns = []rtColumn{
+	{"seqno", func(rt *RoundTrip) string {
+		return strconv.FormatUint(uint64(rt.Seqno), 10)
+	}},
+	{"lost", func(rt *RoundTrip) string { return rt.Lost.String() }},
+	{"rtt", func(rt *RoundTrip) string { return durString(rt.RTT()) }},
+	{"send_delay", func(rt *RoundTrip) string {
+		return durString(rt.SendDelay())
+	}},
+	{"receive_delay", func(rt *RoundTrip) string {
+		return durString(rt.ReceiveDelay())
+	}},
+	{"ipdv", func(rt *RoundTrip) string { return durString(rt.IPDV) }},
+	{"send_ipdv", func(rt *RoundTrip) string { return durString(rt.SendIPDV) }},
+	{"receive_ipdv", func(rt *RoundTrip) string {
+		return durString(rt.ReceiveIPDV)
+	}},
+	{"late", func(rt *RoundTrip) string { return strconv.FormatBool(rt.Late) }},
+	{"length", func(rt *RoundTrip) string { return strconv.Itoa(rt.Length) }},
+	{"client_send", func(rt *RoundTrip) string {
+		return wallString(rt.Client.Send)
+	}},
+	{"server_receive", func(rt *RoundTrip) string {
+		return wallString(rt.Server.Receive)
+	}},
+	{"server_send", func(rt *RoundTrip) string {
+		return wallString(rt.Server.Send)
+	}},
+	{"client_receive", func(rt *RoundTrip) string {
+		return wallString(rt.Client.Receive)
+	}},
+}
+
+// statsColumns are all of the available summary stats columns.
+var statsColumns = func() []statsColumn {
+	u := func(name string, fn func(s *Stats) uint64) statsColumn {
+		return statsColumn{name, func(s *Stats) string {
+			return strconv.FormatUint(fn(s), 10)
+		}}
+	}
+	f := func(name string, fn func(s *Stats) float64) statsColumn {
+		return statsColumn{name, func(s *Stats) string {
+			return strconv.FormatFloat(fn(s), 'f', -1, 64)
+		}}
+	}
+	cols := []statsColumn{
+		u("packets_sent", func(s *Stats) uint64 { return uint64(s.PacketsSent) }),
+		u("packets_received", func(s *Stats) uint64 {
+			return uint64(s.PacketsReceived)
+		}),
+		f("packet_loss_percent", func(s *Stats) float64 {
+			return s.PacketLossPercent
+		}),
+		f("upstream_loss_percent", func(s *Stats) float64 {
+			return s.UpstreamLossPercent
+		}),
+		f("downstream_loss_percent", func(s *Stats) float64 {
+			return s.DownstreamLossPercent
+		}),
+		u("duplicates", func(s *Stats) uint64 { return uint64(s.Duplicates) }),
+		u("late_packets", func(s *Stats) uint64 { return uint64(s.LatePackets) }),
+		u("bytes_sent", func(s *Stats) uint64 { return s.BytesSent }),
+		u("bytes_received", func(s *Stats) uint64 { return s.BytesReceived }),
+		{"duration", func(s *Stats) string { return durString(s.Duration) }},
+	}
+	for _, ds := range []struct {
+		name string
+		fn   func(s *Stats) *DurationStats
+	}{
+		{"rtt", func(s *Stats) *DurationStats { return &s.RTTStats }},
+		{"send_delay", func(s *Stats) *DurationStats { return &s.SendDelayStats }},
+		{"receive_delay", func(s *Stats) *DurationStats {
+			return &s.ReceiveDelayStats
+		}},
+		{"ipdv", func(s *Stats) *DurationStats { return &s.RoundTripIPDVStats }},
+		{"send_ipdv", func(s *Stats) *DurationStats { return &s.SendIPDVStats }},
+		{"receive_ipdv", func(s *Stats) *DurationStats {
+			return &s.ReceiveIPDVStats
+		}},
+	} {
+		dfn := ds.fn
+		stat := func(suffix string,
+			fn func(d *DurationStats) (time.Duration, bool)) statsColumn {
+			return statsColumn{ds.name + "_" + suffix, func(s *Stats) string {
+				d := dfn(s)
+				if d.N == 0 {
+					return ""
+				}
+				v, ok := fn(d)
+				if !ok {
+					return ""
+				}
+				return durString(v)
+			}}
+		}
+		cols = append(cols,
+			stat("min", func(d *DurationStats) (time.Duration, bool) {
+				return d.Min, true
+			}),
+			stat("mean", func(d *DurationStats) (time.Duration, bool) {
+				return d.Mean(), true
+			}),
+			stat("median", func(d *DurationStats) (time.Duration, bool) {
+				return d.Median()
+			}),
+			stat("max", func(d *DurationStats) (time.Duration, bool) {
+				return d.Max, true
+			}),
+			stat("stddev", func(d *DurationStats) (time.Duration, bool) {
+				return d.Stddev(), true
+			}),
+		)
+	}
+	return cols
+}()
+
+// rtColumnNames returns the comma separated per-round-trip column names.
+func rtColumnNames() string {
+	ns := make([]string, len(rtColumns))
+	for i, c := range rtColumns {
+		ns[i] = c.name
+	}
+	return strings.Join(ns, ",")
+}
+
+// statsColumnNames returns the comma separated summary stats column names.
+func statsColumnNames() string {
+	ns := make([]string, len(statsColumns))
+	for i, c := range statsColumns {
+		ns[i] = c.name
+	}
+	return strings.Join(ns, ",")
+}
+
+// selectRTColumns returns the per-round-trip columns for a comma separated
+// list of names, or all columns if names is empty.
+func selectRTColumns(names string) ([]rtColumn, error) {
+	if names == "" {
+		return rtColumns, nil
+	}
+	var cols []rtColumn
+outer:
+	for _, n := range strings.Split(names, ",") {
+		for _, c := range rtColumns {
+			if c.name == n {
+				cols = append(cols, c)
+				continue outer
+			}
+		}
+		return nil, Errorf(NoSuchColumn, "no such round trip column %s", n)
+	}
+	return cols, nil
+}
+
+// selectStatsColumns returns the summary stats columns for a comma separated
+// list of names, or all columns if names is empty.
+func selectStatsColumns(names string) ([]statsColumn, error) {
+	if names == "" {
+		return statsColumns, nil
+	}
+	var cols []statsColumn
+outer:
+	for _, n := range strings.Split(names, ",") {
+		for _, c := range statsColumns {
+			if c.name == n {
+				cols = append(cols, c)
+				continue outer
+			}
+		}
+		return nil, Errorf(NoSuchColumn, "no such summary column %s", n)
+	}
+	return cols, nil
+}
+
+// delimitedWriter writes delimited output (CSV or TSV).
+type delimitedWriter struct {
+	*csv.Writer
+	header bool
+}
+
+// newDelimitedWriter returns a new delimitedWriter with the given delimiter,
+// which writes a header row first if header is true.
+func newDelimitedWriter(w io.Writer, delim rune,
+	header bool) *delimitedWriter {
+	cw := csv.NewWriter(w)
+	cw.Comma = delim
+	return &delimitedWriter{cw, header}
+}
+
+// writeRoundTrips writes a row for each round trip.
+func (w *delimitedWriter) writeRoundTrips(cols []rtColumn,
+	rts []RoundTrip) error {
+	row := make([]string, len(cols))
+	if w.header {
+		for i, c := range cols {
+			row[i] = c.name
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	for j := range rts {
+		for i, c := range cols {
+			row[i] = c.value(&rts[j])
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeStats writes a single row of summary stats.
+func (w *delimitedWriter) writeStats(cols []statsColumn, s *Stats) error {
+	row := make([]string, len(cols))
+	if w.header {
+		for i, c := range cols {
+			row[i] = c.name
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	for i, c := range cols {
+		row[i] = c.value(s)
+	}
+	if err := w.Write(row); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// delimiterFor returns the delimiter for a format, csv or tsv.
+func delimiterFor(format string) (rune, bool) {
+	switch format {
+	case "csv":
+		return ',', true
+	case "tsv":
+		return '\t', true
+	}
+	return 0, false
+}
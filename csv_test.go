@@ -0,0 +1,274 @@
+package irtt
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWall is a base wall clock time for test timestamps.
+const testWall = int64(1500000000000000000)
+
+// testRoundTrips returns a received round trip with server timestamps, and a
+// lost round trip.
+func testRoundTrips() []RoundTrip {
+	return []RoundTrip{
+		{
+			Seqno: 0,
+			Lost:  LostFalse,
+			RoundTripData: &RoundTripData{
+				Client: Timestamp{
+					Send:    Time{testWall, 1000},
+					Receive: Time{testWall + 21000000, 21001000},
+				},
+				Server: Timestamp{
+					Receive: Time{testWall + 12000000, 0},
+					Send:    Time{testWall + 12050000, 0},
+				},
+				Late:              true,
+				Length:            172,
+				Scheduled:         10 * time.Millisecond,
+				SentTOS:           0xb8,
+				ServerReceivedTOS: 0xb8,
+				ReceivedTOS:       0xba,
+			},
+			IPDV:        -1500000,
+			SendIPDV:    InvalidDuration,
+			ReceiveIPDV: 250000,
+		},
+		{
+			Seqno: 1,
+			Lost:  LostTrue,
+			RoundTripData: &RoundTripData{
+				Client: Timestamp{
+					Send: Time{testWall + 20000000, 20001000},
+				},
+				Length:            64,
+				Scheduled:         InvalidDuration,
+				SentTOS:           0,
+				ServerReceivedTOS: InvalidTOS,
+				ReceivedTOS:       InvalidTOS,
+			},
+			IPDV:        InvalidDuration,
+			SendIPDV:    InvalidDuration,
+			ReceiveIPDV: InvalidDuration,
+		},
+	}
+}
+
+// testStats returns Stats with RTT stats that have a median and quantiles.
+func testStats() *Stats {
+	s := &Stats{
+		Recorder:          &Recorder{BytesSent: 236, BytesReceived: 172},
+		Duration:          time.Second,
+		PacketsSent:       2,
+		PacketsReceived:   1,
+		PacketLossPercent: 50,
+	}
+	fs := []float64{}
+	for _, d := range []time.Duration{3 * time.Millisecond,
+		time.Millisecond, 2 * time.Millisecond, 10 * time.Millisecond} {
+		s.RTTStats.push(d)
+		fs = append(fs, float64(d))
+	}
+	s.RTTStats.setMedian(median(fs))
+	s.RTTStats.setQuantiles(quantiles(fs, Percentiles{50, 90, 99.9}))
+	s.RoundTripIPDVStats.push(-1500 * time.Microsecond)
+	return s
+}
+
+// testDelimited returns delimited output written by fn, as records.
+func testDelimited(t *testing.T, fn func(w *delimitedWriter) error) [][]string {
+	var b bytes.Buffer
+	if err := fn(newDelimitedWriter(&b, ',', true)); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+// TestConvertRoundTrip tests that round trips and stats marshaled to JSON and
+// unmarshaled again are unchanged, and give the same CSV output as the
+// originals.
+func TestConvertRoundTrip(t *testing.T) {
+	type result struct {
+		Stats      *Stats      `json:"stats"`
+		RoundTrips []RoundTrip `json:"round_trips"`
+	}
+	orig := &result{testStats(), testRoundTrips()}
+	b, err := json.Marshal(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r result
+	if err := json.Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	// check round trips
+	if len(r.RoundTrips) != len(orig.RoundTrips) {
+		t.Fatalf("unmarshaled %d round trips, expected %d", len(r.RoundTrips),
+			len(orig.RoundTrips))
+	}
+	for i := range r.RoundTrips {
+		o, u := &orig.RoundTrips[i], &r.RoundTrips[i]
+		// the sent TOS is only kept with a received TOS
+		if !o.ServerReceivedTOS.IsValid() && !o.ReceivedTOS.IsValid() &&
+			u.SentTOS != InvalidTOS {
+			t.Errorf("round trip %d sent TOS unmarshaled as %s", i, u.SentTOS)
+		}
+		u.SentTOS = o.SentTOS
+		if o.Seqno != u.Seqno || o.Lost != u.Lost || o.Late != u.Late ||
+			o.Length != u.Length || o.Scheduled != u.Scheduled ||
+			o.Client != u.Client || o.Server != u.Server ||
+			o.IPDV != u.IPDV || o.SendIPDV != u.SendIPDV ||
+			o.ReceiveIPDV != u.ReceiveIPDV || o.SentTOS != u.SentTOS ||
+			o.ServerReceivedTOS != u.ServerReceivedTOS ||
+			o.ReceivedTOS != u.ReceivedTOS {
+			t.Errorf("round trip %d unmarshaled as %+v %+v, expected %+v %+v",
+				i, *u, *u.RoundTripData, *o, *o.RoundTripData)
+		}
+	}
+
+	// check stats
+	o, u := &orig.Stats.RTTStats, &r.Stats.RTTStats
+	if o.N != u.N || o.Total != u.Total || o.Min != u.Min || o.Max != u.Max ||
+		o.Mean() != u.Mean() {
+		t.Errorf("RTT stats unmarshaled as %+v, expected %+v", *u, *o)
+	}
+	if d := math.Abs(float64(o.Stddev() - u.Stddev())); d > 1 {
+		t.Errorf("RTT stddev unmarshaled as %s, expected %s", u.Stddev(),
+			o.Stddev())
+	}
+	om, _ := o.Median()
+	if um, ok := u.Median(); !ok || um != om {
+		t.Errorf("RTT median unmarshaled as %s, expected %s", um, om)
+	}
+	if len(u.Quantiles()) != len(o.Quantiles()) {
+		t.Errorf("RTT quantiles unmarshaled as %v, expected %v", u.Quantiles(),
+			o.Quantiles())
+	} else {
+		for i, q := range u.Quantiles() {
+			if q != o.Quantiles()[i] {
+				t.Errorf("RTT quantiles unmarshaled as %v, expected %v",
+					u.Quantiles(), o.Quantiles())
+				break
+			}
+		}
+	}
+	if _, ok := r.Stats.SendDelayStats.Median(); ok {
+		t.Error("empty send delay stats unmarshaled with a median")
+	}
+
+	// CSV from unmarshaled round trips and stats is the same as from the
+	// originals
+	rtRecs := testDelimited(t, func(w *delimitedWriter) error {
+		return w.writeRoundTrips(rtColumns, r.RoundTrips)
+	})
+	expRecs := testDelimited(t, func(w *delimitedWriter) error {
+		return w.writeRoundTrips(rtColumns, orig.RoundTrips)
+	})
+	if !equalRecords(rtRecs, expRecs) {
+		t.Errorf("round trip CSV is\n%v\nexpected\n%v", rtRecs, expRecs)
+	}
+	statsRecs := testDelimited(t, func(w *delimitedWriter) error {
+		return w.writeStats(statsColumns, r.Stats)
+	})
+	expRecs = testDelimited(t, func(w *delimitedWriter) error {
+		return w.writeStats(statsColumns, orig.Stats)
+	})
+	if !equalRecords(statsRecs, expRecs) {
+		t.Errorf("stats CSV is\n%v\nexpected\n%v", statsRecs, expRecs)
+	}
+
+	// check some values
+	expect := map[string][]string{
+		"seqno":          {"0", "1"},
+		"lost":           {"false", "true"},
+		"rtt":            {"20950000", ""},
+		"send_delay":     {"12000000", ""},
+		"receive_delay":  {"8950000", ""},
+		"ipdv":           {"-1500000", ""},
+		"send_ipdv":      {"", ""},
+		"receive_ipdv":   {"250000", ""},
+		"late":           {"true", "false"},
+		"length":         {"172", "64"},
+		"client_send":    {"1500000000000000000", "1500000000020000000"},
+		"server_receive": {"1500000000012000000", ""},
+	}
+	for name, vs := range expect {
+		col := columnValues(rtRecs, name)
+		if strings.Join(col, ",") != strings.Join(vs, ",") {
+			t.Errorf("column %s is %v, expected %v", name, col, vs)
+		}
+	}
+	for name, v := range map[string]string{
+		"packets_sent":        "2",
+		"packet_loss_percent": "50",
+		"bytes_sent":          "236",
+		"duration":            "1000000000",
+		"rtt_min":             "1000000",
+		"rtt_mean":            "4000000",
+		"rtt_median":          "2500000",
+		"rtt_max":             "10000000",
+		"send_delay_min":      "",
+		"ipdv_median":         "",
+	} {
+		if col := columnValues(statsRecs, name); len(col) != 1 || col[0] != v {
+			t.Errorf("column %s is %v, expected %s", name, col, v)
+		}
+	}
+}
+
+// TestSelectColumns tests selecting columns by name.
+func TestSelectColumns(t *testing.T) {
+	cols, err := selectRTColumns("rtt,seqno")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 2 || cols[0].name != "rtt" || cols[1].name != "seqno" {
+		t.Errorf("selected %v, expected rtt,seqno", cols)
+	}
+	if _, err := selectRTColumns("rtt,nope"); !isErrorCode(NoSuchColumn, err) {
+		t.Errorf("expected NoSuchColumn, got %v", err)
+	}
+	if _, err := selectStatsColumns("rtt"); !isErrorCode(NoSuchColumn, err) {
+		t.Errorf("expected NoSuchColumn, got %v", err)
+	}
+}
+
+func equalRecords(a, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if strings.Join(a[i], "\x00") != strings.Join(b[i], "\x00") {
+			return false
+		}
+	}
+	return true
+}
+
+// columnValues returns the values for the named column, using the header row.
+func columnValues(recs [][]string, name string) []string {
+	if len(recs) == 0 {
+		return nil
+	}
+	for i, n := range recs[0] {
+		if n == name {
+			vs := []string{}
+			for _, rec := range recs[1:] {
+				vs = append(vs, rec[i])
+			}
+			return vs
+		}
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package irtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ctlRequest is a request to the control socket.
+type ctlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// ctlResponse is a response from the control socket.
+type ctlResponse struct {
+	Error   string     `json:"error,omitempty"`
+	Message string     `json:"message,omitempty"`
+	Conns   []ctlConn  `json:"conns,omitempty"`
+	Limits  *ctlLimits `json:"limits,omitempty"`
+	Bans    []ctlBan   `json:"bans,omitempty"`
+}
+
+// ctlConn describes an active connection.
+type ctlConn struct {
+	Listener   string        `json:"listener"`
+	RemoteAddr string        `json:"remote_address"`
+	Token      string        `json:"token"`
+	Age        time.Duration `json:"age"`
+	Duration   time.Duration `json:"duration"`
+	Interval   time.Duration `json:"interval"`
+	Length     int           `json:"length"`
+	Packets    uint64        `json:"packets"`
+	Bytes      uint64        `json:"bytes"`
+}
+
+// ctlLimits are the limits that may be changed at runtime.
+type ctlLimits struct {
+	MinInterval time.Duration `json:"min_interval"`
+	MaxDuration time.Duration `json:"max_duration"`
+	MaxLength   int           `json:"max_length"`
+}
+
+// ctlBan describes a banned source.
+type ctlBan struct {
+	IP        string        `json:"ip"`
+	Remaining time.Duration `json:"remaining"`
+	Bans      int           `json:"bans"`
+}
+
+// ctlServer serves requests on a Unix domain control socket, to list and close
+// connections, change limits, edit the ban list and shut down the server. Each connection to the
+// socket carries one JSON request and response.
+type ctlServer struct {
+	s  *Server
+	ln net.Listener
+}
+
+func newCtlServer(s *Server) *ctlServer {
+	return &ctlServer{s: s}
+}
+
+// listen creates the control socket, removing any stale socket first, and
+// makes it accessible only to the owner. The socket is created with a umask
+// that denies access to others, so there's no window where it's accessible
+// before the chmod, which is kept for platforms without a umask. The umask is
+// process wide, but only makes files created at the same time more private.
+func (cs *ctlServer) listen() (err error) {
+	path := cs.s.ControlSocket
+	if fi, serr := os.Stat(path); serr == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, derr := net.Dial("unix", path); derr == nil {
+			c.Close()
+			return fmt.Errorf("control socket %s in use", path)
+		}
+		os.Remove(path)
+	}
+	umask := setUmask(0077)
+	cs.ln, err = net.Listen("unix", path)
+	setUmask(umask)
+	if err != nil {
+		return
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		cs.ln.Close()
+	}
+	return
+}
+
+// serve accepts and handles connections until the socket is closed.
+func (cs *ctlServer) serve() {
+	for {
+		c, err := cs.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				cs.eventf(ControlError, "error for control socket (%s)", err)
+			}
+			return
+		}
+		go cs.handle(c)
+	}
+}
+
+func (cs *ctlServer) close() error {
+	return cs.ln.Close()
+}
+
+// handle reads one request from a connection and writes the response.
+func (cs *ctlServer) handle(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(ctlTimeout))
+	var req ctlRequest
+	if err := json.NewDecoder(c).Decode(&req); err != nil {
+		cs.eventf(ControlError, "invalid control request (%s)", err)
+		return
+	}
+	cs.eventf(ControlCommand, "control command: %s",
+		strings.TrimSpace(req.Command+" "+strings.Join(req.Args, " ")))
+	resp, err := cs.exec(&req)
+	if err != nil {
+		resp = &ctlResponse{Error: err.Error()}
+	}
+	json.NewEncoder(c).Encode(resp)
+}
+
+// exec executes a request.
+func (cs *ctlServer) exec(req *ctlRequest) (*ctlResponse, error) {
+	nargs := map[string][2]int{
+		"list":     {0, 0},
+		"limits":   {0, 0},
+		"close":    {1, 1},
+		"set":      {2, 2},
+		"bans":     {0, 0},
+		"ban":      {1, 2},
+		"unban":    {1, 1},
+		"shutdown": {0, 0},
+	}
+	n, ok := nargs[req.Command]
+	if !ok {
+		return nil, fmt.Errorf("unknown command %s", req.Command)
+	}
+	if len(req.Args) < n[0] || len(req.Args) > n[1] {
+		if n[0] != n[1] {
+			return nil, fmt.Errorf("%s requires %d to %d arguments", req.Command,
+				n[0], n[1])
+		}
+		return nil, fmt.Errorf("%s requires %d argument(s)", req.Command, n[0])
+	}
+	switch req.Command {
+	case "list":
+		return &ctlResponse{Conns: cs.list()}, nil
+	case "limits":
+		return &ctlResponse{Limits: cs.limits()}, nil
+	case "close":
+		return cs.closeConn(req.Args[0])
+	case "set":
+		return cs.set(req.Args[0], req.Args[1])
+	case "bans":
+		return &ctlResponse{Bans: cs.s.bans.list()}, nil
+	case "ban":
+		return cs.ban(req.Args)
+	case "unban":
+		return cs.unban(req.Args[0])
+	case "shutdown":
+		go cs.s.Shutdown()
+		return &ctlResponse{Message: "shutting down"}, nil
+	}
+	return nil, nil
+}
+
+// list returns the active connections for all listeners.
+func (cs *ctlServer) list() []ctlConn {
+	conns := []ctlConn{}
+	now := time.Now()
+	for _, l := range cs.s.getListeners() {
+		l.mtx.Lock()
+		for ct, sc := range l.cmgr.sconns {
+			if sc.expired() {
+				continue
+			}
+			conns = append(conns, ctlConn{
+				Listener:   l.conn.localAddr().String(),
+				RemoteAddr: sc.raddr.String(),
+				Token:      fmt.Sprintf("%016x", ct),
+				Age:        now.Sub(sc.created),
+				Duration:   sc.params.Duration,
+				Interval:   sc.params.Interval,
+				Length:     sc.params.Length,
+				Packets:    uint64(sc.receivedCount),
+				Bytes:      sc.bytes,
+			})
+		}
+		l.mtx.Unlock()
+	}
+	return conns
+}
+
+// limits returns the current limits.
+func (cs *ctlServer) limits() *ctlLimits {
+	var lim *ctlLimits
+	cs.s.withListenersLocked(cs.s.getListeners(), func() {
+		lim = &ctlLimits{cs.s.MinInterval, cs.s.MaxDuration, cs.s.MaxLength}
+	})
+	return lim
+}
+
+// closeConn sends a close to the connection with the given token, so the
+// client stops sending, and removes it.
+func (cs *ctlServer) closeConn(token string) (*ctlResponse, error) {
+	t, err := strconv.ParseUint(token, 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token %s", token)
+	}
+	for _, l := range cs.s.getListeners() {
+		l.mtx.Lock()
+		sc := l.cmgr.sconns[ctoken(t)]
+		if sc != nil {
+			if err := sc.sendClose(CloseControl); err != nil {
+				l.eventf(Drop, sc.raddr, "unable to send close (%s)", err)
+			}
+			l.cmgr.remove(sc.ctoken)
+			l.metrics.closesControl.Add(1)
+		}
+		l.mtx.Unlock()
+		if sc != nil {
+			return &ctlResponse{
+				Message: fmt.Sprintf("closed connection from %s", sc.raddr),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no connection with token %s", token)
+}
+
+// set changes a limit. Limits apply to new connections, and to the requests
+// of existing connections.
+func (cs *ctlServer) set(name, value string) (*ctlResponse, error) {
+	var set func()
+	switch name {
+	case "min-interval", "max-duration":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid duration %s", value)
+		}
+		set = func() {
+			if name == "min-interval" {
+				cs.s.MinInterval = d
+			} else {
+				cs.s.MaxDuration = d
+			}
+		}
+	case "max-length":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid length %s", value)
+		}
+		set = func() {
+			cs.s.MaxLength = n
+		}
+	default:
+		return nil, fmt.Errorf("unknown limit %s", name)
+	}
+	cs.s.withListenersLocked(cs.s.getListeners(), set)
+	return &ctlResponse{Limits: cs.limits()}, nil
+}
+
+// ban bans the IP in args[0] for the duration in args[1], or for the next
+// backoff duration if not given.
+func (cs *ctlServer) ban(args []string) (*ctlResponse, error) {
+	ip := net.ParseIP(args[0])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %s", args[0])
+	}
+	var d time.Duration
+	if len(args) > 1 {
+		var err error
+		if d, err = time.ParseDuration(args[1]); err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration %s", args[1])
+		}
+	}
+	d = cs.s.bans.add(ip, d)
+	return &ctlResponse{Message: fmt.Sprintf("banned %s for %s", ip, d)}, nil
+}
+
+// unban removes the ban for an IP.
+func (cs *ctlServer) unban(addr string) (*ctlResponse, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %s", addr)
+	}
+	if !cs.s.bans.remove(ip) {
+		return nil, fmt.Errorf("%s is not banned", ip)
+	}
+	return &ctlResponse{Message: fmt.Sprintf("unbanned %s", ip)}, nil
+}
+
+func (cs *ctlServer) eventf(code Code, format string, detail ...interface{}) {
+	if cs.s.Handler != nil {
+		cs.s.Handler.OnEvent(Eventf(code, nil, nil, format, detail...))
+	}
+}
+
+// ctlExec sends a request to the control socket at path, and returns the
+// response.
+func ctlExec(path string, req *ctlRequest) (*ctlResponse, error) {
+	c, err := net.DialTimeout("unix", path, ctlTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(ctlTimeout))
+	if err = json.NewEncoder(c).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := &ctlResponse{}
+	if err = json.NewDecoder(c).Decode(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,53 @@
+package irtt
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCtlClose tests that closing a connection from the control socket sends
+// the client a close, so it stops the test early.
+func TestCtlClose(t *testing.T) {
+	cfg := NewServerConfig()
+	cfg.ControlSocket = filepath.Join(t.TempDir(), "ctl")
+	s, addr := testServer(t, cfg)
+	rc := testRun(t, addr, time.Minute, 10*time.Millisecond)
+	testWaitConns(t, s, 1)
+
+	resp, err := ctlExec(cfg.ControlSocket, &ctlRequest{Command: "list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Conns) != 1 {
+		t.Fatalf("listed %d conns, expected 1", len(resp.Conns))
+	}
+	resp, err = ctlExec(cfg.ControlSocket, &ctlRequest{Command: "close",
+		Args: []string{resp.Conns[0].Token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != "" {
+		t.Fatal(resp.Error)
+	}
+
+	select {
+	case r := <-rc:
+		if r == nil {
+			return
+		}
+		if r.SendErr != nil || r.ReceiveErr != nil {
+			t.Errorf("client stopped with errors %v and %v", r.SendErr,
+				r.ReceiveErr)
+		}
+		if r.ServerClose != CloseControl || r.ServerShutdown {
+			t.Errorf("client stopped for close reason %s, shutdown %t, "+
+				"expected %s", r.ServerClose, r.ServerShutdown, CloseControl)
+		}
+		if r.Duration >= time.Minute {
+			t.Errorf("client ran for %s after close", r.Duration)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("client did not stop after close")
+	}
+}
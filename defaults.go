@@ -22,6 +22,7 @@ const (
 	DefaultStampAt                 = AtBoth
 	DefaultClock                   = BothClocks
 	DefaultDSCP                    = 0
+	DefaultReceivedTOS             = false
 	DefaultLoose                   = false
 	DefaultLocalAddress            = ":0"
 	DefaultLocalPort               = "0"
@@ -29,6 +30,11 @@ const (
 	DefaultCompTimerMinErrorFactor = 0.0
 	DefaultCompTimerMaxErrorFactor = 2.0
 	DefaultHybridTimerSleepFactor  = 0.90
+	DefaultJitterFraction          = 0.5
+	DefaultOnDuration              = 1 * time.Second
+	DefaultOffDuration             = 1 * time.Second
+	DefaultRampFactor              = 10.0
+	DefaultStreamWindow            = 1 * time.Minute
 	DefaultAverageWindow           = 5
 	DefaultExponentialAverageAlpha = 0.1
 )
@@ -53,6 +59,13 @@ var DefaultWait = &WaitMaxRTT{time.Duration(4) * time.Second, 3}
 // DefaultTimer is the default timer implementation, CompTimer.
 var DefaultTimer = NewCompTimer(DefaultCompTimerAverage)
 
+// DefaultScheduler is the default send schedule, IsochronousScheduler.
+var DefaultScheduler = &IsochronousScheduler{}
+
+// DefaultPercentiles are the default percentiles to calculate quantiles for
+// (none).
+var DefaultPercentiles = Percentiles{}
+
 // DefaultTimeSource is the default TimeSource implementation (WindowsTimeSource
 // for Windows and GoTimeSource for everything else).
 var DefaultTimeSource = NewDefaultTimeSource()
@@ -65,22 +78,68 @@ var DefaultServerFiller = NewDefaultPatternFiller()
 
 // Server defaults.
 const (
-	DefaultMaxDuration   = time.Duration(0)
-	DefaultMinInterval   = 10 * time.Millisecond
-	DefaultMaxLength     = 0
-	DefaultServerTimeout = 1 * time.Minute
-	DefaultPacketBurst   = 5
-	DefaultAllowStamp    = DualStamps
-	DefaultAllowDSCP     = true
-	DefaultSetSrcIP      = false
+	DefaultMaxDuration      = time.Duration(0)
+	DefaultMinInterval      = 10 * time.Millisecond
+	DefaultMaxLength        = 0
+	DefaultServerTimeout    = 1 * time.Minute
+	DefaultOpenTimeout      = 10 * time.Second
+	DefaultShutdownGrace    = 5 * time.Second
+	DefaultPacketBurst      = 5
+	DefaultAllowStamp       = DualStamps
+	DefaultAllowDSCP        = true
+	DefaultAllowReceivedTOS = true
+	DefaultSetSrcIP         = false
+	DefaultBitratePolicy    = BitrateDrop
+	DefaultConnLimitPolicy  = ConnLimitReject
+	DefaultACLPolicy        = ACLClose
+	DefaultBanTime          = 1 * time.Minute
+)
+
+// Default prefix lengths for per-prefix SourceLimits.
+const (
+	DefaultLimitPrefix4 = 24
+	DefaultLimitPrefix6 = 56
 )
 
+// DefaultControlSocket is the default control socket path for the ctl command.
+const DefaultControlSocket = "/run/irtt/irtt.sock"
+
 // DefaultBindAddrs are the default bind addresses.
 var DefaultBindAddrs = []string{":2112"}
 
 // DefaultAllowFills are the default allowed fill prefixes.
 var DefaultAllowFills = []string{"rand"}
 
+// read header timeout for the metrics HTTP server
+const metricsReadTimeout = 10 * time.Second
+
+// read/write timeout for control socket connections
+const ctlTimeout = 10 * time.Second
+
+// interval to check for remaining conns during a graceful shutdown
+const shutdownPollInterval = 100 * time.Millisecond
+
+// time to wait for a new process to be ready during an upgrade
+const upgradeTimeout = 10 * time.Second
+
+// interval to remove state for idle sources with SourceLimits
+const sourceSweepInterval = 10 * time.Second
+
+// burst of drops allowed over the ban rate, in time at the rate
+const banBurst = 10 * time.Second
+
+// max duration of bans, which double for each ban of a source
+const maxBanTime = 24 * time.Hour
+
+// time after a source's last ban that previous bans are forgotten
+const banForget = 1 * time.Hour
+
+// interval to unban sources whose bans have expired
+const banSweepInterval = 1 * time.Second
+
+// burst of replies allowed over the bitrate limits, in time at the limit
+const bitrateBurst = 100 * time.Millisecond
+
 // server duplicates and drops for testing (0.0-1.0)
 const serverDupsPercent = 0
 const serverDropsPercent = 0
@@ -111,14 +170,24 @@ const patternMaxInitLen = 4 * 1024
 // maxMTU is the MTU used if it could not be determined by autodetection.
 const maxMTU = 64 * 1024
 
+// number of slots the stream stats sliding window is divided into
+const streamWindowSlots = 10
+
+// number of bits used for DurationSketch buckets (relative error < 1/128)
+const sketchBits = 8
+
+// number of packets in the received window
+const receivedWindowLen = 64
+
+// max time between flushes of incremental JSON and JSON Lines output
+const flushInterval = 1 * time.Second
+
+// length of buffer for received socket control messages
+const oobLen = 128
+
 // minimum valid MTU per RFC 791
 const minValidMTU = 68
 
-// number of sconns to check to remove on each add (2 seems to be the least
-// aggresive number where the map size still levels off over time, but I use 5
-// to clean up unused sconns more quickly)
-const checkExpiredCount = 5
-
 // initial capacity for sconns map
 const sconnsInitSize = 32
 
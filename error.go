@@ -23,6 +23,7 @@ const (
 	ParamOverflow
 	InvalidParamValue
 	ProtocolVersionMismatch
+	ReceiveTOSNotSupported
 )
 
 // Server error codes.
@@ -38,6 +39,21 @@ const (
 	AddressMismatch
 	SyslogNotSupported
 	InvalidSyslogURI
+	InvalidListenFDs
+	NonUDPListenFD
+	UpgradeFailed
+	ReloadFailed
+	InvalidSourceLimit
+	SourcePacketLimit
+	SourceByteLimit
+	InvalidBitratePolicy
+	BitrateLimit
+	OpenRateLimited
+	InvalidConnLimitPolicy
+	InvalidACLPrefix
+	InvalidACLPolicy
+	AccessDenied
+	SourceOpenLimit
 )
 
 // Client error codes.
@@ -73,6 +89,13 @@ const (
 	OpenTimeoutTooShort
 	ServerFillTooLong
 	UnexpectedInitChannelClose
+	NoSuchScheduler
+	InvalidSchedulerArgs
+	InvalidTrace
+	InvalidPercentile
+	StreamWindowNonPositive
+	InvalidLostString
+	NoSuchColumn
 )
 
 // Error is an IRTT error.
@@ -32,6 +32,29 @@ const (
 	NoReceiveDstAddrSupport
 	RemoveNoConn
 	InvalidServerFill
+	NoReceiveTOSSupport
+	MetricsStart
+	MetricsError
+	ControlStart
+	ControlError
+	ControlCommand
+	ShuttingDown
+	ShutdownCloseConn
+	UpgradeStart
+	UpgradeResume
+	UpgradeError
+	ConfigReload
+	ConfigReloadError
+	ListenerRemove
+	SourceConnLimit
+	BitrateRestriction
+	BitrateConnLimit
+	OpenExpired
+	ConnTableFull
+	ConnEvicted
+	AccessDeniedClose
+	SourceBanned
+	SourceUnbanned
 )
 
 // Client event codes.
@@ -43,6 +66,8 @@ const (
 	ServerRestriction
 	NoTest
 	ConnectedClosed
+	ServerShutdown
+	ServerClose
 )
 
 // Event is an event sent to a Handler.
@@ -52,12 +77,17 @@ type Event struct {
 	RemoteAddr *net.UDPAddr
 	format     string
 	Detail     []interface{}
+
+	// Count is the number of identical events merged into this one by an
+	// AggregateHandler, or 0 if it wasn't merged.
+	Count int
 }
 
 // Eventf returns a new event.
 func Eventf(code Code, laddr *net.UDPAddr, raddr *net.UDPAddr, format string,
 	detail ...interface{}) *Event {
-	return &Event{code, laddr, raddr, format, detail}
+	return &Event{Code: code, LocalAddr: laddr, RemoteAddr: raddr,
+		format: format, Detail: detail}
 }
 
 // IsError returns true if the event is an error (its code is negative).
@@ -67,6 +97,9 @@ func (e *Event) IsError() bool {
 
 func (e *Event) String() string {
 	msg := fmt.Sprintf(e.format, e.Detail...)
+	if e.Count > 0 {
+		msg += fmt.Sprintf(" (x%d)", e.Count)
+	}
 	if e.RemoteAddr != nil {
 		return fmt.Sprintf("[%s] [%s] %s", e.RemoteAddr, e.Code.String(), msg)
 	}
@@ -0,0 +1,115 @@
+package irtt
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// IntervalSummary contains statistics for one reporting interval of a test.
+// Replies are counted in the interval they're received in, so loss may be
+// slightly overestimated for an interval, and underestimated for the next.
+// The median and quantiles are approximate (see DurationSketch).
+type IntervalSummary struct {
+	// Number is the number of the interval, starting from 1.
+	Number uint
+
+	// Start is the start of the interval, relative to the start of the test.
+	Start time.Duration
+
+	// End is the end of the interval, relative to the start of the test.
+	End time.Duration
+
+	StreamSummary
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (s *IntervalSummary) MarshalJSON() ([]byte, error) {
+	j := &struct {
+		Number  uint           `json:"number"`
+		Start   time.Duration  `json:"start"`
+		End     time.Duration  `json:"end"`
+		Summary *StreamSummary `json:"summary"`
+	}{
+		Number:  s.Number,
+		Start:   s.Start,
+		End:     s.End,
+		Summary: &s.StreamSummary,
+	}
+	return json.Marshal(j)
+}
+
+// IntervalHandler may be implemented by a ClientHandler to receive periodic
+// summaries during the test, when ClientConfig.SummaryInterval or
+// SummaryPackets is set. OnInterval is called with the Recorder locked (see
+// Recorder), and the IntervalSummary is only valid until OnInterval returns.
+type IntervalHandler interface {
+	// OnInterval is called at the end of each reporting interval, and with
+	// the final partial interval at the end of the test.
+	OnInterval(s *IntervalSummary)
+}
+
+// intervalStats aggregates statistics for reporting intervals, which end
+// either every interval of time, every number of packets sent, or both.
+type intervalStats struct {
+	interval    time.Duration
+	packets     uint
+	percentiles Percentiles
+	handler     IntervalHandler
+	cur         IntervalSummary
+}
+
+func newIntervalStats(interval time.Duration, packets uint, ps Percentiles,
+	h IntervalHandler) *intervalStats {
+	return &intervalStats{
+		interval:    interval,
+		packets:     packets,
+		percentiles: ps,
+		handler:     h,
+		cur:         IntervalSummary{Number: 1},
+	}
+}
+
+// advance ends any intervals of time that have passed at elapsed. Intervals
+// with no packets sent or received are also reported.
+func (is *intervalStats) advance(elapsed time.Duration) {
+	if is.interval <= 0 {
+		return
+	}
+	for elapsed >= is.cur.Start+is.interval {
+		is.end(is.cur.Start + is.interval)
+	}
+}
+
+// end reports the current interval and starts the next one.
+func (is *intervalStats) end(at time.Duration) {
+	is.cur.End = at
+	is.cur.setQuantiles(is.percentiles)
+	is.handler.OnInterval(&is.cur)
+	n := is.cur.Number
+	is.cur.reset()
+	is.cur.Number = n + 1
+	is.cur.Start = at
+	is.cur.End = 0
+}
+
+func (is *intervalStats) onSent(elapsed time.Duration) {
+	is.advance(elapsed)
+	if is.packets > 0 && is.cur.PacketsSent >= is.packets {
+		is.end(elapsed)
+	}
+	is.cur.PacketsSent++
+}
+
+func (is *intervalStats) onReceived(elapsed, rtt, ipdv time.Duration) {
+	is.advance(elapsed)
+	is.cur.onReceived(rtt, ipdv)
+}
+
+// flush reports the final partial interval, if any packets were sent or
+// received in it.
+func (is *intervalStats) flush(elapsed time.Duration) {
+	is.advance(elapsed)
+	if is.cur.PacketsSent > 0 || is.cur.PacketsReceived > 0 {
+		is.end(elapsed)
+	}
+}
@@ -18,6 +18,10 @@ const defaultReallyQuiet = false
 
 const defaultHMACKey = ""
 
+const defaultClientConfigFile = "irtt/client.json"
+
+const summaryHeaderRows = 20
+
 type command struct {
 	name  string
 	desc  string
@@ -45,6 +49,11 @@ func init() {
 	registerCommand("server", "runs the server", runServerCLI, serverUsage)
 	registerCommand("report", "emits results from a JSON file", runReport,
 		reportUsage)
+	registerCommand("convert", "converts JSON results to CSV or TSV", runConvert,
+		convertUsage)
+	registerCommand("anonymize", "removes private data from JSON results",
+		runAnonymize, anonymizeUsage)
+	registerCommand("ctl", "controls a running server", runCtl, ctlUsage)
 	registerCommand("bench", "runs HMAC and fill benchmarks", runBench, nil)
 	registerCommand("timer", "runs timer resolution test", runTimer, nil)
 	registerCommand("clock", "runs wall vs monotonic clock test", runClock, nil)
@@ -0,0 +1,98 @@
+package irtt
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	flag "github.com/ogier/pflag"
+)
+
+func anonymizeUsage() {
+	setBufio()
+	printf("Usage: anonymize [flags] [file|-]")
+	printf("")
+	printf("Removes or replaces private data in JSON or JSON Lines output, which is the")
+	printf("hostname, and the local and remote addresses in the config. IP addresses in")
+	printf("other strings, such as errors, and hostnames from the addresses, are also")
+	printf("replaced. HMAC keys are never written to JSON output.")
+	printf("")
+	printf("If a filename is given, JSON is read from the given file.")
+	printf("")
+	printf("If no argument or a - character is given, JSON is read from stdin.")
+	printf("")
+	printf("Gzipped input is detected and decompressed automatically.")
+	printf("")
+	printf("Flags:")
+	printf("------")
+	printf("")
+	printf("-o file         write output to file (default stdout)")
+	printf("                if extension is .gz, output is gzipped")
+	printf("--mode=mode     how private data is treated (default hash)")
+	printf("                omit: remove hostnames and addresses")
+	printf("                hash: replace with consistent pseudonyms, IPv4 addresses in")
+	printf("                      10.0.0.0/8, IPv6 in fd00::/8, hostnames as host-xxxxxxxx")
+	printf("                prefix: truncate IPs to /24 (IPv4) or /48 (IPv6), remove")
+	printf("                        hostnames")
+	printf("--key=key       key for hash mode pseudonyms (0x for hex), so they're")
+	printf("                consistent between runs (default random)")
+	printf("")
+	printf("Loopback and unspecified IP addresses, and ports, are kept as is, except in")
+	printf("omit mode, where addresses in other strings are replaced with \"omitted\".")
+}
+
+// runAnonymize anonymizes JSON output.
+func runAnonymize(args []string) {
+	fs := flag.NewFlagSet("anonymize", 0)
+	fs.Usage = func() {
+		usageAndExit(anonymizeUsage, exitCodeBadCommandLine)
+	}
+	var outputStr = fs.StringP("o", "o", "", "output file")
+	var modeStr = fs.String("mode", anonHash.String(), "mode")
+	var keyStr = fs.String("key", "", "key")
+	err := fs.Parse(args)
+	exitOnError(err, exitCodeBadCommandLine)
+	if len(fs.Args()) > 1 {
+		usageAndExit(anonymizeUsage, exitCodeBadCommandLine)
+	}
+	mode, err := parseAnonMode(*modeStr)
+	exitOnError(err, exitCodeBadCommandLine)
+	key, err := decodeHexOrNot(*keyStr)
+	exitOnError(err, exitCodeBadCommandLine)
+	a, err := newAnonymizer(mode, key)
+	exitOnError(err, exitCodeRuntimeError)
+
+	// open input
+	var in io.Reader = os.Stdin
+	if len(fs.Args()) > 0 && fs.Args()[0] != "-" {
+		f, err := os.Open(fs.Args()[0])
+		exitOnError(err, exitCodeRuntimeError)
+		defer f.Close()
+		in = f
+	}
+	in, err = gunzipIfNeeded(in)
+	exitOnError(err, exitCodeRuntimeError)
+
+	// open output and rewrite
+	var out io.Writer = os.Stdout
+	var f *os.File
+	var gzw *gzip.Writer
+	if *outputStr != "" && *outputStr != "-" {
+		f, err = os.Create(*outputStr)
+		exitOnError(err, exitCodeRuntimeError)
+		out = f
+		if strings.HasSuffix(*outputStr, ".gz") {
+			gzw = gzip.NewWriter(f)
+			out = gzw
+		}
+	}
+	err = a.rewrite(in, out)
+	exitOnError(err, exitCodeRuntimeError)
+	if gzw != nil {
+		exitOnError(gzw.Close(), exitCodeRuntimeError)
+	}
+	if f != nil {
+		exitOnError(f.Close(), exitCodeRuntimeError)
+	}
+}
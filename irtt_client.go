@@ -1,6 +1,7 @@
 package irtt
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/json"
@@ -9,6 +10,7 @@ import (
 	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -27,28 +29,68 @@ func clientUsage() {
 	printf("")
 	printf("-d duration     total time to send (see Duration units below)")
 	printf("                default %s, or infinite in streaming mode", DefaultDuration)
+	printf("                or trace duration for trace schedules (see --sched)")
 	printf("-i interval     send interval (default %s, see Duration units below)", DefaultInterval)
+	printf("                or mean trace interval for trace schedules")
 	printf("-l length       length of packet (including irtt headers, default %d)", DefaultLength)
+	printf("                or max trace length for trace schedules")
 	printf("                increased as necessary for irtt headers, common values:")
 	printf("                1472 (max unfragmented size of IPv4 datagram for 1500 byte MTU)")
 	printf("                1452 (max unfragmented size of IPv6 datagram for 1500 byte MTU)")
 	printf("-s              streaming mode, allows infinitely long tests")
 	printf("                test duration is infinite by default")
-	printf("                does not record results or analyze statistics")
-	printf("                see also --stream-buflen")
+	printf("                keeps statistics with approximate quantiles for the whole")
+	printf("                run and a sliding window, printed when the test ends")
+	printf("                see also --stream-buflen and --stream-window")
 	printf("-o file         write JSON output to file (use '-' for stdout)")
 	printf("                if file has no extension, .json.gz is added, output is gzipped")
 	printf("                if extension is .json.gz, output is gzipped")
 	printf("                if extension is .gz, it's changed to .json.gz, output is gzipped")
 	printf("                if extension is .json, output is not gzipped")
 	printf("                output to stdout is not gzipped, pipe to gzip if needed")
-	printf("-r              raw mode, emit space delimited milliseconds to stdout")
+	printf("                if extension is .csv or .tsv, round trips are written as CSV")
+	printf("                or TSV instead of JSON (see the convert command)")
+	printf("                in streaming mode, JSON Lines are written to .jsonl files,")
+	printf("                which are gzipped when closed (see --rotate and --stream-data)")
+	printf("--anon=mode     remove or replace private data in JSON output (hostname")
+	printf("                and addresses, see the anonymize command for details)")
+	printf("                none: keep private data (default)")
+	printf("                omit: remove hostname and addresses")
+	printf("                hash: replace with consistent pseudonyms (see --anon-key)")
+	printf("                prefix: truncate IPs to /24 (IPv4) or /48 (IPv6)")
+	printf("--anon-key=key  key for --anon=hash pseudonyms (0x for hex), so they're")
+	printf("                consistent between tests (default random)")
+	printf("-r              raw mode, emit per-packet output to stdout, and all other")
+	printf("                output to stderr, with --format=space by default")
+	printf("--format=fmt    per-packet output format, a preset or template:")
+	printf("                human: human readable (default)")
+	printf("                space: space delimited milliseconds (seqno rtt rd sd ipdv")
+	printf("                       dup late)")
+	printf("                csv: CSV in nanoseconds, with a header (see Format fields)")
+	printf("                template: text with {field} or {field:unit}, where unit is")
+	printf("                ns, us, ms or s, e.g. '{seqno}\\t{rtt:us}'")
 	printf("-q              quiet, suppress per-packet output")
 	printf("-Q              really quiet, suppress all output except errors to stderr")
 	printf("-n              no test, connect to the server and validate test parameters")
 	printf("                but don't run the test")
+	printf("--incremental   write round trips to JSON output during the test, for long")
+	printf("                tests, using bounded memory (median and quantiles approximate)")
 	printf("--stream-buflen number of round trips to store in circular buffer for stream mode")
-	printf("                defaults to 3 seconds of round trips based on interval")
+	printf("                and incremental mode (min 64), defaults to 3 seconds of round")
+	printf("                trips based on interval")
+	printf("--stream-window=dur")
+	printf("                sliding window for stream mode statistics (default %s)", DefaultStreamWindow)
+	printf("--stream-data=data")
+	printf("                data written to JSON Lines output in stream mode:")
+	printf("                round_trips: each round trip when final (default)")
+	printf("                summaries: each interval summary (see --summary)")
+	printf("                both: both round trips and summaries")
+	printf("--rotate=rot    rotate JSON Lines output in stream mode, comma separated:")
+	printf("                #[K|M|G]: rotate at size in bytes (e.g. 100M)")
+	printf("                duration: rotate after duration (e.g. 1h)")
+	printf("--summary=every print a summary of each interval during the test, every:")
+	printf("                duration: every duration of time (e.g. 10s)")
+	printf("                #p: every # packets sent (e.g. 1000p)")
 	printf("--stats=stats   server stats on received packets (default %s)", DefaultReceivedStats.String())
 	printf("                none: no server stats on received packets")
 	printf("                count: total count of received packets")
@@ -70,6 +112,8 @@ func clientUsage() {
 	printf("                0xa0 (CS5- Video)")
 	printf("                0xb8 (EF- Expedited forwarding)")
 	printf("                https://www.tucny.com/Home/dscp-tos")
+	printf("--recv-tos      record received DSCP/ECN (TOS) values in both directions,")
+	printf("                counting DSCP remarks and ECN CE marks (server must support)")
 	printf("--df=DF         setting for do not fragment (DF) bit in all packets")
 	printf("                default: OS default")
 	printf("                false: DF bit not set")
@@ -90,6 +134,13 @@ func clientUsage() {
 	for _, afac := range AveragerFactories {
 		printf("                %s", afac.Usage)
 	}
+	printf("--sched=sched   send schedule (default %s), interval is mean interval and", DefaultScheduler.String())
+	printf("                length is max length, sched may be one of:")
+	for _, sfac := range SchedulerFactories {
+		printf("                %s", sfac.Usage)
+	}
+	printf("--quantiles=qs  comma separated percentiles to calculate for RTT, one-way")
+	printf("                delay and IPDV stats, e.g. p90,p95,p99,p99.9 (default none)")
 	printf("--fill=fill     fill payload with given data (default none)")
 	printf("                none: leave payload as all zeroes")
 	for _, ffac := range FillerFactories {
@@ -106,6 +157,7 @@ func clientUsage() {
 	printf("--hmac=key      add HMAC with key (0x for hex) to all packets, provides:")
 	printf("                dropping of all packets without a correct HMAC")
 	printf("                protection for server against unauthorized discovery and use")
+	printf("--hmac-file=fl  read HMAC key (0x for hex) from the first line of file fl")
 	printf("-4              IPv4 only")
 	printf("-6              IPv6 only")
 	printf("--timeouts=drs  timeouts used when connecting to server (default %s)", DefaultOpenTimeouts.String())
@@ -117,12 +169,22 @@ func clientUsage() {
 	printf("--loose         accept and use any server restricted test parameters instead")
 	printf("                of exiting with nonzero status")
 	printf("--thread        lock sending and receiving goroutines to OS threads")
+	printf("--profile=name  use the settings in profile name from the config file, with")
+	printf("                flags on the command line taking precedence")
+	printf("--config=file   config file with profiles (default %s)", clientConfigFile())
+	printf("                JSON with flag long names as keys, or duration, interval,")
+	printf("                length, stream, no-test, output, raw, quiet, really-quiet,")
+	printf("                ipv4 and ipv6 for flags with only short names, e.g.:")
+	printf("                {\"profiles\": {\"voip\": {\"interval\": \"20ms\",")
+	printf("                \"length\": 172, \"dscp\": \"0xb8\", \"fill\": \"rand\"}}}")
 	printf("-h              show help")
 	printf("-v              show version")
 	printf("")
 	hostUsage()
 	printf("")
 	durationUsage()
+	printf("")
+	formatUsage()
 }
 
 func hostUsage() {
@@ -156,6 +218,31 @@ func durationUsage() {
 	printf("ns             nanoseconds")
 }
 
+func formatUsage() {
+	printf("Format fields:")
+	printf("--------------")
+	printf("")
+	printf("Fields for --format templates. Durations with no unit are shown in human")
+	printf("readable form, or n/a if unavailable. With a unit, they're shown as decimal")
+	printf("numbers, or NaN if unavailable. Timestamps are wall clock times since the")
+	printf("Unix epoch, in nanoseconds by default. Use {{ and }} for literal braces, and")
+	printf("\\t for a tab.")
+	printf("")
+	printf("seqno          sequence number")
+	printf("rtt            round-trip time")
+	printf("send_delay     send delay (one-way delay from client to server)")
+	printf("receive_delay  receive delay (one-way delay from server to client)")
+	printf("ipdv           round-trip IPDV (jitter)")
+	printf("send_ipdv      send IPDV")
+	printf("receive_ipdv   receive IPDV")
+	printf("late           1 if the packet was received out of order, 0 otherwise")
+	printf("dup            1 if the packet was a duplicate, 0 otherwise")
+	printf("client_send    client send timestamp")
+	printf("server_receive server receive timestamp")
+	printf("server_send    server send timestamp")
+	printf("client_receive client receive timestamp")
+}
+
 // runClientCLI runs the client command line interface.
 func runClientCLI(args []string) {
 	// client flags
@@ -164,38 +251,68 @@ func runClientCLI(args []string) {
 		usageAndExit(clientUsage, exitCodeBadCommandLine)
 	}
 	var durationStr = fs.StringP("d", "d", "", "total time to send")
-	var intervalStr = fs.StringP("i", "i", DefaultInterval.String(), "send interval")
+	var intervalStr = fs.StringP("i", "i", "", "send interval")
 	var length = fs.IntP("l", "l", DefaultLength, "packet length")
 	var stream = fs.BoolP("s", "s", false, "streaming mode")
 	var noTest = fs.BoolP("n", "n", false, "no test")
 	var streamBufLen = fs.Int("stream-buflen", 0, "stream mode buffer length")
+	var streamWindow = fs.Duration("stream-window", DefaultStreamWindow,
+		"stream mode window")
+	var summaryStr = fs.String("summary", "", "summary every")
+	var rotateStr = fs.String("rotate", "", "rotate output")
+	var incremental = fs.Bool("incremental", false, "incremental output")
+	var streamDataStr = fs.String("stream-data", "round_trips", "stream data")
 	var rsStr = fs.String("stats", DefaultReceivedStats.String(), "received stats")
 	var tsatStr = fs.String("tstamp", DefaultStampAt.String(), "stamp at")
 	var clockStr = fs.String("clock", DefaultClock.String(), "clock")
 	var outputStr = fs.StringP("o", "o", "", "output file")
 	var raw = fs.BoolP("r", "r", defaultRaw, "raw mode")
+	var formatStr = fs.String("format", "", "per-packet format")
+	var anonStr = fs.String("anon", anonNone.String(), "anonymization mode")
+	var anonKeyStr = fs.String("anon-key", "", "anonymization key")
 	var quiet = fs.BoolP("q", "q", defaultQuiet, "quiet")
 	var reallyQuiet = fs.BoolP("Q", "Q", defaultReallyQuiet, "really quiet")
 	var dscpStr = fs.String("dscp", strconv.Itoa(DefaultDSCP), "dscp value")
+	var recvTOS = fs.Bool("recv-tos", DefaultReceivedTOS, "received TOS")
 	var dfStr = fs.String("df", DefaultDF.String(), "do not fragment")
 	var waitStr = fs.String("wait", DefaultWait.String(), "wait")
 	var timerStr = fs.String("timer", DefaultTimer.String(), "timer")
 	var tcompStr = fs.String("tcomp", DefaultCompTimerAverage.String(),
 		"timer compensation algorithm")
+	var schedStr = fs.String("sched", DefaultScheduler.String(), "scheduler")
+	var quantilesStr = fs.String("quantiles", DefaultPercentiles.String(),
+		"quantiles")
 	var fillStr = fs.String("fill", "none", "fill")
 	var fillOne = fs.Bool("fill-one", false, "fill one")
 	var sfillStr = fs.String("sfill", "", "sfill")
 	var laddrStr = fs.String("local", DefaultLocalAddress, "local address")
 	var hmacStr = fs.String("hmac", defaultHMACKey, "HMAC key")
+	var hmacFile = fs.String("hmac-file", "", "HMAC key file")
 	var ipv4 = fs.BoolP("4", "4", false, "IPv4 only")
 	var ipv6 = fs.BoolP("6", "6", false, "IPv6 only")
 	var timeoutsStr = fs.String("timeouts", DefaultOpenTimeouts.String(), "open timeouts")
 	var ttl = fs.Int("ttl", DefaultTTL, "IP time to live")
 	var loose = fs.Bool("loose", DefaultLoose, "loose")
 	var threadLock = fs.Bool("thread", DefaultThreadLock, "thread")
+	var profile = fs.String("profile", "", "profile")
+	var configFile = fs.String("config", "", "config file")
 	var version = fs.BoolP("version", "v", false, "version")
 	err := fs.Parse(args)
 
+	// apply profile from config file, treating --hmac and --hmac-file as one
+	// setting so either on the command line overrides both in the profile
+	if *profile != "" {
+		explicit := explicitFlags(fs)
+		if explicit["hmac"] || explicit["hmac-file"] {
+			explicit["hmac"], explicit["hmac-file"] = true, true
+		}
+		err = applyProfile(fs, *configFile, *profile, explicit)
+		exitOnError(err, exitCodeBadCommandLine)
+	} else if *configFile != "" {
+		exitOnError(fmt.Errorf("--config requires --profile"),
+			exitCodeBadCommandLine)
+	}
+
 	// start profiling, if enabled in build
 	if profileEnabled {
 		defer startProfile("./client.pprof").Stop()
@@ -207,11 +324,18 @@ func runClientCLI(args []string) {
 		os.Exit(0)
 	}
 
+	// parse scheduler
+	scheduler, err := NewScheduler(*schedStr)
+	exitOnError(err, exitCodeBadCommandLine)
+	trace, isTrace := scheduler.(*TraceScheduler)
+
 	// parse duration
 	var duration time.Duration
 	if *durationStr == "" {
 		if *stream {
 			duration = time.Duration(math.MaxInt64)
+		} else if isTrace {
+			duration = trace.Duration()
 		} else {
 			duration = DefaultDuration
 		}
@@ -221,12 +345,24 @@ func runClientCLI(args []string) {
 	}
 
 	// parse interval
-	interval, err := time.ParseDuration(*intervalStr)
-	if err != nil {
+	var interval time.Duration
+	if *intervalStr == "" {
+		if isTrace {
+			interval = trace.MeanInterval()
+		} else {
+			interval = DefaultInterval
+		}
+	} else if interval, err = time.ParseDuration(*intervalStr); err != nil {
 		exitOnError(fmt.Errorf("%s (use s for seconds)", err),
 			exitCodeBadCommandLine)
 	}
 
+	// use max length from trace, if length not set on the command line or in
+	// a profile
+	if isTrace && !explicitFlags(fs)["l"] {
+		*length = trace.MaxLength()
+	}
+
 	// determine IP version
 	ipVer := IPVersionFromBooleans(*ipv4, *ipv6, DualStack)
 
@@ -262,6 +398,14 @@ func runClientCLI(args []string) {
 	timer, err := NewTimer(*timerStr, timerComp)
 	exitOnError(err, exitCodeBadCommandLine)
 
+	// parse summary
+	summaryInterval, summaryPackets, err := parseSummaryEvery(*summaryStr)
+	exitOnError(err, exitCodeBadCommandLine)
+
+	// parse quantiles
+	percentiles, err := ParsePercentiles(*quantilesStr)
+	exitOnError(err, exitCodeBadCommandLine)
+
 	// parse fill
 	filler, err := NewFiller(*fillStr)
 	exitOnError(err, exitCodeBadCommandLine)
@@ -273,7 +417,15 @@ func runClientCLI(args []string) {
 			exitCodeBadCommandLine)
 	}
 
-	// parse HMAC key
+	// parse HMAC key, or read it from a file
+	if *hmacFile != "" {
+		if *hmacStr != "" {
+			exitOnError(fmt.Errorf("--hmac and --hmac-file may not both be used"),
+				exitCodeBadCommandLine)
+		}
+		*hmacStr, err = readKeyFile(*hmacFile)
+		exitOnError(err, exitCodeBadCommandLine)
+	}
 	var hmacKey []byte
 	if *hmacStr != "" {
 		hmacKey, err = decodeHexOrNot(*hmacStr)
@@ -286,12 +438,62 @@ func runClientCLI(args []string) {
 	}
 	raddrStr := fs.Args()[0]
 
-	// -o not compatible with -s
-	if *outputStr != "" && *stream {
-		exitOnError(fmt.Errorf("output not possible in streaming mode"),
+	// parse rotate and stream data, only for output in streaming mode
+	rotateSize, rotateAge, err := parseRotate(*rotateStr)
+	exitOnError(err, exitCodeBadCommandLine)
+	if (rotateSize > 0 || rotateAge > 0) && (!*stream || *outputStr == "") {
+		exitOnError(fmt.Errorf("--rotate requires -s and -o"),
+			exitCodeBadCommandLine)
+	}
+	if *incremental && (*stream || *outputStr == "") {
+		exitOnError(fmt.Errorf("--incremental requires -o and not -s"),
+			exitCodeBadCommandLine)
+	}
+	delim, delimited := delimitedOutput(*outputStr)
+	if delimited && (*stream || *incremental) {
+		exitOnError(fmt.Errorf("CSV or TSV output not supported with -s or --incremental"),
 			exitCodeBadCommandLine)
 	}
 
+	// parse per-packet format, defaulting to space for raw mode
+	if *formatStr == "" && *raw {
+		*formatStr = "space"
+	}
+	var format *packetFormat
+	if *formatStr != "" && *formatStr != "human" {
+		format, err = parsePacketFormat(*formatStr)
+		exitOnError(err, exitCodeBadCommandLine)
+	}
+
+	// parse anonymization mode for JSON output
+	anonMode, err := parseAnonMode(*anonStr)
+	exitOnError(err, exitCodeBadCommandLine)
+	var anon *anonymizer
+	if anonMode != anonNone {
+		anonKey, err := decodeHexOrNot(*anonKeyStr)
+		exitOnError(err, exitCodeBadCommandLine)
+		anon, err = newAnonymizer(anonMode, anonKey)
+		exitOnError(err, exitCodeRuntimeError)
+	}
+
+	var sdRoundTrips, sdSummaries bool
+	switch *streamDataStr {
+	case "round_trips":
+		sdRoundTrips = true
+	case "summaries":
+		sdSummaries = true
+	case "both":
+		sdRoundTrips = true
+		sdSummaries = true
+	default:
+		exitOnError(fmt.Errorf("invalid stream data %s", *streamDataStr),
+			exitCodeBadCommandLine)
+	}
+	if sdSummaries && summaryInterval == 0 && summaryPackets == 0 {
+		exitOnError(fmt.Errorf("--stream-data=%s requires --summary",
+			*streamDataStr), exitCodeBadCommandLine)
+	}
+
 	// set default buflen for stream mode
 
 	// send regular output to stderr if raw mode, or json going to stdout
@@ -332,25 +534,63 @@ func runClientCLI(args []string) {
 	cfg.StampAt = at
 	cfg.Clock = clock
 	cfg.DSCP = int(dscp)
+	cfg.ReceivedTOS = *recvTOS
 	cfg.ServerFill = *sfillStr
 	cfg.Stream = *stream
 	cfg.StreamBufLen = *streamBufLen
+	cfg.StreamWindow = *streamWindow
 	cfg.Loose = *loose
 	cfg.IPVersion = ipVer
 	cfg.DF = df
 	cfg.TTL = int(*ttl)
 	cfg.Timer = timer
+	cfg.Scheduler = scheduler
 	cfg.Waiter = waiter
 	cfg.Filler = filler
 	cfg.FillOne = *fillOne
+	cfg.Percentiles = percentiles
 	cfg.HMACKey = hmacKey
+	cfg.Profile = *profile
 	if *quiet || *reallyQuiet {
 		cfg.Handler = &discardHandler{}
-	} else if *raw {
-		cfg.Handler = &rawHandler{}
+	} else if format != nil {
+		w := printTo
+		if *raw {
+			w = os.Stdout
+		}
+		cfg.Handler = &formatHandler{format: format, w: w}
 	} else {
 		cfg.Handler = &humanHandler{}
 	}
+	cfg.SummaryInterval = summaryInterval
+	cfg.SummaryPackets = summaryPackets
+	if (summaryInterval > 0 || summaryPackets > 0) && !*reallyQuiet {
+		cfg.Handler = &summaryHandler{ClientHandler: cfg.Handler}
+	}
+	var c *Client
+	header := func() interface{} {
+		si, cfg := NewSystemInfo(), c.ClientConfig
+		if anon != nil {
+			si, cfg = anon.systemInfo(si), anon.config(cfg)
+		}
+		return &struct {
+			VersionInfo *VersionInfo  `json:"version"`
+			SystemInfo  *SystemInfo   `json:"system_info"`
+			Config      *ClientConfig `json:"config"`
+		}{NewVersionInfo(), si, cfg}
+	}
+	var jw *jsonlWriter
+	var rw *resultWriter
+	oerr := &outputError{stop: cancel}
+	if *stream && *outputStr != "" {
+		jw = newJSONLWriter(*outputStr, rotateSize, rotateAge, header)
+		cfg.Handler = &jsonlHandler{cfg.Handler, oerr, jw, sdRoundTrips,
+			sdSummaries}
+	} else if *incremental {
+		cfg.Incremental = true
+		rw = newResultWriter(*outputStr, header, anon)
+		cfg.Handler = &resultHandler{cfg.Handler, oerr, rw}
+	}
 	cfg.ThreadLock = *threadLock
 
 	// set default for stream buflen
@@ -359,9 +599,19 @@ func runClientCLI(args []string) {
 	}
 
 	// run test
-	c := NewClient(cfg)
+	c = NewClient(cfg)
 	r, err := c.Run(ctx)
+	if err == nil {
+		err = oerr.err
+	}
 	if err != nil {
+		// close any output, so buffered lines are written and gzip streams
+		// are terminated, before exiting with the first error
+		if jw != nil {
+			jw.close()
+		} else if rw != nil {
+			rw.abort()
+		}
 		exitOnError(err, exitCodeRuntimeError)
 	}
 
@@ -370,16 +620,35 @@ func runClientCLI(args []string) {
 		return
 	}
 
+	// exit if the server closed the connection on open
+	if r == nil {
+		os.Exit(exitCodeRuntimeError)
+	}
+
 	// print results
-	if !*reallyQuiet && !*stream {
-		printResult(&r.PrintableResult)
+	if !*reallyQuiet {
+		if *stream {
+			printStreamStats(&r.PrintableResult, r.StreamStats)
+		} else {
+			printResult(&r.PrintableResult)
+		}
 	}
 
-	// write results to JSON
-	if *outputStr != "" {
-		if err := writeResultJSON(r, *outputStr, ctx.Err() != nil); err != nil {
-			exitOnError(err, exitCodeRuntimeError)
+	// write stream stats to JSON Lines, or results to JSON
+	if jw != nil {
+		err := jw.write("stream_stats", r.StreamStats)
+		if cerr := jw.close(); err == nil {
+			err = cerr
 		}
+		exitOnError(err, exitCodeRuntimeError)
+	} else if rw != nil {
+		exitOnError(rw.close(r), exitCodeRuntimeError)
+	} else if delimited {
+		err := writeResultDelimited(r, *outputStr, delim)
+		exitOnError(err, exitCodeRuntimeError)
+	} else if *outputStr != "" {
+		err := writeResultJSON(r, *outputStr, ctx.Err() != nil, anon)
+		exitOnError(err, exitCodeRuntimeError)
 	}
 }
 
@@ -406,33 +675,32 @@ func printResult(r *PrintableResult) {
 		printf("\nTerminated due to receive error: %s", r.ReceiveErr)
 		e = true
 	}
+	if r.ServerShutdown {
+		printf("\nStopped early due to server shutdown")
+		e = true
+	} else if r.ServerClose != 0 {
+		printf("\nStopped early, connection closed by server (%s)",
+			r.ServerClose)
+		e = true
+	}
 	if e {
 		printf("")
 	}
 
+	// quantile columns are taken from the RTT stats
+	qs := rtts.Quantiles()
 	printStats := func(title string, s DurationStats) {
-		if s.N > 0 {
-			var med string
-			if m, ok := s.Median(); ok {
-				med = rdur(m).String()
-			}
-			printf("%s\t%s\t%s\t%s\t%s\t%s\t", title, rdur(s.Min), rdur(s.Mean()),
-				med, rdur(s.Max), rdur(s.Stddev()))
-		}
+		printDurationStats(title, s, qs)
 	}
-
-	setTabWriter(tabwriter.AlignRight)
-
-	printf("\tMin\tMean\tMedian\tMax\tStddev\t")
-	printf("\t---\t----\t------\t---\t------\t")
+	qblank := printStatsHeader(qs)
 	printStats("RTT", rtts)
 	printStats("send delay", sds)
 	printStats("receive delay", rds)
-	printf("\t\t\t\t\t\t")
+	printf("\t\t\t\t%s\t\t", qblank)
 	printStats("IPDV (jitter)", rttvs)
 	printStats("send IPDV", svs)
 	printStats("receive IPDV", rvs)
-	printf("\t\t\t\t\t\t")
+	printf("\t\t\t\t%s\t\t", qblank)
 	printStats("send call time", ss)
 	printStats("timer error", tes)
 	printStats("server proc. time", sps)
@@ -453,6 +721,14 @@ func printResult(r *PrintableResult) {
 		printf("late (out-of-order) pkts: %d (%.2f%%)", r.LatePackets,
 			r.LatePacketsPercent)
 	}
+	if r.UpstreamDSCPRemarks > 0 || r.DownstreamDSCPRemarks > 0 {
+		printf("   DSCP remarked up/down: %d/%d", r.UpstreamDSCPRemarks,
+			r.DownstreamDSCPRemarks)
+	}
+	if r.UpstreamCEMarks > 0 || r.DownstreamCEMarks > 0 {
+		printf("    ECN CE marks up/down: %d/%d", r.UpstreamCEMarks,
+			r.DownstreamCEMarks)
+	}
 	printf("     bytes sent/received: %d/%d", r.BytesSent, r.BytesReceived)
 	printf("       send/receive rate: %s / %s", r.SendRate, r.ReceiveRate)
 	printf("             timer stats: %d/%d (%.2f%%) missed, %.2f%% error",
@@ -462,7 +738,97 @@ func printResult(r *PrintableResult) {
 	flush()
 }
 
-func writeResultJSON(r *Result, output string, cancelled bool) error {
+// printStatsHeader sets the tab writer and prints the header for a table of
+// DurationStats, with columns for the given quantiles. The blank columns for
+// quantiles are returned, for printing empty rows.
+func printStatsHeader(qs []Quantile) (qblank string) {
+	var qhdr, qsep string
+	for _, q := range qs {
+		p := percentileString(q.Percentile)
+		qhdr += p + "\t"
+		qsep += strings.Repeat("-", len(p)) + "\t"
+		qblank += "\t"
+	}
+
+	setTabWriter(tabwriter.AlignRight)
+
+	printf("\tMin\tMean\tMedian\t%sMax\tStddev\t", qhdr)
+	printf("\t---\t----\t------\t%s---\t------\t", qsep)
+	return
+}
+
+// printDurationStats prints a row in a table of DurationStats, if the stats
+// have any values.
+func printDurationStats(title string, s DurationStats, qs []Quantile) {
+	if s.N == 0 {
+		return
+	}
+	var med string
+	if m, ok := s.Median(); ok {
+		med = rdur(m).String()
+	}
+	var qss string
+	for _, q := range qs {
+		if v, ok := s.Quantile(q.Percentile); ok {
+			qss += rdur(v).String()
+		}
+		qss += "\t"
+	}
+	printf("%s\t%s\t%s\t%s\t%s%s\t%s\t", title, rdur(s.Min),
+		rdur(s.Mean()), med, qss, rdur(s.Max), rdur(s.Stddev()))
+}
+
+// printStreamStats prints the summary of a streaming mode test, for the whole
+// run and the sliding window.
+func printStreamStats(r *PrintableResult, ss *StreamStats) {
+	run := ss.Summary()
+	win := ss.Window()
+
+	if r.SendErr != nil && r.SendErr != context.Canceled {
+		printf("\nTerminated due to send error: %s\n", r.SendErr)
+	}
+	if r.ReceiveErr != nil {
+		printf("\nTerminated due to receive error: %s\n", r.ReceiveErr)
+	}
+	if r.ServerShutdown {
+		printf("\nStopped early due to server shutdown\n")
+	} else if r.ServerClose != 0 {
+		printf("\nStopped early, connection closed by server (%s)\n",
+			r.ServerClose)
+	}
+
+	qs := run.RTTStats.Quantiles()
+	qblank := printStatsHeader(qs)
+	printDurationStats("RTT", run.RTTStats, qs)
+	printDurationStats("IPDV (jitter)", run.IPDVStats, qs)
+	printf("\t\t\t\t%s\t\t", qblank)
+	printDurationStats(fmt.Sprintf("RTT (last %s)", ss.WindowLen),
+		win.RTTStats, qs)
+	printDurationStats(fmt.Sprintf("IPDV (last %s)", ss.WindowLen),
+		win.IPDVStats, qs)
+	printf("")
+	printf("                duration: %s (wait %s)", rdur(r.Duration), rdur(r.Wait))
+	printf("   packets sent/received: %d/%d (%.2f%% loss)", run.PacketsSent,
+		run.PacketsReceived, run.PacketLossPercent())
+	printf("%24s: %d/%d (%.2f%% loss)",
+		fmt.Sprintf("last %s sent/received", ss.WindowLen), win.PacketsSent,
+		win.PacketsReceived, win.PacketLossPercent())
+	if r.Duplicates > 0 {
+		printf("          *** DUPLICATES: %d", r.Duplicates)
+	}
+	if r.LatePackets > 0 {
+		printf("late (out-of-order) pkts: %d", r.LatePackets)
+	}
+	printf("     bytes sent/received: %d/%d", r.BytesSent, r.BytesReceived)
+	printf("(median and quantiles are approximate in streaming mode)")
+
+	flush()
+}
+
+// writeResultJSON writes a Result as JSON to output, anonymized if anon is not
+// nil.
+func writeResultJSON(r *Result, output string, cancelled bool,
+	anon *anonymizer) error {
 	var jout io.Writer
 
 	var gz bool
@@ -472,16 +838,7 @@ func writeResultJSON(r *Result, output string, cancelled bool) error {
 		}
 		jout = os.Stdout
 	} else {
-		gz = true
-		if strings.HasSuffix(output, ".json") {
-			gz = false
-		} else if !strings.HasSuffix(output, ".json.gz") {
-			if strings.HasSuffix(output, ".gz") {
-				output = output[:len(output)-3] + ".json.gz"
-			} else {
-				output = output + ".json.gz"
-			}
-		}
+		output, gz = resultOutputName(output)
 		of, err := os.Create(output)
 		if err != nil {
 			exitOnError(err, exitCodeRuntimeError)
@@ -497,11 +854,211 @@ func writeResultJSON(r *Result, output string, cancelled bool) error {
 		}()
 		jout = gzw
 	}
+	if anon != nil {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return anon.rewrite(bytes.NewReader(b), jout)
+	}
 	e := json.NewEncoder(jout)
 	e.SetIndent("", "    ")
 	return e.Encode(r)
 }
 
+// delimitedOutput returns the delimiter for CSV or TSV output, and true if the
+// output has a .csv or .tsv extension.
+func delimitedOutput(output string) (rune, bool) {
+	ext := filepath.Ext(output)
+	if ext != ".csv" && ext != ".tsv" {
+		return 0, false
+	}
+	return delimiterFor(ext[1:])
+}
+
+// writeResultDelimited writes the round trips of a Result to a CSV or TSV
+// file, with all columns.
+func writeResultDelimited(r *Result, output string, delim rune) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := newDelimitedWriter(f, delim, true)
+	if err := w.writeRoundTrips(rtColumns, r.RoundTrips); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// resultOutputName returns the file name for JSON output, and whether or not
+// the output should be gzipped, according to the extension.
+func resultOutputName(output string) (string, bool) {
+	if strings.HasSuffix(output, ".json") {
+		return output, false
+	}
+	if !strings.HasSuffix(output, ".json.gz") {
+		if strings.HasSuffix(output, ".gz") {
+			output = output[:len(output)-3] + ".json.gz"
+		} else {
+			output = output + ".json.gz"
+		}
+	}
+	return output, true
+}
+
+// parseSummaryEvery parses the summary interval, as either a duration or a
+// number of packets with the p suffix.
+func parseSummaryEvery(s string) (d time.Duration, n uint, err error) {
+	if s == "" {
+		return
+	}
+	if strings.HasSuffix(s, "p") {
+		var n64 uint64
+		n64, err = strconv.ParseUint(strings.TrimSuffix(s, "p"), 10, 32)
+		if err != nil || n64 == 0 {
+			err = fmt.Errorf("invalid summary packets %s", s)
+		}
+		n = uint(n64)
+		return
+	}
+	d, err = time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		err = fmt.Errorf("invalid summary duration %s", s)
+	}
+	return
+}
+
+// parseRotate parses a comma separated list of a max file size, with an
+// optional K, M or G suffix, and/or a max file age, as a duration.
+func parseRotate(s string) (size int64, age time.Duration, err error) {
+	if s == "" {
+		return
+	}
+	for _, r := range strings.Split(s, ",") {
+		if d, derr := time.ParseDuration(r); derr == nil && d > 0 {
+			age = d
+			continue
+		}
+		m := int64(1)
+		n := strings.TrimSuffix(r, "B")
+		switch {
+		case strings.HasSuffix(n, "K"):
+			m = 1 << 10
+		case strings.HasSuffix(n, "M"):
+			m = 1 << 20
+		case strings.HasSuffix(n, "G"):
+			m = 1 << 30
+		}
+		if m > 1 {
+			n = n[:len(n)-1]
+		}
+		v, perr := strconv.ParseInt(n, 10, 64)
+		if perr != nil || v <= 0 {
+			err = fmt.Errorf("invalid rotate size or duration %s", r)
+			return
+		}
+		size = v * m
+	}
+	return
+}
+
+// outputError records the first error writing output from a handler, and
+// stops the test, since handlers are called with the Recorder locked and
+// can't exit without losing buffered output.
+type outputError struct {
+	stop context.CancelFunc
+	err  error
+}
+
+// set records err, if it's the first error, and stops the test.
+func (o *outputError) set(err error) {
+	if err != nil && o.err == nil {
+		o.err = err
+		o.stop()
+	}
+}
+
+// jsonlHandler writes final round trips and/or interval summaries as JSON
+// Lines, and passes other calls to the underlying ClientHandler.
+type jsonlHandler struct {
+	ClientHandler
+	*outputError
+	w          *jsonlWriter
+	roundTrips bool
+	summaries  bool
+}
+
+func (h *jsonlHandler) OnRoundTrip(rt *RoundTrip) {
+	if h.roundTrips && h.err == nil {
+		h.set(h.w.write("round_trip", rt))
+	}
+}
+
+func (h *jsonlHandler) OnInterval(s *IntervalSummary) {
+	if ih, ok := h.ClientHandler.(IntervalHandler); ok {
+		ih.OnInterval(s)
+	}
+	if h.summaries && h.err == nil {
+		h.set(h.w.write("interval", s))
+	}
+}
+
+// resultHandler writes final round trips to incremental JSON output, and
+// passes other calls to the underlying ClientHandler.
+type resultHandler struct {
+	ClientHandler
+	*outputError
+	w *resultWriter
+}
+
+func (h *resultHandler) OnRoundTrip(rt *RoundTrip) {
+	if h.err == nil {
+		h.set(h.w.writeRoundTrip(rt))
+	}
+}
+
+func (h *resultHandler) OnInterval(s *IntervalSummary) {
+	if ih, ok := h.ClientHandler.(IntervalHandler); ok {
+		ih.OnInterval(s)
+	}
+}
+
+// summaryHandler prints interval summaries, and passes other calls to the
+// underlying ClientHandler.
+type summaryHandler struct {
+	ClientHandler
+	rows int
+}
+
+func (h *summaryHandler) OnInterval(s *IntervalSummary) {
+	if h.rows%summaryHeaderRows == 0 {
+		printf("%15s %6s %6s %7s | %8s %8s %8s %8s | %9s %8s %8s",
+			"interval", "sent", "rcvd", "loss", "rtt min", "mean", "median",
+			"max", "ipdv mean", "median", "max")
+	}
+	h.rows++
+	dur := func(ds *DurationStats, d func(*DurationStats) time.Duration) string {
+		if ds.N == 0 {
+			return "-"
+		}
+		return rdur(d(ds)).String()
+	}
+	min := func(ds *DurationStats) time.Duration { return ds.Min }
+	mean := func(ds *DurationStats) time.Duration { return ds.Mean() }
+	med := func(ds *DurationStats) time.Duration {
+		m, _ := ds.Median()
+		return m
+	}
+	max := func(ds *DurationStats) time.Duration { return ds.Max }
+	printf("%15s %6d %6d %6.2f%% | %8s %8s %8s %8s | %9s %8s %8s",
+		fmt.Sprintf("%.1f-%.1fs", s.Start.Seconds(), s.End.Seconds()),
+		s.PacketsSent, s.PacketsReceived, s.PacketLossPercent(),
+		dur(&s.RTTStats, min), dur(&s.RTTStats, mean), dur(&s.RTTStats, med),
+		dur(&s.RTTStats, max), dur(&s.IPDVStats, mean),
+		dur(&s.IPDVStats, med), dur(&s.IPDVStats, max))
+}
+
 // humanHandler emits output for human consumption.
 type humanHandler struct {
 }
@@ -543,47 +1100,6 @@ func (c *humanHandler) OnEvent(e *Event) {
 	printf("%s", e)
 }
 
-// rawHandler emits space separated output for machine consumption.
-type rawHandler struct {
-}
-
-func (r *rawHandler) OnSent(seqno Seqno, rtd *RoundTripData) {
-}
-
-func (r *rawHandler) OnReceived(seqno Seqno, rtd *RoundTripData,
-	prtd *RoundTripData, dup bool) {
-	if dup {
-		fmt.Printf("%d NaN NaN NaN NaN 1 NaN\n", seqno)
-		return
-	}
-
-	rtt := float64(rtd.RTT()) / float64(time.Millisecond)
-	rd := math.NaN()
-	if rtd.ReceiveDelay() != InvalidDuration {
-		rd = float64(rtd.ReceiveDelay()) / float64(time.Millisecond)
-	}
-	sd := math.NaN()
-	if rtd.SendDelay() != InvalidDuration {
-		sd = float64(rtd.SendDelay()) / float64(time.Millisecond)
-	}
-	ipdv := math.NaN()
-	if prtd != nil {
-		dv := rtd.IPDVSince(prtd)
-		if dv != InvalidDuration {
-			ipdv = float64(dv) / float64(time.Millisecond)
-		}
-	}
-	l := 0
-	if rtd.Late {
-		l = 1
-	}
-	fmt.Printf("%d %f %f %f %f 0 %d\n", seqno, rtt, rd, sd, ipdv, l)
-}
-
-func (r *rawHandler) OnEvent(e *Event) {
-	printf("%s", e)
-}
-
 // discardHandler ignores all Handler calls.
 type discardHandler struct {
 }
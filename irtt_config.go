@@ -0,0 +1,176 @@
+package irtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	flag "github.com/ogier/pflag"
+)
+
+// flags that may not be set in config files
+var noConfigFlags = map[string]bool{
+	"config":  true,
+	"profile": true,
+	"version": true,
+}
+
+// clientConfigAliases are the client config file names for flags with only
+// short names.
+var clientConfigAliases = map[string]string{
+	"duration":     "d",
+	"interval":     "i",
+	"length":       "l",
+	"stream":       "s",
+	"no-test":      "n",
+	"output":       "o",
+	"raw":          "r",
+	"quiet":        "q",
+	"really-quiet": "Q",
+	"ipv4":         "4",
+	"ipv6":         "6",
+}
+
+// readConfigFile reads settings from a JSON config file. Each setting is named
+// by a flag's long name, or an alias for flags with only a short name.
+func readConfigFile(path string) (settings map[string]interface{}, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err = dec.Decode(&settings); err != nil {
+		err = fmt.Errorf("invalid config file %s (%s)", path, err)
+	}
+	return
+}
+
+// explicitFlags returns the names of the flags set on the command line.
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// setFlags sets flags from config file settings, except for explicit flags
+// that were set on the command line. Setting names are first looked up in
+// aliases. Lists may be given as JSON arrays, and are joined with commas.
+func setFlags(fs *flag.FlagSet, settings map[string]interface{},
+	aliases map[string]string, explicit map[string]bool) error {
+	for name, v := range settings {
+		fname := name
+		if a, ok := aliases[name]; ok {
+			fname = a
+		}
+		if noConfigFlags[fname] || fs.Lookup(fname) == nil {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		if explicit[fname] {
+			continue
+		}
+		value, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s (%s)", name, err)
+		}
+		if err := fs.Set(fname, value); err != nil {
+			return fmt.Errorf("invalid value for %s (%s)", name, err)
+		}
+	}
+	return nil
+}
+
+// configValue returns the flag value for a JSON setting.
+func configValue(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case json.Number:
+		return t.String(), nil
+	case []interface{}:
+		ss := make([]string, 0, len(t))
+		for _, e := range t {
+			s, err := configValue(e)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("list element %s contains a comma", s)
+			}
+			ss = append(ss, s)
+		}
+		return strings.Join(ss, ","), nil
+	}
+	return "", fmt.Errorf("unsupported type %T", v)
+}
+
+// clientConfigFile returns the path to the default client config file, in the
+// user's config directory, or an empty string if it can't be determined.
+func clientConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, defaultClientConfigFile)
+}
+
+// applyProfile sets flags from the named profile in a client config file,
+// except for explicit flags that were set on the command line. If path is
+// empty, the default client config file is used.
+func applyProfile(fs *flag.FlagSet, path, name string,
+	explicit map[string]bool) error {
+	if path == "" {
+		if path = clientConfigFile(); path == "" {
+			return fmt.Errorf("unable to find config file for profile %s, "+
+				"use --config", name)
+		}
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for k := range settings {
+		if k != "profiles" {
+			return fmt.Errorf("config file %s: unknown setting %s", path, k)
+		}
+	}
+	profiles, ok := settings["profiles"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("config file %s: profiles must be an object", path)
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("config file %s: no profile %s", path, name)
+	}
+	ps, ok := profile.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("config file %s: profile %s must be an object", path,
+			name)
+	}
+	if err := setFlags(fs, ps, clientConfigAliases, explicit); err != nil {
+		return fmt.Errorf("config file %s: profile %s: %s", path, name, err)
+	}
+	return nil
+}
+
+// readKeyFile returns the first line of a key file, without surrounding
+// whitespace.
+func readKeyFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(strings.SplitN(string(b), "\n", 2)[0])
+	if key == "" {
+		return "", fmt.Errorf("no key in %s", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,149 @@
+package irtt
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	flag "github.com/ogier/pflag"
+)
+
+func convertUsage() {
+	setBufio()
+	printf("Usage: convert [flags] [file|-]")
+	printf("")
+	printf("Converts JSON output to CSV or TSV, with one row per round trip, or a")
+	printf("single row of summary statistics.")
+	printf("")
+	printf("If a filename is given, JSON is read from the given file.")
+	printf("")
+	printf("If no argument or a - character is given, JSON is read from stdin.")
+	printf("")
+	printf("Gzipped input is detected and decompressed automatically.")
+	printf("")
+	printf("Flags:")
+	printf("------")
+	printf("")
+	printf("-o file         write output to file (default stdout)")
+	printf("                if extension is .csv or .tsv, it sets the format")
+	printf("--format=fmt    output format, csv or tsv (default csv)")
+	printf("--cols=cols     comma separated list of columns to output (default all)")
+	printf("--summary       output a single row of summary statistics")
+	printf("--no-header     don't output a header row with the column names")
+	printf("")
+	printf("Round trip columns:")
+	printf("-------------------")
+	printf("")
+	printf("%s", rtColumnNames())
+	printf("")
+	printf("Summary columns:")
+	printf("----------------")
+	printf("")
+	printf("%s", statsColumnNames())
+	printf("")
+	printf("Notes:")
+	printf("------")
+	printf("")
+	printf("- Durations and timestamps are in integer nanoseconds. Timestamps are")
+	printf("  wall clock values, in nanoseconds since the Unix epoch.")
+	printf("- Values that are unavailable, for example the RTT of a lost packet, or")
+	printf("  one-way delays without timestamps from the server, are empty.")
+}
+
+// runConvert converts JSON output to CSV or TSV.
+func runConvert(args []string) {
+	fs := flag.NewFlagSet("convert", 0)
+	fs.Usage = func() {
+		usageAndExit(convertUsage, exitCodeBadCommandLine)
+	}
+	var outputStr = fs.StringP("o", "o", "", "output file")
+	var formatStr = fs.String("format", "", "output format")
+	var colsStr = fs.String("cols", "", "columns")
+	var summary = fs.Bool("summary", false, "summary")
+	var noHeader = fs.Bool("no-header", false, "no header")
+	err := fs.Parse(args)
+	exitOnError(err, exitCodeBadCommandLine)
+	if len(fs.Args()) > 1 {
+		usageAndExit(convertUsage, exitCodeBadCommandLine)
+	}
+
+	// determine delimiter from format, or output file extension
+	format := *formatStr
+	if format == "" {
+		format = "csv"
+		if ext := filepath.Ext(*outputStr); ext == ".csv" || ext == ".tsv" {
+			format = ext[1:]
+		}
+	}
+	delim, ok := delimiterFor(format)
+	if !ok {
+		exitOnError(fmt.Errorf("invalid format %s", format),
+			exitCodeBadCommandLine)
+	}
+
+	// select columns
+	var rtCols []rtColumn
+	var statsCols []statsColumn
+	if *summary {
+		statsCols, err = selectStatsColumns(*colsStr)
+	} else {
+		rtCols, err = selectRTColumns(*colsStr)
+	}
+	exitOnError(err, exitCodeBadCommandLine)
+
+	// open input
+	var in io.Reader = os.Stdin
+	if len(fs.Args()) > 0 && fs.Args()[0] != "-" {
+		f, err := os.Open(fs.Args()[0])
+		exitOnError(err, exitCodeRuntimeError)
+		defer f.Close()
+		in = f
+	}
+	in, err = gunzipIfNeeded(in)
+	exitOnError(err, exitCodeRuntimeError)
+
+	// decode only the stats and round trips
+	var r struct {
+		Stats      *Stats      `json:"stats"`
+		RoundTrips []RoundTrip `json:"round_trips"`
+	}
+	err = json.NewDecoder(in).Decode(&r)
+	exitOnError(err, exitCodeRuntimeError)
+	if *summary && r.Stats == nil {
+		exitOnError(fmt.Errorf("no stats found in input"), exitCodeRuntimeError)
+	}
+
+	// open output and write
+	var out io.Writer = os.Stdout
+	if *outputStr != "" && *outputStr != "-" {
+		f, err := os.Create(*outputStr)
+		exitOnError(err, exitCodeRuntimeError)
+		defer f.Close()
+		out = f
+	}
+	w := newDelimitedWriter(out, delim, !*noHeader)
+	if *summary {
+		err = w.writeStats(statsCols, r.Stats)
+	} else {
+		err = w.writeRoundTrips(rtCols, r.RoundTrips)
+	}
+	exitOnError(err, exitCodeRuntimeError)
+}
+
+// gunzipIfNeeded returns a Reader that decompresses the input if it starts
+// with the gzip magic number, or otherwise returns the input as is.
+func gunzipIfNeeded(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
@@ -0,0 +1,105 @@
+package irtt
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	flag "github.com/ogier/pflag"
+)
+
+func ctlUsage() {
+	setBufio()
+	printf("Usage: ctl [flags] command [args]")
+	printf("")
+	printf("Controls a running server through its control socket (see server --ctl).")
+	printf("")
+	printf("Flags:")
+	printf("------")
+	printf("")
+	printf("-S path         control socket path (default %s)", DefaultControlSocket)
+	printf("")
+	printf("Commands:")
+	printf("---------")
+	printf("")
+	printf("list            list active connections")
+	printf("close token     close the connection with the given token (from list)")
+	printf("limits          show the current limits")
+	printf("set limit value change a limit, for new connections and the requests of")
+	printf("                existing connections, where limit is one of:")
+	printf("                min-interval: min send interval, or 0 for no minimum")
+	printf("                max-duration: max test duration, or 0 for no maximum")
+	printf("                max-length: max packet length, or 0 for no maximum")
+	printf("bans            list banned sources")
+	printf("ban ip [dur]    ban a source for dur, or for the next backoff duration of")
+	printf("                the source if not given (see server --ban-time)")
+	printf("unban ip        unban a source, and forget its previous bans")
+	printf("shutdown        shut down the server")
+}
+
+// runCtl runs the control socket client.
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", 0)
+	fs.Usage = func() {
+		usageAndExit(ctlUsage, exitCodeBadCommandLine)
+	}
+	var socketStr = fs.StringP("S", "S", DefaultControlSocket, "socket")
+	err := fs.Parse(args)
+	exitOnError(err, exitCodeBadCommandLine)
+	if len(fs.Args()) == 0 {
+		usageAndExit(ctlUsage, exitCodeBadCommandLine)
+	}
+
+	req := &ctlRequest{Command: fs.Args()[0], Args: fs.Args()[1:]}
+	resp, err := ctlExec(*socketStr, req)
+	exitOnError(err, exitCodeRuntimeError)
+	if resp.Error != "" {
+		exitOnError(fmt.Errorf("%s", resp.Error), exitCodeRuntimeError)
+	}
+
+	if resp.Message != "" {
+		printf("%s", resp.Message)
+	}
+	if req.Command == "list" {
+		printConns(resp.Conns)
+	}
+	if resp.Limits != nil {
+		printLimits(resp.Limits)
+	}
+	if req.Command == "bans" {
+		printBans(resp.Bans)
+	}
+	os.Exit(exitCodeSuccess)
+}
+
+func printConns(conns []ctlConn) {
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Age > conns[j].Age
+	})
+	setTabWriter(0)
+	printf("Listener\tRemote\tToken\tAge\tDuration\tInterval\tLength\tPackets\tBytes")
+	for _, c := range conns {
+		printf("%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d", c.Listener, c.RemoteAddr,
+			c.Token, c.Age.Round(time.Second), c.Duration, c.Interval, c.Length,
+			c.Packets, c.Bytes)
+	}
+	flush()
+}
+
+func printLimits(lim *ctlLimits) {
+	setTabWriter(0)
+	printf("min-interval\t%s", lim.MinInterval)
+	printf("max-duration\t%s", lim.MaxDuration)
+	printf("max-length\t%d", lim.MaxLength)
+	flush()
+}
+
+func printBans(bans []ctlBan) {
+	setTabWriter(0)
+	printf("IP\tRemaining\tBans")
+	for _, b := range bans {
+		printf("%s\t%s\t%d", b.IP, b.Remaining.Round(time.Second), b.Bans)
+	}
+	flush()
+}
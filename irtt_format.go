@@ -0,0 +1,295 @@
+package irtt
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formatPacket contains the data for one received packet, for formatting.
+type formatPacket struct {
+	seqno Seqno
+	rtd   *RoundTripData
+	prtd  *RoundTripData
+	dup   bool
+}
+
+// formatKind is the kind of value a format field has, which determines the
+// units it may be formatted with.
+type formatKind int
+
+const (
+	formatInt formatKind = iota
+	formatFlag
+	formatDuration
+	formatTime
+)
+
+// formatValue returns the value of a field for a packet, or false if the value
+// is not available.
+type formatValue func(p *formatPacket) (int64, bool)
+
+// formatField is a field that may be used in a per-packet format.
+type formatField struct {
+	name  string
+	kind  formatKind
+	value formatValue
+}
+
+// nodup returns a formatValue that is not available for duplicates, and
+// otherwise returns the duration from fn, if it's valid.
+func nodup(fn func(p *formatPacket) time.Duration) formatValue {
+	return func(p *formatPacket) (int64, bool) {
+		if p.dup {
+			return 0, false
+		}
+		d := fn(p)
+		return int64(d), d != InvalidDuration
+	}
+}
+
+// wallOf returns a formatValue for the wall clock value of a Time, which is not
+// available for duplicates or if the Time has no wall clock value.
+func wallOf(fn func(rtd *RoundTripData) Time) formatValue {
+	return func(p *formatPacket) (int64, bool) {
+		if p.dup {
+			return 0, false
+		}
+		t := fn(p.rtd)
+		return t.Wall, !t.IsWallZero()
+	}
+}
+
+// ipdvOf returns a formatValue for an IPDV, which is not available for the
+// first packet received.
+func ipdvOf(fn func(rtd, prtd *RoundTripData) time.Duration) formatValue {
+	return nodup(func(p *formatPacket) time.Duration {
+		if p.prtd == nil {
+			return InvalidDuration
+		}
+		return fn(p.rtd, p.prtd)
+	})
+}
+
+var formatFields = []formatField{
+	{"seqno", formatInt, func(p *formatPacket) (int64, bool) {
+		return int64(p.seqno), true
+	}},
+	{"rtt", formatDuration, nodup(func(p *formatPacket) time.Duration {
+		return p.rtd.RTT()
+	})},
+	{"send_delay", formatDuration, nodup(func(p *formatPacket) time.Duration {
+		return p.rtd.SendDelay()
+	})},
+	{"receive_delay", formatDuration, nodup(func(p *formatPacket) time.Duration {
+		return p.rtd.ReceiveDelay()
+	})},
+	{"ipdv", formatDuration, ipdvOf(func(rtd, prtd *RoundTripData) time.Duration {
+		return rtd.IPDVSince(prtd)
+	})},
+	{"send_ipdv", formatDuration, ipdvOf(
+		func(rtd, prtd *RoundTripData) time.Duration {
+			return rtd.SendIPDVSince(prtd)
+		})},
+	{"receive_ipdv", formatDuration, ipdvOf(
+		func(rtd, prtd *RoundTripData) time.Duration {
+			return rtd.ReceiveIPDVSince(prtd)
+		})},
+	{"late", formatFlag, func(p *formatPacket) (int64, bool) {
+		if p.dup {
+			return 0, false
+		}
+		return flagValue(p.rtd.Late), true
+	}},
+	{"dup", formatFlag, func(p *formatPacket) (int64, bool) {
+		return flagValue(p.dup), true
+	}},
+	{"client_send", formatTime, wallOf(func(rtd *RoundTripData) Time {
+		return rtd.Client.Send
+	})},
+	{"server_receive", formatTime, wallOf(func(rtd *RoundTripData) Time {
+		return rtd.Server.Receive
+	})},
+	{"server_send", formatTime, wallOf(func(rtd *RoundTripData) Time {
+		return rtd.Server.Send
+	})},
+	{"client_receive", formatTime, wallOf(func(rtd *RoundTripData) Time {
+		return rtd.Client.Receive
+	})},
+}
+
+func flagValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// formatPresets are the named formats that may be given instead of a
+// template. The human preset is handled by humanHandler.
+var formatPresets = map[string]string{
+	"csv": "{seqno},{rtt:ns},{send_delay:ns},{receive_delay:ns},{ipdv:ns}," +
+		"{send_ipdv:ns},{receive_ipdv:ns},{late},{dup},{client_send}," +
+		"{server_receive},{server_send},{client_receive}",
+	"space": "{seqno} {rtt:ms} {receive_delay:ms} {send_delay:ms} {ipdv:ms} " +
+		"{dup} {late}",
+}
+
+// formatHeaders are the header lines written before the first line of output
+// for presets that have them.
+var formatHeaders = map[string]string{
+	"csv": "seqno,rtt,send_delay,receive_delay,ipdv,send_ipdv,receive_ipdv," +
+		"late,dup,client_send,server_receive,server_send,client_receive",
+}
+
+// formatUnits are the divisors for each unit, and the number of decimal places
+// needed to show them with nanosecond precision.
+var formatUnits = map[string]struct {
+	div  time.Duration
+	prec int
+}{
+	"ns": {time.Nanosecond, 0},
+	"us": {time.Microsecond, 3},
+	"ms": {time.Millisecond, 6},
+	"s":  {time.Second, 9},
+}
+
+// formatElem is either literal text, or a field with a unit.
+type formatElem struct {
+	text  string
+	field *formatField
+	unit  string
+}
+
+// packetFormat is a parsed per-packet format template.
+type packetFormat struct {
+	elems  []formatElem
+	header string
+}
+
+// parsePacketFormat parses a preset name or a template. In a template, fields
+// are given as {field} or {field:unit}, {{ and }} are a literal brace, and \t
+// is a tab.
+func parsePacketFormat(s string) (*packetFormat, error) {
+	f := &packetFormat{}
+	if t, ok := formatPresets[s]; ok {
+		f.header = formatHeaders[s]
+		s = t
+	} else if !strings.Contains(s, "{") {
+		return nil, fmt.Errorf("unknown format preset %s", s)
+	}
+	var text strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"), strings.HasPrefix(s[i:], "}}"):
+			text.WriteByte(s[i])
+			i++
+		case strings.HasPrefix(s[i:], `\t`):
+			text.WriteByte('\t')
+			i++
+		case s[i] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated field in format %s", s)
+			}
+			e, err := parseFormatField(s[i+1 : i+end])
+			if err != nil {
+				return nil, err
+			}
+			if text.Len() > 0 {
+				f.elems = append(f.elems, formatElem{text: text.String()})
+				text.Reset()
+			}
+			f.elems = append(f.elems, e)
+			i += end
+		case s[i] == '}':
+			return nil, fmt.Errorf("unmatched } in format %s", s)
+		default:
+			text.WriteByte(s[i])
+		}
+	}
+	if text.Len() > 0 {
+		f.elems = append(f.elems, formatElem{text: text.String()})
+	}
+	return f, nil
+}
+
+// parseFormatField parses a field and optional unit, separated by a colon.
+func parseFormatField(s string) (e formatElem, err error) {
+	name, unit, _ := strings.Cut(s, ":")
+	for i := range formatFields {
+		if formatFields[i].name == name {
+			e.field = &formatFields[i]
+		}
+	}
+	if e.field == nil {
+		err = fmt.Errorf("unknown format field %s", name)
+		return
+	}
+	if unit != "" {
+		_, ok := formatUnits[unit]
+		if !ok || (e.field.kind != formatDuration && e.field.kind != formatTime) {
+			err = fmt.Errorf("invalid unit %s for format field %s", unit, name)
+			return
+		}
+	}
+	e.unit = unit
+	return
+}
+
+// format returns the formatted line for a packet, without a newline.
+func (f *packetFormat) format(p *formatPacket) string {
+	var b strings.Builder
+	for _, e := range f.elems {
+		if e.field == nil {
+			b.WriteString(e.text)
+			continue
+		}
+		v, ok := e.field.value(p)
+		if e.field.kind == formatDuration && e.unit == "" {
+			if ok {
+				b.WriteString(rdur(time.Duration(v)).String())
+			} else {
+				b.WriteString("n/a")
+			}
+			continue
+		}
+		if !ok {
+			b.WriteString("NaN")
+			continue
+		}
+		u, ok := formatUnits[e.unit]
+		if !ok || u.prec == 0 {
+			b.WriteString(strconv.FormatInt(v, 10))
+			continue
+		}
+		b.WriteString(strconv.FormatFloat(float64(v)/float64(u.div), 'f',
+			u.prec, 64))
+	}
+	return b.String()
+}
+
+// formatHandler emits per-packet output using a packetFormat.
+type formatHandler struct {
+	format *packetFormat
+	w      io.Writer
+	header bool
+}
+
+func (h *formatHandler) OnSent(seqno Seqno, rtd *RoundTripData) {
+}
+
+func (h *formatHandler) OnReceived(seqno Seqno, rtd *RoundTripData,
+	prtd *RoundTripData, dup bool) {
+	if !h.header && h.format.header != "" {
+		fmt.Fprintln(h.w, h.format.header)
+	}
+	h.header = true
+	fmt.Fprintln(h.w, h.format.format(&formatPacket{seqno, rtd, prtd, dup}))
+}
+
+func (h *formatHandler) OnEvent(e *Event) {
+	printf("%s", e)
+}
@@ -0,0 +1,152 @@
+package irtt
+
+import (
+	"strings"
+	"testing"
+)
+
+// testFormatPackets returns a received packet with server timestamps, and a
+// duplicate of it.
+func testFormatPackets() (p, dup *formatPacket) {
+	prtd := &RoundTripData{
+		Client: Timestamp{
+			Send:    Time{testWall - 10000000, 1000},
+			Receive: Time{testWall + 10000000, 20001000},
+		},
+	}
+	rtd := &RoundTripData{
+		Client: Timestamp{
+			Send:    Time{testWall, 10001000},
+			Receive: Time{testWall + 21000000, 31001000},
+		},
+		Server: Timestamp{
+			Receive: Time{testWall + 12000000, 0},
+			Send:    Time{testWall + 12500000, 0},
+		},
+		Late: true,
+	}
+	p = &formatPacket{7, rtd, prtd, false}
+	dup = &formatPacket{7, rtd, prtd, true}
+	return
+}
+
+// TestParsePacketFormat tests parsing and formatting templates, with units and
+// escapes.
+func TestParsePacketFormat(t *testing.T) {
+	p, dup := testFormatPackets()
+	tests := []struct {
+		format string
+		expect string
+		dup    string
+	}{
+		{"{seqno}", "7", "7"},
+		{"seq={seqno} rtt={rtt}", "seq=7 rtt=20.5ms", "seq=7 rtt=n/a"},
+		{"{rtt:ns} {rtt:us} {rtt:ms} {rtt:s}",
+			"20500000 20500.000 20.500000 0.020500000", "NaN NaN NaN NaN"},
+		{"{send_delay:ms} {receive_delay:ms}", "12.000000 8.500000",
+			"NaN NaN"},
+		{"{ipdv:us}", "500.000", "NaN"},
+		{"{late} {dup}", "1 0", "NaN 1"},
+		{"{client_send}", "1500000000000000000", "NaN"},
+		{"{server_send:ms}", "1500000000012.500000", "NaN"},
+		{"{{{seqno}}}", "{7}", "{7}"},
+		{"}}{{", "}{", "}{"},
+		{`{seqno}\t{dup}`, "7\t0", "7\t1"},
+		{`a\tb{{`, "a\tb{", "a\tb{"},
+		{`{seqno}\x`, `7\x`, `7\x`},
+	}
+	for _, tc := range tests {
+		f, err := parsePacketFormat(tc.format)
+		if err != nil {
+			t.Errorf("%q: %s", tc.format, err)
+			continue
+		}
+		if f.header != "" {
+			t.Errorf("%q: template has header %q", tc.format, f.header)
+		}
+		if s := f.format(p); s != tc.expect {
+			t.Errorf("%q: formatted %q, expected %q", tc.format, s, tc.expect)
+		}
+		if s := f.format(dup); s != tc.dup {
+			t.Errorf("%q: formatted duplicate %q, expected %q", tc.format, s,
+				tc.dup)
+		}
+	}
+}
+
+// TestParsePacketFormatErrors tests that invalid presets, fields, units and
+// braces are errors.
+func TestParsePacketFormatErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"nope",
+		"human",
+		"{nope}",
+		"{}",
+		"{rtt:ps}",
+		"{rtt:}x{seqno:ms}",
+		"{seqno:ms}",
+		"{late:ns}",
+		"{dup:s}",
+		"{rtt",
+		"{rtt}}",
+		"x}",
+		"{seqno}{",
+	} {
+		if _, err := parsePacketFormat(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+// TestPacketFormatPresets tests that every preset parses, and that presets
+// with headers have a column for each field.
+func TestPacketFormatPresets(t *testing.T) {
+	p, _ := testFormatPackets()
+	for name, tmpl := range formatPresets {
+		f, err := parsePacketFormat(name)
+		if err != nil {
+			t.Errorf("preset %s: %s", name, err)
+			continue
+		}
+		nfields := 0
+		for _, e := range f.elems {
+			if e.field != nil {
+				nfields++
+			}
+		}
+		if n := strings.Count(tmpl, "{"); nfields != n {
+			t.Errorf("preset %s: parsed %d fields, expected %d", name, nfields, n)
+		}
+		if h, ok := formatHeaders[name]; ok {
+			if f.header != h {
+				t.Errorf("preset %s: header %q, expected %q", name, f.header, h)
+			}
+			i := 0
+			for _, e := range f.elems {
+				if e.field == nil {
+					continue
+				}
+				col := strings.Split(h, ",")
+				if i >= len(col) || col[i] != e.field.name {
+					t.Errorf("preset %s: header does not match field %s", name,
+						e.field.name)
+				}
+				i++
+			}
+		}
+		if s := f.format(p); !strings.HasPrefix(s, "7") {
+			t.Errorf("preset %s: formatted %q, expected seqno first", name, s)
+		}
+	}
+	f, err := parsePacketFormat("csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "7,20500000,12000000,8500000,500000,NaN,NaN,1,0," +
+		"1500000000000000000,1500000000012000000,1500000000012500000," +
+		"1500000000021000000"
+	if s := f.format(p); s != expect {
+		t.Errorf("csv preset formatted %q, expected %q", s, expect)
+	}
+}
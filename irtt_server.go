@@ -1,10 +1,13 @@
 package irtt
 
 import (
+	"fmt"
+	"net/netip"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	flag "github.com/ogier/pflag"
 )
@@ -38,10 +41,26 @@ func serverUsage() {
 		printf("               udp://logsrv:514/irttsrv: UDP to logsrv:514, tag irttsrv")
 		printf("               tcp://logsrv:8514/: TCP to logsrv:8514, default tag irtt")
 	}
+	printf("--event-window=dur")
+	printf("               merge events with the same code, remote address and error")
+	printf("               code over dur, logging the first immediately and the rest")
+	printf("               as one event with a count, or 0 to not merge (default 0)")
+	printf("--event-rate=# max events per second for each code, or 0 for no limit")
+	printf("               (default 0), events over the limit are counted in one")
+	printf("               event per code, and the first of each error code in each")
+	printf("               window is always logged (events with no remote address")
+	printf("               are never merged or limited)")
 	printf("--timeout=dur  timeout for closing connections if no requests received")
 	printf("               0 means no timeout (not recommended on public servers)")
 	printf("               max client interval will be restricted to timeout/%d", maxIntervalTimeoutFactor)
 	printf("               (default %s, see Duration units below)", DefaultServerTimeout)
+	printf("--open-timeout=dur")
+	printf("               timeout for closing connections if no echo requests")
+	printf("               received since the open, or 0 to use --timeout")
+	printf("               (default %s)", DefaultOpenTimeout)
+	printf("--grace=dur    on shutdown, send a close to clients and wait up to dur")
+	printf("               for them to stop, or 0 to stop immediately (default %s)",
+		DefaultShutdownGrace)
 	printf("--pburst=#     packet burst allowed before enforcing minimum interval")
 	printf("               (default %d)", DefaultPacketBurst)
 	printf("--fill=fill    payload fill if not requested (default %s)", DefaultServerFiller.String())
@@ -54,32 +73,139 @@ func serverUsage() {
 	printf("               allowing non-random fills insecure on public servers")
 	printf("               use --allow-fills=\"\" to disallow all fill requests")
 	printf("               note: patterns may contain * for matching")
+	printf("--ip-limit=lim limits for each source IP, comma separated list of:")
+	printf("               conns=n: max concurrent connections")
+	printf("               packets=n: max requests per second")
+	printf("               bytes=n: max request bytes per second")
+	printf("               opens=n: max open requests per second")
+	printf("               rates may have a K, M or G suffix (multiples of 1000)")
+	printf("               opens over the conns limit are refused, and opens and")
+	printf("               requests over the rate limits are dropped")
+	printf("--prefix-limit=lim")
+	printf("               limits for each source prefix, with the settings for")
+	printf("               --ip-limit, plus the prefix lengths prefix4=len (default")
+	printf("               %d) and prefix6=len (default %d)", DefaultLimitPrefix4,
+		DefaultLimitPrefix6)
+	printf("--open-rate=#  max open requests per second for the whole server, or 0")
+	printf("               for no limit (default 0), opens over the limit are dropped")
+	printf("--max-conns=#  max connections for the whole server, or 0 for no limit")
+	printf("               (default 0)")
+	printf("--listener-conns=#")
+	printf("               max connections for each listener, or 0 for no limit")
+	printf("               (default 0)")
+	printf("--conns-policy=pol")
+	printf("               action for new connections when the max is reached")
+	printf("               (default %s):", DefaultConnLimitPolicy)
+	printf("               reject: refuse the new connection")
+	printf("               evict: close the least recently used connection on the")
+	printf("               listener, preferring those with no echo requests yet")
+	printf("--allow=prefixes")
+	printf("               comma separated IP prefixes (e.g. 192.0.2.0/24) of sources")
+	printf("               to allow (default all), all others are denied, and --deny")
+	printf("               takes precedence")
+	printf("               prefix@listener applies to one listener only, where")
+	printf("               listener is an address as in ListenerStart events")
+	printf("--deny=prefixes")
+	printf("               comma separated IP prefixes of sources to deny, with")
+	printf("               prefix@listener as for --allow (default none)")
+	printf("--acl-policy=pol")
+	printf("               action for packets from denied sources (default %s):",
+		DefaultACLPolicy)
+	printf("               close: send a close reply to opens, drop others")
+	printf("               drop: drop all packets before parsing them")
+	printf("--ban-rate=#   ban sources with more than # dropped packets per second,")
+	printf("               averaged over %s, dropping their packets before parsing", banBurst)
+	printf("               them, or 0 to not ban sources (default 0)")
+	printf("--ban-time=dur duration of first bans, which double for each further ban")
+	printf("               of a source, up to %s (default %s)", maxBanTime,
+		DefaultBanTime)
+	printf("--max-bitrate=rate")
+	printf("               max bitrate of echo replies for the whole server, in bits")
+	printf("               per second with optional K, M or G suffix (multiples of")
+	printf("               1000), or 0 for no limit (default 0)")
+	printf("--listener-bitrate=rate")
+	printf("               max bitrate of echo replies for each listener, in the same")
+	printf("               format as --max-bitrate (default 0)")
+	printf("--bitrate-policy=pol")
+	printf("               action for bitrate limits (default %s):", DefaultBitratePolicy)
+	printf("               drop: drop replies over the limits")
+	printf("               restrict: increase the interval, or reduce the length, of")
+	printf("               new connections to fit within the limits, and refuse them")
+	printf("               if they can't fit (replies over the limits still dropped)")
 	printf("--tstamp=modes timestamp modes to allow (default %s)", DefaultAllowStamp)
 	printf("               none: don't allow timestamps")
 	printf("               single: allow a single timestamp (send, receive or midpoint)")
 	printf("               dual: allow dual timestamps")
 	printf("--no-dscp      don't allow setting dscp (default %t)", !DefaultAllowDSCP)
+	printf("--no-recv-tos  don't allow reporting received DSCP/ECN (TOS) values")
+	printf("               (default %t)", !DefaultAllowReceivedTOS)
 	printf("-4             IPv4 only")
 	printf("-6             IPv6 only")
 	printf("--set-src-ip   set source IP address on all outgoing packets from listeners")
 	printf("               on unspecified IP addresses (use for more reliable reply")
 	printf("               routing, but increases per-packet heap allocations)")
 	printf("--thread       lock request handling goroutines to OS threads")
+	printf("--metrics=addr serve metrics and health check over HTTP on addr (e.g.")
+	printf("               localhost:9112, default none), with paths:")
+	printf("               /metrics: OpenMetrics (Prometheus) counters and gauges")
+	printf("               /healthz: 200 if any listener is up, 503 otherwise")
+	printf("--ctl=path     create a Unix domain control socket at path for the ctl")
+	printf("               command (default none, ctl uses %s)", DefaultControlSocket)
+	printf("--config=file  read settings from a JSON config file, with flag long names")
+	printf("               as keys, or bind, max-duration, min-interval, max-length,")
+	printf("               ipv4 and ipv6 for flags with only short names, e.g.:")
+	printf("               {\"bind\": [\"a\", \"b\"], \"timeout\": \"1m\", \"no-dscp\": true}")
+	printf("               flags on the command line take precedence")
 	printf("-h             show help")
 	printf("-v             show version")
 	printf("")
+	printf("If UDP sockets are passed with systemd socket activation (LISTEN_FDS), the")
+	printf("server listens on those instead of the bind addresses, and -b may not be used.")
+	printf("")
+	printf("On SIGUSR2, the server starts its executable again and hands off its sockets")
+	printf("and connections to the new process, so tests in progress continue.")
+	printf("")
+	printf("On SIGHUP, the server re-reads the config file and applies any changes,")
+	printf("adding or removing listeners, changing limits and rotating the HMAC key,")
+	printf("without dropping tests in progress.")
+	printf("")
 	hostUsage()
 	printf("")
 	durationUsage()
 }
 
-// runServerCLI runs the server command line interface.
-func runServerCLI(args []string) {
+// serverConfigAliases are the config file names for flags with only short
+// names.
+var serverConfigAliases = map[string]string{
+	"bind":         "b",
+	"max-duration": "d",
+	"min-interval": "i",
+	"max-length":   "l",
+	"ipv4":         "4",
+	"ipv6":         "6",
+}
+
+// serverCLIConfig is the server configuration from the command line and
+// config file.
+type serverCLIConfig struct {
+	*ServerConfig
+	configFile  string
+	syslog      string
+	eventWindow time.Duration
+	eventRate   float64
+	explicit    map[string]bool
+	version     bool
+}
+
+// parseServerArgs parses the server command line, and the config file if one
+// is given, with flags on the command line taking precedence.
+func parseServerArgs(args []string) (*serverCLIConfig, error) {
 	// server flags
 	fs := flag.NewFlagSet("server", 0)
 	fs.Usage = func() {
 		usageAndExit(serverUsage, exitCodeBadCommandLine)
 	}
+	var configFile = fs.String("config", "", "config file")
 	var baddrsStr = fs.StringP("b", "b", strings.Join(DefaultBindAddrs, ","), "bind addresses")
 	var maxDuration = fs.DurationP("d", "d", DefaultMaxDuration, "max duration")
 	var minInterval = fs.DurationP("i", "i", DefaultMinInterval, "min interval")
@@ -90,7 +216,16 @@ func runServerCLI(args []string) {
 	if syslogSupport {
 		syslogStr = fs.String("syslog", "", "syslog uri")
 	}
+	var eventWindow = fs.Duration("event-window", 0, "event window")
+	var eventRateStr = fs.String("event-rate", "0", "event rate")
 	var timeout = fs.Duration("timeout", DefaultServerTimeout, "timeout")
+	var openTimeout = fs.Duration("open-timeout", DefaultOpenTimeout, "open timeout")
+	var openRateStr = fs.String("open-rate", "0", "max open rate")
+	var maxConns = fs.Int("max-conns", 0, "max conns")
+	var lMaxConns = fs.Int("listener-conns", 0, "listener max conns")
+	var connsPolicyStr = fs.String("conns-policy", DefaultConnLimitPolicy.String(),
+		"conns policy")
+	var grace = fs.Duration("grace", DefaultShutdownGrace, "shutdown grace")
 	var packetBurst = fs.Int("pburst", DefaultPacketBurst, "packet burst")
 	var fillStr = fs.String("fill", DefaultServerFiller.String(), "fill")
 	var allowFillsStr = fs.String("allow-fills", strings.Join(DefaultAllowFills, ","), "sfill")
@@ -98,20 +233,41 @@ func runServerCLI(args []string) {
 	var ipv6 = fs.BoolP("6", "6", false, "IPv6 only")
 	var ttl = fs.Int("ttl", DefaultTTL, "IP time to live")
 	var noDSCP = fs.Bool("no-dscp", !DefaultAllowDSCP, "no DSCP")
+	var noRecvTOS = fs.Bool("no-recv-tos", !DefaultAllowReceivedTOS, "no received TOS")
 	var setSrcIP = fs.Bool("set-src-ip", DefaultSetSrcIP, "set source IP")
 	var lockOSThread = fs.Bool("thread", DefaultThreadLock, "thread")
+	var metricsAddr = fs.String("metrics", "", "metrics address")
+	var ctlPath = fs.String("ctl", "", "control socket")
+	var ipLimitStr = fs.String("ip-limit", "", "per-IP limit")
+	var prefixLimitStr = fs.String("prefix-limit", "", "per-prefix limit")
+	var allowStr = fs.String("allow", "", "allowed prefixes")
+	var denyStr = fs.String("deny", "", "denied prefixes")
+	var aclPolicyStr = fs.String("acl-policy", DefaultACLPolicy.String(),
+		"ACL policy")
+	var banRateStr = fs.String("ban-rate", "0", "ban rate")
+	var banTime = fs.Duration("ban-time", DefaultBanTime, "ban time")
+	var maxBitrateStr = fs.String("max-bitrate", "0", "max bitrate")
+	var lMaxBitrateStr = fs.String("listener-bitrate", "0", "listener max bitrate")
+	var bitratePolicyStr = fs.String("bitrate-policy", DefaultBitratePolicy.String(),
+		"bitrate policy")
 	var version = fs.BoolP("version", "v", false, "version")
 	fs.Parse(args)
-
-	// start profiling, if enabled in build
-	if profileEnabled {
-		defer startProfile("./server.pprof").Stop()
+	sc := &serverCLIConfig{
+		configFile: *configFile,
+		explicit:   explicitFlags(fs),
+		version:    *version,
 	}
 
-	// version
-	if *version {
-		runVersion(args)
-		os.Exit(0)
+	// apply config file
+	if *configFile != "" {
+		settings, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		err = setFlags(fs, settings, serverConfigAliases, sc.explicit)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: %s", *configFile, err)
+		}
 	}
 
 	// determine IP version
@@ -119,27 +275,106 @@ func runServerCLI(args []string) {
 
 	// parse allow stamp string
 	allowStamp, err := ParseAllowStamp(*allowTimestampStr)
-	exitOnError(err, exitCodeBadCommandLine)
+	if err != nil {
+		return nil, err
+	}
 
 	// parse fill
 	filler, err := NewFiller(*fillStr)
-	exitOnError(err, exitCodeBadCommandLine)
+	if err != nil {
+		return nil, err
+	}
 
 	// parse HMAC key
 	var hmacKey []byte
 	if *hmacStr != "" {
 		hmacKey, err = decodeHexOrNot(*hmacStr)
-		exitOnError(err, exitCodeBadCommandLine)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// create event handler with console handler as default
-	handler := &MultiHandler{[]Handler{&consoleHandler{}}}
+	// parse source limits, per IP and per prefix
+	var sourceLimits []SourceLimit
+	for _, sl := range []struct {
+		s                string
+		prefix4, prefix6 int
+	}{
+		{*ipLimitStr, 32, 128},
+		{*prefixLimitStr, DefaultLimitPrefix4, DefaultLimitPrefix6},
+	} {
+		if sl.s == "" {
+			continue
+		}
+		lim, err := ParseSourceLimit(sl.s, sl.prefix4, sl.prefix6)
+		if err != nil {
+			return nil, err
+		}
+		sourceLimits = append(sourceLimits, *lim)
+	}
 
-	// add syslog event handler
-	if syslogStr != nil && *syslogStr != "" {
-		sh, err := newSyslogHandler(*syslogStr)
-		exitOnError(err, exitCodeRuntimeError)
-		handler.AddHandler(sh)
+	// parse open rate
+	openRate, err := parseRate(*openRateStr)
+	if err != nil || openRate < 0 {
+		return nil, fmt.Errorf("invalid open rate %s", *openRateStr)
+	}
+
+	// parse connection limits
+	if *maxConns < 0 || *lMaxConns < 0 {
+		return nil, fmt.Errorf("max connections may not be negative")
+	}
+	connsPolicy, err := ParseConnLimitPolicy(*connsPolicyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// parse ACLs
+	acl, listenerACLs, err := parseACLs(*allowStr, *denyStr)
+	if err != nil {
+		return nil, err
+	}
+	aclPolicy, err := ParseACLPolicy(*aclPolicyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// parse ban rate and time
+	banRate, err := parseRate(*banRateStr)
+	if err != nil || banRate < 0 {
+		return nil, fmt.Errorf("invalid ban rate %s", *banRateStr)
+	}
+	if *banTime <= 0 {
+		return nil, fmt.Errorf("ban time must be positive")
+	}
+
+	// parse bitrate limits
+	maxBitrate, err := ParseBitrate(*maxBitrateStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max bitrate %s (%s)", *maxBitrateStr, err)
+	}
+	lMaxBitrate, err := ParseBitrate(*lMaxBitrateStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listener max bitrate %s (%s)",
+			*lMaxBitrateStr, err)
+	}
+	bitratePolicy, err := ParseBitratePolicy(*bitratePolicyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// get syslog URI
+	if syslogStr != nil {
+		sc.syslog = *syslogStr
+	}
+
+	// parse event aggregation
+	if *eventWindow < 0 {
+		return nil, fmt.Errorf("event window may not be negative")
+	}
+	sc.eventWindow = *eventWindow
+	sc.eventRate, err = parseRate(*eventRateStr)
+	if err != nil || sc.eventRate < 0 {
+		return nil, fmt.Errorf("invalid event rate %s", *eventRateStr)
 	}
 
 	// create server config
@@ -150,16 +385,75 @@ func runServerCLI(args []string) {
 	cfg.AllowStamp = allowStamp
 	cfg.HMACKey = hmacKey
 	cfg.Timeout = *timeout
+	cfg.OpenTimeout = *openTimeout
+	cfg.MaxOpenRate = openRate
+	cfg.MaxConns = *maxConns
+	cfg.ListenerMaxConns = *lMaxConns
+	cfg.ConnLimitPolicy = connsPolicy
+	cfg.ShutdownGrace = *grace
 	cfg.PacketBurst = *packetBurst
 	cfg.MaxLength = *maxLength
 	cfg.Filler = filler
 	cfg.AllowFills = strings.Split(*allowFillsStr, ",")
 	cfg.AllowDSCP = !*noDSCP
+	cfg.AllowReceivedTOS = !*noRecvTOS
 	cfg.TTL = *ttl
-	cfg.Handler = handler
 	cfg.IPVersion = ipVer
 	cfg.SetSrcIP = *setSrcIP
 	cfg.ThreadLock = *lockOSThread
+	cfg.MetricsAddr = *metricsAddr
+	cfg.ControlSocket = *ctlPath
+	cfg.SourceLimits = sourceLimits
+	cfg.ACL = acl
+	cfg.ListenerACLs = listenerACLs
+	cfg.ACLPolicy = aclPolicy
+	cfg.BanRate = banRate
+	cfg.BanTime = *banTime
+	cfg.MaxBitrate = maxBitrate
+	cfg.ListenerMaxBitrate = lMaxBitrate
+	cfg.BitratePolicy = bitratePolicy
+	sc.ServerConfig = cfg
+	return sc, nil
+}
+
+// runServerCLI runs the server command line interface.
+func runServerCLI(args []string) {
+	sc, err := parseServerArgs(args)
+	exitOnError(err, exitCodeBadCommandLine)
+
+	// start profiling, if enabled in build
+	if profileEnabled {
+		defer startProfile("./server.pprof").Stop()
+	}
+
+	// version
+	if sc.version {
+		runVersion(args)
+		os.Exit(0)
+	}
+
+	// create event handler with console handler as default
+	handler := &MultiHandler{[]Handler{&consoleHandler{}}}
+
+	// add syslog event handler
+	if sc.syslog != "" {
+		sh, err := newSyslogHandler(sc.syslog)
+		exitOnError(err, exitCodeRuntimeError)
+		handler.AddHandler(sh)
+	}
+
+	// merge and limit events before the other handlers
+	agg := NewAggregateHandler(handler, sc.eventWindow, sc.eventRate)
+	cfg := sc.ServerConfig
+	cfg.Handler = agg
+
+	// use sockets passed with socket activation, if any
+	cfg.Conns, err = ActivationConns()
+	exitOnError(err, exitCodeRuntimeError)
+	if len(cfg.Conns) > 0 && sc.explicit["b"] {
+		exitOnError(fmt.Errorf("-b may not be used with socket activation"),
+			exitCodeBadCommandLine)
+	}
 
 	// create server
 	s := NewServer(cfg)
@@ -176,6 +470,110 @@ func runServerCLI(args []string) {
 		os.Exit(exitCodeDoubleSignal)
 	}()
 
+	// install signal handler to upgrade server
+	if len(upgradeSignals) > 0 {
+		usigs := make(chan os.Signal, 1)
+		signal.Notify(usigs, upgradeSignals...)
+		go func() {
+			for range usigs {
+				if err := s.Upgrade(); err != nil {
+					handler.OnEvent(Eventf(UpgradeError, nil, nil,
+						"upgrade failed, continuing (%s)", err))
+				}
+			}
+		}()
+	}
+
+	// install signal handler to reload config file
+	if len(reloadSignals) > 0 && sc.configFile != "" {
+		rsigs := make(chan os.Signal, 1)
+		signal.Notify(rsigs, reloadSignals...)
+		go func() {
+			for range rsigs {
+				if err := reloadServer(s, sc, args); err != nil {
+					handler.OnEvent(Eventf(ConfigReloadError, nil, nil,
+						"unable to reload %s, continuing (%s)", sc.configFile, err))
+				}
+			}
+		}()
+	}
+
 	err = s.ListenAndServe()
+	agg.Flush()
 	exitOnError(err, exitCodeRuntimeError)
 }
+
+// reloadServer re-reads the config file and reloads the server.
+func reloadServer(s *Server, sc *serverCLIConfig, args []string) error {
+	rc, err := parseServerArgs(args)
+	if err != nil {
+		return err
+	}
+	if rc.syslog != sc.syslog {
+		sc.Handler.OnEvent(Eventf(ConfigReloadError, nil, nil,
+			"changes to syslog require a restart"))
+	}
+	rc.Handler = sc.Handler
+	if err := s.Reload(rc.ServerConfig); err != nil {
+		return err
+	}
+	if a, ok := sc.Handler.(*AggregateHandler); ok {
+		a.SetLimits(rc.eventWindow, rc.eventRate)
+	}
+	return nil
+}
+
+// parseACLs parses the global ACL and the ACLs for each listener from comma
+// separated lists of allowed and denied prefixes. Prefixes for one listener are
+// given as prefix@listener.
+func parseACLs(allow, deny string) (acl ACL, listenerACLs map[string]ACL,
+	err error) {
+	add := func(list string, allow bool) error {
+		if list == "" {
+			return nil
+		}
+		for _, s := range strings.Split(list, ",") {
+			ps, laddr, per := strings.Cut(s, "@")
+			n, err := ParseACLPrefix(ps)
+			if err != nil {
+				return err
+			}
+			a := acl
+			if per {
+				if laddr, err = normalizeListenAddr(laddr); err != nil {
+					return err
+				}
+				if listenerACLs == nil {
+					listenerACLs = make(map[string]ACL)
+				}
+				a = listenerACLs[laddr]
+			}
+			if allow {
+				a.Allow = append(a.Allow, n)
+			} else {
+				a.Deny = append(a.Deny, n)
+			}
+			if per {
+				listenerACLs[laddr] = a
+			} else {
+				acl = a
+			}
+		}
+		return nil
+	}
+	if err = add(allow, true); err != nil {
+		return
+	}
+	err = add(deny, false)
+	return
+}
+
+// normalizeListenAddr returns a listener address in the form used for
+// listener ACLs.
+func normalizeListenAddr(s string) (string, error) {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid listener address %s (%s)", s, err)
+	}
+	return ap.String(), nil
+}
@@ -0,0 +1,220 @@
+package irtt
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonlWriter writes JSON Lines (one JSON object per line) to stdout or a
+// file, which may be rotated by size and/or age. Files are written
+// uncompressed while active so they may be followed during a test, and if gz
+// is set, are gzipped in the background when rotated or closed. Each file
+// starts with a header line.
+type jsonlWriter struct {
+	base    string
+	gz      bool
+	maxSize int64
+	maxAge  time.Duration
+	header  func() interface{}
+	out     io.Writer
+	f       *os.File
+	w       *bufio.Writer
+	name    string
+	size    int64
+	opened  time.Time
+	flushed time.Time
+	gzwg    sync.WaitGroup
+	gzerr   error
+	gzmtx   sync.Mutex
+}
+
+// newJSONLWriter returns a new jsonlWriter for the output, which follows the
+// same gzip conventions as writeResultJSON, but with the .jsonl extension.
+func newJSONLWriter(output string, maxSize int64, maxAge time.Duration,
+	header func() interface{}) *jsonlWriter {
+	w := &jsonlWriter{
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		header:  header,
+	}
+	if output == "-" {
+		w.out = os.Stdout
+		return w
+	}
+	w.gz = true
+	switch {
+	case strings.HasSuffix(output, ".jsonl"):
+		w.gz = false
+		output = strings.TrimSuffix(output, ".jsonl")
+	case strings.HasSuffix(output, ".json"):
+		w.gz = false
+		output = strings.TrimSuffix(output, ".json")
+	case strings.HasSuffix(output, ".gz"):
+		output = strings.TrimSuffix(output, ".gz")
+		output = strings.TrimSuffix(output, ".jsonl")
+		output = strings.TrimSuffix(output, ".json")
+	}
+	w.base = output
+	return w
+}
+
+// rotates returns true if files are rotated.
+func (w *jsonlWriter) rotates() bool {
+	return w.maxSize > 0 || w.maxAge > 0
+}
+
+// open opens a new file and writes the header.
+func (w *jsonlWriter) open() (err error) {
+	now := time.Now()
+	if w.out != nil {
+		w.w = bufio.NewWriter(w.out)
+	} else {
+		name := w.base + ".jsonl"
+		if w.rotates() {
+			ts := now.Format("20060102-150405")
+			name = fmt.Sprintf("%s-%s.jsonl", w.base, ts)
+			for i := 1; fileExists(name) || fileExists(name+".gz"); i++ {
+				name = fmt.Sprintf("%s-%s-%d.jsonl", w.base, ts, i)
+			}
+		}
+		if w.f, err = os.Create(name); err != nil {
+			return
+		}
+		w.name = name
+		w.w = bufio.NewWriter(w.f)
+	}
+	w.size = 0
+	w.opened = now
+	w.flushed = now
+	if w.header != nil {
+		err = w.writeLine(w.header())
+	}
+	return
+}
+
+// write writes an object with the given key and value as a line, rotating the
+// file first if needed.
+func (w *jsonlWriter) write(key string, v interface{}) (err error) {
+	if w.w == nil {
+		if err = w.open(); err != nil {
+			return
+		}
+	} else if w.out == nil && ((w.maxSize > 0 && w.size >= w.maxSize) ||
+		(w.maxAge > 0 && time.Since(w.opened) >= w.maxAge)) {
+		if err = w.closeFile(); err != nil {
+			return
+		}
+		if err = w.open(); err != nil {
+			return
+		}
+	}
+	if err = w.writeLine(map[string]interface{}{key: v}); err != nil {
+		return
+	}
+	if time.Since(w.flushed) >= flushInterval {
+		w.flushed = time.Now()
+		err = w.w.Flush()
+	}
+	return
+}
+
+func (w *jsonlWriter) writeLine(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	n, err := w.w.Write(b)
+	w.size += int64(n)
+	return err
+}
+
+// closeFile closes the current file, and gzips it in the background.
+func (w *jsonlWriter) closeFile() error {
+	err := w.w.Flush()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	w.w = nil
+	if err != nil {
+		return err
+	}
+	if w.gz {
+		name := w.name
+		w.gzwg.Add(1)
+		go func() {
+			defer w.gzwg.Done()
+			if err := gzipFile(name); err != nil {
+				w.gzmtx.Lock()
+				w.gzerr = err
+				w.gzmtx.Unlock()
+			}
+		}()
+	}
+	return w.gzError()
+}
+
+func (w *jsonlWriter) gzError() error {
+	w.gzmtx.Lock()
+	defer w.gzmtx.Unlock()
+	return w.gzerr
+}
+
+// close flushes output, closes any open file, and waits for any gzips to
+// complete.
+func (w *jsonlWriter) close() (err error) {
+	if w.out != nil {
+		if w.w != nil {
+			err = w.w.Flush()
+		}
+		return
+	}
+	if w.w != nil {
+		err = w.closeFile()
+	}
+	w.gzwg.Wait()
+	if err == nil {
+		err = w.gzError()
+	}
+	return
+}
+
+// gzipFile gzips a file to the same name with .gz appended, and removes the
+// original.
+func gzipFile(name string) (err error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(name + ".gz")
+	if err != nil {
+		return
+	}
+	gzw := gzip.NewWriter(out)
+	if _, err = io.Copy(gzw, in); err != nil {
+		out.Close()
+		return
+	}
+	if err = gzw.Close(); err != nil {
+		out.Close()
+		return
+	}
+	if err = out.Close(); err != nil {
+		return
+	}
+	return os.Remove(name)
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,586 @@
+package irtt
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SourceLimit limits the concurrent connections and request rates of each
+// client source IP, or each prefix of source IPs. The packet and byte rates
+// allow bursts of up to one second.
+type SourceLimit struct {
+	// Prefix4 is the IPv4 prefix length that sources are grouped by (32 for
+	// each IP).
+	Prefix4 int
+
+	// Prefix6 is the IPv6 prefix length that sources are grouped by (128 for
+	// each IP).
+	Prefix6 int
+
+	// Conns is the max number of concurrent connections, or 0 for no limit.
+	Conns int
+
+	// Packets is the max number of requests per second, or 0 for no limit.
+	Packets float64
+
+	// Bytes is the max number of request bytes per second, or 0 for no limit.
+	Bytes float64
+
+	// Opens is the max number of open requests per second, or 0 for no limit.
+	Opens float64
+}
+
+// ParseSourceLimit parses a SourceLimit from a comma separated list of
+// key=value settings, with the keys conns, packets (per second), bytes (per
+// second), opens (per second), prefix4 and prefix6. Rates may have a K, M or G
+// suffix (multiples of 1000). If not given, the prefix lengths are prefix4 and
+// prefix6.
+func ParseSourceLimit(s string, prefix4, prefix6 int) (*SourceLimit, error) {
+	l := &SourceLimit{Prefix4: prefix4, Prefix6: prefix6}
+	for _, kv := range strings.Split(s, ",") {
+		kvs := strings.SplitN(kv, "=", 2)
+		if len(kvs) != 2 {
+			return nil, Errorf(InvalidSourceLimit,
+				"invalid source limit setting %s (use key=value)", kv)
+		}
+		var err error
+		switch k, v := kvs[0], kvs[1]; k {
+		case "conns":
+			l.Conns, err = strconv.Atoi(v)
+		case "packets":
+			l.Packets, err = parseRate(v)
+		case "bytes":
+			l.Bytes, err = parseRate(v)
+		case "opens":
+			l.Opens, err = parseRate(v)
+		case "prefix4":
+			l.Prefix4, err = strconv.Atoi(v)
+			if err == nil && (l.Prefix4 < 0 || l.Prefix4 > 32) {
+				err = fmt.Errorf("out of range")
+			}
+		case "prefix6":
+			l.Prefix6, err = strconv.Atoi(v)
+			if err == nil && (l.Prefix6 < 0 || l.Prefix6 > 128) {
+				err = fmt.Errorf("out of range")
+			}
+		default:
+			return nil, Errorf(InvalidSourceLimit, "unknown source limit %s", k)
+		}
+		if err == nil && (l.Conns < 0 || l.Packets < 0 || l.Bytes < 0 ||
+			l.Opens < 0) {
+			err = fmt.Errorf("negative value")
+		}
+		if err != nil {
+			return nil, Errorf(InvalidSourceLimit,
+				"invalid value for source limit %s (%s)", kv, err)
+		}
+	}
+	return l, nil
+}
+
+// parseRate parses a finite rate with an optional K, M or G suffix, in either
+// case.
+func parseRate(s string) (float64, error) {
+	m := 1.0
+	switch {
+	case strings.HasSuffix(s, "K"), strings.HasSuffix(s, "k"):
+		m = 1e3
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		m = 1e6
+	case strings.HasSuffix(s, "G"), strings.HasSuffix(s, "g"):
+		m = 1e9
+	}
+	if m > 1 {
+		s = s[:len(s)-1]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid rate %s", s)
+	}
+	return f * m, nil
+}
+
+func (l *SourceLimit) String() string {
+	return fmt.Sprintf(
+		"conns=%d,packets=%g,bytes=%g,opens=%g,prefix4=%d,prefix6=%d",
+		l.Conns, l.Packets, l.Bytes, l.Opens, l.Prefix4, l.Prefix6)
+}
+
+// prefix returns ip masked to the limit's prefix length, and its length.
+func (l *SourceLimit) prefix(ip net.IP) (net.IP, int) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.Prefix4, 32)), l.Prefix4
+	}
+	return ip.Mask(net.CIDRMask(l.Prefix6, 128)), l.Prefix6
+}
+
+// sourceLimiter enforces SourceLimits for all listeners, with the state for
+// each source kept separately for each limit. It also enforces the server-wide
+// open rate.
+type sourceLimiter struct {
+	limits       []SourceLimit
+	sources      []map[string]*sourceState
+	lastSweep    time.Time
+	openRate     float64
+	opens        float64
+	opensUpdated time.Time
+	now          func() time.Time
+	mtx          sync.Mutex
+}
+
+// sourceState is the state of a source for a limit. The token buckets may go
+// negative, so packets larger than the byte rate are still allowed, and the
+// average rate is kept.
+type sourceState struct {
+	conns   int
+	packets float64
+	bytes   float64
+	opens   float64
+	updated time.Time
+}
+
+func newSourceLimiter(limits []SourceLimit, openRate float64) *sourceLimiter {
+	sl := &sourceLimiter{now: time.Now}
+	sl.setLimits(limits, openRate)
+	return sl
+}
+
+// setLimits sets new limits and the server-wide open rate. The token buckets
+// are kept, so they aren't refilled by a reload, including the source state of
+// each previous limit with the same prefix lengths as a new limit. Conn counts
+// are cleared, and must be counted again with addConn.
+func (sl *sourceLimiter) setLimits(limits []SourceLimit, openRate float64) {
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	sl.openRate = openRate
+	if sl.opensUpdated.IsZero() {
+		sl.opens = openRate
+		sl.opensUpdated = sl.now()
+	}
+	prev, prevSources := sl.limits, sl.sources
+	sl.limits = limits
+	sl.sources = make([]map[string]*sourceState, len(limits))
+	for i := range sl.sources {
+		for j := range prev {
+			if prevSources[j] != nil && prev[j].Prefix4 == limits[i].Prefix4 &&
+				prev[j].Prefix6 == limits[i].Prefix6 {
+				sl.sources[i] = prevSources[j]
+				prevSources[j] = nil
+				break
+			}
+		}
+		if sl.sources[i] == nil {
+			sl.sources[i] = make(map[string]*sourceState)
+			continue
+		}
+		for _, st := range sl.sources[i] {
+			st.conns = 0
+		}
+	}
+}
+
+// state returns the state for a source for the limit at index i, creating it
+// if necessary and refilling its token buckets. It must be called with mtx
+// held.
+func (sl *sourceLimiter) state(i int, ip net.IP, now time.Time) *sourceState {
+	if now.Sub(sl.lastSweep) > sourceSweepInterval {
+		sl.sweep(now)
+	}
+	l := &sl.limits[i]
+	pfx, _ := l.prefix(ip)
+	st := sl.sources[i][string(pfx)]
+	if st == nil {
+		st = &sourceState{packets: l.Packets, bytes: l.Bytes, opens: l.Opens,
+			updated: now}
+		sl.sources[i][string(pfx)] = st
+		return st
+	}
+	dt := now.Sub(st.updated).Seconds()
+	st.packets = refill(st.packets, l.Packets, dt)
+	st.bytes = refill(st.bytes, l.Bytes, dt)
+	st.opens = refill(st.opens, l.Opens, dt)
+	st.updated = now
+	return st
+}
+
+func refill(tokens, rate, dt float64) float64 {
+	if tokens += rate * dt; tokens > rate {
+		tokens = rate
+	}
+	return tokens
+}
+
+// sweep removes the state for sources with no conns, that have been idle long
+// enough for their token buckets to be full. It must be called with mtx held.
+func (sl *sourceLimiter) sweep(now time.Time) {
+	for _, m := range sl.sources {
+		for k, st := range m {
+			if st.conns == 0 && now.Sub(st.updated) > sourceSweepInterval {
+				delete(m, k)
+			}
+		}
+	}
+	sl.lastSweep = now
+}
+
+// allowConn returns an empty string if a new conn from ip is allowed, or a
+// description of the limit that was reached otherwise.
+func (sl *sourceLimiter) allowConn(ip net.IP) string {
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	now := sl.now()
+	for i := range sl.limits {
+		l := &sl.limits[i]
+		if l.Conns == 0 {
+			continue
+		}
+		if st := sl.state(i, ip, now); st.conns >= l.Conns {
+			pfx, n := l.prefix(ip)
+			return fmt.Sprintf("%d connections from %s/%d", st.conns, pfx, n)
+		}
+	}
+	return ""
+}
+
+// addConn counts a new conn from ip.
+func (sl *sourceLimiter) addConn(ip net.IP) {
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	now := sl.now()
+	for i := range sl.limits {
+		sl.state(i, ip, now).conns++
+	}
+}
+
+// removeConn stops counting a conn from ip.
+func (sl *sourceLimiter) removeConn(ip net.IP) {
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	now := sl.now()
+	for i := range sl.limits {
+		if st := sl.state(i, ip, now); st.conns > 0 {
+			st.conns--
+		}
+	}
+}
+
+// allowOpen returns an OpenRateLimited error if an open from ip would exceed
+// the server-wide open rate, or a SourceOpenLimit error if it would exceed the
+// open rate of any limit. Otherwise, the open is counted.
+func (sl *sourceLimiter) allowOpen(ip net.IP) error {
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	now := sl.now()
+	if sl.openRate > 0 {
+		sl.opens = refill(sl.opens, sl.openRate,
+			now.Sub(sl.opensUpdated).Seconds())
+		sl.opensUpdated = now
+		if sl.opens < 0 {
+			return Errorf(OpenRateLimited, "over server open rate limit (%g/s)",
+				sl.openRate)
+		}
+	}
+	var sts []*sourceState
+	for i := range sl.limits {
+		l := &sl.limits[i]
+		if l.Opens == 0 {
+			continue
+		}
+		st := sl.state(i, ip, now)
+		if st.opens < 0 {
+			pfx, n := l.prefix(ip)
+			return Errorf(SourceOpenLimit,
+				"over open rate limit for %s/%d (%g/s)", pfx, n, l.Opens)
+		}
+		sts = append(sts, st)
+	}
+	if sl.openRate > 0 {
+		sl.opens--
+	}
+	for _, st := range sts {
+		st.opens--
+	}
+	return nil
+}
+
+// allowRequest returns an error if a request of length n from ip would exceed
+// the packet or byte rate of any limit. Otherwise, the request is counted.
+func (sl *sourceLimiter) allowRequest(ip net.IP, n int) error {
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	if len(sl.limits) == 0 {
+		return nil
+	}
+	now := sl.now()
+	sts := make([]*sourceState, len(sl.limits))
+	for i := range sl.limits {
+		l := &sl.limits[i]
+		st := sl.state(i, ip, now)
+		if l.Packets > 0 && st.packets < 0 {
+			pfx, n := l.prefix(ip)
+			return Errorf(SourcePacketLimit,
+				"over packet rate limit for %s/%d (%g/s)", pfx, n, l.Packets)
+		}
+		if l.Bytes > 0 && st.bytes < 0 {
+			pfx, n := l.prefix(ip)
+			return Errorf(SourceByteLimit,
+				"over byte rate limit for %s/%d (%g/s)", pfx, n, l.Bytes)
+		}
+		sts[i] = st
+	}
+	for _, st := range sts {
+		st.packets--
+		st.bytes -= float64(n)
+	}
+	return nil
+}
+
+// ConnLimitPolicy selects what the server does with a new conn when the max
+// number of conns is reached.
+type ConnLimitPolicy int
+
+// ConnLimitPolicy constants.
+const (
+	// ConnLimitReject refuses new conns with a close reply.
+	ConnLimitReject ConnLimitPolicy = iota
+
+	// ConnLimitEvict closes the least recently used conn on the listener, if it
+	// has any, to make room for the new one.
+	ConnLimitEvict
+)
+
+var clps = [...]string{"reject", "evict"}
+
+func (cp ConnLimitPolicy) String() string {
+	if int(cp) < 0 || int(cp) >= len(clps) {
+		return fmt.Sprintf("ConnLimitPolicy:%d", cp)
+	}
+	return clps[cp]
+}
+
+// ParseConnLimitPolicy returns a ConnLimitPolicy from a string.
+func ParseConnLimitPolicy(s string) (ConnLimitPolicy, error) {
+	for i, v := range clps {
+		if s == v {
+			return ConnLimitPolicy(i), nil
+		}
+	}
+	return ConnLimitReject, Errorf(InvalidConnLimitPolicy,
+		"invalid ConnLimitPolicy string: %s", s)
+}
+
+// BitratePolicy selects what the server does to stay within its bitrate
+// limits.
+type BitratePolicy int
+
+// BitratePolicy constants.
+const (
+	// BitrateDrop drops echo replies that would exceed the bitrate limits.
+	BitrateDrop BitratePolicy = iota
+
+	// BitrateRestrict restricts the interval, or if necessary the length, of new
+	// conns so that the bitrate of all conns fits within the bitrate limits, and
+	// refuses new conns that can't fit. Replies that would still exceed the
+	// limits are dropped.
+	BitrateRestrict
+)
+
+var bps = [...]string{"drop", "restrict"}
+
+func (bp BitratePolicy) String() string {
+	if int(bp) < 0 || int(bp) >= len(bps) {
+		return fmt.Sprintf("BitratePolicy:%d", bp)
+	}
+	return bps[bp]
+}
+
+// ParseBitratePolicy returns a BitratePolicy from a string.
+func ParseBitratePolicy(s string) (BitratePolicy, error) {
+	for i, v := range bps {
+		if s == v {
+			return BitratePolicy(i), nil
+		}
+	}
+	return BitrateDrop, Errorf(InvalidBitratePolicy,
+		"invalid BitratePolicy string: %s", s)
+}
+
+// ParseBitrate parses a Bitrate in bits per second, with an optional K, M or G
+// suffix (multiples of 1000).
+func ParseBitrate(s string) (Bitrate, error) {
+	r, err := parseRate(s)
+	if err != nil {
+		return 0, err
+	}
+	if r < 0 {
+		return 0, fmt.Errorf("negative bitrate %s", s)
+	}
+	return Bitrate(r), nil
+}
+
+// bitrateLimiter is a token bucket for the bitrate of echo replies, which
+// allows bursts of up to bitrateBurst. The bucket may go negative, so replies
+// larger than the burst are still sent, and the average rate is kept. It also
+// keeps the total bitrate reserved by conns, for BitrateRestrict.
+type bitrateLimiter struct {
+	rate     float64
+	tokens   float64
+	updated  time.Time
+	reserved float64
+	mtx      sync.Mutex
+}
+
+func newBitrateLimiter(rate Bitrate) *bitrateLimiter {
+	bl := &bitrateLimiter{}
+	bl.setRate(rate)
+	return bl
+}
+
+// setRate sets the bitrate limit, or 0 for no limit.
+func (bl *bitrateLimiter) setRate(rate Bitrate) {
+	bl.mtx.Lock()
+	defer bl.mtx.Unlock()
+	bl.rate = float64(rate)
+	bl.tokens = bl.burst()
+	bl.updated = time.Now()
+}
+
+func (bl *bitrateLimiter) burst() float64 {
+	return bl.rate * bitrateBurst.Seconds()
+}
+
+// available returns the bitrate not yet reserved, or +Inf if there's no limit.
+// It must be called with mtx held.
+func (bl *bitrateLimiter) available() float64 {
+	if bl.rate == 0 {
+		return math.Inf(1)
+	}
+	return bl.rate - bl.reserved
+}
+
+// lockBitrate locks the bitrate limiters of the listener and server, in that
+// order, and returns them.
+func (l *listener) lockBitrate() []*bitrateLimiter {
+	bls := []*bitrateLimiter{l.bitrate, l.srvBitrate}
+	for _, bl := range bls {
+		bl.mtx.Lock()
+	}
+	return bls
+}
+
+func unlockBitrate(bls []*bitrateLimiter) {
+	for i := len(bls) - 1; i >= 0; i-- {
+		bls[i].mtx.Unlock()
+	}
+}
+
+// allowBitrate returns true if a reply of n bytes is within the listener and
+// server bitrate limits, in which case it's counted.
+func (l *listener) allowBitrate(n int) bool {
+	bls := l.lockBitrate()
+	defer unlockBitrate(bls)
+	now := time.Now()
+	for _, bl := range bls {
+		if bl.rate == 0 {
+			continue
+		}
+		dt := now.Sub(bl.updated).Seconds()
+		if bl.tokens += bl.rate * dt; bl.tokens > bl.burst() {
+			bl.tokens = bl.burst()
+		}
+		bl.updated = now
+	}
+	for _, bl := range bls {
+		if bl.rate > 0 && bl.tokens < 0 {
+			return false
+		}
+	}
+	for _, bl := range bls {
+		bl.tokens -= float64(8 * n)
+	}
+	return true
+}
+
+// replyBits returns the max number of bits in each echo reply for params.
+func replyBits(p *Params) float64 {
+	n := p.Length
+	if n < maxHeaderLen {
+		n = maxHeaderLen
+	}
+	return float64(8 * n)
+}
+
+// replyBitrate returns the bitrate of echo replies for params. Conns with no
+// interval reserve nothing, as their bitrate is unknown.
+func replyBitrate(p *Params) float64 {
+	if p.Interval <= 0 {
+		return 0
+	}
+	return replyBits(p) / p.Interval.Seconds()
+}
+
+// reserveBitrate reserves the bitrate of the sconn's echo replies from the
+// listener and server bitrate limiters. With restrict true, the interval, or
+// if necessary the length, is first restricted so the reply bitrate fits within
+// the bitrate that's available, and false is returned if it can't fit.
+func (sc *sconn) reserveBitrate(restrict bool) bool {
+	bls := sc.lockBitrate()
+	defer unlockBitrate(bls)
+	if restrict {
+		avail := math.Inf(1)
+		for _, bl := range bls {
+			avail = math.Min(avail, bl.available())
+		}
+		if !restrictBitrate(sc.params, avail, sc.Timeout) {
+			return false
+		}
+	}
+	sc.bitrate = replyBitrate(sc.params)
+	for _, bl := range bls {
+		bl.reserved += sc.bitrate
+	}
+	return true
+}
+
+// restrictBitrate restricts params so the reply bitrate is at most avail. The
+// interval is increased up to the max interval for timeout, after which the
+// length is reduced. It returns false if the bitrate can't be restricted enough.
+func restrictBitrate(p *Params, avail float64, timeout time.Duration) bool {
+	if math.IsInf(avail, 1) || (p.Interval > 0 && replyBitrate(p) <= avail) {
+		return true
+	}
+	if avail <= 0 {
+		return false
+	}
+	iv := time.Duration(math.Ceil(replyBits(p) / avail * float64(time.Second)))
+	maxiv := timeout / maxIntervalTimeoutFactor
+	if timeout == 0 || iv <= maxiv {
+		p.Interval = iv
+		return true
+	}
+	p.Interval = maxiv
+	n := int(avail * maxiv.Seconds() / 8)
+	if n < maxHeaderLen {
+		return false
+	}
+	p.Length = n
+	return true
+}
+
+// releaseBitrate releases the bitrate reserved by the sconn.
+func (sc *sconn) releaseBitrate() {
+	bls := sc.lockBitrate()
+	defer unlockBitrate(bls)
+	for _, bl := range bls {
+		bl.reserved -= sc.bitrate
+	}
+	sc.bitrate = 0
+}
@@ -0,0 +1,274 @@
+package irtt
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestParseSourceLimit tests parsing source limits, with rate suffixes and
+// invalid values.
+func TestParseSourceLimit(t *testing.T) {
+	tests := []struct {
+		s      string
+		expect SourceLimit
+	}{
+		{"conns=4", SourceLimit{Prefix4: 24, Prefix6: 48, Conns: 4}},
+		{"packets=1.5k,bytes=2M,opens=0.5",
+			SourceLimit{Prefix4: 24, Prefix6: 48, Packets: 1500, Bytes: 2e6,
+				Opens: 0.5}},
+		{"packets=1K,bytes=3m,opens=1g",
+			SourceLimit{Prefix4: 24, Prefix6: 48, Packets: 1000, Bytes: 3e6,
+				Opens: 1e9}},
+		{"bytes=1G,prefix4=32,prefix6=128",
+			SourceLimit{Prefix4: 32, Prefix6: 128, Bytes: 1e9}},
+		{"packets=0,prefix4=0", SourceLimit{Prefix4: 0, Prefix6: 48}},
+	}
+	for _, tc := range tests {
+		l, err := ParseSourceLimit(tc.s, 24, 48)
+		if err != nil {
+			t.Errorf("%s: %s", tc.s, err)
+			continue
+		}
+		if *l != tc.expect {
+			t.Errorf("%s: parsed %s, expected %s", tc.s, l, &tc.expect)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"conns",
+		"nope=1",
+		"conns=1.5",
+		"conns=-1",
+		"packets=-1",
+		"packets=NaN",
+		"packets=nan",
+		"bytes=Inf",
+		"bytes=+Infk",
+		"opens=-inf",
+		"packets=1T",
+		"packets=k",
+		"prefix4=33",
+		"prefix6=-1",
+	} {
+		if _, err := ParseSourceLimit(s, 24, 48); !isErrorCode(InvalidSourceLimit,
+			err) {
+			t.Errorf("%q: expected InvalidSourceLimit, got %v", s, err)
+		}
+	}
+}
+
+// TestSourceLimiterSetLimits tests that setting limits keeps the token buckets
+// of sources for limits with unchanged prefix lengths, and clears conns.
+func TestSourceLimiterSetLimits(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	lim := SourceLimit{Prefix4: 32, Prefix6: 128, Conns: 2, Packets: 2}
+	pfx := SourceLimit{Prefix4: 24, Prefix6: 48, Packets: 4}
+	sl := newSourceLimiter([]SourceLimit{lim, pfx}, 0)
+	sl.addConn(ip)
+	sl.addConn(ip)
+	for i := 0; i < 3; i++ {
+		if err := sl.allowRequest(ip, 100); err != nil {
+			t.Fatalf("request %d: %s", i, err)
+		}
+	}
+	if err := sl.allowRequest(ip, 100); !isErrorCode(SourcePacketLimit, err) {
+		t.Fatalf("expected SourcePacketLimit, got %v", err)
+	}
+
+	// a reload with the same prefix lengths and a higher rate keeps the empty
+	// bucket, and a new prefix length starts with a full bucket
+	lim.Packets = 10
+	pfx.Prefix6 = 56
+	sl.setLimits([]SourceLimit{pfx, lim}, 0)
+	if err := sl.allowRequest(ip, 100); !isErrorCode(SourcePacketLimit, err) {
+		t.Errorf("after reload, expected SourcePacketLimit, got %v", err)
+	}
+	p, _ := lim.prefix(ip)
+	st := sl.sources[1][string(p)]
+	if st == nil {
+		t.Fatal("source state not kept")
+	}
+	if st.conns != 0 {
+		t.Errorf("%d conns kept after reload, expected 0", st.conns)
+	}
+	p, _ = pfx.prefix(ip)
+	if st := sl.sources[0][string(p)]; st == nil || st.packets != pfx.Packets {
+		t.Errorf("new prefix length has state %+v, expected full bucket", st)
+	}
+
+	// the bucket refills at the new rate
+	st.updated = st.updated.Add(-time.Second)
+	if err := sl.allowRequest(ip, 100); err != nil {
+		t.Errorf("after refill: %s", err)
+	}
+	if st.packets > lim.Packets {
+		t.Errorf("bucket has %g packets, more than rate %g", st.packets,
+			lim.Packets)
+	}
+}
+
+// TestSourceLimiterAllowOpen tests the server-wide and per-source open rates,
+// that each refuses with its own code, and that an open refused by one isn't
+// counted in the other.
+func TestSourceLimiterAllowOpen(t *testing.T) {
+	clk := newTestClock()
+	sl := &sourceLimiter{now: clk.now}
+	sl.setLimits([]SourceLimit{{Prefix4: 32, Prefix6: 128, Opens: 2}}, 3)
+	ip1 := net.ParseIP("192.0.2.1")
+	ip2 := net.ParseIP("192.0.2.2")
+	steps := []struct {
+		dt   time.Duration
+		ip   net.IP
+		code Code
+	}{
+		// the buckets may go negative, so the per-source bucket allows three
+		{0, ip1, 0},
+		{0, ip1, 0},
+		{0, ip1, 0},
+		// refused for the source, and not counted for the server
+		{0, ip1, SourceOpenLimit},
+		{0, ip2, 0},
+		// refused for the server, and not counted for the source
+		{0, ip2, OpenRateLimited},
+		// the server and source buckets refill
+		{time.Second, ip2, 0},
+		{0, ip1, 0},
+		{0, ip1, 0},
+		{0, ip1, OpenRateLimited},
+		// refills are capped at the rate
+		{time.Hour, ip2, 0},
+		{0, ip2, 0},
+		{0, ip2, 0},
+		{0, ip2, SourceOpenLimit},
+	}
+	for i, s := range steps {
+		clk.advance(s.dt)
+		err := sl.allowOpen(s.ip)
+		if s.code == 0 && err != nil {
+			t.Errorf("step %d: %s", i, err)
+		} else if s.code != 0 && !isErrorCode(s.code, err) {
+			t.Errorf("step %d: expected %s, got %v", i, s.code, err)
+		}
+	}
+}
+
+// TestRestrictBitrate tests restricting the interval, then the length, of
+// params to fit within an available bitrate.
+func TestRestrictBitrate(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		interval time.Duration
+		length   int
+		avail    float64
+		timeout  time.Duration
+		ok       bool
+		expIv    time.Duration
+		expLen   int
+	}{
+		// no limit
+		{10 * time.Millisecond, 1024, inf, time.Minute, true,
+			10 * time.Millisecond, 1024},
+		// fits exactly
+		{125 * time.Millisecond, 1024, 65536, time.Minute, true,
+			125 * time.Millisecond, 1024},
+		// interval increased
+		{10 * time.Millisecond, 1024, 65536, time.Minute, true,
+			125 * time.Millisecond, 1024},
+		// no interval
+		{0, 1024, 65536, time.Minute, true, 125 * time.Millisecond, 1024},
+		// lengths below the header length use the header length
+		{time.Millisecond, 0, float64(8 * maxHeaderLen), 0, true, time.Second,
+			0},
+		// no timeout, so no max interval
+		{10 * time.Millisecond, 1024, 1, 0, true, 8192 * time.Second, 1024},
+		// interval at max, then length reduced
+		{10 * time.Millisecond, 1024, 4096, 4 * time.Second, true, time.Second,
+			512},
+		// length reduced to the header length
+		{10 * time.Millisecond, 1024, float64(8 * maxHeaderLen),
+			4 * time.Second, true, time.Second, maxHeaderLen},
+		// length can't be reduced below the header length
+		{10 * time.Millisecond, 1024, float64(8 * (maxHeaderLen - 1)),
+			4 * time.Second, false, time.Second, 1024},
+		// no bitrate available
+		{10 * time.Millisecond, 1024, 0, time.Minute, false,
+			10 * time.Millisecond, 1024},
+		{10 * time.Millisecond, 1024, -1000, time.Minute, false,
+			10 * time.Millisecond, 1024},
+	}
+	for _, tc := range tests {
+		p := &Params{Interval: tc.interval, Length: tc.length}
+		ok := restrictBitrate(p, tc.avail, tc.timeout)
+		if ok != tc.ok || p.Interval != tc.expIv || p.Length != tc.expLen {
+			t.Errorf("interval %s length %d avail %g timeout %s: got %t, "+
+				"interval %s length %d, expected %t, interval %s length %d",
+				tc.interval, tc.length, tc.avail, tc.timeout, ok, p.Interval,
+				p.Length, tc.ok, tc.expIv, tc.expLen)
+		}
+		if ok && replyBitrate(p) > tc.avail {
+			t.Errorf("interval %s length %d avail %g timeout %s: restricted "+
+				"bitrate %g over available", tc.interval, tc.length, tc.avail,
+				tc.timeout, replyBitrate(p))
+		}
+	}
+}
+
+// TestAllowBitrate tests the listener and server reply bitrate token buckets.
+func TestAllowBitrate(t *testing.T) {
+	type step struct {
+		dt time.Duration
+		n  int
+		ok bool
+	}
+	tests := []struct {
+		name    string
+		lrate   Bitrate
+		srate   Bitrate
+		steps   []step
+		ltokens float64
+		stokens float64
+	}{
+		{"no limits", 0, 0, []step{{0, 1500, true}, {time.Hour, 1500, true}},
+			0, 0},
+		// the burst is 800 bits, and the bucket may go negative
+		{"listener", 8000, 0, []step{{0, 100, true}, {0, 100, true},
+			{0, 1, false}, {50 * time.Millisecond, 1, false},
+			{50 * time.Millisecond, 50, true}}, -400, 0},
+		// refills are capped at the burst
+		{"listener burst", 8000, 0, []step{{0, 1000, true},
+			{time.Hour, 1, true}}, 792, 0},
+		{"server", 0, 8000, []step{{0, 100, true}, {0, 100, true},
+			{0, 1, false}}, 0, -800},
+		// replies refused by one bucket aren't counted in the other
+		{"listener refuses", 8000, 16000, []step{{0, 200, true},
+			{0, 1, false}}, -800, 0},
+		{"server refuses", 16000, 8000, []step{{0, 200, true},
+			{0, 1, false}}, 0, -800},
+	}
+	for _, tc := range tests {
+		l := &listener{bitrate: newBitrateLimiter(tc.lrate),
+			srvBitrate: newBitrateLimiter(tc.srate)}
+		for i, s := range tc.steps {
+			for _, bl := range []*bitrateLimiter{l.bitrate, l.srvBitrate} {
+				bl.updated = time.Now().Add(-s.dt)
+			}
+			if ok := l.allowBitrate(s.n); ok != s.ok {
+				t.Errorf("%s: step %d allowed %t, expected %t", tc.name, i, ok,
+					s.ok)
+			}
+		}
+		if (tc.lrate > 0 && !approx(l.bitrate.tokens, tc.ltokens)) ||
+			(tc.srate > 0 && !approx(l.srvBitrate.tokens, tc.stokens)) {
+			t.Errorf("%s: tokens %g and %g, expected %g and %g", tc.name,
+				l.bitrate.tokens, l.srvBitrate.tokens, tc.ltokens, tc.stokens)
+		}
+	}
+}
+
+// approx returns true if a and b are within one bit of each other, to allow
+// for refills in the time between steps.
+func approx(a, b float64) bool {
+	return math.Abs(a-b) <= 1
+}
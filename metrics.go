@@ -0,0 +1,275 @@
+package irtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// listenerMetrics are the runtime counters and gauges for a listener. Counters
+// are updated by the listener goroutine, and read by the metrics HTTP server.
+type listenerMetrics struct {
+	up                atomic.Bool
+	conns             atomic.Int64
+	opens             atomic.Uint64
+	openCloses        atomic.Uint64
+	closesClient      atomic.Uint64
+	closesDuration    atomic.Uint64
+	closesTimeout     atomic.Uint64
+	closesOpenTimeout atomic.Uint64
+	closesEvicted     atomic.Uint64
+	connsFullRefused  atomic.Uint64
+	deniedOpens       atomic.Uint64
+	bannedPackets     atomic.Uint64
+	closesControl     atomic.Uint64
+	closesShutdown    atomic.Uint64
+	limitedConns      atomic.Uint64
+	limitedPackets    atomic.Uint64
+	limitedBytes      atomic.Uint64
+	bitrateDropped    atomic.Uint64
+	bitrateRestricted atomic.Uint64
+	bitrateRefused    atomic.Uint64
+	packets           atomic.Uint64
+	bytes             atomic.Uint64
+	errors            atomic.Uint64
+	drops             map[Code]uint64
+	dropsMtx          sync.Mutex
+}
+
+func newListenerMetrics() *listenerMetrics {
+	return &listenerMetrics{drops: make(map[Code]uint64)}
+}
+
+// drop counts a dropped packet by the Code of its error, or 0 if the error
+// has no Code.
+func (m *listenerMetrics) drop(err error) {
+	var code Code
+	if e, ok := err.(*Error); ok {
+		code = e.Code
+	}
+	m.dropsMtx.Lock()
+	m.drops[code]++
+	m.dropsMtx.Unlock()
+}
+
+// dropCounts returns a copy of the drop counts.
+func (m *listenerMetrics) dropCounts() map[Code]uint64 {
+	m.dropsMtx.Lock()
+	defer m.dropsMtx.Unlock()
+	d := make(map[Code]uint64, len(m.drops))
+	for c, n := range m.drops {
+		d[c] = n
+	}
+	return d
+}
+
+// metricsServer serves OpenMetrics (or Prometheus text format) metrics at
+// /metrics, and a health check at /healthz.
+type metricsServer struct {
+	*http.Server
+	s  *Server
+	ln net.Listener
+}
+
+func newMetricsServer(s *Server) *metricsServer {
+	ms := &metricsServer{s: s}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", ms.serveMetrics)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		ms.serveHealth(w, r)
+	})
+	ms.Server = &http.Server{
+		Addr:              s.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: metricsReadTimeout,
+	}
+	return ms
+}
+
+// serveHealth returns 200 OK if the server is not shutting down and any of
+// its listeners are up, or 503 Service Unavailable otherwise.
+func (ms *metricsServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ms.s.isShutdown() {
+		for _, l := range ms.s.getListeners() {
+			if l.metrics.up.Load() {
+				io.WriteString(w, "ok\n")
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, "unavailable\n")
+}
+
+// serveMetrics writes the metrics in the OpenMetrics format if the client
+// accepts it, or the Prometheus text format otherwise.
+func (ms *metricsServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	om := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if om {
+		w.Header().Set("Content-Type",
+			"application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	bw := bufio.NewWriter(w)
+	ms.writeMetrics(bw, om)
+	bw.Flush()
+}
+
+// writeMetrics writes all metrics. In the OpenMetrics format, counter
+// families are named without the _total suffix, and the output ends with EOF.
+func (ms *metricsServer) writeMetrics(w io.Writer, om bool) {
+	family := func(name, typ, help string) string {
+		fname := name
+		if om && typ == "counter" {
+			fname = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", fname, typ)
+		fmt.Fprintf(w, "# HELP %s %s\n", fname, help)
+		return name
+	}
+	listeners := ms.s.getListeners()
+	each := func(name, typ, help string, fn func(m *listenerMetrics) uint64) {
+		name = family(name, typ, help)
+		for _, l := range listeners {
+			fmt.Fprintf(w, "%s{listener=\"%s\"} %d\n", name,
+				escapeLabel(l.conn.localAddr().String()), fn(l.metrics))
+		}
+	}
+
+	name := family("irtt_info", "gauge", "IRTT server version.")
+	fmt.Fprintf(w, "%s{version=\"%s\"} 1\n", name, escapeLabel(Version))
+	each("irtt_listener_up", "gauge", "Whether the listener is serving.",
+		func(m *listenerMetrics) uint64 {
+			if m.up.Load() {
+				return 1
+			}
+			return 0
+		})
+	each("irtt_listener_errors_total", "counter", "Listener errors.",
+		func(m *listenerMetrics) uint64 { return m.errors.Load() })
+	each("irtt_conns", "gauge",
+		"Active connections, including expired ones not yet removed.",
+		func(m *listenerMetrics) uint64 { return uint64(m.conns.Load()) })
+	each("irtt_opens_total", "counter", "Connections opened.",
+		func(m *listenerMetrics) uint64 { return m.opens.Load() })
+	each("irtt_open_closes_total", "counter",
+		"Open requests closed immediately (e.g. for a client no-test).",
+		func(m *listenerMetrics) uint64 { return m.openCloses.Load() })
+
+	each("irtt_conns_full_total", "counter",
+		"Opens refused because the max connections was reached.",
+		func(m *listenerMetrics) uint64 { return m.connsFullRefused.Load() })
+
+	each("irtt_denied_opens_total", "counter",
+		"Opens refused with a close because the source was denied by the ACLs.",
+		func(m *listenerMetrics) uint64 { return m.deniedOpens.Load() })
+
+	each("irtt_banned_packets_total", "counter",
+		"Packets dropped before parsing because the source was banned.",
+		func(m *listenerMetrics) uint64 { return m.bannedPackets.Load() })
+
+	name = family("irtt_closes_total", "counter", "Connections closed, by reason.")
+	for _, l := range listeners {
+		laddr := escapeLabel(l.conn.localAddr().String())
+		for _, c := range []struct {
+			reason string
+			n      *atomic.Uint64
+		}{
+			{"client", &l.metrics.closesClient},
+			{"duration", &l.metrics.closesDuration},
+			{"timeout", &l.metrics.closesTimeout},
+			{"open_timeout", &l.metrics.closesOpenTimeout},
+			{"evicted", &l.metrics.closesEvicted},
+			{"control", &l.metrics.closesControl},
+			{"shutdown", &l.metrics.closesShutdown},
+		} {
+			fmt.Fprintf(w, "%s{listener=\"%s\",reason=\"%s\"} %d\n", name, laddr,
+				c.reason, c.n.Load())
+		}
+	}
+
+	name = family("irtt_drops_total", "counter",
+		"Packets dropped, by the code of the error (Unknown if none).")
+	for _, l := range listeners {
+		laddr := escapeLabel(l.conn.localAddr().String())
+		drops := l.metrics.dropCounts()
+		codes := make([]Code, 0, len(drops))
+		for c := range drops {
+			codes = append(codes, c)
+		}
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+		for _, c := range codes {
+			cstr := c.String()
+			if c == 0 {
+				cstr = "Unknown"
+			}
+			fmt.Fprintf(w, "%s{listener=\"%s\",code=\"%s\"} %d\n", name, laddr,
+				cstr, drops[c])
+		}
+	}
+
+	name = family("irtt_source_limited_total", "counter",
+		"Opens refused or requests dropped for source limits, by limit.")
+	for _, l := range listeners {
+		laddr := escapeLabel(l.conn.localAddr().String())
+		for _, c := range []struct {
+			limit string
+			n     *atomic.Uint64
+		}{
+			{"conns", &l.metrics.limitedConns},
+			{"packets", &l.metrics.limitedPackets},
+			{"bytes", &l.metrics.limitedBytes},
+		} {
+			fmt.Fprintf(w, "%s{listener=\"%s\",limit=\"%s\"} %d\n", name, laddr,
+				c.limit, c.n.Load())
+		}
+	}
+
+	name = family("irtt_bitrate_limited_total", "counter",
+		"Replies dropped, and opens restricted or refused, for bitrate limits.")
+	for _, l := range listeners {
+		laddr := escapeLabel(l.conn.localAddr().String())
+		for _, c := range []struct {
+			action string
+			n      *atomic.Uint64
+		}{
+			{"drop", &l.metrics.bitrateDropped},
+			{"restrict", &l.metrics.bitrateRestricted},
+			{"refuse", &l.metrics.bitrateRefused},
+		} {
+			fmt.Fprintf(w, "%s{listener=\"%s\",action=\"%s\"} %d\n", name,
+				laddr, c.action, c.n.Load())
+		}
+	}
+
+	each("irtt_packets_echoed_total", "counter", "Echo replies sent.",
+		func(m *listenerMetrics) uint64 { return m.packets.Load() })
+	each("irtt_bytes_echoed_total", "counter",
+		"Bytes sent in echo replies (UDP payload).",
+		func(m *listenerMetrics) uint64 { return m.bytes.Load() })
+
+	if om {
+		io.WriteString(w, "# EOF\n")
+	}
+}
+
+// listen starts listening on the metrics address, so errors are returned
+// before the server is started.
+func (ms *metricsServer) listen() (net.Listener, error) {
+	return net.Listen("tcp", ms.Addr)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the OpenMetrics text format.
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
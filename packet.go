@@ -4,6 +4,8 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"hash"
 	"io"
 	"math"
@@ -53,6 +55,37 @@ type ReceivedWindow uint64
 // ctoken is a conn token
 type ctoken uint64
 
+// CloseReason is the reason the server closed a conn, sent to the client as the
+// payload of a close reply with no echo reply fields.
+type CloseReason byte
+
+// CloseReason constants.
+const (
+	// CloseShutdown is sent when the server is shutting down.
+	CloseShutdown CloseReason = iota + 1
+
+	// CloseControl is sent when the conn is closed from the control socket.
+	CloseControl
+
+	// CloseEvicted is sent when the conn is evicted to make room for a new
+	// one, with ConnLimitEvict.
+	CloseEvicted
+)
+
+var crs = [...]string{"shutdown", "control", "evicted"}
+
+func (r CloseReason) String() string {
+	if r < 1 || int(r) > len(crs) {
+		return fmt.Sprintf("CloseReason:%d", r)
+	}
+	return crs[r-1]
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (r CloseReason) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
 // magic bytes
 var magic = []byte{0x14, 0xa7, 0x5b}
 
@@ -106,14 +139,15 @@ const (
 	fMMono
 	fSWall
 	fSMono
+	fRTOS
 )
 
-const fcount = fSMono + 1
+const fcount = fRTOS + 1
 
 const foptidx = fHMAC
 
 // field capacities (sync with field constants)
-var fcaps = []int{3, 1, md5.Size, 8, 4, 4, 8, 8, 8, 8, 8, 8, 8}
+var fcaps = []int{3, 1, md5.Size, 8, 4, 4, 8, 8, 8, 8, 8, 8, 8, 1}
 
 // field index definitions
 var finit = []fidx{fMagic, fFlags}
@@ -126,6 +160,8 @@ var fRequest = []fidx{fMagic, fFlags, fConnToken}
 
 var fcloseRequest = []fidx{fMagic, fFlags, fConnToken}
 
+var fcloseReply = []fidx{fMagic, fFlags, fConnToken}
+
 var fechoRequest = []fidx{fMagic, fFlags, fConnToken, fSeqno}
 
 var fechoReply = []fidx{fMagic, fFlags, fConnToken, fSeqno}
@@ -183,17 +219,17 @@ type packet struct {
 	srcIP   net.IP
 	dstIP   net.IP
 	dscp    int
+	tos     TOS
 }
 
 func newPacket(tlen int, cap int, hmacKey []byte) *packet {
 	if cap < maxHeaderLen {
 		cap = maxHeaderLen
 	}
-	p := &packet{fbuf: newFbuf(newFields(), tlen, cap)}
-	if len(hmacKey) > 0 {
+	p := &packet{fbuf: newFbuf(newFields(), tlen, cap), tos: InvalidTOS}
+	p.setHMACKey(hmacKey)
+	if p.md5Hash != nil {
 		p.setFields(finitHMAC, true)
-		p.md5Hash = hmac.New(md5.New, hmacKey)
-		p.hmacKey = hmacKey
 	} else {
 		p.setFields(finit, true)
 	}
@@ -201,6 +237,18 @@ func newPacket(tlen int, cap int, hmacKey []byte) *packet {
 	return p
 }
 
+// setHMACKey sets the key used to validate and sign the packet, or no key if
+// it's empty. The fields are set on the next readReset.
+func (p *packet) setHMACKey(hmacKey []byte) {
+	if len(hmacKey) > 0 {
+		p.md5Hash = hmac.New(md5.New, hmacKey)
+		p.hmacKey = hmacKey
+	} else {
+		p.md5Hash = nil
+		p.hmacKey = nil
+	}
+}
+
 func (p *packet) readReset(n int) error {
 	if p.md5Hash != nil {
 		p.setFields(finitHMAC, false)
@@ -260,6 +308,8 @@ func (p *packet) validate() error {
 		p.md5Hash.Write(p.bytes())
 		x := p.md5Hash.Sum(nil)
 		if !hmac.Equal(y, x) {
+			// restore HMAC so the packet may be validated again with another key
+			p.set(fHMAC, y)
 			return Errorf(BadHMAC, "invalid HMAC: %x != %x", y, x)
 		}
 	} else if p.flags()&flHMAC != 0 {
@@ -282,6 +332,26 @@ func (p *packet) clearFlagBits(f flags) {
 	p.setb(fFlags, byte(p.flags().clear(f)))
 }
 
+// closeReason returns the reason for a close reply with no echo reply fields,
+// which the server sends to close a conn outside of an exchange, and true if
+// the packet is one. The reason is a single byte payload. Servers without
+// close reasons send these only when they're shutting down, with no payload.
+func (p *packet) closeReason() (CloseReason, bool) {
+	if p.flags()&(flOpen|flClose) != flClose {
+		return 0, false
+	}
+	if err := p.addFields(fcloseReply, false); err != nil {
+		return 0, false
+	}
+	switch b := p.payload(); len(b) {
+	case 0:
+		return CloseShutdown, true
+	case 1:
+		return CloseReason(b[0]), b[0] != 0
+	}
+	return 0, false
+}
+
 // Reply
 
 func (p *packet) reply() bool {
@@ -366,6 +436,37 @@ func (p *packet) addReceivedStatsFields(rs ReceivedStats) {
 	p.addFields(rfs, false)
 }
 
+// Received TOS
+
+func (p *packet) receivedTOS() TOS {
+	return TOS(p.getb(fRTOS))
+}
+
+func (p *packet) setReceivedTOS(t TOS) {
+	if !t.IsValid() {
+		t = 0
+	}
+	p.setb(fRTOS, byte(t))
+}
+
+func (p *packet) hasReceivedTOS() bool {
+	return p.isset(fRTOS)
+}
+
+func (p *packet) zeroReceivedTOS(rtos bool) {
+	if rtos {
+		p.zero(fRTOS)
+	} else {
+		p.remove(fRTOS)
+	}
+}
+
+func (p *packet) addReceivedTOSField(rtos bool) {
+	if rtos {
+		p.addFields([]fidx{fRTOS}, false)
+	}
+}
+
 // Timestamps
 
 func (p *packet) tget(wf fidx, mf fidx, t *Time) {
@@ -19,13 +19,13 @@ const testReqSeqno = Seqno(0x6fe2a1bb)
 
 var testReqHMACKey = []byte{0x3c, 0x68, 0x1d, 0x39, 0x41, 0x1d, 0x72, 0x43}
 
-var testReqBytes = []byte{0x14, 0xa7, 0x5b, 0x8, 0xe7, 0x3, 0x41, 0xe7, 0xd4,
-	0x8, 0xcf, 0x69, 0x41, 0xf3, 0xf4, 0x78, 0x5a, 0x56, 0xc, 0x4c, 0xea, 0x3e,
+var testReqBytes = []byte{0x14, 0xa7, 0x5b, 0x8, 0x29, 0x88, 0xc4, 0x36, 0x5b,
+	0x4c, 0xb, 0xa5, 0x4e, 0xe6, 0x9b, 0xe5, 0x84, 0xd, 0x7b, 0x93, 0xea, 0x3e,
 	0xb3, 0x22, 0xa7, 0xc9, 0x6b, 0x88, 0xbb, 0xa1, 0xe2, 0x6f, 0x0, 0x0, 0x0, 0x0,
 	0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
 	0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
 	0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xff, 0xfe, 0xfd, 0xfc, 0xff, 0xfe,
-	0xfd, 0xfc, 0xff, 0xfe, 0xfd, 0xfc, 0xff, 0xfe, 0xfd, 0xfc}
+	0xfd, 0xfc, 0xff, 0xfe, 0xfd, 0xfc, 0xff, 0xfe, 0xfd, 0xfc, 0xff}
 
 // reply
 
@@ -44,14 +44,14 @@ var testRepTimestamp = Timestamp{
 	Time{0x589705d446293f69, time.Duration(0x461df12fdd2c5066)},
 }
 
-var testRepBytes = []byte{0x14, 0xa7, 0x5b, 0x8, 0xd2, 0x98, 0xa3, 0x4a, 0x6a,
-	0x13, 0x41, 0x2, 0x68, 0xb2, 0x67, 0xa8, 0xd6, 0x7e, 0x28, 0x25, 0xc3, 0xcb,
+var testRepBytes = []byte{0x14, 0xa7, 0x5b, 0x8, 0xe4, 0x1b, 0x9b, 0x5c, 0x52,
+	0x57, 0x15, 0xcb, 0x85, 0xfb, 0x1c, 0x8, 0xee, 0x8f, 0xe, 0xff, 0xc3, 0xcb,
 	0x6f, 0x76, 0xb6, 0xce, 0x66, 0xe6, 0x6, 0x7, 0x3b, 0x1d, 0x19, 0x9f, 0xbc,
 	0xa3, 0x9b, 0x3b, 0xf8, 0x86, 0xe5, 0x39, 0xe9, 0xd7, 0xa1, 0x75, 0x2a, 0xee,
 	0x3d, 0xf1, 0x5a, 0x52, 0x9a, 0xc6, 0x4a, 0x3e, 0x22, 0x62, 0x55, 0x2d, 0x69,
 	0x3f, 0x29, 0x46, 0xd4, 0x5, 0x97, 0x58, 0x66, 0x50, 0x2c, 0xdd, 0x2f, 0xf1,
-	0x1d, 0x46, 0xff, 0xfe, 0xfd, 0xfc, 0xff, 0xfe, 0xfd, 0xfc, 0xff, 0xfe, 0xfd,
-	0xfc, 0xff, 0xfe, 0xfd, 0xfc}
+	0x1d, 0x46, 0xfe, 0xfd, 0xfc, 0xff, 0xfe, 0xfd, 0xfc, 0xff, 0xfe, 0xfd, 0xfc,
+	0xff, 0xfe, 0xfd, 0xfc, 0xff, 0xfe}
 
 // TestRequestPacket tests a typical filled request with HMAC.
 func TestRequestPacket(t *testing.T) {
@@ -103,6 +103,43 @@ func TestReplyPacket(t *testing.T) {
 	}
 }
 
+// TestReceivedTOSPacket tests that a received TOS value set in a reply can be
+// read back by the client.
+func TestReceivedTOSPacket(t *testing.T) {
+	const tos = TOS(0xbb)
+	p := newPacket(0, maxHeaderLen, testRepHMACKey)
+	p.setConnToken(testRepCtoken)
+	p.addFields(fechoReply, true)
+	p.setReceivedCount(testRepReceivedCount)
+	p.setReceivedWindow(testRepReceivedWindow)
+	p.setReceivedTOS(tos)
+	p.setSeqno(testRepSeqno)
+	p.setReply(true)
+	p.updateHMAC()
+
+	r := newPacket(0, maxHeaderLen, testRepHMACKey)
+	n := copy(r.readTo(), p.bytes())
+	if err := r.readReset(n); err != nil {
+		t.Fatal(err)
+	}
+	r.addFields(fechoReply, false)
+	r.addReceivedStatsFields(ReceivedStatsBoth)
+	r.addReceivedTOSField(true)
+	if !r.hasReceivedTOS() {
+		t.Fatal("received TOS field not set")
+	}
+	if r.receivedTOS() != tos {
+		t.Errorf("unexpected received TOS %s != %s", r.receivedTOS(), tos)
+	}
+	if r.receivedTOS().DSCP() != 46 || r.receivedTOS().ECN() != CE {
+		t.Errorf("unexpected DSCP %d or ECN %s", r.receivedTOS().DSCP(),
+			r.receivedTOS().ECN())
+	}
+	if r.receivedCount() != testRepReceivedCount {
+		t.Errorf("unexpected received count %d", r.receivedCount())
+	}
+}
+
 func byteArrayLiteral(b []byte) string {
 	buf := bytes.NewBufferString("")
 	fmt.Fprint(buf, "[]byte{")
@@ -117,3 +154,44 @@ func byteArrayLiteral(b []byte) string {
 	fmt.Fprint(buf, " }")
 	return buf.String()
 }
+
+// TestCloseReason tests reading the reason from close replies with no echo
+// reply fields, including those with no reason from older servers.
+func TestCloseReason(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   flags
+		payload []byte
+		reason  CloseReason
+		ok      bool
+	}{
+		{"no reason", flReply | flClose, nil, CloseShutdown, true},
+		{"shutdown", flReply | flClose, []byte{byte(CloseShutdown)},
+			CloseShutdown, true},
+		{"control", flReply | flClose, []byte{byte(CloseControl)},
+			CloseControl, true},
+		{"zero reason", flReply | flClose, []byte{0}, 0, false},
+		{"echo reply", flReply | flClose, []byte{1, 0, 0, 0}, 0, false},
+		{"open reply", flReply | flOpen | flClose, nil, 0, false},
+		{"no close", flReply, nil, 0, false},
+	}
+	for _, tc := range tests {
+		p := newPacket(0, maxHeaderLen, testRepHMACKey)
+		p.setFields(fcloseReply, true)
+		p.setPayload(tc.payload)
+		p.setFlagBits(tc.flags)
+		p.setConnToken(testRepCtoken)
+		p.updateHMAC()
+
+		r := newPacket(0, maxHeaderLen, testRepHMACKey)
+		n := copy(r.readTo(), p.bytes())
+		if err := r.readReset(n); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		reason, ok := r.closeReason()
+		if reason != tc.reason || ok != tc.ok {
+			t.Errorf("%s: got reason %s and %t, expected %s and %t", tc.name,
+				reason, ok, tc.reason, tc.ok)
+		}
+	}
+}
@@ -19,6 +19,7 @@ const (
 	pClock
 	pDSCP
 	pServerFill
+	pReceivedTOS
 )
 
 // Params are the test parameters sent to and received from the server.
@@ -32,6 +33,7 @@ type Params struct {
 	Clock           Clock         `json:"clock"`
 	DSCP            int           `json:"dscp"`
 	ServerFill      string        `json:"server_fill"`
+	ReceivedTOS     bool          `json:"received_tos"`
 }
 
 func parseParams(b []byte) (*Params, error) {
@@ -85,6 +87,10 @@ func (p *Params) bytes() []byte {
 		pos += binary.PutUvarint(b[pos:], pServerFill)
 		pos += putString(b[pos:], p.ServerFill, maxServerFillLen)
 	}
+	if p.ReceivedTOS {
+		pos += binary.PutUvarint(b[pos:], pReceivedTOS)
+		pos += binary.PutVarint(b[pos:], 1)
+	}
 	return b[:pos]
 }
 
@@ -131,6 +137,8 @@ func (p *Params) readParam(b []byte) (pos int, err error) {
 			p.Clock, err = ClockFromInt(int(v))
 		case pDSCP:
 			p.DSCP = int(v)
+		case pReceivedTOS:
+			p.ReceivedTOS = v != 0
 		default:
 			// note: unknown params are silently ignored
 		}
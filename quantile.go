@@ -0,0 +1,79 @@
+package irtt
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Percentiles contains a slice of percentiles (0-100) to calculate quantiles
+// for.
+type Percentiles []float64
+
+func (ps Percentiles) String() string {
+	pss := make([]string, len(ps))
+	for i, p := range ps {
+		pss[i] = percentileString(p)
+	}
+	return strings.Join(pss, ",")
+}
+
+// ParsePercentiles returns a Percentiles value from a comma separated list of
+// percentiles, each with an optional p prefix (e.g. p90,p99,p99.9). The
+// returned Percentiles are sorted, and an empty string returns no Percentiles.
+func ParsePercentiles(s string) (ps Percentiles, err error) {
+	if s == "" || s == "none" {
+		return nil, nil
+	}
+	ss := strings.Split(s, ",")
+	ps = make([]float64, len(ss))
+	for i, ps0 := range ss {
+		p, perr := strconv.ParseFloat(strings.TrimPrefix(ps0, "p"), 64)
+		if perr != nil || !(p > 0 && p < 100) {
+			return nil, Errorf(InvalidPercentile,
+				"invalid percentile %s (must be > 0 and < 100)", ps0)
+		}
+		ps[i] = p
+	}
+	sort.Float64s(ps)
+	return ps, nil
+}
+
+// percentileString returns a percentile in the form p99.9.
+func percentileString(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// Quantile is the value of a DurationStats at a given percentile.
+type Quantile struct {
+	Percentile float64
+	Value      time.Duration
+}
+
+// quantiles calculates the quantiles for the given percentiles from the
+// supplied float64 slice, which must already be sorted. Linear interpolation
+// is used between the closest ranks.
+func quantiles(f []float64, ps Percentiles) []Quantile {
+	qs := make([]Quantile, len(ps))
+	for i, p := range ps {
+		qs[i] = Quantile{p, time.Duration(quantile(f, p))}
+	}
+	return qs
+}
+
+// quantile calculates the quantile for percentile p from the sorted float64
+// slice.
+func quantile(f []float64, p float64) float64 {
+	l := len(f)
+	if l == 0 {
+		return math.NaN()
+	}
+	h := float64(l-1) * p / 100
+	i := int(h)
+	if i >= l-1 {
+		return f[l-1]
+	}
+	return f[i] + (h-float64(i))*(f[i+1]-f[i])
+}
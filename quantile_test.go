@@ -0,0 +1,121 @@
+package irtt
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestParsePercentiles tests parsing valid and invalid percentile lists.
+func TestParsePercentiles(t *testing.T) {
+	tests := []struct {
+		s      string
+		expect Percentiles
+		err    bool
+	}{
+		{"", nil, false},
+		{"none", nil, false},
+		{"p90", Percentiles{90}, false},
+		{"99.9", Percentiles{99.9}, false},
+		{"p99,p50,90", Percentiles{50, 90, 99}, false},
+		{"p0.1,p99.99", Percentiles{0.1, 99.99}, false},
+		{"p0", nil, true},
+		{"100", nil, true},
+		{"-1", nil, true},
+		{"p", nil, true},
+		{"x90", nil, true},
+		{"pp90", nil, true},
+		{"p90,", nil, true},
+		{"NaN", nil, true},
+		{"Inf", nil, true},
+	}
+	for _, tc := range tests {
+		ps, err := ParsePercentiles(tc.s)
+		if tc.err {
+			if !isErrorCode(InvalidPercentile, err) {
+				t.Errorf("%q: expected InvalidPercentile, got %v", tc.s, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.s, err)
+			continue
+		}
+		if len(ps) != len(tc.expect) {
+			t.Errorf("%q: parsed %v, expected %v", tc.s, ps, tc.expect)
+			continue
+		}
+		for i := range ps {
+			if ps[i] != tc.expect[i] {
+				t.Errorf("%q: parsed %v, expected %v", tc.s, ps, tc.expect)
+				break
+			}
+		}
+	}
+}
+
+// TestPercentilesString tests that Percentiles format the way they're parsed.
+func TestPercentilesString(t *testing.T) {
+	s := "p50,p90,p99.9"
+	ps, err := ParsePercentiles(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.String() != s {
+		t.Errorf("formatted as %s, expected %s", ps, s)
+	}
+}
+
+// TestQuantile tests linear interpolation between closest ranks on small
+// sorted sample sets.
+func TestQuantile(t *testing.T) {
+	tests := []struct {
+		f      []float64
+		p      float64
+		expect float64
+	}{
+		{[]float64{5}, 1, 5},
+		{[]float64{5}, 99, 5},
+		{[]float64{1, 2}, 50, 1.5},
+		{[]float64{1, 2}, 25, 1.25},
+		{[]float64{1, 2, 3}, 50, 2},
+		{[]float64{1, 2, 3, 4}, 50, 2.5},
+		{[]float64{1, 2, 3, 4}, 90, 3.7},
+		{[]float64{10, 20, 30, 40, 50}, 10, 14},
+		{[]float64{10, 20, 30, 40, 50}, 75, 40},
+		{[]float64{10, 20, 30, 40, 50}, 99.9, 49.96},
+		{[]float64{0, 100}, 0.1, 0.1},
+		{[]float64{1, 1, 1, 9}, 50, 1},
+	}
+	for _, tc := range tests {
+		q := quantile(tc.f, tc.p)
+		if math.Abs(q-tc.expect) > 1e-9 {
+			t.Errorf("p%g of %v is %g, expected %g", tc.p, tc.f, q, tc.expect)
+		}
+	}
+	if q := quantile(nil, 50); !math.IsNaN(q) {
+		t.Errorf("quantile of no samples is %g, expected NaN", q)
+	}
+}
+
+// TestQuantiles tests that quantiles are returned for each percentile, in
+// order.
+func TestQuantiles(t *testing.T) {
+	f := []float64{
+		float64(time.Millisecond),
+		float64(2 * time.Millisecond),
+		float64(3 * time.Millisecond),
+	}
+	qs := quantiles(f, Percentiles{25, 50, 75})
+	expect := []time.Duration{1500 * time.Microsecond, 2 * time.Millisecond,
+		2500 * time.Microsecond}
+	if len(qs) != len(expect) {
+		t.Fatalf("got %d quantiles, expected %d", len(qs), len(expect))
+	}
+	for i, q := range qs {
+		if q.Value != expect[i] {
+			t.Errorf("%s is %s, expected %s", percentileString(q.Percentile),
+				q.Value, expect[i])
+		}
+	}
+}
@@ -3,6 +3,9 @@ package irtt
 import (
 	"encoding/json"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -31,13 +34,24 @@ type Recorder struct {
 	BytesReceived         uint64          `json:"bytes_received"`
 	Duplicates            uint            `json:"duplicates"`
 	LatePackets           uint            `json:"late_packets"`
+	UpstreamDSCPRemarks   uint            `json:"upstream_dscp_remarks"`
+	DownstreamDSCPRemarks uint            `json:"downstream_dscp_remarks"`
+	UpstreamCEMarks       uint            `json:"upstream_ce_marks"`
+	DownstreamCEMarks     uint            `json:"downstream_ce_marks"`
 	Wait                  time.Duration   `json:"wait"`
 	RoundTripData         []RoundTripData `json:"-"`
+	StreamStats           *StreamStats    `json:"stream_stats,omitempty"`
 	RecorderHandler       RecorderHandler `json:"-"`
-	sentIndex             uint            // index of most recently sent RTD
-	maxRoundTrips         uint            // max number of round trips in test
+	intervalStats         *intervalStats
+	rtHandler             RoundTripHandler
+	finalStats            *finalStats
+	finalPrior            *RoundTripData // copy of last finalized RTD
+	sentIndex             uint           // index of most recently sent RTD
+	maxRoundTrips         uint           // max number of round trips in test
+	wrap                  bool           // wrap around RoundTripData at capacity
 	priorSent             Seqno
 	priorReceived         Seqno
+	sentTOS               TOS
 	timeSource            TimeSource
 	mtx                   sync.RWMutex
 }
@@ -52,23 +66,30 @@ func (r *Recorder) RUnlock() {
 	r.mtx.RUnlock()
 }
 
-func newRecorder(maxRoundTrips, bufCap uint, ts TimeSource, h RecorderHandler) (
-	rec *Recorder) {
+func newRecorder(maxRoundTrips, bufCap uint, wrap bool, sentTOS TOS,
+	ts TimeSource, h RecorderHandler) (rec *Recorder) {
 	rec = &Recorder{
 		RoundTripData:   make([]RoundTripData, 0, bufCap),
 		RecorderHandler: h,
 		maxRoundTrips:   maxRoundTrips,
+		wrap:            wrap,
+		sentTOS:         sentTOS,
 		timeSource:      ts,
 	}
 	return
 }
 
-func (r *Recorder) recordPreSend(seqno Seqno) Time {
+func (r *Recorder) recordPreSend(seqno Seqno, sched time.Duration) Time {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 
 	// create RoundTripData and stamp time
-	rtd := RoundTripData{}
+	rtd := RoundTripData{
+		Scheduled:         sched,
+		SentTOS:           r.sentTOS,
+		ServerReceivedTOS: InvalidTOS,
+		ReceivedTOS:       InvalidTOS,
+	}
 	tsend := r.timeSource.Now(BothClocks)
 	rtd.Client.Send = tsend
 
@@ -77,13 +98,18 @@ func (r *Recorder) recordPreSend(seqno Seqno) Time {
 		r.sentIndex++
 	}
 
-	// append to RoundTripData or wrap around at capacity
-	if len(r.RoundTripData) < cap(r.RoundTripData) {
+	// append to RoundTripData or wrap around at capacity (the capacity may be
+	// exceeded without wrap, as schedules may send more than maxRoundTrips)
+	if len(r.RoundTripData) < cap(r.RoundTripData) || !r.wrap {
 		r.RoundTripData = append(r.RoundTripData, rtd)
 	} else {
 		if r.sentIndex == uint(len(r.RoundTripData)) {
 			r.sentIndex = 0
 		}
+		if r.rtHandler != nil || r.finalStats != nil {
+			n := len(r.RoundTripData)
+			r.finalize(int(r.sentIndex), seqno-Seqno(n), n-1)
+		}
 		r.RoundTripData[r.sentIndex] = rtd
 	}
 
@@ -117,18 +143,98 @@ func (r *Recorder) recordPostSend(seqno Seqno, tsend, tsent Time, n uint64) {
 	// update send and sent times
 	r.LastSent = tsent
 
+	// set length
+	rtd := &r.RoundTripData[r.sentIndex]
+	rtd.Length = int(n)
+
+	// update stream and interval stats
+	if r.StreamStats != nil {
+		r.StreamStats.onSent(tsent)
+	}
+	if r.intervalStats != nil {
+		r.intervalStats.onSent(tsent.Sub(r.Start))
+	}
+
 	// call handler
 	if r.RecorderHandler != nil {
-		var i int
-		if r.sentIndex == 0 {
-			i = len(r.RoundTripData) - 1
-		} else {
-			i = int(r.sentIndex)
+		r.RecorderHandler.OnSent(seqno, rtd)
+	}
+}
+
+func (r *Recorder) recordEnd(t Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	// finalize remaining round trips, from oldest to newest
+	if (r.rtHandler != nil || r.finalStats != nil) &&
+		len(r.RoundTripData) > 0 {
+		n := len(r.RoundTripData)
+		oldest := (int(r.sentIndex) + 1) % n
+		for o := n - 1; o >= 0; o-- {
+			r.finalize((oldest+n-1-o)%n, r.priorSent-Seqno(o), o)
 		}
-		r.RecorderHandler.OnSent(seqno, &r.RoundTripData[i])
+	}
+
+	// report final interval summary
+	if r.intervalStats != nil && !r.Start.IsZero() {
+		r.intervalStats.flush(t.Sub(r.Start))
 	}
 }
 
+// finalize updates the final stats and calls the RoundTripHandler with the
+// RoundTrip for the RoundTripData at index i in the buffer, which is followed
+// by later round trips in the buffer. Round trips must be finalized in order of
+// sequence number.
+func (r *Recorder) finalize(i int, seqno Seqno, later int) {
+	rtd := &r.RoundTripData[i]
+	rt := &RoundTrip{
+		Seqno:         seqno,
+		Lost:          r.lost(i, later),
+		RoundTripData: rtd,
+		IPDV:          InvalidDuration,
+		SendIPDV:      InvalidDuration,
+		ReceiveIPDV:   InvalidDuration,
+	}
+	if r.finalPrior != nil && rtd.ReplyReceived() &&
+		r.finalPrior.ReplyReceived() {
+		rt.IPDV = rtd.IPDVSince(r.finalPrior)
+		rt.SendIPDV = rtd.SendIPDVSince(r.finalPrior)
+		rt.ReceiveIPDV = rtd.ReceiveIPDVSince(r.finalPrior)
+	}
+	if r.finalStats != nil {
+		r.finalStats.push(rt)
+	}
+	if r.rtHandler != nil {
+		r.rtHandler.OnRoundTrip(rt)
+	}
+	if r.finalPrior == nil {
+		r.finalPrior = &RoundTripData{}
+	}
+	*r.finalPrior = *rtd
+}
+
+// lost returns the lost status for the RoundTripData at index i in the buffer,
+// using the received windows of the later round trips in the buffer to
+// determine if the packet was lost upstream or downstream.
+func (r *Recorder) lost(i int, later int) Lost {
+	if r.RoundTripData[i].ReplyReceived() {
+		return LostFalse
+	}
+	l := LostTrue
+	for k := 1; k <= later && k < receivedWindowLen; k++ {
+		lrtd := &r.RoundTripData[(i+k)%len(r.RoundTripData)]
+		rwin := lrtd.receivedWindow
+		if !lrtd.ReplyReceived() || rwin&0x1 == 0 {
+			continue
+		}
+		if rwin&(1<<uint(k)) != 0 {
+			return LostDown
+		}
+		l = LostUp
+	}
+	return l
+}
+
 func (r *Recorder) recordTimerErr(terr time.Duration) {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
@@ -225,9 +331,43 @@ func (r *Recorder) recordReceive(p *packet, sts *Timestamp) (
 		rtd.receivedWindow = p.receivedWindow()
 	}
 
+	// set received TOS values and count remarks and CE marks
+	if p.hasReceivedTOS() {
+		rtd.ServerReceivedTOS = p.receivedTOS()
+		if rtd.ServerReceivedTOS.DSCP() != rtd.SentTOS.DSCP() {
+			r.UpstreamDSCPRemarks++
+		}
+		if rtd.ServerReceivedTOS.ECN() == CE {
+			r.UpstreamCEMarks++
+		}
+	}
+	if p.tos.IsValid() {
+		rtd.ReceivedTOS = p.tos
+		if rtd.ReceivedTOS.DSCP() != rtd.SentTOS.DSCP() {
+			r.DownstreamDSCPRemarks++
+		}
+		if rtd.ReceivedTOS.ECN() == CE {
+			r.DownstreamCEMarks++
+		}
+	}
+
 	// update bytes received
 	r.BytesReceived += uint64(p.length())
 
+	// update stream and interval stats
+	if r.StreamStats != nil || r.intervalStats != nil {
+		ipdv := InvalidDuration
+		if prtd != nil {
+			ipdv = rtd.IPDVSince(prtd)
+		}
+		if r.StreamStats != nil {
+			r.StreamStats.onReceived(p.trcvd, rtd.RTT(), ipdv)
+		}
+		if r.intervalStats != nil {
+			r.intervalStats.onReceived(p.trcvd.Sub(r.Start), rtd.RTT(), ipdv)
+		}
+	}
+
 	// call recorder handler
 	if r.RecorderHandler != nil {
 		r.RecorderHandler.OnReceived(seqno, rtd, prtd, false)
@@ -239,10 +379,15 @@ func (r *Recorder) recordReceive(p *packet, sts *Timestamp) (
 // RoundTripData contains the information recorded for each round trip during
 // the test.
 type RoundTripData struct {
-	Client         Timestamp `json:"client"`
-	Server         Timestamp `json:"server"`
-	receivedWindow ReceivedWindow
-	Late           bool `json:"late"`
+	Client            Timestamp `json:"client"`
+	Server            Timestamp `json:"server"`
+	receivedWindow    ReceivedWindow
+	Late              bool          `json:"late"`
+	Length            int           `json:"-"`
+	Scheduled         time.Duration `json:"-"`
+	SentTOS           TOS           `json:"-"`
+	ServerReceivedTOS TOS           `json:"-"`
+	ReceivedTOS       TOS           `json:"-"`
 }
 
 // ReplyReceived returns true if a reply was received from the server.
@@ -404,14 +549,15 @@ func (ts *RoundTripData) ServerProcessingTime() (d time.Duration) {
 // add standard deviation and variance for timer error and send call time, and
 // running standard deviation for all packet times.
 type DurationStats struct {
-	Total    time.Duration `json:"total"`
-	N        uint          `json:"n"`
-	Min      time.Duration `json:"min"`
-	Max      time.Duration `json:"max"`
-	s        float64
-	mean     float64
-	median   float64
-	medianOk bool
+	Total     time.Duration `json:"total"`
+	N         uint          `json:"n"`
+	Min       time.Duration `json:"min"`
+	Max       time.Duration `json:"max"`
+	s         float64
+	mean      float64
+	median    float64
+	medianOk  bool
+	quantiles []Quantile
 }
 
 func (s *DurationStats) push(d time.Duration) {
@@ -435,6 +581,32 @@ func (s *DurationStats) push(d time.Duration) {
 	s.s += (fd - om) * (fd - s.mean)
 }
 
+// merge merges the values from another DurationStats, using the parallel
+// algorithm for combining the running mean and variance. The median and
+// quantiles are not merged.
+func (s *DurationStats) merge(o *DurationStats) {
+	if o.N == 0 {
+		return
+	}
+	if s.N == 0 {
+		*s = DurationStats{Total: o.Total, N: o.N, Min: o.Min, Max: o.Max,
+			s: o.s, mean: o.mean}
+		return
+	}
+	if o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Total += o.Total
+	n := s.N + o.N
+	d := o.mean - s.mean
+	s.s += o.s + d*d*float64(s.N)*float64(o.N)/float64(n)
+	s.mean += d * float64(o.N) / float64(n)
+	s.N = n
+}
+
 // IsZero returns true if DurationStats has no recorded values.
 func (s *DurationStats) IsZero() bool {
 	return s.N == 0
@@ -470,15 +642,37 @@ func (s *DurationStats) setMedian(m float64) {
 	s.medianOk = true
 }
 
+// Quantiles returns the quantiles (externally calculated), in order of
+// increasing percentile.
+func (s *DurationStats) Quantiles() []Quantile {
+	return s.quantiles
+}
+
+// Quantile returns the quantile for the given percentile (0-100), if it was
+// calculated.
+func (s *DurationStats) Quantile(p float64) (dur time.Duration, ok bool) {
+	for _, q := range s.quantiles {
+		if q.Percentile == p {
+			return q.Value, true
+		}
+	}
+	return
+}
+
+func (s *DurationStats) setQuantiles(qs []Quantile) {
+	s.quantiles = qs
+}
+
 // MarshalJSON implements the json.Marshaler interface.
 func (s *DurationStats) MarshalJSON() ([]byte, error) {
 	type Alias DurationStats
 	j := &struct {
 		*Alias
-		Mean     time.Duration `json:"mean"`
-		Median   time.Duration `json:"median,omitempty"`
-		Stddev   time.Duration `json:"stddev"`
-		Variance time.Duration `json:"variance"`
+		Mean      time.Duration            `json:"mean"`
+		Median    time.Duration            `json:"median,omitempty"`
+		Stddev    time.Duration            `json:"stddev"`
+		Variance  time.Duration            `json:"variance"`
+		Quantiles map[string]time.Duration `json:"quantiles,omitempty"`
 	}{
 		Alias:    (*Alias)(s),
 		Mean:     s.Mean(),
@@ -488,6 +682,12 @@ func (s *DurationStats) MarshalJSON() ([]byte, error) {
 	if m, ok := s.Median(); ok {
 		j.Median = m
 	}
+	if len(s.quantiles) > 0 {
+		j.Quantiles = make(map[string]time.Duration)
+		for _, q := range s.quantiles {
+			j.Quantiles[percentileString(q.Percentile)] = q.Value
+		}
+	}
 	return json.Marshal(j)
 }
 
@@ -496,14 +696,27 @@ func (s *DurationStats) UnmarshalJSON(data []byte) error {
 	type Alias DurationStats
 	j := &struct {
 		*Alias
-		Mean     time.Duration `json:"mean"`
-		Median   time.Duration `json:"median,omitempty"`
-		Stddev   time.Duration `json:"stddev"`
-		Variance time.Duration `json:"variance"`
+		Mean      time.Duration            `json:"mean"`
+		Median    time.Duration            `json:"median,omitempty"`
+		Stddev    time.Duration            `json:"stddev"`
+		Variance  time.Duration            `json:"variance"`
+		Quantiles map[string]time.Duration `json:"quantiles,omitempty"`
 	}{}
 	if err := json.Unmarshal(data, &j); err != nil {
 		return err
 	}
+	// parse quantiles, sorted by percentile
+	var qs []Quantile
+	for k, v := range j.Quantiles {
+		p, err := strconv.ParseFloat(strings.TrimPrefix(k, "p"), 64)
+		if err != nil {
+			return err
+		}
+		qs = append(qs, Quantile{p, v})
+	}
+	sort.Slice(qs, func(i, k int) bool {
+		return qs[i].Percentile < qs[k].Percentile
+	})
 	// reverse engineer s from the variance
 	var ss float64
 	if j.N > 1 {
@@ -518,6 +731,7 @@ func (s *DurationStats) UnmarshalJSON(data []byte) error {
 		float64(j.Mean),
 		float64(j.Median),
 		j.Median != 0,
+		qs,
 	}
 	return nil
 }
@@ -545,3 +759,14 @@ type RecorderHandler interface {
 	// OnReceived is called when a packet is received.
 	OnReceived(seqno Seqno, rtd *RoundTripData, pred *RoundTripData, dup bool)
 }
+
+// RoundTripHandler may be implemented by a ClientHandler to receive each
+// RoundTrip in order once it's final, and will no longer be updated. In
+// streaming or incremental mode, round trips are final when they're removed
+// from the circular buffer (see ClientConfig.StreamBufLen and Incremental), or
+// at the end of the test.
+// OnRoundTrip is called with the Recorder locked (see Recorder), and the
+// RoundTrip is only valid until OnRoundTrip returns.
+type RoundTripHandler interface {
+	OnRoundTrip(rt *RoundTrip)
+}
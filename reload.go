@@ -0,0 +1,265 @@
+package irtt
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Reload applies a new configuration to the running Server, without dropping
+// tests in progress. Listeners are started for new bind addresses, and
+// listeners for bind addresses that were removed close their conns like on
+// Shutdown, then stop. Limits and other settings apply to new conns, and to the
+// requests of existing conns. If the HMAC key changed, existing conns continue
+// to use the key they were opened with, and new conns must use the new key.
+//
+// Addrs are ignored if the Server was started with Conns. Conns, Handler,
+// TimeSource, ThreadLock, MetricsAddr and ControlSocket are not changed.
+func (s *Server) Reload(cfg *ServerConfig) (err error) {
+	s.changeMtx.Lock()
+	defer s.changeMtx.Unlock()
+	if s.errC == nil || s.isShutdown() {
+		return Errorf(ReloadFailed, "server not running")
+	}
+	ls := s.getListeners()
+
+	// create listeners for new bind addresses, and find those to remove
+	var added, removed []*listener
+	if !s.activated {
+		if added, removed, err = s.diffListeners(ls, cfg); err != nil {
+			return
+		}
+	}
+
+	// apply settings, with all listeners locked
+	var nprev int
+	var ttlErr error
+	s.withListenersLocked(ls, func() {
+		prevKey := s.HMACKey
+		prevTTL := s.TTL
+		s.Addrs = cfg.Addrs
+		s.IPVersion = cfg.IPVersion
+		s.SetSrcIP = cfg.SetSrcIP
+		s.HMACKey = cfg.HMACKey
+		s.MaxDuration = cfg.MaxDuration
+		s.MinInterval = cfg.MinInterval
+		s.MaxLength = cfg.MaxLength
+		s.Timeout = cfg.Timeout
+		s.OpenTimeout = cfg.OpenTimeout
+		s.ShutdownGrace = cfg.ShutdownGrace
+		s.PacketBurst = cfg.PacketBurst
+		s.Filler = cfg.Filler
+		s.AllowFills = cfg.AllowFills
+		s.AllowStamp = cfg.AllowStamp
+		s.AllowDSCP = cfg.AllowDSCP
+		s.AllowReceivedTOS = cfg.AllowReceivedTOS
+		s.TTL = cfg.TTL
+		s.SourceLimits = cfg.SourceLimits
+		s.MaxOpenRate = cfg.MaxOpenRate
+		s.MaxConns = cfg.MaxConns
+		s.ListenerMaxConns = cfg.ListenerMaxConns
+		s.ConnLimitPolicy = cfg.ConnLimitPolicy
+		s.ACL = cfg.ACL
+		s.ListenerACLs = cfg.ListenerACLs
+		s.ACLPolicy = cfg.ACLPolicy
+		s.MaxBitrate = cfg.MaxBitrate
+		s.ListenerMaxBitrate = cfg.ListenerMaxBitrate
+		s.BitratePolicy = cfg.BitratePolicy
+		s.BanRate = cfg.BanRate
+		s.BanTime = cfg.BanTime
+		s.bans.setRate(s.BanRate, s.BanTime)
+		s.bitrate.setRate(s.MaxBitrate)
+		s.limiter.setLimits(s.SourceLimits, s.MaxOpenRate)
+		for _, l := range ls {
+			for _, sc := range l.cmgr.sconns {
+				s.limiter.addConn(sc.raddr.IP)
+			}
+		}
+		for _, l := range removed {
+			l.closing = true
+		}
+		for _, l := range added {
+			l.bitrate.setRate(s.ListenerMaxBitrate)
+		}
+		for _, l := range ls {
+			l.bitrate.setRate(s.ListenerMaxBitrate)
+			if !bytes.Equal(prevKey, s.HMACKey) {
+				nprev += l.rotateKey(prevKey)
+			}
+			if s.TTL != prevTTL && s.TTL != 0 && !l.closing {
+				if terr := l.conn.setTTL(s.TTL); terr != nil && ttlErr == nil {
+					ttlErr = terr
+				}
+			}
+		}
+	})
+
+	// send ConfigReload events
+	if s.Handler != nil {
+		s.Handler.OnEvent(Eventf(ConfigReload, nil, nil,
+			"reloaded configuration, adding %d and removing %d listener(s)",
+			len(added), len(removed)))
+		if nprev > 0 {
+			s.Handler.OnEvent(Eventf(ConfigReload, nil, nil,
+				"HMAC key changed, %d connection(s) continue with previous key",
+				nprev))
+		}
+		if ttlErr != nil {
+			s.Handler.OnEvent(Eventf(ConfigReloadError, nil, nil,
+				"unable to change TTL (%s)", ttlErr))
+		}
+		var restart []string
+		if cfg.ThreadLock != s.ThreadLock {
+			restart = append(restart, "thread")
+		}
+		if cfg.MetricsAddr != s.MetricsAddr {
+			restart = append(restart, "metrics")
+		}
+		if cfg.ControlSocket != s.ControlSocket {
+			restart = append(restart, "ctl")
+		}
+		if len(restart) > 0 {
+			s.Handler.OnEvent(Eventf(ConfigReloadError, nil, nil,
+				"changes to %s require a restart", strings.Join(restart, ", ")))
+		}
+	}
+
+	// start new listeners, and close removed ones
+	for _, l := range added {
+		s.startListener(l)
+	}
+	grace := s.shutdownGrace(s.getListeners())
+	for _, l := range removed {
+		l.eventf(ListenerRemove, nil, "removing listener on %s, grace period %s",
+			l.conn.localAddr(), grace)
+		go func(l *listener) {
+			if grace > 0 {
+				s.closeConns([]*listener{l}, grace)
+			}
+			l.shutdown()
+			l.mtx.Lock()
+			l.cmgr.removeAll()
+			l.mtx.Unlock()
+		}(l)
+	}
+	return
+}
+
+// diffListeners creates listeners for the bind addresses in cfg that aren't
+// already in ls, and returns them, along with the listeners in ls for bind
+// addresses that were removed.
+func (s *Server) diffListeners(ls []*listener, cfg *ServerConfig) (added,
+	removed []*listener, err error) {
+	laddrs, err := resolveListenAddrs(cfg.Addrs, cfg.IPVersion)
+	if err != nil {
+		return
+	}
+	if len(laddrs) == 0 {
+		err = Errorf(NoSuitableAddressFound, "no suitable %s address found",
+			cfg.IPVersion)
+		return
+	}
+	defer func() {
+		if err != nil {
+			for _, l := range added {
+				l.conn.close()
+			}
+			added = nil
+		}
+	}()
+	keep := make(map[*listener]bool)
+laddrs:
+	for _, laddr := range laddrs {
+		for _, l := range ls {
+			if !l.isClosing() && l.conn.localAddr().String() == laddr.String() {
+				keep[l] = true
+				continue laddrs
+			}
+		}
+		var lc *lconn
+		if lc, err = listen(laddr, cfg.SetSrcIP, s.TimeSource); err != nil {
+			return
+		}
+		added = append(added, newListener(s, lc))
+	}
+	for _, l := range ls {
+		if !keep[l] && !l.isClosing() {
+			removed = append(removed, l)
+		}
+	}
+	return
+}
+
+// isClosing returns true if the listener is closing its conns.
+func (l *listener) isClosing() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.closing
+}
+
+// rotateKey is called after the HMAC key was changed from prev. Previous keys
+// are kept for as long as conns opened with them remain, and the number of
+// those conns is returned. It must be called with mtx held.
+func (l *listener) rotateKey(prev []byte) (n int) {
+	keys := append(l.prevKeys, prev)
+	l.prevKeys = nil
+	for _, k := range keys {
+		if bytes.Equal(k, l.HMACKey) || l.hasPrevKey(k) {
+			continue
+		}
+		used := 0
+		for _, sc := range l.cmgr.sconns {
+			if !sc.expired() && bytes.Equal(sc.hmacKey, k) {
+				used++
+			}
+		}
+		if used > 0 {
+			l.prevKeys = append(l.prevKeys, k)
+			n += used
+		}
+	}
+	return
+}
+
+// hasPrevKey returns true if key is a previous HMAC key still in use.
+func (l *listener) hasPrevKey(key []byte) bool {
+	for _, k := range l.prevKeys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateKeys validates a packet that was validated with a key other than
+// the current HMAC key, or failed HMAC validation with err, using the current
+// key and any previous keys still in use. On success, the packet is left set
+// to the key that matched. It must be called with mtx held.
+func (l *listener) validateKeys(p *packet, err error) error {
+	tried := p.hmacKey
+	if err == nil && l.hasPrevKey(tried) {
+		return nil
+	}
+	n := len(p.buf)
+	for _, k := range append([][]byte{l.HMACKey}, l.prevKeys...) {
+		if bytes.Equal(k, tried) {
+			continue
+		}
+		p.setHMACKey(k)
+		if p.readReset(n) == nil {
+			if p.reply() {
+				return Errorf(UnexpectedReplyFlag, "unexpected reply flag set")
+			}
+			return nil
+		}
+	}
+	if err == nil {
+		err = Errorf(BadHMAC, "HMAC key no longer valid")
+	}
+	return err
+}
+
+// isHMACError returns true if err is from HMAC validation.
+func isHMACError(err error) bool {
+	return isErrorCode(BadHMAC, err) || isErrorCode(NoHMAC, err) ||
+		isErrorCode(UnexpectedHMAC, err)
+}
@@ -8,9 +8,11 @@ import (
 )
 
 type PrintableResult struct {
-	SendErr    error `json:"send_err,omitempty"`
-	ReceiveErr error `json:"receive_err,omitempty"`
-	*Stats     `json:"stats"`
+	SendErr        error       `json:"send_err,omitempty"`
+	ReceiveErr     error       `json:"receive_err,omitempty"`
+	ServerShutdown bool        `json:"server_shutdown,omitempty"`
+	ServerClose    CloseReason `json:"server_close,omitempty"`
+	*Stats         `json:"stats"`
 }
 
 // Result is returned from Run.
@@ -38,6 +40,81 @@ func newResult(rec *Recorder, cfg *ClientConfig, serr error, rerr error) *Result
 	// calculate total duration (monotonic time since start)
 	r.Duration = cfg.TimeSource.Now(Monotonic).Sub(r.Start)
 
+	// calculate round trip stats, or if round trips were finalized during the
+	// test, use the final stats
+	if rec.finalStats != nil {
+		rec.finalStats.setStats(r.Stats, cfg.Percentiles)
+	} else {
+		r.calculateRoundTripStats(rec, cfg)
+	}
+
+	// set packets sent and received
+	r.PacketsSent = r.SendCallStats.N
+	r.PacketsReceived = r.RTTStats.N + r.Duplicates
+
+	// calculate expected packets sent based on the time between the first and
+	// last send, or for non-isochronous schedules, where sends are never
+	// skipped, use the number of packets sent
+	if _, ok := cfg.Scheduler.(*IsochronousScheduler); ok {
+		r.ExpectedPacketsSent = pcount(r.LastSent.Sub(r.FirstSend),
+			r.Config.Interval)
+	} else {
+		r.ExpectedPacketsSent = r.PacketsSent
+	}
+
+	// calculate timer stats
+	r.TimerErrPercent = 100 * float64(r.TimerErrorStats.Mean()) / float64(r.Config.Interval)
+
+	// for some reason, occasionally one more packet is sent than expected, which
+	// wraps around the uint, so just punt and hard prevent this for now
+	if r.ExpectedPacketsSent < r.PacketsSent {
+		r.TimerMisses = 0
+		r.ExpectedPacketsSent = r.PacketsSent
+	} else {
+		r.TimerMisses = r.ExpectedPacketsSent - r.PacketsSent
+	}
+	r.TimerMissPercent = 100 * float64(r.TimerMisses) / float64(r.ExpectedPacketsSent)
+
+	// calculate send rate
+	r.SendRate = calculateBitrate(r.BytesSent, r.LastSent.Sub(r.FirstSend))
+
+	// calculate receive rate (start from time of first receipt)
+	r.ReceiveRate = calculateBitrate(r.BytesReceived, r.LastReceived.Sub(r.FirstReceived))
+
+	// calculate packet loss percent
+	if r.RTTStats.N > 0 {
+		r.PacketLossPercent = 100 * float64(r.SendCallStats.N-r.RTTStats.N) /
+			float64(r.SendCallStats.N)
+	} else {
+		r.PacketLossPercent = float64(100)
+	}
+
+	// calculate upstream and downstream loss percent
+	if r.ServerPacketsReceived > 0 {
+		r.UpstreamLossPercent = 100 *
+			float64(r.SendCallStats.N-uint(r.ServerPacketsReceived)) /
+			float64(r.SendCallStats.N)
+		r.DownstreamLossPercent = 100.0 *
+			float64(uint(r.ServerPacketsReceived)-r.PacketsReceived) /
+			float64(r.ServerPacketsReceived)
+	}
+
+	// calculate duplicate percent
+	if r.PacketsReceived > 0 {
+		r.DuplicatePercent = 100 * float64(r.Duplicates) / float64(r.PacketsReceived)
+	}
+
+	// calculate late packets percent
+	if r.PacketsReceived > 0 {
+		r.LatePacketsPercent = 100 * float64(r.LatePackets) / float64(r.PacketsReceived)
+	}
+
+	return r
+}
+
+// calculateRoundTripStats creates the RoundTrips from the RoundTripData, and
+// calculates the stats that require all round trips.
+func (r *Result) calculateRoundTripStats(rec *Recorder, cfg *ClientConfig) {
 	// create RoundTrips array
 	r.RoundTrips = make([]RoundTrip, len(rec.RoundTripData))
 	for i := 0; i < len(r.RoundTrips); i++ {
@@ -115,67 +192,10 @@ func newResult(rec *Recorder, cfg *ClientConfig, serr error, rerr error) *Result
 			r.ServerProcessingTimeStats.push(spt)
 		}
 	}
-
-	// set packets sent and received
-	r.PacketsSent = r.SendCallStats.N
-	r.PacketsReceived = r.RTTStats.N + r.Duplicates
-
-	// calculate expected packets sent based on the time between the first and
-	// last send
-	r.ExpectedPacketsSent = pcount(r.LastSent.Sub(r.FirstSend), r.Config.Interval)
-
-	// calculate timer stats
-	r.TimerErrPercent = 100 * float64(r.TimerErrorStats.Mean()) / float64(r.Config.Interval)
-
-	// for some reason, occasionally one more packet is sent than expected, which
-	// wraps around the uint, so just punt and hard prevent this for now
-	if r.ExpectedPacketsSent < r.PacketsSent {
-		r.TimerMisses = 0
-		r.ExpectedPacketsSent = r.PacketsSent
-	} else {
-		r.TimerMisses = r.ExpectedPacketsSent - r.PacketsSent
-	}
-	r.TimerMissPercent = 100 * float64(r.TimerMisses) / float64(r.ExpectedPacketsSent)
-
-	// calculate send rate
-	r.SendRate = calculateBitrate(r.BytesSent, r.LastSent.Sub(r.FirstSend))
-
-	// calculate receive rate (start from time of first receipt)
-	r.ReceiveRate = calculateBitrate(r.BytesReceived, r.LastReceived.Sub(r.FirstReceived))
-
-	// calculate packet loss percent
-	if r.RTTStats.N > 0 {
-		r.PacketLossPercent = 100 * float64(r.SendCallStats.N-r.RTTStats.N) /
-			float64(r.SendCallStats.N)
-	} else {
-		r.PacketLossPercent = float64(100)
-	}
-
-	// calculate upstream and downstream loss percent
-	if r.ServerPacketsReceived > 0 {
-		r.UpstreamLossPercent = 100 *
-			float64(r.SendCallStats.N-uint(r.ServerPacketsReceived)) /
-			float64(r.SendCallStats.N)
-		r.DownstreamLossPercent = 100.0 *
-			float64(uint(r.ServerPacketsReceived)-r.PacketsReceived) /
-			float64(r.ServerPacketsReceived)
-	}
-
-	// calculate duplicate percent
-	if r.PacketsReceived > 0 {
-		r.DuplicatePercent = 100 * float64(r.Duplicates) / float64(r.PacketsReceived)
-	}
-
-	// calculate late packets percent
-	if r.PacketsReceived > 0 {
-		r.LatePacketsPercent = 100 * float64(r.LatePackets) / float64(r.PacketsReceived)
-	}
-
-	return r
 }
 
 // visitStats visits each RoundTrip, optionally pushes to a DurationStats, and
-// at the end, sets the median value on the DurationStats.
+// at the end, sets the median and quantile values on the DurationStats.
 func (r *Result) visitStats(ds *DurationStats, push bool,
 	fn func(*RoundTrip) time.Duration) {
 	fs := make([]float64, 0, len(r.RoundTrips))
@@ -190,6 +210,10 @@ func (r *Result) visitStats(ds *DurationStats, push bool,
 	}
 	if len(fs) > 0 {
 		ds.setMedian(median(fs))
+		// fs is now sorted, as required for quantiles
+		if len(r.Config.Percentiles) > 0 {
+			ds.setQuantiles(quantiles(fs, r.Config.Percentiles))
+		}
 	}
 }
 
@@ -229,18 +253,88 @@ func (rt *RoundTrip) MarshalJSON() ([]byte, error) {
 		ipdv["receive"] = rt.ReceiveIPDV
 	}
 
+	var tos map[string]interface{}
+	if rt.ServerReceivedTOS.IsValid() || rt.ReceivedTOS.IsValid() {
+		tos = make(map[string]interface{})
+		tos["sent"] = rt.SentTOS
+		if rt.ServerReceivedTOS.IsValid() {
+			tos["server_received"] = rt.ServerReceivedTOS
+		}
+		if rt.ReceivedTOS.IsValid() {
+			tos["received"] = rt.ReceivedTOS
+		}
+	}
+
+	var sched *time.Duration
+	if rt.Scheduled != InvalidDuration {
+		sched = &rt.Scheduled
+	}
+
 	j := &struct {
 		*Alias
-		Delay map[string]interface{} `json:"delay"`
-		IPDV  map[string]interface{} `json:"ipdv"`
+		Length    int                    `json:"length"`
+		Scheduled *time.Duration         `json:"scheduled,omitempty"`
+		Delay     map[string]interface{} `json:"delay"`
+		IPDV      map[string]interface{} `json:"ipdv"`
+		TOS       map[string]interface{} `json:"tos,omitempty"`
 	}{
-		Alias: (*Alias)(rt),
-		Delay: delay,
-		IPDV:  ipdv,
+		Alias:     (*Alias)(rt),
+		Length:    rt.Length,
+		Scheduled: sched,
+		Delay:     delay,
+		IPDV:      ipdv,
+		TOS:       tos,
 	}
 	return json.Marshal(j)
 }
 
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (rt *RoundTrip) UnmarshalJSON(data []byte) error {
+	type Alias RoundTrip
+	j := &struct {
+		*Alias
+		Length    int            `json:"length"`
+		Scheduled *time.Duration `json:"scheduled"`
+		IPDV      struct {
+			RTT     *time.Duration `json:"rtt"`
+			Send    *time.Duration `json:"send"`
+			Receive *time.Duration `json:"receive"`
+		} `json:"ipdv"`
+		TOS struct {
+			Sent           *TOS `json:"sent"`
+			ServerReceived *TOS `json:"server_received"`
+			Received       *TOS `json:"received"`
+		} `json:"tos"`
+	}{
+		Alias: (*Alias)(rt),
+	}
+	rt.RoundTripData = &RoundTripData{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return err
+	}
+	rt.Length = j.Length
+	dur := func(d *time.Duration) time.Duration {
+		if d == nil {
+			return InvalidDuration
+		}
+		return *d
+	}
+	rt.Scheduled = dur(j.Scheduled)
+	rt.IPDV = dur(j.IPDV.RTT)
+	rt.SendIPDV = dur(j.IPDV.Send)
+	rt.ReceiveIPDV = dur(j.IPDV.Receive)
+	tos := func(t *TOS) TOS {
+		if t == nil {
+			return InvalidTOS
+		}
+		return *t
+	}
+	rt.SentTOS = tos(j.TOS.Sent)
+	rt.ServerReceivedTOS = tos(j.TOS.ServerReceived)
+	rt.ReceivedTOS = tos(j.TOS.Received)
+	return nil
+}
+
 // Stats are the statistics in the Result.
 type Stats struct {
 	*Recorder
@@ -264,6 +358,74 @@ type Stats struct {
 	ReceiveRate               Bitrate       `json:"receive_rate"`
 }
 
+// finalStats accumulates the stats that are otherwise calculated from all
+// RoundTrips in newResult, for when round trips are finalized during the test
+// and not kept. Medians and quantiles are approximate (see DurationSketch).
+type finalStats struct {
+	rtt                       DurationSketch
+	sendDelay                 DurationSketch
+	receiveDelay              DurationSketch
+	ipdv                      DurationSketch
+	sendIPDV                  DurationSketch
+	receiveIPDV               DurationSketch
+	sendIPDVStats             DurationStats
+	receiveIPDVStats          DurationStats
+	roundTripIPDVStats        DurationStats
+	serverProcessingTimeStats DurationStats
+}
+
+// push adds a final RoundTrip to the stats.
+func (fs *finalStats) push(rt *RoundTrip) {
+	pushIf := func(k *DurationSketch, ds *DurationStats, d time.Duration) {
+		if d == InvalidDuration {
+			return
+		}
+		if k != nil {
+			k.push(d)
+		}
+		if ds != nil {
+			ds.push(d)
+		}
+	}
+	pushIf(&fs.rtt, nil, rt.RTT())
+	pushIf(&fs.sendDelay, nil, rt.SendDelay())
+	pushIf(&fs.receiveDelay, nil, rt.ReceiveDelay())
+	if rt.IPDV != InvalidDuration {
+		pushIf(&fs.ipdv, &fs.roundTripIPDVStats, AbsDuration(rt.IPDV))
+	}
+	if rt.SendIPDV != InvalidDuration {
+		pushIf(&fs.sendIPDV, &fs.sendIPDVStats, AbsDuration(rt.SendIPDV))
+	}
+	if rt.ReceiveIPDV != InvalidDuration {
+		pushIf(&fs.receiveIPDV, &fs.receiveIPDVStats,
+			AbsDuration(rt.ReceiveIPDV))
+	}
+	pushIf(nil, &fs.serverProcessingTimeStats, rt.ServerProcessingTime())
+}
+
+// setStats sets the final stats on Stats, including the approximate medians
+// and quantiles.
+func (fs *finalStats) setStats(s *Stats, ps Percentiles) {
+	s.SendIPDVStats = fs.sendIPDVStats
+	s.ReceiveIPDVStats = fs.receiveIPDVStats
+	s.RoundTripIPDVStats = fs.roundTripIPDVStats
+	s.ServerProcessingTimeStats = fs.serverProcessingTimeStats
+	set := func(ds *DurationStats, k *DurationSketch) {
+		if m, ok := k.Quantile(50); ok {
+			ds.setMedian(float64(m))
+		}
+		if len(ps) > 0 && k.N() > 0 {
+			ds.setQuantiles(k.quantiles(ps))
+		}
+	}
+	set(&s.RTTStats, &fs.rtt)
+	set(&s.SendDelayStats, &fs.sendDelay)
+	set(&s.ReceiveDelayStats, &fs.receiveDelay)
+	set(&s.RoundTripIPDVStats, &fs.ipdv)
+	set(&s.SendIPDVStats, &fs.sendIPDV)
+	set(&s.ReceiveIPDVStats, &fs.receiveIPDV)
+}
+
 // median calculates the median value of the supplied float64 slice. The array
 // is sorted in place, so its original order is modified.
 func median(f []float64) float64 {
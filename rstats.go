@@ -74,3 +74,18 @@ func (l Lost) String() string {
 func (l Lost) MarshalJSON() ([]byte, error) {
 	return json.Marshal(l.String())
 }
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (l *Lost) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	for i, v := range lsts {
+		if v == s {
+			*l = Lost(i)
+			return nil
+		}
+	}
+	return Errorf(InvalidLostString, "invalid Lost string: %s", s)
+}
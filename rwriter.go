@@ -0,0 +1,175 @@
+package irtt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// resultWriter writes a Result as JSON incrementally. The version, system info
+// and config are written first, followed by each round trip as it's finalized
+// during the test, and the remaining fields at the end. The output is
+// equivalent to that of writeResultJSON, except for the order of the fields,
+// so it may be read by the report command.
+type resultWriter struct {
+	output  string
+	header  func() interface{}
+	anon    *anonymizer
+	f       *os.File
+	gzw     *gzip.Writer
+	w       *bufio.Writer
+	n       uint
+	flushed time.Time
+}
+
+// newResultWriter returns a new resultWriter for the output, which follows the
+// same conventions as writeResultJSON. The header func is called when the first
+// round trip is written, or at close if no round trips were written. If anon is
+// not nil, it's used to anonymize the remaining fields written at close, and
+// the header should already be anonymized.
+func newResultWriter(output string, header func() interface{},
+	anon *anonymizer) *resultWriter {
+	return &resultWriter{
+		output: output,
+		header: header,
+		anon:   anon,
+	}
+}
+
+// open creates the output and writes the header.
+func (w *resultWriter) open() (err error) {
+	var out io.Writer = os.Stdout
+	var gz bool
+	if w.output != "-" {
+		var name string
+		name, gz = resultOutputName(w.output)
+		if w.f, err = os.Create(name); err != nil {
+			return
+		}
+		out = w.f
+	}
+	if gz {
+		w.gzw = gzip.NewWriter(out)
+		out = w.gzw
+	}
+	w.w = bufio.NewWriter(out)
+	w.flushed = time.Now()
+
+	// write header fields, leaving the object open for the round trips
+	b, err := json.MarshalIndent(w.header(), "", "    ")
+	if err != nil {
+		return
+	}
+	b = b[:len(b)-2]
+	_, err = w.w.Write(append(b, ",\n    \"round_trips\": ["...))
+	return
+}
+
+// writeRoundTrip writes a final round trip.
+func (w *resultWriter) writeRoundTrip(rt *RoundTrip) (err error) {
+	if w.w == nil {
+		if err = w.open(); err != nil {
+			return
+		}
+	}
+	b, err := json.MarshalIndent(rt, "        ", "    ")
+	if err != nil {
+		return
+	}
+	sep := ",\n        "
+	if w.n == 0 {
+		sep = sep[1:]
+	}
+	if _, err = w.w.WriteString(sep); err != nil {
+		return
+	}
+	if _, err = w.w.Write(b); err != nil {
+		return
+	}
+	w.n++
+	if time.Since(w.flushed) >= flushInterval {
+		w.flushed = time.Now()
+		err = w.flush()
+	}
+	return
+}
+
+// flush flushes any buffered output, including to the gzip writer.
+func (w *resultWriter) flush() (err error) {
+	if err = w.w.Flush(); err != nil {
+		return
+	}
+	if w.gzw != nil {
+		err = w.gzw.Flush()
+	}
+	return
+}
+
+// close writes the remaining fields of the Result and closes the output.
+func (w *resultWriter) close(r *Result) (err error) {
+	if w.w == nil {
+		if err = w.open(); err != nil {
+			return
+		}
+	}
+	end := "\n    ]"
+	if w.n == 0 {
+		end = "]"
+	}
+	if _, err = w.w.WriteString(end); err != nil {
+		return
+	}
+
+	// write remaining fields, without the opening brace
+	b, err := json.MarshalIndent(&r.PrintableResult, "", "    ")
+	if err != nil {
+		return
+	}
+	if w.anon != nil {
+		var ab bytes.Buffer
+		if err = w.anon.rewrite(bytes.NewReader(b), &ab); err != nil {
+			return
+		}
+		b = bytes.TrimSuffix(ab.Bytes(), []byte("\n"))
+	}
+	b[0] = ','
+	if _, err = w.w.Write(append(b, '\n')); err != nil {
+		return
+	}
+	if err = w.flush(); err != nil {
+		return
+	}
+	if w.gzw != nil {
+		if err = w.gzw.Close(); err != nil {
+			return
+		}
+	}
+	if w.f != nil {
+		err = w.f.Close()
+	}
+	return
+}
+
+// abort flushes what it can and closes the output without writing the
+// remaining fields, after an error writing it. The output is then incomplete,
+// but any gzip stream is terminated.
+func (w *resultWriter) abort() (err error) {
+	if w.w != nil {
+		err = w.w.Flush()
+	}
+	if w.gzw != nil {
+		if gerr := w.gzw.Close(); err == nil {
+			err = gerr
+		}
+	}
+	if w.f != nil {
+		if ferr := w.f.Close(); err == nil {
+			err = ferr
+		}
+	}
+	return
+}
@@ -0,0 +1,294 @@
+package irtt
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scheduler is implemented to determine the send schedule, that is, when each
+// packet is sent and how long it is.
+type Scheduler interface {
+	// Next returns the time the packet with the given seqno should be sent,
+	// relative to the start of the test, and the length of the packet. The
+	// Interval and Length in params are those negotiated with the server, and
+	// should be used as the mean interval and maximum length, respectively.
+	// sent is when the prior packet was sent and now is the current time, both
+	// relative to the start of the test. If the returned time has already
+	// passed, the packet is sent immediately. For seqno 0, Next is called
+	// before the start of the test and only the length is used. The returned
+	// length is increased as necessary for the irtt headers, and is reduced to
+	// params.Length if it exceeds it. ScheduleEnd may be returned to end the
+	// test before its duration has passed.
+	Next(seqno Seqno, params *Params, sent, now time.Duration) (time.Duration,
+		int)
+
+	String() string
+}
+
+// ScheduleEnd is returned by Scheduler.Next when there are no more packets to
+// send.
+const ScheduleEnd = time.Duration(math.MaxInt64)
+
+// IsochronousScheduler sends fixed length packets at a fixed interval. If a
+// send occurs more than half-way to the next interval, the next interval is
+// skipped.
+type IsochronousScheduler struct {
+}
+
+// Next returns the next interval and the negotiated length.
+func (s *IsochronousScheduler) Next(seqno Seqno, params *Params, sent,
+	now time.Duration) (time.Duration, int) {
+	// set the current base interval we're at
+	i := params.Interval
+	next := i * (now / i)
+
+	// if we're under half-way to the next interval, send at the next interval,
+	// but if we're over half-way, send at the interval after that
+	if sent%i < i/2 {
+		next += i
+	} else {
+		next += 2 * i
+	}
+	return next, params.Length
+}
+
+func (s *IsochronousScheduler) String() string {
+	return "iso"
+}
+
+// PoissonScheduler sends fixed length packets with exponentially distributed
+// intervals, with the negotiated interval as the mean. This simulates
+// independent arrivals, such as requests from a large number of users.
+type PoissonScheduler struct {
+	rnd  *rand.Rand
+	next time.Duration
+}
+
+// NewPoissonScheduler returns a new PoissonScheduler.
+func NewPoissonScheduler() *PoissonScheduler {
+	return &PoissonScheduler{
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next returns the prior scheduled time plus a random exponential interval.
+func (s *PoissonScheduler) Next(seqno Seqno, params *Params, sent,
+	now time.Duration) (time.Duration, int) {
+	if seqno == 0 {
+		s.next = 0
+	} else {
+		s.next += time.Duration(s.rnd.ExpFloat64() * float64(params.Interval))
+	}
+	return s.next, params.Length
+}
+
+func (s *PoissonScheduler) String() string {
+	return "poisson"
+}
+
+// JitterScheduler sends fixed length packets at the negotiated interval, with
+// each send time uniformly distributed within a fraction of the interval
+// around its isochronous send time.
+type JitterScheduler struct {
+	Fraction float64
+	rnd      *rand.Rand
+}
+
+// NewJitterScheduler returns a new JitterScheduler with the given fraction of
+// the interval (0 - 1.0) to jitter send times by.
+func NewJitterScheduler(fraction float64) *JitterScheduler {
+	return &JitterScheduler{
+		Fraction: fraction,
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next returns the isochronous send time plus uniform jitter.
+func (s *JitterScheduler) Next(seqno Seqno, params *Params, sent,
+	now time.Duration) (time.Duration, int) {
+	i := float64(params.Interval)
+	j := (s.rnd.Float64() - 0.5) * s.Fraction * i
+	return time.Duration(float64(seqno)*i + j), params.Length
+}
+
+func (s *JitterScheduler) String() string {
+	return fmt.Sprintf("jitter:%g", s.Fraction)
+}
+
+// OnOffScheduler sends fixed length packets at the negotiated interval during
+// on periods, and sends nothing during off periods. This simulates bursty
+// traffic, such as talk spurts in VoIP.
+type OnOffScheduler struct {
+	On  time.Duration
+	Off time.Duration
+}
+
+// Next returns the next send time in the current on period, or the start of
+// the next on period.
+func (s *OnOffScheduler) Next(seqno Seqno, params *Params, sent,
+	now time.Duration) (time.Duration, int) {
+	n := Seqno((s.On + params.Interval - 1) / params.Interval)
+	if n == 0 {
+		n = 1
+	}
+	cycle := time.Duration(seqno/n) * (s.On + s.Off)
+	return cycle + time.Duration(seqno%n)*params.Interval, params.Length
+}
+
+func (s *OnOffScheduler) String() string {
+	return fmt.Sprintf("onoff:%s/%s", s.On, s.Off)
+}
+
+// RampScheduler starts sending at a multiple of the negotiated interval with
+// minimum length packets, then linearly decreases the interval and increases
+// the length until the negotiated interval and length are reached at the end
+// of the test.
+type RampScheduler struct {
+	Factor float64
+	next   time.Duration
+}
+
+// Next returns the prior scheduled time plus the current ramped interval,
+// and the current ramped length.
+func (s *RampScheduler) Next(seqno Seqno, params *Params, sent,
+	now time.Duration) (time.Duration, int) {
+	if seqno == 0 {
+		s.next = 0
+		return 0, 0
+	}
+	// with no duration, there's nothing to ramp over
+	f := 1.0
+	if params.Duration > 0 {
+		f = math.Min(float64(s.next)/float64(params.Duration), 1)
+	}
+	s.next += time.Duration(float64(params.Interval) * (s.Factor - (s.Factor-1)*f))
+	return s.next, int(f * float64(params.Length))
+}
+
+func (s *RampScheduler) String() string {
+	return fmt.Sprintf("ramp:%g", s.Factor)
+}
+
+// SchedulerFactories are the registered Scheduler factories.
+var SchedulerFactories = make([]SchedulerFactory, 0)
+
+// SchedulerFactory can create a Scheduler from a string.
+type SchedulerFactory struct {
+	FactoryFunc func(string) (Scheduler, error)
+	Usage       string
+}
+
+// RegisterScheduler registers a new Scheduler.
+func RegisterScheduler(fn func(string) (Scheduler, error), usage string) {
+	SchedulerFactories = append(SchedulerFactories, SchedulerFactory{fn, usage})
+}
+
+// NewScheduler returns a Scheduler from a string.
+func NewScheduler(s string) (Scheduler, error) {
+	for _, fac := range SchedulerFactories {
+		sch, err := fac.FactoryFunc(s)
+		if err != nil {
+			return nil, err
+		}
+		if sch != nil {
+			return sch, nil
+		}
+	}
+	return nil, Errorf(NoSuchScheduler, "no such Scheduler %s", s)
+}
+
+func init() {
+	RegisterScheduler(
+		func(s string) (sch Scheduler, err error) {
+			if s == "iso" {
+				sch = &IsochronousScheduler{}
+			}
+			return
+		},
+		"iso: isochronous, fixed interval and length",
+	)
+
+	RegisterScheduler(
+		func(s string) (sch Scheduler, err error) {
+			if s == "poisson" {
+				sch = NewPoissonScheduler()
+			}
+			return
+		},
+		"poisson: exponential intervals with mean of interval",
+	)
+
+	RegisterScheduler(
+		func(s string) (Scheduler, error) {
+			args := strings.Split(s, ":")
+			if args[0] != "jitter" {
+				return nil, nil
+			}
+			if len(args) == 1 {
+				return NewJitterScheduler(DefaultJitterFraction), nil
+			}
+			f, err := strconv.ParseFloat(args[1], 64)
+			if err != nil || f <= 0 || f > 1 {
+				return nil, Errorf(InvalidSchedulerArgs,
+					"invalid fraction %s to jitter scheduler", args[1])
+			}
+			return NewJitterScheduler(f), nil
+		},
+		fmt.Sprintf("jitter:#: uniform jitter of # of interval (dfl %.2f)",
+			DefaultJitterFraction),
+	)
+
+	RegisterScheduler(
+		func(s string) (Scheduler, error) {
+			args := strings.Split(s, ":")
+			if args[0] != "onoff" {
+				return nil, nil
+			}
+			if len(args) == 1 {
+				return &OnOffScheduler{DefaultOnDuration, DefaultOffDuration}, nil
+			}
+			ds := strings.Split(args[1], "/")
+			if len(ds) != 2 {
+				return nil, Errorf(InvalidSchedulerArgs,
+					"invalid on/off durations %s to onoff scheduler", args[1])
+			}
+			on, err := time.ParseDuration(ds[0])
+			if err != nil || on <= 0 {
+				return nil, Errorf(InvalidSchedulerArgs,
+					"invalid on duration %s to onoff scheduler", ds[0])
+			}
+			off, err := time.ParseDuration(ds[1])
+			if err != nil || off < 0 {
+				return nil, Errorf(InvalidSchedulerArgs,
+					"invalid off duration %s to onoff scheduler", ds[1])
+			}
+			return &OnOffScheduler{on, off}, nil
+		},
+		fmt.Sprintf("onoff:on/off: send for on, pause for off (dfl %s/%s)",
+			DefaultOnDuration, DefaultOffDuration),
+	)
+
+	RegisterScheduler(
+		func(s string) (Scheduler, error) {
+			args := strings.Split(s, ":")
+			if args[0] != "ramp" {
+				return nil, nil
+			}
+			if len(args) == 1 {
+				return &RampScheduler{Factor: DefaultRampFactor}, nil
+			}
+			f, err := strconv.ParseFloat(args[1], 64)
+			if err != nil || f < 1 {
+				return nil, Errorf(InvalidSchedulerArgs,
+					"invalid factor %s to ramp scheduler", args[1])
+			}
+			return &RampScheduler{Factor: f}, nil
+		},
+		fmt.Sprintf("ramp:#: ramp from # x interval and min length (dfl %g)",
+			DefaultRampFactor),
+	)
+}
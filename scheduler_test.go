@@ -0,0 +1,53 @@
+package irtt
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSchedulerReset tests that schedulers with state start over at seqno 0,
+// so a second run with the same Scheduler has the same schedule.
+func TestSchedulerReset(t *testing.T) {
+	params := &Params{
+		Duration: time.Second,
+		Interval: 10 * time.Millisecond,
+		Length:   100,
+	}
+	for _, s := range []Scheduler{NewPoissonScheduler(),
+		&RampScheduler{Factor: 10}} {
+		for run := 0; run < 2; run++ {
+			var last time.Duration
+			for seqno := Seqno(0); seqno < 10; seqno++ {
+				next, _ := s.Next(seqno, params, 0, 0)
+				if seqno == 0 && next != 0 {
+					t.Errorf("%s run %d: first send at %s, expected 0", s, run,
+						next)
+				}
+				if next < last {
+					t.Errorf("%s run %d: send time for seqno %d went backwards",
+						s, run, seqno)
+				}
+				last = next
+			}
+			if run == 0 && last == 0 {
+				t.Errorf("%s: schedule did not advance", s)
+			}
+		}
+	}
+}
+
+// TestRampSchedulerNoDuration tests that with no duration, the ramp scheduler
+// uses the negotiated interval and length from the first packet.
+func TestRampSchedulerNoDuration(t *testing.T) {
+	params := &Params{Interval: 10 * time.Millisecond, Length: 100}
+	s := &RampScheduler{Factor: 10}
+	s.Next(0, params, 0, 0)
+	for seqno := Seqno(1); seqno < 4; seqno++ {
+		next, l := s.Next(seqno, params, 0, 0)
+		if exp := time.Duration(seqno) * params.Interval; next != exp ||
+			l != params.Length {
+			t.Errorf("seqno %d: got %s and length %d, expected %s and %d",
+				seqno, next, l, exp, params.Length)
+		}
+	}
+}
@@ -1,45 +1,76 @@
 package irtt
 
-import "time"
+import (
+	"net"
+	"time"
+)
 
-// ServerConfig defines the Server configuration.
+// ServerConfig defines the Server configuration. If Conns is not empty, the
+// Server listens on those already bound UDP conns (e.g. from ActivationConns)
+// instead of Addrs.
 type ServerConfig struct {
-	Addrs       []string
-	HMACKey     []byte
-	MaxDuration time.Duration
-	MinInterval time.Duration
-	MaxLength   int
-	Timeout     time.Duration
-	PacketBurst int
-	Filler      Filler
-	AllowFills  []string
-	AllowStamp  AllowStamp
-	AllowDSCP   bool
-	TTL         int
-	IPVersion   IPVersion
-	Handler     Handler
-	SetSrcIP    bool
-	TimeSource  TimeSource
-	ThreadLock  bool
+	Addrs              []string
+	Conns              []*net.UDPConn
+	HMACKey            []byte
+	MaxDuration        time.Duration
+	MinInterval        time.Duration
+	MaxLength          int
+	Timeout            time.Duration
+	OpenTimeout        time.Duration
+	ShutdownGrace      time.Duration
+	PacketBurst        int
+	Filler             Filler
+	AllowFills         []string
+	AllowStamp         AllowStamp
+	AllowDSCP          bool
+	AllowReceivedTOS   bool
+	TTL                int
+	IPVersion          IPVersion
+	Handler            Handler
+	SetSrcIP           bool
+	TimeSource         TimeSource
+	ThreadLock         bool
+	MetricsAddr        string
+	ControlSocket      string
+	SourceLimits       []SourceLimit
+	MaxOpenRate        float64
+	MaxConns           int
+	ListenerMaxConns   int
+	ConnLimitPolicy    ConnLimitPolicy
+	ACL                ACL
+	ListenerACLs       map[string]ACL
+	ACLPolicy          ACLPolicy
+	MaxBitrate         Bitrate
+	ListenerMaxBitrate Bitrate
+	BitratePolicy      BitratePolicy
+	BanRate            float64
+	BanTime            time.Duration
 }
 
 // NewServerConfig returns a new ServerConfig with the default settings.
 func NewServerConfig() *ServerConfig {
 	return &ServerConfig{
-		Addrs:       DefaultBindAddrs,
-		MaxDuration: DefaultMaxDuration,
-		MinInterval: DefaultMinInterval,
-		MaxLength:   DefaultMaxLength,
-		Timeout:     DefaultServerTimeout,
-		PacketBurst: DefaultPacketBurst,
-		Filler:      DefaultServerFiller,
-		AllowFills:  DefaultAllowFills,
-		AllowStamp:  DefaultAllowStamp,
-		AllowDSCP:   DefaultAllowDSCP,
-		TTL:         DefaultTTL,
-		IPVersion:   DefaultIPVersion,
-		SetSrcIP:    DefaultSetSrcIP,
-		TimeSource:  DefaultTimeSource,
-		ThreadLock:  DefaultThreadLock,
+		Addrs:            DefaultBindAddrs,
+		MaxDuration:      DefaultMaxDuration,
+		MinInterval:      DefaultMinInterval,
+		MaxLength:        DefaultMaxLength,
+		Timeout:          DefaultServerTimeout,
+		OpenTimeout:      DefaultOpenTimeout,
+		ShutdownGrace:    DefaultShutdownGrace,
+		PacketBurst:      DefaultPacketBurst,
+		Filler:           DefaultServerFiller,
+		AllowFills:       DefaultAllowFills,
+		AllowStamp:       DefaultAllowStamp,
+		AllowDSCP:        DefaultAllowDSCP,
+		AllowReceivedTOS: DefaultAllowReceivedTOS,
+		TTL:              DefaultTTL,
+		IPVersion:        DefaultIPVersion,
+		SetSrcIP:         DefaultSetSrcIP,
+		TimeSource:       DefaultTimeSource,
+		ThreadLock:       DefaultThreadLock,
+		BitratePolicy:    DefaultBitratePolicy,
+		ConnLimitPolicy:  DefaultConnLimitPolicy,
+		ACLPolicy:        DefaultACLPolicy,
+		BanTime:          DefaultBanTime,
 	}
 }
@@ -1,6 +1,7 @@
 package irtt
 
 import (
+	"container/list"
 	"math/rand"
 	"net"
 	"time"
@@ -11,6 +12,8 @@ type sconn struct {
 	*listener
 	ctoken         ctoken
 	raddr          *net.UDPAddr
+	srcIP          net.IP
+	hmacKey        []byte
 	params         *Params
 	filler         Filler
 	created        time.Time
@@ -22,20 +25,30 @@ type sconn struct {
 	receivedWindow ReceivedWindow
 	rwinValid      bool
 	bytes          uint64
+	bitrate        float64
+	closing        bool
+	elem           *list.Element
 }
 
 func newSconn(l *listener, raddr *net.UDPAddr) *sconn {
 	return &sconn{
 		listener:     l,
 		raddr:        raddr,
+		hmacKey:      l.HMACKey,
 		filler:       l.Filler,
-		created:      time.Now(),
+		created:      l.cmgr.now(),
 		lastSeqno:    InvalidSeqno,
 		packetBucket: float64(l.PacketBurst),
 	}
 }
 
 func accept(l *listener, p *packet) (sc *sconn, err error) {
+	// remove expired sconns, and enforce open rate limits
+	l.cmgr.removeExpired()
+	if err = l.limiter.allowOpen(p.raddr.IP); err != nil {
+		return
+	}
+
 	// create sconn
 	sc = newSconn(l, p.raddr)
 
@@ -62,21 +75,60 @@ func accept(l *listener, p *packet) (sc *sconn, err error) {
 	}
 
 	// determine state of connection
+	iv, ln := params.Interval, params.Length
 	if params.ProtocolVersion != ProtocolVersion {
 		l.eventf(ProtocolVersionMismatch, p.raddr,
 			"close connection, client version %d != server version %d",
 			params.ProtocolVersion, ProtocolVersion)
 		p.setFlagBits(flClose)
+	} else if deny := l.denied(p.raddr.IP); deny != "" {
+		l.metrics.deniedOpens.Add(1)
+		l.eventf(AccessDeniedClose, p.raddr,
+			"refuse new connection, access denied (%s)", deny)
+		p.setFlagBits(flClose)
 	} else if p.flags()&flClose != 0 {
+		l.metrics.openCloses.Add(1)
 		l.eventf(OpenClose, p.raddr, "open-close connection")
+	} else if l.closing {
+		l.eventf(ShutdownCloseConn, p.raddr,
+			"refuse new connection during shutdown")
+		p.setFlagBits(flClose)
+	} else if lim := l.limiter.allowConn(p.raddr.IP); lim != "" {
+		l.metrics.limitedConns.Add(1)
+		l.eventf(SourceConnLimit, p.raddr,
+			"refuse new connection, source limit reached (%s)", lim)
+		p.setFlagBits(flClose)
+	} else if l.cmgr.full() && !l.canEvict() {
+		l.metrics.connsFullRefused.Add(1)
+		l.eventf(ConnTableFull, p.raddr,
+			"refuse new connection, max connections reached")
+		p.setFlagBits(flClose)
+	} else if !sc.reserveBitrate(l.BitratePolicy == BitrateRestrict) {
+		l.metrics.bitrateRefused.Add(1)
+		l.eventf(BitrateConnLimit, p.raddr,
+			"refuse new connection, bitrate limit reached")
+		p.setFlagBits(flClose)
 	} else {
+		// evict only once the new conn won't be refused for anything else, so
+		// refused opens don't close existing conns
+		if l.cmgr.full() {
+			l.evict()
+		}
+		if params.Interval != iv || params.Length != ln {
+			l.metrics.bitrateRestricted.Add(1)
+			l.eventf(BitrateRestriction, p.raddr,
+				"restrict interval from %s to %s and length from %d to %d "+
+					"for bitrate limit", iv, params.Interval, ln, params.Length)
+		}
 		l.cmgr.put(sc)
+		l.metrics.opens.Add(1)
 		l.eventf(NewConn, p.raddr, "new connection, token=%016x", sc.ctoken)
 	}
 
 	// prepare and send open reply
 	if sc.SetSrcIP {
 		p.srcIP = p.dstIP
+		sc.srcIP = p.dstIP
 	}
 	if sc.AllowDSCP && sc.conn.dscpSupport {
 		p.dscp = sc.params.DSCP
@@ -88,6 +140,27 @@ func accept(l *listener, p *packet) (sc *sconn, err error) {
 	return
 }
 
+// canEvict returns true if ConnLimitEvict is set, and the listener has an sconn
+// to evict.
+func (l *listener) canEvict() bool {
+	return l.ConnLimitPolicy == ConnLimitEvict && l.cmgr.lru() != nil
+}
+
+// evict removes the least recently used sconn on the listener to make room for
+// a new one, and sends it a close. It must only be called if canEvict returns
+// true.
+func (l *listener) evict() {
+	sc := l.cmgr.lru()
+	l.metrics.closesEvicted.Add(1)
+	l.eventf(ConnEvicted, sc.raddr,
+		"evict least recently used connection for new connection, token=%016x",
+		sc.ctoken)
+	if err := sc.sendClose(CloseEvicted); err != nil {
+		l.eventf(Drop, sc.raddr, "unable to send close (%s)", err)
+	}
+	l.cmgr.remove(sc.ctoken)
+}
+
 func (sc *sconn) serve(p *packet) (closed bool, err error) {
 	if !udpAddrsEqual(p.raddr, sc.raddr) {
 		err = Errorf(AddressMismatch, "address mismatch (expected %s for %016x)",
@@ -107,6 +180,9 @@ func (sc *sconn) serveClose(p *packet) (err error) {
 	if err = p.addFields(fcloseRequest, false); err != nil {
 		return
 	}
+	if !sc.closing {
+		sc.metrics.closesClient.Add(1)
+	}
 	sc.eventf(CloseConn, p.raddr, "close connection, token=%016x", sc.ctoken)
 	if scr := sc.cmgr.remove(sc.ctoken); scr == nil {
 		sc.eventf(RemoveNoConn, p.raddr,
@@ -120,6 +196,7 @@ func (sc *sconn) serveEcho(p *packet) (closed bool, err error) {
 	if err = p.addFields(fechoRequest, false); err != nil {
 		return
 	}
+	rlen := p.length()
 
 	// check that request isn't too large
 	if sc.MaxLength > 0 && p.length() > sc.MaxLength {
@@ -129,7 +206,7 @@ func (sc *sconn) serveEcho(p *packet) (closed bool, err error) {
 	}
 
 	// update first used
-	now := time.Now()
+	now := sc.cmgr.now()
 	if sc.firstUsed.IsZero() {
 		sc.firstUsed = now
 	}
@@ -144,7 +221,7 @@ func (sc *sconn) serveEcho(p *packet) (closed bool, err error) {
 			}
 		}
 		if sc.packetBucket < 1 {
-			sc.lastUsed = now
+			sc.cmgr.touch(sc, now)
 			err = Errorf(ShortInterval, "drop due to short packet interval")
 			return
 		}
@@ -155,7 +232,7 @@ func (sc *sconn) serveEcho(p *packet) (closed bool, err error) {
 	p.setReply(true)
 
 	// update last used
-	sc.lastUsed = now
+	sc.cmgr.touch(sc, now)
 
 	// slide received seqno window
 	seqno := p.seqno()
@@ -176,8 +253,9 @@ func (sc *sconn) serveEcho(p *packet) (closed bool, err error) {
 	sc.lastSeqno = seqno
 
 	// check if max test duration exceeded (but still return packet)
-	if sc.MaxDuration > 0 && time.Since(sc.firstUsed) >
+	if sc.MaxDuration > 0 && now.Sub(sc.firstUsed) >
 		sc.MaxDuration+maxDurationGrace {
+		sc.metrics.closesDuration.Add(1)
 		sc.eventf(ExceededDuration, p.raddr,
 			"closing connection due to duration limit exceeded")
 		sc.cmgr.remove(sc.ctoken)
@@ -210,6 +288,11 @@ func (sc *sconn) serveEcho(p *packet) (closed bool, err error) {
 		}
 	}
 
+	// set received TOS
+	if sc.params.ReceivedTOS {
+		p.setReceivedTOS(p.tos)
+	}
+
 	// set timestamps
 	at := sc.params.StampAt
 	cl := sc.params.Clock
@@ -233,8 +316,9 @@ func (sc *sconn) serveEcho(p *packet) (closed bool, err error) {
 		p.removeTimestamps()
 	}
 
-	// set length
-	p.setLen(sc.params.Length)
+	// set length to the request length, up to the negotiated length, so
+	// variable length schedules are echoed
+	p.setLen(min(rlen, sc.params.Length))
 
 	// fill payload
 	if sc.filler != nil {
@@ -243,6 +327,13 @@ func (sc *sconn) serveEcho(p *packet) (closed bool, err error) {
 		}
 	}
 
+	// enforce bitrate limits
+	if !sc.allowBitrate(p.length()) {
+		sc.metrics.bitrateDropped.Add(1)
+		err = Errorf(BitrateLimit, "drop reply over bitrate limit")
+		return
+	}
+
 	// simulate dropped packets, if necessary
 	if serverDropsPercent > 0 && rand.Float32() < serverDropsPercent {
 		return
@@ -258,16 +349,52 @@ func (sc *sconn) serveEcho(p *packet) (closed bool, err error) {
 	}
 
 	// send reply
-	err = sc.conn.send(p)
+	if err = sc.conn.send(p); err != nil {
+		return
+	}
+	sc.bytes += uint64(p.length())
+	sc.metrics.packets.Add(1)
+	sc.metrics.bytes.Add(uint64(p.length()))
+
+	// resend close if shutting down, in case the first was lost
+	if sc.closing && !closed {
+		err = sc.sendClose(CloseShutdown)
+	}
 	return
 }
 
+// sendClose sends a close reply with no echo reply fields, which tells the
+// client to stop sending, and why.
+func (sc *sconn) sendClose(r CloseReason) error {
+	p := newPacket(0, maxHeaderLen, sc.hmacKey)
+	if err := p.setFields(fcloseReply, true); err != nil {
+		return err
+	}
+	p.setPayload([]byte{byte(r)})
+	p.setFlagBits(flReply | flClose)
+	p.setConnToken(sc.ctoken)
+	p.raddr = sc.raddr
+	p.srcIP = sc.srcIP
+	if sc.AllowDSCP && sc.conn.dscpSupport {
+		p.dscp = sc.params.DSCP
+	}
+	return sc.conn.send(p)
+}
+
+// expired returns true if the sconn has timed out. Sconns that haven't sent an
+// echo request since their open use OpenTimeout, if set.
 func (sc *sconn) expired() bool {
+	if sc.lastUsed.IsZero() && sc.OpenTimeout > 0 {
+		return sc.cmgr.now().Sub(sc.created) > sc.OpenTimeout
+	}
 	if sc.Timeout == 0 {
 		return false
 	}
-	return !sc.lastUsed.IsZero() &&
-		time.Since(sc.lastUsed) > sc.Timeout+timeoutGrace
+	last := sc.lastUsed
+	if last.IsZero() {
+		last = sc.created
+	}
+	return sc.cmgr.now().Sub(last) > sc.Timeout+timeoutGrace
 }
 
 func (sc *sconn) restrictParams(p *Params) {
@@ -290,6 +417,9 @@ func (sc *sconn) restrictParams(p *Params) {
 	if !sc.AllowDSCP || !sc.conn.dscpSupport {
 		p.DSCP = 0
 	}
+	if !sc.AllowReceivedTOS || !sc.conn.recvTOS {
+		p.ReceivedTOS = false
+	}
 	if len(p.ServerFill) > 0 && !globAny(sc.AllowFills, p.ServerFill) {
 		p.ServerFill = DefaultServerFiller.String()
 	}
@@ -1,21 +1,37 @@
 package irtt
 
 import (
+	"bytes"
+	"container/list"
 	"encoding/binary"
 	"math/rand"
 	"net"
+	"net/http"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Server is the irtt server.
 type Server struct {
 	*ServerConfig
-	start       time.Time
-	shutdown    bool
-	shutdownMtx sync.Mutex
-	shutdownC   chan struct{}
+	start        time.Time
+	shutdown     bool
+	handoff      bool
+	activated    bool
+	shutdownMtx  sync.Mutex
+	shutdownC    chan struct{}
+	listeners    []*listener
+	listenersMtx sync.Mutex
+	errC         chan error
+	ms           *metricsServer
+	cs           *ctlServer
+	changeMtx    sync.Mutex
+	limiter      *sourceLimiter
+	bitrate      *bitrateLimiter
+	bans         *banList
+	conns        atomic.Int64
 }
 
 // NewServer returns a new server.
@@ -23,6 +39,9 @@ func NewServer(cfg *ServerConfig) *Server {
 	return &Server{
 		ServerConfig: cfg,
 		shutdownC:    make(chan struct{}),
+		limiter:      newSourceLimiter(cfg.SourceLimits, cfg.MaxOpenRate),
+		bitrate:      newBitrateLimiter(cfg.MaxBitrate),
+		bans:         newBanList(cfg.BanRate, cfg.BanTime, cfg.Handler),
 	}
 }
 
@@ -40,36 +59,134 @@ func (s *Server) ListenAndServe() error {
 			"starting IRTT server version %s", Version))
 	}
 
+	// inherit sockets and conns from the previous process, if upgrading
+	in, err := inherit()
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		defer in.close()
+	}
+
 	// make listeners
-	listeners, err := s.makeListeners()
+	listeners, err := s.makeListeners(in)
 	if err != nil {
 		return err
 	}
+	s.activated = len(s.Conns) > 0 || (in != nil && in.state.Activated)
+	if in != nil {
+		n := in.restore(listeners)
+		if s.Handler != nil {
+			s.Handler.OnEvent(Eventf(UpgradeResume, nil, nil,
+				"resuming %d connection(s) from previous process %d", n,
+				in.state.PID))
+		}
+	}
 
-	// start listeners
-	errC := make(chan error)
-	for _, l := range listeners {
-		// send ListenerStart event
-		l.eventf(ListenerStart, nil, "starting %s listener on %s", l.conn.ipVer,
-			l.conn.localAddr())
+	// start metrics server
+	var ms *metricsServer
+	if s.MetricsAddr != "" {
+		ms = newMetricsServer(s)
+		if in != nil && in.metricsLn != nil {
+			ms.ln, in.metricsLn = in.metricsLn, nil
+		} else if ms.ln, err = ms.listen(); err != nil {
+			for _, l := range listeners {
+				l.conn.close()
+			}
+			return err
+		}
+		if s.Handler != nil {
+			s.Handler.OnEvent(Eventf(MetricsStart, nil, nil,
+				"starting metrics HTTP server on %s", ms.ln.Addr()))
+		}
+		go func() {
+			err := ms.Serve(ms.ln)
+			if err != http.ErrServerClosed && s.Handler != nil {
+				s.Handler.OnEvent(Eventf(MetricsError, nil, nil,
+					"error for metrics HTTP server (%s)", err))
+			}
+		}()
+	}
+
+	// start control socket
+	var cs *ctlServer
+	if s.ControlSocket != "" {
+		cs = newCtlServer(s)
+		if in != nil && in.ctlLn != nil {
+			cs.ln, in.ctlLn = in.ctlLn, nil
+		} else if err := cs.listen(); err != nil {
+			for _, l := range listeners {
+				l.conn.close()
+			}
+			if ms != nil {
+				ms.Close()
+			}
+			return err
+		}
+		if s.Handler != nil {
+			s.Handler.OnEvent(Eventf(ControlStart, nil, nil,
+				"starting control socket on %s", s.ControlSocket))
+		}
+		go cs.serve()
+	}
+
+	// tell the previous process we're ready, if upgrading
+	if in != nil {
+		if err := in.signalReady(); err != nil {
+			return err
+		}
+	}
 
-		go l.listenAndServe(errC)
+	// start listeners, saving running state for upgrades and reloads
+	s.changeMtx.Lock()
+	s.ms = ms
+	s.cs = cs
+	s.errC = make(chan error)
+	for _, l := range listeners {
+		s.startListener(l)
 	}
+	s.changeMtx.Unlock()
 
-	// wait on shutdown chan
+	// wait on shutdown chan, and for any upgrade or reload to finish, then
+	// close conns gracefully before stopping
 	go func() {
 		<-s.shutdownC
-		for _, l := range listeners {
+		s.changeMtx.Lock()
+		ls := s.getListeners()
+		s.changeMtx.Unlock()
+		if !s.isHandoff() {
+			if grace := s.shutdownGrace(ls); grace > 0 {
+				if s.Handler != nil {
+					s.Handler.OnEvent(Eventf(ShuttingDown, nil, nil,
+						"shutting down, closing connections with grace period %s",
+						grace))
+				}
+				s.closeConns(ls, grace)
+			}
+		}
+		for _, l := range ls {
 			l.shutdown()
 		}
 	}()
 
-	// wait for all listeners, and out of an abundance of caution, shut down
-	// all other listeners if any one of them fails
-	for i := 0; i < len(listeners); i++ {
-		if err := <-errC; err != nil {
+	// wait for all listeners, including any added on reload, and out of an
+	// abundance of caution, shut down all other listeners if any one of them
+	// fails
+	for {
+		if err := <-s.errC; err != nil {
 			s.Shutdown()
 		}
+		if len(s.getListeners()) == 0 {
+			break
+		}
+	}
+
+	// stop metrics server and control socket
+	if ms != nil {
+		ms.Close()
+	}
+	if cs != nil {
+		cs.close()
 	}
 
 	// send ServerStop event
@@ -81,7 +198,11 @@ func (s *Server) ListenAndServe() error {
 	return nil
 }
 
-// Shutdown stops the Server. After this call, the Server may no longer be used.
+// Shutdown stops the Server. If ShutdownGrace is positive, a close is first
+// sent to all active connections, and the Server waits up to ShutdownGrace for
+// them to close, while still replying to their requests. Shutdown does not
+// wait for the Server to stop. After this call, the Server may no longer be
+// used.
 func (s *Server) Shutdown() {
 	s.shutdownMtx.Lock()
 	defer s.shutdownMtx.Unlock()
@@ -91,49 +212,167 @@ func (s *Server) Shutdown() {
 	}
 }
 
-func (s *Server) makeListeners() ([]*listener, error) {
-	lconns, err := listenAll(s.IPVersion, s.Addrs, s.SetSrcIP, s.TimeSource)
+// startListener adds a listener and starts it. When it stops, it's removed.
+// It must be called with changeMtx held.
+func (s *Server) startListener(l *listener) {
+	s.listenersMtx.Lock()
+	s.listeners = append(s.listeners, l)
+	s.listenersMtx.Unlock()
+
+	// send ListenerStart event
+	l.eventf(ListenerStart, nil, "starting %s listener on %s", l.conn.ipVer,
+		l.conn.localAddr())
+
+	go func() {
+		err := l.listenAndServe()
+		s.removeListener(l)
+		s.errC <- err
+	}()
+}
+
+// removeListener removes a stopped listener.
+func (s *Server) removeListener(l *listener) {
+	s.listenersMtx.Lock()
+	defer s.listenersMtx.Unlock()
+	for i, sl := range s.listeners {
+		if sl == l {
+			s.listeners = append(s.listeners[:i:i], s.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// getListeners returns the running listeners, including any closing after a
+// reload. The returned slice must not be modified.
+func (s *Server) getListeners() []*listener {
+	s.listenersMtx.Lock()
+	defer s.listenersMtx.Unlock()
+	return s.listeners
+}
+
+// shutdownGrace returns ShutdownGrace, which may be changed on reload.
+func (s *Server) shutdownGrace(ls []*listener) (grace time.Duration) {
+	s.withListenersLocked(ls, func() {
+		grace = s.ShutdownGrace
+	})
+	return
+}
+
+// closeConns sends a close to all active conns, then waits until they've
+// closed or the grace period has passed. New conns are refused.
+func (s *Server) closeConns(ls []*listener, grace time.Duration) {
+	n := 0
+	for _, l := range ls {
+		l.mtx.Lock()
+		n += l.closeConns()
+		l.mtx.Unlock()
+	}
+	end := time.Now().Add(grace)
+	for n > 0 && time.Now().Before(end) {
+		time.Sleep(shutdownPollInterval)
+		n = 0
+		for _, l := range ls {
+			l.mtx.Lock()
+			n += l.activeConns()
+			l.mtx.Unlock()
+		}
+	}
+}
+
+// withListenersLocked calls fn with all listeners locked, so the ServerConfig
+// may be changed safely while the server is running.
+func (s *Server) withListenersLocked(ls []*listener, fn func()) {
+	for _, l := range ls {
+		l.mtx.Lock()
+	}
+	defer func() {
+		for _, l := range ls {
+			l.mtx.Unlock()
+		}
+	}()
+	fn()
+}
+
+// isShutdown returns true if Shutdown has been called.
+func (s *Server) isShutdown() bool {
+	s.shutdownMtx.Lock()
+	defer s.shutdownMtx.Unlock()
+	return s.shutdown
+}
+
+func (s *Server) makeListeners(in *inherited) ([]*listener, error) {
+	var lconns []*lconn
+	var err error
+	if in != nil {
+		lconns, err = wrapAll(DualStack, in.conns, s.SetSrcIP, s.TimeSource)
+		in.conns = nil
+	} else if len(s.Conns) > 0 {
+		lconns, err = wrapAll(s.IPVersion, s.Conns, s.SetSrcIP, s.TimeSource)
+	} else {
+		lconns, err = listenAll(s.IPVersion, s.Addrs, s.SetSrcIP, s.TimeSource)
+	}
 	if err != nil {
 		return nil, err
 	}
 	ls := make([]*listener, 0, len(lconns))
 	for _, lconn := range lconns {
-		ls = append(ls, newListener(s.ServerConfig, lconn))
+		ls = append(ls, newListener(s, lconn))
 	}
 	return ls, nil
 }
 
-// listener is a server listener.
+// listener is a server listener. mtx is held while handling each packet, and
+// when the connmgr, its sconns or the ServerConfig are accessed from other
+// goroutines.
 type listener struct {
 	*ServerConfig
-	conn      *lconn
-	pktPool   *pktPool
-	cmgr      *connmgr
-	closed    bool
-	closedMtx sync.Mutex
+	conn       *lconn
+	pktPool    *pktPool
+	cmgr       *connmgr
+	limiter    *sourceLimiter
+	bitrate    *bitrateLimiter
+	srvBitrate *bitrateLimiter
+	bans       *banList
+	laddr      string
+	metrics    *listenerMetrics
+	mtx        sync.Mutex
+	closing    bool
+	prevKeys   [][]byte
+	paused     atomic.Bool
+	parkedC    chan struct{}
+	resumeC    chan struct{}
+	closed     bool
+	closedMtx  sync.Mutex
 }
 
-func newListener(cfg *ServerConfig, lc *lconn) *listener {
+// newListener returns a new listener for the Server, sharing its config and
+// server-wide limits.
+func newListener(s *Server, lc *lconn) *listener {
+	cfg := s.ServerConfig
 	cap, _ := detectMTU(lc.localAddr().IP)
 
 	pp := newPacketPool(func() *packet {
 		return newPacket(0, cap, cfg.HMACKey)
 	}, 16)
 
+	m := newListenerMetrics()
 	return &listener{
 		ServerConfig: cfg,
 		conn:         lc,
 		pktPool:      pp,
-		cmgr:         newConnMgr(cfg),
+		cmgr:         newConnMgr(cfg, m, s.limiter, &s.conns),
+		limiter:      s.limiter,
+		bitrate:      newBitrateLimiter(cfg.ListenerMaxBitrate),
+		srvBitrate:   s.bitrate,
+		bans:         s.bans,
+		laddr:        lc.localAddr().String(),
+		metrics:      m,
+		parkedC:      make(chan struct{}),
+		resumeC:      make(chan struct{}),
 	}
 }
 
-func (l *listener) listenAndServe(errC chan<- error) (err error) {
-	// always return error to channel
-	defer func() {
-		errC <- err
-	}()
-
+func (l *listener) listenAndServe() (err error) {
 	// always close conn
 	defer func() {
 		l.conn.close()
@@ -142,6 +381,7 @@ func (l *listener) listenAndServe(errC chan<- error) (err error) {
 	// always log error or stoppage
 	defer func() {
 		if err != nil {
+			l.metrics.errors.Add(1)
 			l.eventf(ListenerError, nil, "error for listener on %s (%s)",
 				l.conn.localAddr(), err)
 		} else {
@@ -155,6 +395,24 @@ func (l *listener) listenAndServe(errC chan<- error) (err error) {
 		runtime.LockOSThread()
 	}
 
+	// set socket options, with the ServerConfig locked
+	l.mtx.Lock()
+	err = l.setOptions()
+	l.mtx.Unlock()
+	if err != nil {
+		return
+	}
+
+	l.metrics.up.Store(true)
+	err = l.readAndReply()
+	l.metrics.up.Store(false)
+	if l.isClosed() {
+		err = nil
+	}
+	return
+}
+
+func (l *listener) setOptions() (err error) {
 	// set TTL
 	if l.TTL != 0 {
 		err = l.conn.setTTL(l.TTL)
@@ -169,6 +427,15 @@ func (l *listener) listenAndServe(errC chan<- error) (err error) {
 			l.conn.localAddr(), l.conn.ipVer, l.conn.dscpError)
 	}
 
+	// enable receipt of TOS
+	if l.AllowReceivedTOS {
+		if rtoserr := l.conn.setReceiveTOS(); rtoserr != nil {
+			l.eventf(NoReceiveTOSSupport, nil,
+				"[%s] no %s received TOS support available (%s)",
+				l.conn.localAddr(), l.conn.ipVer, rtoserr)
+		}
+	}
+
 	// enable receipt of destination IP
 	if l.SetSrcIP && l.conn.localAddr().IP.IsUnspecified() {
 		if rdsterr := l.conn.setReceiveDstAddr(true); rdsterr != nil {
@@ -179,11 +446,6 @@ func (l *listener) listenAndServe(errC chan<- error) (err error) {
 			}
 		}
 	}
-
-	err = l.readAndReply()
-	if l.isClosed() {
-		err = nil
-	}
 	return
 }
 
@@ -191,25 +453,72 @@ func (l *listener) readAndReply() (err error) {
 	p := l.pktPool.new()
 	for {
 		if err = l.readOneAndReply(p); err != nil {
+			if l.paused.Load() && isTimeout(err) {
+				l.parkedC <- struct{}{}
+				<-l.resumeC
+				continue
+			}
 			if l.isFatalError(err) {
 				return
 			}
-			l.eventf(Drop, p.raddr, "%s", err.Error())
+			l.metrics.drop(err)
+			l.eventf(Drop, p.raddr, "%s", err)
+			if p.raddr != nil {
+				l.bans.drop(p.raddr.IP, err)
+			}
 		}
 	}
 }
 
 func (l *listener) readOneAndReply(p *packet) (err error) {
 	// read a packet
-	if err = l.conn.receive(p); err != nil {
+	n, err := l.conn.read(p)
+	if err != nil {
 		return
 	}
 
+	// drop packets from banned sources, without a Drop event
+	if l.bans.banned(p.raddr.IP) {
+		l.metrics.bannedPackets.Add(1)
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	// check the ACLs, dropping packets from denied sources before parsing, or
+	// later for all but opens with ACLClose
+	deny := l.denied(p.raddr.IP)
+	if deny != "" && l.ACLPolicy == ACLDrop {
+		err = Errorf(AccessDenied, "access denied (%s)", deny)
+		return
+	}
+
+	// parse the packet
+	if err = l.conn.parse(p, n); err != nil && !isHMACError(err) {
+		return
+	}
+
+	// after an HMAC key change, validate with the current and previous keys
+	if err != nil || !bytes.Equal(p.hmacKey, l.HMACKey) {
+		defer p.setHMACKey(l.HMACKey)
+		if err = l.validateKeys(p, err); err != nil {
+			return
+		}
+	}
+
 	// handle open
 	if p.flags()&flOpen != 0 {
+		if !bytes.Equal(p.hmacKey, l.HMACKey) {
+			err = Errorf(BadHMAC, "open with previous HMAC key")
+			return
+		}
 		_, err = accept(l, p)
 		return
 	}
+	if deny != "" {
+		err = Errorf(AccessDenied, "access denied (%s)", deny)
+		return
+	}
 
 	// handle packet for sconn
 	if err = p.addFields(fRequest, false); err != nil {
@@ -221,10 +530,56 @@ func (l *listener) readOneAndReply(p *packet) (err error) {
 		err = Errorf(InvalidConnToken, "invalid conn token %016x", ct)
 		return
 	}
+	if !bytes.Equal(p.hmacKey, sc.hmacKey) {
+		err = Errorf(BadHMAC, "HMAC key not the one opened with, token=%016x", ct)
+		return
+	}
+	if p.flags()&flClose == 0 {
+		if err = l.limiter.allowRequest(p.raddr.IP, p.length()); err != nil {
+			if isErrorCode(SourcePacketLimit, err) {
+				l.metrics.limitedPackets.Add(1)
+			} else {
+				l.metrics.limitedBytes.Add(1)
+			}
+			return
+		}
+	}
 	_, err = sc.serve(p)
 	return
 }
 
+// closeConns sends a close to all active conns and refuses new ones, and
+// returns the number of conns closed. It must be called with mtx held.
+func (l *listener) closeConns() (n int) {
+	l.closing = true
+	for ct, sc := range l.cmgr.sconns {
+		if sc.expired() {
+			l.cmgr.expire(ct, sc)
+			continue
+		}
+		sc.closing = true
+		l.metrics.closesShutdown.Add(1)
+		l.eventf(ShutdownCloseConn, sc.raddr,
+			"close connection for shutdown, token=%016x", ct)
+		if err := sc.sendClose(CloseShutdown); err != nil {
+			l.eventf(Drop, sc.raddr, "unable to send close (%s)", err)
+		}
+		n++
+	}
+	return
+}
+
+// activeConns returns the number of unexpired conns. It must be called with
+// mtx held.
+func (l *listener) activeConns() (n int) {
+	for _, sc := range l.cmgr.sconns {
+		if !sc.expired() {
+			n++
+		}
+	}
+	return
+}
+
 func (l *listener) eventf(code Code, raddr *net.UDPAddr, format string,
 	detail ...interface{}) {
 	if l.Handler != nil {
@@ -321,24 +676,108 @@ func (po *pktPool) put(p *packet) {
 	po.pool = append(po.pool, p)
 }
 
-// connmgr manages server connections
+// connmgr manages server connections. Besides the map by ctoken, sconns are
+// kept in two lists, so expired sconns can be removed from the front in O(1)
+// amortized time. The unused list has the sconns that haven't sent an echo
+// request, in order of creation, and the used list has the rest, in order of
+// last use.
 type connmgr struct {
 	*ServerConfig
-	sconns map[ctoken]*sconn
+	sconns  map[ctoken]*sconn
+	unused  *list.List
+	used    *list.List
+	metrics *listenerMetrics
+	limiter *sourceLimiter
+	total   *atomic.Int64
+	now     func() time.Time
 }
 
-func newConnMgr(cfg *ServerConfig) *connmgr {
+func newConnMgr(cfg *ServerConfig, m *listenerMetrics, lim *sourceLimiter,
+	total *atomic.Int64) *connmgr {
 	return &connmgr{
 		ServerConfig: cfg,
 		sconns:       make(map[ctoken]*sconn, sconnsInitSize),
+		unused:       list.New(),
+		used:         list.New(),
+		metrics:      m,
+		limiter:      lim,
+		total:        total,
+		now:          time.Now,
 	}
 }
 
 func (cm *connmgr) put(sc *sconn) {
-	cm.removeSomeExpired()
 	ct := cm.newCtoken()
 	sc.ctoken = ct
 	cm.sconns[ct] = sc
+	sc.elem = cm.unused.PushBack(sc)
+	cm.added(sc)
+}
+
+// restore adds an sconn with an existing ctoken, after an upgrade.
+func (cm *connmgr) restore(sc *sconn) {
+	cm.sconns[sc.ctoken] = sc
+	if sc.lastUsed.IsZero() {
+		sc.elem = insertSorted(cm.unused, sc, func(sc *sconn) time.Time {
+			return sc.created
+		})
+	} else {
+		sc.elem = insertSorted(cm.used, sc, func(sc *sconn) time.Time {
+			return sc.lastUsed
+		})
+	}
+	cm.added(sc)
+}
+
+// added counts a new sconn.
+func (cm *connmgr) added(sc *sconn) {
+	cm.metrics.conns.Add(1)
+	cm.total.Add(1)
+	cm.limiter.addConn(sc.raddr.IP)
+}
+
+// insertSorted inserts sc into lst, which is sorted by the time returned by t,
+// searching from the back.
+func insertSorted(lst *list.List, sc *sconn,
+	t func(*sconn) time.Time) *list.Element {
+	for e := lst.Back(); e != nil; e = e.Prev() {
+		if !t(e.Value.(*sconn)).After(t(sc)) {
+			return lst.InsertAfter(sc, e)
+		}
+	}
+	return lst.PushFront(sc)
+}
+
+// touch sets an sconn's last used time after an echo request, moving it to the
+// back of the used list, unless it was already removed.
+func (cm *connmgr) touch(sc *sconn, now time.Time) {
+	if sc.elem != nil {
+		if sc.lastUsed.IsZero() {
+			cm.unused.Remove(sc.elem)
+			sc.elem = cm.used.PushBack(sc)
+		} else {
+			cm.used.MoveToBack(sc.elem)
+		}
+	}
+	sc.lastUsed = now
+}
+
+// full returns true if no more sconns are allowed on the listener, or the
+// server.
+func (cm *connmgr) full() bool {
+	return (cm.ListenerMaxConns > 0 && len(cm.sconns) >= cm.ListenerMaxConns) ||
+		(cm.MaxConns > 0 && cm.total.Load() >= int64(cm.MaxConns))
+}
+
+// lru returns the least recently used sconn, preferring those that haven't sent
+// an echo request, or nil if there are none.
+func (cm *connmgr) lru() *sconn {
+	for _, lst := range []*list.List{cm.unused, cm.used} {
+		if e := lst.Front(); e != nil {
+			return e.Value.(*sconn)
+		}
+	}
+	return nil
 }
 
 func (cm *connmgr) get(ct ctoken) (sc *sconn) {
@@ -346,7 +785,7 @@ func (cm *connmgr) get(ct ctoken) (sc *sconn) {
 		return
 	}
 	if sc.expired() {
-		cm.delete(ct)
+		cm.expire(ct, sc)
 	}
 	return
 }
@@ -359,24 +798,43 @@ func (cm *connmgr) remove(ct ctoken) (sc *sconn) {
 	return
 }
 
-// removeSomeExpired checks checkExpiredCount sconns for expiration and removes
-// them if expired. Yes, I know, I'm depending on Go's random map iteration
-// start point, which per the language spec, I should not depend on. That said,
-// this makes for a highly CPU efficient way to eventually clean up expired
-// sconns, and because the Go team very intentionally made map order traversal
-// random for a good reason, I don't think that's going to change any time soon.
-func (cm *connmgr) removeSomeExpired() {
-	i := 0
-	for ct, sc := range cm.sconns {
-		if sc.expired() {
-			cm.delete(ct)
-		}
-		if i++; i >= checkExpiredCount {
-			break
+// removeExpired removes all expired sconns from the front of the unused and
+// used lists. As the sconns in each list are in order of their expiration, this
+// takes O(1) amortized time. It's called for each open, including those dropped
+// for the open rate limits, so expired sconns don't count towards the limits.
+func (cm *connmgr) removeExpired() {
+	for _, lst := range []*list.List{cm.unused, cm.used} {
+		for e := lst.Front(); e != nil; e = lst.Front() {
+			sc := e.Value.(*sconn)
+			if !sc.expired() {
+				break
+			}
+			cm.expire(sc.ctoken, sc)
 		}
 	}
 }
 
+// expire removes an expired sconn, which is an open timeout if it never sent an
+// echo request.
+func (cm *connmgr) expire(ct ctoken, sc *sconn) {
+	if sc.lastUsed.IsZero() {
+		cm.metrics.closesOpenTimeout.Add(1)
+		sc.eventf(OpenExpired, sc.raddr,
+			"close connection with no echo requests after open timeout, "+
+				"token=%016x", ct)
+	} else {
+		cm.metrics.closesTimeout.Add(1)
+	}
+	cm.delete(ct)
+}
+
+// removeAll removes all sconns, after the listener has stopped.
+func (cm *connmgr) removeAll() {
+	for ct := range cm.sconns {
+		cm.delete(ct)
+	}
+}
+
 func (cm *connmgr) newCtoken() ctoken {
 	var ct ctoken
 	b := make([]byte, 8)
@@ -391,5 +849,19 @@ func (cm *connmgr) newCtoken() ctoken {
 }
 
 func (cm *connmgr) delete(ct ctoken) {
+	sc, ok := cm.sconns[ct]
+	if !ok {
+		return
+	}
+	if sc.lastUsed.IsZero() {
+		cm.unused.Remove(sc.elem)
+	} else {
+		cm.used.Remove(sc.elem)
+	}
+	sc.elem = nil
+	cm.limiter.removeConn(sc.raddr.IP)
+	sc.releaseBitrate()
 	delete(cm.sconns, ct)
+	cm.metrics.conns.Add(-1)
+	cm.total.Add(-1)
 }
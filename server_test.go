@@ -0,0 +1,362 @@
+package irtt
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer starts a Server on a loopback address, and returns it with the
+// address of its listener. The Server is shut down when the test ends.
+func testServer(t *testing.T, cfg *ServerConfig) (*Server, string) {
+	cfg.Addrs = []string{"127.0.0.1:0"}
+	s := NewServer(cfg)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+	t.Cleanup(func() {
+		s.Shutdown()
+		<-done
+	})
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); {
+		if ls := s.getListeners(); len(ls) > 0 {
+			return s, ls[0].conn.localAddr().String()
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("server stopped (%v)", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("server did not start")
+	return nil, ""
+}
+
+// testRun runs a Client with the given duration and interval against addr in
+// the background, and returns a chan for its Result.
+func testRun(t *testing.T, addr string, dur, iv time.Duration) <-chan *Result {
+	cfg := NewClientConfig()
+	cfg.RemoteAddress = addr
+	cfg.Duration = dur
+	cfg.Interval = iv
+	rc := make(chan *Result, 1)
+	go func() {
+		r, err := NewClient(cfg).Run(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		rc <- r
+	}()
+	return rc
+}
+
+// testWaitConns waits until the Server has n active connections.
+func testWaitConns(t *testing.T, s *Server, n int) {
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); {
+		c := 0
+		for _, l := range s.getListeners() {
+			l.mtx.Lock()
+			c += l.activeConns()
+			l.mtx.Unlock()
+		}
+		if c == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server did not reach %d connection(s)", n)
+}
+
+// TestServerShutdown tests that on a graceful shutdown, the server sends the
+// client a close with the shutdown reason, so it stops the test early without
+// errors, and the server stops once the client has closed.
+func TestServerShutdown(t *testing.T) {
+	cfg := NewServerConfig()
+	cfg.ShutdownGrace = 5 * time.Second
+	s, addr := testServer(t, cfg)
+	rc := testRun(t, addr, time.Minute, 10*time.Millisecond)
+	testWaitConns(t, s, 1)
+	s.Shutdown()
+
+	select {
+	case r := <-rc:
+		if r == nil {
+			return
+		}
+		if r.SendErr != nil || r.ReceiveErr != nil {
+			t.Errorf("client stopped with errors %v and %v", r.SendErr,
+				r.ReceiveErr)
+		}
+		if !r.ServerShutdown || r.ServerClose != CloseShutdown {
+			t.Errorf("client stopped for close reason %s, shutdown %t, "+
+				"expected %s", r.ServerClose, r.ServerShutdown, CloseShutdown)
+		}
+		if r.Duration >= time.Minute {
+			t.Errorf("client ran for %s after shutdown", r.Duration)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("client did not stop after shutdown")
+	}
+	for end := time.Now().Add(cfg.ShutdownGrace); len(s.getListeners()) > 0; {
+		if time.Now().After(end) {
+			t.Fatal("server did not stop within the grace period")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestConnMgrOpenTimeout tests that sconns with no echo requests expire after
+// the open timeout, and the rest after the timeout.
+func TestConnMgrOpenTimeout(t *testing.T) {
+	l := testListener(t, nil)
+	l.OpenTimeout = time.Second
+	l.Timeout = 10 * time.Second
+	clk := newTestClock()
+	l.cmgr.now = clk.now
+	put := func(port int) *sconn {
+		sc := newSconn(l, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port})
+		sc.params = &Params{}
+		l.cmgr.put(sc)
+		return sc
+	}
+	a := put(1)
+	b := put(2)
+	clk.advance(500 * time.Millisecond)
+	l.cmgr.touch(b, clk.now())
+	c := put(3)
+
+	steps := []struct {
+		dt           time.Duration
+		expect       []*sconn
+		openTimeouts uint64
+		timeouts     uint64
+	}{
+		{0, []*sconn{a, b, c}, 0, 0},
+		// a is unused past the open timeout, then c
+		{500*time.Millisecond + 1, []*sconn{b, c}, 1, 0},
+		{500 * time.Millisecond, []*sconn{b}, 2, 0},
+		// b was used, so it lasts until the timeout and grace period
+		{l.Timeout + timeoutGrace - time.Second - 1, []*sconn{b}, 2, 0},
+		{1, nil, 2, 1},
+	}
+	for i, s := range steps {
+		clk.advance(s.dt)
+		l.cmgr.removeExpired()
+		if len(l.cmgr.sconns) != len(s.expect) {
+			t.Errorf("step %d: %d sconns, expected %d", i, len(l.cmgr.sconns),
+				len(s.expect))
+		}
+		for _, sc := range s.expect {
+			if l.cmgr.sconns[sc.ctoken] != sc {
+				t.Errorf("step %d: sconn %016x removed", i, sc.ctoken)
+			}
+		}
+		if n := l.metrics.closesOpenTimeout.Load(); n != s.openTimeouts {
+			t.Errorf("step %d: %d open timeouts, expected %d", i, n,
+				s.openTimeouts)
+		}
+		if n := l.metrics.closesTimeout.Load(); n != s.timeouts {
+			t.Errorf("step %d: %d timeouts, expected %d", i, n, s.timeouts)
+		}
+	}
+}
+
+// testSconn returns an sconn from a test source for l, with the given port.
+func testSconn(l *listener, port int) *sconn {
+	sc := newSconn(l, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port})
+	sc.params = &Params{}
+	return sc
+}
+
+// TestConnMgrFull tests the listener and server max conns.
+func TestConnMgrFull(t *testing.T) {
+	l1 := testListener(t, nil)
+	l2 := testListener(t, nil)
+	var total atomic.Int64
+	for _, l := range []*listener{l1, l2} {
+		l.cmgr = newConnMgr(l.ServerConfig, l.metrics, l.limiter, &total)
+		l.ListenerMaxConns = 2
+		l.MaxConns = 3
+	}
+	steps := []struct {
+		l     *listener
+		full1 bool
+		full2 bool
+		name  string
+	}{
+		{l1, false, false, "first conn"},
+		{l1, true, false, "listener max"},
+		{l2, true, true, "server max"},
+	}
+	for i, s := range steps {
+		s.l.cmgr.put(testSconn(s.l, i))
+		if l1.cmgr.full() != s.full1 || l2.cmgr.full() != s.full2 {
+			t.Errorf("%s: full %t and %t, expected %t and %t", s.name,
+				l1.cmgr.full(), l2.cmgr.full(), s.full1, s.full2)
+		}
+	}
+	l1.cmgr.remove(l1.cmgr.lru().ctoken)
+	if l1.cmgr.full() || l2.cmgr.full() {
+		t.Error("full after remove")
+	}
+}
+
+// TestConnMgrLRU tests that sconns are evicted in order of creation if they
+// haven't sent an echo request, then in order of last use.
+func TestConnMgrLRU(t *testing.T) {
+	l := testListener(t, nil)
+	clk := newTestClock()
+	l.cmgr.now = clk.now
+	var scs []*sconn
+	for i := 0; i < 5; i++ {
+		sc := testSconn(l, i)
+		l.cmgr.put(sc)
+		scs = append(scs, sc)
+		clk.advance(time.Second)
+	}
+	// use 3, 1 then 3 again, leaving 0, 2 and 4 unused
+	for _, i := range []int{3, 1, 3} {
+		l.cmgr.touch(scs[i], clk.now())
+		clk.advance(time.Second)
+	}
+	for _, i := range []int{0, 2, 4, 1, 3} {
+		sc := l.cmgr.lru()
+		if sc != scs[i] {
+			t.Fatalf("evicted port %d, expected %d", sc.raddr.Port, i)
+		}
+		l.cmgr.remove(sc.ctoken)
+	}
+	if sc := l.cmgr.lru(); sc != nil {
+		t.Errorf("evicted port %d from empty connmgr", sc.raddr.Port)
+	}
+}
+
+// TestConnMgrExpiryOrder tests that restored sconns are kept in order of
+// expiration, so removeExpired removes only the expired ones from the front of
+// each list.
+func TestConnMgrExpiryOrder(t *testing.T) {
+	l := testListener(t, nil)
+	l.Timeout = 10 * time.Second
+	l.OpenTimeout = 0
+	clk := newTestClock()
+	l.cmgr.now = clk.now
+	now := clk.now()
+	unused := []time.Duration{-3 * time.Second, -5 * time.Second, -time.Second}
+	used := []time.Duration{-2 * time.Second, -6 * time.Second, -4 * time.Second}
+	for i, d := range unused {
+		sc := testSconn(l, i)
+		sc.ctoken = ctoken(i + 1)
+		sc.created = now.Add(d)
+		l.cmgr.restore(sc)
+	}
+	for i, d := range used {
+		sc := testSconn(l, 10+i)
+		sc.ctoken = ctoken(10 + i + 1)
+		sc.created = now.Add(-time.Minute)
+		sc.lastUsed = now.Add(d)
+		l.cmgr.restore(sc)
+	}
+	order := func(lst *list.List) (ports []int) {
+		for e := lst.Front(); e != nil; e = e.Next() {
+			ports = append(ports, e.Value.(*sconn).raddr.Port)
+		}
+		return
+	}
+	if o := fmt.Sprint(order(l.cmgr.unused)); o != "[1 0 2]" {
+		t.Errorf("unused order %s, expected [1 0 2]", o)
+	}
+	if o := fmt.Sprint(order(l.cmgr.used)); o != "[11 12 10]" {
+		t.Errorf("used order %s, expected [11 12 10]", o)
+	}
+
+	// advance so sconns last active 4s or more ago expire
+	clk.advance(l.Timeout + timeoutGrace - 3500*time.Millisecond)
+	l.cmgr.removeExpired()
+	if o := fmt.Sprint(order(l.cmgr.unused), order(l.cmgr.used)); o !=
+		"[0 2] [10]" {
+		t.Errorf("after expiry, order %s, expected [0 2] [10]", o)
+	}
+	if n, m := l.metrics.closesOpenTimeout.Load(),
+		l.metrics.closesTimeout.Load(); n != 1 || m != 2 {
+		t.Errorf("%d open timeouts and %d timeouts, expected 1 and 2", n, m)
+	}
+}
+
+// TestAcceptEvict tests that a conn is only evicted for a new one if the new
+// one isn't refused for its bitrate, and that the evicted client is sent a
+// close with the evicted reason.
+func TestAcceptEvict(t *testing.T) {
+	l := testListener(t, nil)
+	l.ListenerMaxConns = 1
+	l.ConnLimitPolicy = ConnLimitEvict
+	l.BitratePolicy = BitrateRestrict
+	l.bitrate = newBitrateLimiter(Bitrate(8 * maxHeaderLen))
+	params := &Params{ProtocolVersion: ProtocolVersion, Duration: time.Minute,
+		Interval: time.Second}
+	open := func(raddr *net.UDPAddr) {
+		p := newPacket(0, maxHeaderLen, l.HMACKey)
+		p.setFlagBits(flOpen)
+		p.setPayload(params.bytes())
+		p.updateHMAC()
+		r := newPacket(0, maxHeaderLen, l.HMACKey)
+		n := copy(r.readTo(), p.bytes())
+		if err := l.conn.parse(r, n); err != nil {
+			t.Fatal(err)
+		}
+		r.raddr = raddr
+		if _, err := accept(l, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	caddr := c.LocalAddr().(*net.UDPAddr)
+
+	// the first conn reserves all of the listener bitrate
+	open(caddr)
+	if len(l.cmgr.sconns) != 1 {
+		t.Fatalf("%d sconns after first open, expected 1", len(l.cmgr.sconns))
+	}
+
+	// the second conn is refused for its bitrate, without an eviction
+	open(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: caddr.Port + 1})
+	if l.metrics.bitrateRefused.Load() != 1 || l.metrics.closesEvicted.Load() != 0 ||
+		l.cmgr.lru().raddr.Port != caddr.Port {
+		t.Fatalf("bitrate refusal evicted a conn")
+	}
+
+	// with more bitrate, the third conn evicts the first
+	l.bitrate.setRate(Bitrate(16 * maxHeaderLen))
+	open(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: caddr.Port + 2})
+	if l.metrics.closesEvicted.Load() != 1 || len(l.cmgr.sconns) != 1 ||
+		l.cmgr.lru().raddr.Port != caddr.Port+2 {
+		t.Fatal("first conn not evicted")
+	}
+
+	// the first client gets its open reply, then a close for the eviction
+	p := newPacket(0, maxHeaderLen, l.HMACKey)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, err := c.Read(p.readTo())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.readReset(n); err != nil {
+			t.Fatal(err)
+		}
+		if r, ok := p.closeReason(); ok {
+			if r != CloseEvicted {
+				t.Errorf("close reason %s, expected %s", r, CloseEvicted)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package irtt
+
+import (
+	"encoding/json"
+	"math/bits"
+	"time"
+)
+
+// DurationSketch is a mergeable, bounded memory histogram of durations, used
+// to calculate approximate quantiles. Buckets are log-linear (as in HDR
+// histograms), with 2^(sketchBits-1) buckets per power of two, so the relative
+// error of quantiles is at most 2^-(sketchBits-1). The zero value is ready to
+// use.
+type DurationSketch struct {
+	pos []uint64
+	neg []uint64
+	n   uint64
+}
+
+func (k *DurationSketch) push(d time.Duration) {
+	if d < 0 {
+		k.neg = sketchAdd(k.neg, uint64(-d), 1)
+	} else {
+		k.pos = sketchAdd(k.pos, uint64(d), 1)
+	}
+	k.n++
+}
+
+// N returns the number of durations in the sketch.
+func (k *DurationSketch) N() uint64 {
+	return k.n
+}
+
+// Merge adds the durations from another sketch to this one.
+func (k *DurationSketch) Merge(o *DurationSketch) {
+	for i, c := range o.pos {
+		if c > 0 {
+			k.pos = sketchAddIndex(k.pos, i, c)
+		}
+	}
+	for i, c := range o.neg {
+		if c > 0 {
+			k.neg = sketchAddIndex(k.neg, i, c)
+		}
+	}
+	k.n += o.n
+}
+
+// Reset removes all durations from the sketch, keeping allocated memory.
+func (k *DurationSketch) Reset() {
+	zeroCounts(k.pos)
+	zeroCounts(k.neg)
+	k.n = 0
+}
+
+// Quantile returns the approximate quantile for percentile p (0-100).
+func (k *DurationSketch) Quantile(p float64) (time.Duration, bool) {
+	if k.n == 0 {
+		return 0, false
+	}
+	rank := uint64(p / 100 * float64(k.n-1))
+	var c uint64
+	for i := len(k.neg) - 1; i >= 0; i-- {
+		c += k.neg[i]
+		if c > rank {
+			return -time.Duration(sketchValue(i)), true
+		}
+	}
+	for i := 0; i < len(k.pos); i++ {
+		c += k.pos[i]
+		if c > rank {
+			return time.Duration(sketchValue(i)), true
+		}
+	}
+	return time.Duration(sketchValue(len(k.pos) - 1)), true
+}
+
+// quantiles returns the approximate quantiles for the given percentiles.
+func (k *DurationSketch) quantiles(ps Percentiles) []Quantile {
+	qs := make([]Quantile, 0, len(ps))
+	for _, p := range ps {
+		if v, ok := k.Quantile(p); ok {
+			qs = append(qs, Quantile{p, v})
+		}
+	}
+	return qs
+}
+
+// sketchIndex returns the bucket index for a value. Values < 2^sketchBits have
+// their own bucket, and above that, each power of two is divided into
+// 2^(sketchBits-1) buckets.
+func sketchIndex(v uint64) int {
+	l := bits.Len64(v)
+	if l <= sketchBits {
+		return int(v)
+	}
+	s := uint(l - sketchBits)
+	return int(s)<<(sketchBits-1) + int(v>>s)
+}
+
+// sketchValue returns the midpoint value for a bucket index.
+func sketchValue(i int) uint64 {
+	if i < 1<<sketchBits {
+		return uint64(i)
+	}
+	s := uint(i>>(sketchBits-1)) - 1
+	m := uint64(i - int(s)<<(sketchBits-1))
+	return m<<s + (1<<s)/2
+}
+
+func sketchAdd(b []uint64, v uint64, c uint64) []uint64 {
+	return sketchAddIndex(b, sketchIndex(v), c)
+}
+
+func sketchAddIndex(b []uint64, i int, c uint64) []uint64 {
+	if i >= len(b) {
+		if i < cap(b) {
+			b = b[:i+1]
+		} else {
+			nb := make([]uint64, i+1, 2*(i+1))
+			copy(nb, b)
+			b = nb
+		}
+	}
+	b[i] += c
+	return b
+}
+
+func zeroCounts(b []uint64) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// StreamSummary contains statistics for some period of a stream.
+type StreamSummary struct {
+	PacketsSent     uint          `json:"packets_sent"`
+	PacketsReceived uint          `json:"packets_received"`
+	RTTStats        DurationStats `json:"rtt"`
+	IPDVStats       DurationStats `json:"ipdv_round_trip"`
+	rttSketch       DurationSketch
+	ipdvSketch      DurationSketch
+}
+
+// PacketLossPercent returns the approximate packet loss percent. Because
+// replies for packets sent near the end of the period may not have been
+// received yet, this may slightly overestimate loss.
+func (s *StreamSummary) PacketLossPercent() float64 {
+	if s.PacketsSent == 0 || s.PacketsReceived >= s.PacketsSent {
+		return 0
+	}
+	return 100 * float64(s.PacketsSent-s.PacketsReceived) /
+		float64(s.PacketsSent)
+}
+
+func (s *StreamSummary) onReceived(rtt, ipdv time.Duration) {
+	s.PacketsReceived++
+	s.RTTStats.push(rtt)
+	s.rttSketch.push(rtt)
+	if ipdv != InvalidDuration {
+		ipdv = AbsDuration(ipdv)
+		s.IPDVStats.push(ipdv)
+		s.ipdvSketch.push(ipdv)
+	}
+}
+
+func (s *StreamSummary) merge(o *StreamSummary) {
+	s.PacketsSent += o.PacketsSent
+	s.PacketsReceived += o.PacketsReceived
+	s.RTTStats.merge(&o.RTTStats)
+	s.IPDVStats.merge(&o.IPDVStats)
+	s.rttSketch.Merge(&o.rttSketch)
+	s.ipdvSketch.Merge(&o.ipdvSketch)
+}
+
+func (s *StreamSummary) reset() {
+	rs, is := s.rttSketch, s.ipdvSketch
+	rs.Reset()
+	is.Reset()
+	*s = StreamSummary{rttSketch: rs, ipdvSketch: is}
+}
+
+// setQuantiles sets the approximate median and quantiles on the
+// DurationStats from the sketches.
+func (s *StreamSummary) setQuantiles(ps Percentiles) {
+	set := func(ds *DurationStats, k *DurationSketch) {
+		if m, ok := k.Quantile(50); ok {
+			ds.setMedian(float64(m))
+		}
+		if len(ps) > 0 {
+			ds.setQuantiles(k.quantiles(ps))
+		}
+	}
+	set(&s.RTTStats, &s.rttSketch)
+	set(&s.IPDVStats, &s.ipdvSketch)
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (s *StreamSummary) MarshalJSON() ([]byte, error) {
+	type Alias StreamSummary
+	j := &struct {
+		*Alias
+		PacketLossPercent float64 `json:"packet_loss_percent"`
+	}{
+		Alias:             (*Alias)(s),
+		PacketLossPercent: s.PacketLossPercent(),
+	}
+	return json.Marshal(j)
+}
+
+// StreamStats keeps bounded memory statistics in streaming mode, both for the
+// whole run and for a sliding window. The window is divided into slots, and
+// slides by one slot at a time. Quantiles are approximate (see
+// DurationSketch).
+type StreamStats struct {
+	Run         StreamSummary `json:"run"`
+	WindowLen   time.Duration `json:"window_duration"`
+	slots       []StreamSummary
+	slotLen     time.Duration
+	slotStart   Time
+	cur         int
+	percentiles Percentiles
+}
+
+func newStreamStats(window time.Duration, ps Percentiles) *StreamStats {
+	slotLen := window / streamWindowSlots
+	if slotLen <= 0 {
+		slotLen = 1
+	}
+	return &StreamStats{
+		WindowLen:   window,
+		slots:       make([]StreamSummary, streamWindowSlots),
+		slotLen:     slotLen,
+		percentiles: ps,
+	}
+}
+
+// Window returns a summary of the sliding window, with the median and
+// quantiles set.
+func (ss *StreamStats) Window() *StreamSummary {
+	w := &StreamSummary{}
+	for i := range ss.slots {
+		w.merge(&ss.slots[i])
+	}
+	w.setQuantiles(ss.percentiles)
+	return w
+}
+
+// Summary returns a summary of the whole run, with the median and quantiles
+// set.
+func (ss *StreamStats) Summary() *StreamSummary {
+	ss.Run.setQuantiles(ss.percentiles)
+	return &ss.Run
+}
+
+// rotate advances the current slot for the given time, resetting slots that
+// have slid out of the window.
+func (ss *StreamStats) rotate(t Time) {
+	if ss.slotStart.IsZero() {
+		ss.slotStart = t
+		return
+	}
+	n := int(t.Sub(ss.slotStart) / ss.slotLen)
+	if n <= 0 {
+		return
+	}
+	for i := 0; i < n && i < len(ss.slots); i++ {
+		ss.cur = (ss.cur + 1) % len(ss.slots)
+		ss.slots[ss.cur].reset()
+	}
+	ss.slotStart = ss.slotStart.Add(time.Duration(n) * ss.slotLen)
+}
+
+func (ss *StreamStats) onSent(t Time) {
+	ss.rotate(t)
+	ss.Run.PacketsSent++
+	ss.slots[ss.cur].PacketsSent++
+}
+
+func (ss *StreamStats) onReceived(t Time, rtt, ipdv time.Duration) {
+	ss.rotate(t)
+	ss.Run.onReceived(rtt, ipdv)
+	ss.slots[ss.cur].onReceived(rtt, ipdv)
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (ss *StreamStats) MarshalJSON() ([]byte, error) {
+	j := &struct {
+		Run       *StreamSummary `json:"run"`
+		Window    *StreamSummary `json:"window"`
+		WindowLen time.Duration  `json:"window_duration"`
+	}{
+		Run:       ss.Summary(),
+		Window:    ss.Window(),
+		WindowLen: ss.WindowLen,
+	}
+	return json.Marshal(j)
+}
@@ -0,0 +1,157 @@
+package irtt
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// sketchMaxErr is the maximum relative error of sketch values.
+var sketchMaxErr = math.Pow(2, -(sketchBits - 1))
+
+// TestSketchIndexValue tests that values map to buckets whose midpoint values
+// are within the relative error bound, and map back to the same bucket, at the
+// edges of each power of two, and at 0 and MaxInt64.
+func TestSketchIndexValue(t *testing.T) {
+	vs := []uint64{0, 1, 2, 1<<sketchBits - 1, 1 << sketchBits,
+		1<<sketchBits + 1, math.MaxInt64}
+	for k := uint(sketchBits); k < 63; k++ {
+		vs = append(vs, 1<<k-1, 1<<k, 1<<k+1)
+	}
+	for _, v := range vs {
+		i := sketchIndex(v)
+		sv := sketchValue(i)
+		if v < 1<<sketchBits && sv != v {
+			t.Errorf("value %d in exact bucket %d has value %d", v, i, sv)
+		}
+		if sv > math.MaxInt64 {
+			t.Errorf("value %d in bucket %d has value %d > MaxInt64", v, i, sv)
+		}
+		if d := math.Abs(float64(sv) - float64(v)); d > float64(v)*sketchMaxErr {
+			t.Errorf("value %d in bucket %d has value %d, error %g > %g", v,
+				i, sv, d/float64(v), sketchMaxErr)
+		}
+		if j := sketchIndex(sv); j != i {
+			t.Errorf("value %d in bucket %d has value %d in bucket %d", v, i,
+				sv, j)
+		}
+	}
+}
+
+// TestSketchBuckets tests that buckets are contiguous and in increasing order
+// of value, up to the bucket for MaxInt64.
+func TestSketchBuckets(t *testing.T) {
+	max := sketchIndex(math.MaxInt64)
+	var prev uint64
+	for i := 0; i <= max; i++ {
+		v := sketchValue(i)
+		if i > 0 && v <= prev {
+			t.Fatalf("bucket %d value %d <= bucket %d value %d", i, v, i-1,
+				prev)
+		}
+		if j := sketchIndex(v); j != i {
+			t.Fatalf("bucket %d value %d is in bucket %d", i, v, j)
+		}
+		prev = v
+	}
+	for k := uint(sketchBits); k < 63; k++ {
+		if i, j := sketchIndex(1<<k-1), sketchIndex(1<<k); j != i+1 {
+			t.Errorf("2^%d-1 in bucket %d, 2^%d in bucket %d", k, i, k, j)
+		}
+	}
+}
+
+// TestSketchQuantile tests that sketch quantiles are within the relative
+// error bound of the exact percentiles of the same samples.
+func TestSketchQuantile(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	dists := map[string]func() time.Duration{
+		"exponential": func() time.Duration {
+			return time.Duration(rnd.ExpFloat64() * float64(10*time.Millisecond))
+		},
+		"uniform": func() time.Duration {
+			return time.Duration(rnd.Int63n(int64(time.Second)))
+		},
+		"small": func() time.Duration {
+			return time.Duration(rnd.Intn(1000))
+		},
+		"signed": func() time.Duration {
+			return time.Duration(rnd.NormFloat64() * float64(time.Millisecond))
+		},
+	}
+	ps := []float64{1, 10, 25, 50, 75, 90, 99, 99.9}
+	for name, gen := range dists {
+		for _, n := range []int{1, 2, 10, 1000} {
+			var k DurationSketch
+			f := make([]float64, n)
+			for i := range f {
+				d := gen()
+				k.push(d)
+				f[i] = float64(d)
+			}
+			sort.Float64s(f)
+			if k.N() != uint64(n) {
+				t.Errorf("%s n=%d: sketch has %d durations", name, n, k.N())
+			}
+			for _, p := range ps {
+				q, ok := k.Quantile(p)
+				if !ok {
+					t.Errorf("%s n=%d: no p%g", name, n, p)
+					continue
+				}
+				// the sketch uses the lower closest rank, so the exact
+				// interpolated value is between it and the next rank
+				r := int(p / 100 * float64(n-1))
+				lo, hi := f[r], f[r]
+				if r+1 < n {
+					hi = f[r+1]
+				}
+				lo -= math.Abs(lo) * sketchMaxErr
+				hi += math.Abs(hi) * sketchMaxErr
+				if float64(q) < lo || float64(q) > hi {
+					t.Errorf("%s n=%d: p%g is %s, exact %s, expected %g-%g",
+						name, n, p, q, time.Duration(quantile(f, p)), lo, hi)
+				}
+				if d := math.Abs(float64(q) - f[r]); d > math.Abs(f[r])*sketchMaxErr {
+					t.Errorf("%s n=%d: p%g is %s, rank value %s", name, n, p,
+						q, time.Duration(f[r]))
+				}
+			}
+		}
+	}
+}
+
+// TestSketchMergeReset tests that merged sketches have the same quantiles as
+// one sketch with all durations, and that Reset empties a sketch.
+func TestSketchMergeReset(t *testing.T) {
+	var all, a, b DurationSketch
+	for i := -500; i < 1500; i++ {
+		d := time.Duration(i) * 37 * time.Microsecond
+		all.push(d)
+		if i%3 == 0 {
+			a.push(d)
+		} else {
+			b.push(d)
+		}
+	}
+	a.Merge(&b)
+	if a.N() != all.N() {
+		t.Errorf("merged sketch has %d durations, expected %d", a.N(), all.N())
+	}
+	for _, p := range []float64{0, 5, 50, 95, 100} {
+		qa, _ := a.Quantile(p)
+		qall, _ := all.Quantile(p)
+		if qa != qall {
+			t.Errorf("merged p%g is %s, expected %s", p, qa, qall)
+		}
+	}
+	a.Reset()
+	if a.N() != 0 {
+		t.Errorf("reset sketch has %d durations", a.N())
+	}
+	if _, ok := a.Quantile(50); ok {
+		t.Error("reset sketch returned a quantile")
+	}
+}
@@ -3,6 +3,7 @@
 package irtt
 
 import (
+	"encoding/binary"
 	"net"
 
 	"golang.org/x/sys/unix"
@@ -20,3 +21,30 @@ func setSockoptDF(conn *net.UDPConn, df DF) error {
 	}
 	return setSockoptInt(conn, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, value)
 }
+
+func setSockoptReceiveTOS(conn *net.UDPConn, ipVer IPVersion) error {
+	if ipVer&IPv4 != 0 {
+		return setSockoptInt(conn, unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+	}
+	return setSockoptInt(conn, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+}
+
+// parseTOS returns the TOS (IPv4) or Traffic Class (IPv6) value from socket
+// control messages, or InvalidTOS if not present.
+func parseTOS(oob []byte) TOS {
+	for len(oob) >= unix.SizeofCmsghdr {
+		h, data, rest, err := unix.ParseOneSocketControlMessage(oob)
+		if err != nil {
+			break
+		}
+		if h.Level == unix.IPPROTO_IP && h.Type == unix.IP_TOS && len(data) >= 1 {
+			return TOS(data[0])
+		}
+		if h.Level == unix.IPPROTO_IPV6 && h.Type == unix.IPV6_TCLASS &&
+			len(data) >= 4 {
+			return TOS(int32(binary.NativeEndian.Uint32(data)))
+		}
+		oob = rest
+	}
+	return InvalidTOS
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package irtt
+
+import (
+	"net"
+)
+
+func setSockoptReceiveTOS(conn *net.UDPConn, ipVer IPVersion) error {
+	return Errorf(ReceiveTOSNotSupported, "receive TOS sockopt not supported")
+}
+
+func parseTOS(oob []byte) TOS {
+	return InvalidTOS
+}
@@ -0,0 +1,86 @@
+package irtt
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// TOS is the value of the IPv4 TOS or IPv6 Traffic Class byte. The upper six
+// bits are the DSCP, and the lower two bits are the ECN codepoint.
+type TOS int
+
+// InvalidTOS indicates a TOS value that was not available.
+const InvalidTOS = TOS(-1)
+
+// IsValid returns true if the TOS value is available.
+func (t TOS) IsValid() bool {
+	return t >= 0 && t <= 0xff
+}
+
+// DSCP returns the Differentiated Services Code Point (upper six bits).
+func (t TOS) DSCP() int {
+	return int(t) >> 2
+}
+
+// ECN returns the ECN codepoint (lower two bits).
+func (t TOS) ECN() ECN {
+	return ECN(t & 0x3)
+}
+
+func (t TOS) String() string {
+	if !t.IsValid() {
+		return "n/a"
+	}
+	return fmt.Sprintf("0x%02x", int(t))
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (t TOS) MarshalJSON() ([]byte, error) {
+	j := &struct {
+		Value int `json:"value"`
+		DSCP  int `json:"dscp"`
+		ECN   ECN `json:"ecn"`
+	}{
+		Value: int(t),
+		DSCP:  t.DSCP(),
+		ECN:   t.ECN(),
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (t *TOS) UnmarshalJSON(data []byte) error {
+	j := struct {
+		Value int `json:"value"`
+	}{}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*t = TOS(j.Value)
+	return nil
+}
+
+// ECN is an Explicit Congestion Notification codepoint (RFC 3168).
+type ECN int
+
+// ECN constants.
+const (
+	NotECT ECN = 0x00
+	ECT1   ECN = 0x01
+	ECT0   ECN = 0x02
+	CE     ECN = 0x03
+)
+
+var ecns = [...]string{"not-ect", "ect1", "ect0", "ce"}
+
+func (e ECN) String() string {
+	if int(e) < 0 || int(e) >= len(ecns) {
+		return fmt.Sprintf("ECN:%d", e)
+	}
+	return ecns[e]
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (e ECN) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.String())
+}
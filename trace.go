@@ -0,0 +1,379 @@
+package irtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TracePacket is a packet read from a trace of recorded traffic.
+type TracePacket struct {
+	// Time is the time the packet was captured, relative to the first packet.
+	Time time.Duration
+
+	// Length is the UDP payload length.
+	Length int
+}
+
+// TraceScheduler is a Scheduler that replays the packet timing and lengths
+// from a trace of recorded traffic. The Interval parameter is not used, and
+// the Length parameter limits the length of replayed packets. When all packets
+// in the trace have been sent, ScheduleEnd is returned to end the test.
+type TraceScheduler struct {
+	File    string
+	Packets []TracePacket
+}
+
+// LoadTraceScheduler returns a new TraceScheduler from a trace file, which may
+// be either in pcap format (not pcapng), from which the first UDP flow is
+// replayed, or CSV format with the time in seconds and UDP payload length as
+// the first two columns.
+func LoadTraceScheduler(file string) (*TraceScheduler, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	// sniff magic number to determine format
+	var pkts []TracePacket
+	magic, _ := r.Peek(4)
+	if isPcap(magic) {
+		pkts, err = readPcapTrace(r)
+	} else if bytes.Equal(magic, pcapngMagic) {
+		err = Errorf(InvalidTrace,
+			"pcapng format not supported for %s, convert to pcap (editcap -F pcap)",
+			file)
+	} else {
+		pkts, err = readCSVTrace(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(pkts) == 0 {
+		return nil, Errorf(InvalidTrace, "no UDP packets found in trace %s", file)
+	}
+
+	// sort by time and make relative to first packet
+	sort.SliceStable(pkts, func(i, j int) bool {
+		return pkts[i].Time < pkts[j].Time
+	})
+	t0 := pkts[0].Time
+	for i := range pkts {
+		pkts[i].Time -= t0
+	}
+	return &TraceScheduler{file, pkts}, nil
+}
+
+// Next returns the time and length of the packet in the trace, or ScheduleEnd
+// after the last packet.
+func (s *TraceScheduler) Next(seqno Seqno, params *Params, sent,
+	now time.Duration) (time.Duration, int) {
+	if int(seqno) >= len(s.Packets) {
+		return ScheduleEnd, 0
+	}
+	tp := s.Packets[seqno]
+	return tp.Time, tp.Length
+}
+
+// Duration returns the duration of the trace, which is the time of the last
+// packet plus the mean interval.
+func (s *TraceScheduler) Duration() time.Duration {
+	return s.Packets[len(s.Packets)-1].Time + s.MeanInterval()
+}
+
+// MeanInterval returns the mean interval between packets in the trace.
+func (s *TraceScheduler) MeanInterval() time.Duration {
+	if len(s.Packets) < 2 {
+		return DefaultInterval
+	}
+	i := s.Packets[len(s.Packets)-1].Time / time.Duration(len(s.Packets)-1)
+	if i <= 0 {
+		i = 1
+	}
+	return i
+}
+
+// MaxLength returns the maximum packet length in the trace.
+func (s *TraceScheduler) MaxLength() (l int) {
+	for _, tp := range s.Packets {
+		if tp.Length > l {
+			l = tp.Length
+		}
+	}
+	return
+}
+
+func (s *TraceScheduler) String() string {
+	return fmt.Sprintf("trace:%s", s.File)
+}
+
+// readCSVTrace reads a CSV trace with the time in seconds in the first column
+// and UDP payload length in the second column. Lines starting with # are
+// ignored, as is a header line with a non-numeric time.
+func readCSVTrace(r io.Reader) (pkts []TracePacket, err error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	for first := true; ; first = false {
+		var rec []string
+		rec, err = cr.Read()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		line, _ := cr.FieldPos(0)
+		if len(rec) < 2 {
+			err = Errorf(InvalidTrace,
+				"trace line %d has %d fields, expected time and length",
+				line, len(rec))
+			return
+		}
+		var secs float64
+		secs, err = strconv.ParseFloat(strings.TrimSpace(rec[0]), 64)
+		if err != nil {
+			if first {
+				err = nil
+				continue
+			}
+			err = Errorf(InvalidTrace, "invalid time %s on trace line %d",
+				rec[0], line)
+			return
+		}
+		var l int
+		l, err = strconv.Atoi(strings.TrimSpace(rec[1]))
+		if err != nil || l < 0 {
+			err = Errorf(InvalidTrace, "invalid length %s on trace line %d",
+				rec[1], line)
+			return
+		}
+		pkts = append(pkts,
+			TracePacket{time.Duration(secs * float64(time.Second)), l})
+	}
+}
+
+// pcap constants
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+	pcapHeaderLen   = 24
+	pcapRecordLen   = 16
+	pcapMaxSnaplen  = 256 * 1024
+)
+
+// pcap link types
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+func isPcap(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		m := bo.Uint32(magic)
+		if m == pcapMagicMicros || m == pcapMagicNanos {
+			return true
+		}
+	}
+	return false
+}
+
+// udpFlow identifies the direction of a UDP flow by its source and destination
+// addresses and ports. IPv4 addresses are stored in IPv6 form.
+type udpFlow struct {
+	src   [16]byte
+	dst   [16]byte
+	sport uint16
+	dport uint16
+}
+
+// readPcapTrace reads the UDP packets in the first flow of a pcap file, which
+// is the flow and direction of the first UDP packet. Other packets, including
+// non-initial fragments and replies in the opposite direction, are skipped.
+func readPcapTrace(r io.Reader) (pkts []TracePacket, err error) {
+	hdr := make([]byte, pcapHeaderLen)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	m := bo.Uint32(hdr)
+	if m != pcapMagicMicros && m != pcapMagicNanos {
+		bo = binary.BigEndian
+		m = bo.Uint32(hdr)
+	}
+	tsUnit := time.Microsecond
+	if m == pcapMagicNanos {
+		tsUnit = time.Nanosecond
+	}
+	snaplen := bo.Uint32(hdr[16:])
+	if snaplen == 0 || snaplen > pcapMaxSnaplen {
+		snaplen = pcapMaxSnaplen
+	}
+	lt := bo.Uint32(hdr[20:]) & 0x0fffffff
+
+	rec := make([]byte, pcapRecordLen)
+	var data []byte
+	var first udpFlow
+	for {
+		if _, err = io.ReadFull(r, rec); err != nil {
+			if err == io.EOF {
+				err = nil
+			} else if err == io.ErrUnexpectedEOF {
+				err = Errorf(InvalidTrace, "truncated pcap record header")
+			}
+			return
+		}
+		t := time.Duration(bo.Uint32(rec))*time.Second +
+			time.Duration(bo.Uint32(rec[4:]))*tsUnit
+		n := bo.Uint32(rec[8:])
+		if n > snaplen {
+			err = Errorf(InvalidTrace, "pcap record length %d exceeds max %d",
+				n, snaplen)
+			return
+		}
+		if uint32(cap(data)) < n {
+			data = make([]byte, n)
+		}
+		data = data[:n]
+		if _, err = io.ReadFull(r, data); err != nil {
+			err = Errorf(InvalidTrace, "truncated pcap record")
+			return
+		}
+		f, l, ok := udpDatagram(lt, data)
+		if !ok {
+			continue
+		}
+		if len(pkts) == 0 {
+			first = f
+		} else if f != first {
+			continue
+		}
+		pkts = append(pkts, TracePacket{t, l})
+	}
+}
+
+// udpDatagram returns the flow and UDP payload length of a captured frame with
+// the given link type, and true if the frame contains a UDP datagram.
+func udpDatagram(lt uint32, b []byte) (f udpFlow, l int, ok bool) {
+	// strip link layer header
+	switch lt {
+	case linkTypeNull, linkTypeLoop:
+		if len(b) < 4 {
+			return
+		}
+		b = b[4:]
+	case linkTypeEthernet:
+		if len(b) < 14 {
+			return
+		}
+		et := binary.BigEndian.Uint16(b[12:])
+		b = b[14:]
+		for et == 0x8100 || et == 0x88a8 {
+			if len(b) < 4 {
+				return
+			}
+			et = binary.BigEndian.Uint16(b[2:])
+			b = b[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(b) < 16 {
+			return
+		}
+		b = b[16:]
+	case linkTypeSLL2:
+		if len(b) < 20 {
+			return
+		}
+		b = b[20:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	default:
+		return
+	}
+
+	// strip IP header
+	if len(b) < 1 {
+		return
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 || b[9] != 17 {
+			return
+		}
+		if binary.BigEndian.Uint16(b[6:])&0x1fff != 0 {
+			return
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if len(b) < ihl {
+			return
+		}
+		copy(f.src[:], net.IPv4(b[12], b[13], b[14], b[15]))
+		copy(f.dst[:], net.IPv4(b[16], b[17], b[18], b[19]))
+		b = b[ihl:]
+	case 6:
+		if len(b) < 40 || b[6] != 17 {
+			return
+		}
+		copy(f.src[:], b[8:24])
+		copy(f.dst[:], b[24:40])
+		b = b[40:]
+	default:
+		return
+	}
+
+	// get ports and length from UDP header
+	if len(b) < 8 {
+		return
+	}
+	f.sport = binary.BigEndian.Uint16(b)
+	f.dport = binary.BigEndian.Uint16(b[2:])
+	if l = int(binary.BigEndian.Uint16(b[4:])) - 8; l < 0 {
+		return
+	}
+	ok = true
+	return
+}
+
+func init() {
+	RegisterScheduler(
+		func(s string) (Scheduler, error) {
+			args := strings.SplitN(s, ":", 2)
+			if args[0] != "trace" {
+				return nil, nil
+			}
+			if len(args) == 1 || args[1] == "" {
+				return nil, Errorf(InvalidSchedulerArgs,
+					"trace scheduler requires a file")
+			}
+			ts, err := LoadTraceScheduler(args[1])
+			if err != nil {
+				return nil, err
+			}
+			return ts, nil
+		},
+		"trace:file: replay timing and lengths from pcap or CSV file",
+	)
+}
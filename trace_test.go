@@ -0,0 +1,272 @@
+package irtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPcapFrame is a frame to write to a test pcap file.
+type testPcapFrame struct {
+	t     time.Duration
+	src   string
+	dst   string
+	sport uint16
+	dport uint16
+	plen  int
+}
+
+// testEthernetFrame returns an Ethernet frame with an IPv4 or IPv6 UDP
+// datagram.
+func testEthernetFrame(f testPcapFrame) []byte {
+	src, dst := net.ParseIP(f.src), net.ParseIP(f.dst)
+	udp := make([]byte, 8+f.plen)
+	binary.BigEndian.PutUint16(udp, f.sport)
+	binary.BigEndian.PutUint16(udp[2:], f.dport)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	var b []byte
+	if src.To4() != nil {
+		b = make([]byte, 14+20)
+		binary.BigEndian.PutUint16(b[12:], 0x0800)
+		ip := b[14:]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[9] = 17
+		copy(ip[12:], src.To4())
+		copy(ip[16:], dst.To4())
+	} else {
+		b = make([]byte, 14+40)
+		binary.BigEndian.PutUint16(b[12:], 0x86dd)
+		ip := b[14:]
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+		ip[6] = 17
+		copy(ip[8:], src)
+		copy(ip[24:], dst)
+	}
+	return append(b, udp...)
+}
+
+// testPcap returns a pcap file with Ethernet frames in the given byte order,
+// with nanosecond timestamps if nanos is true.
+func testPcap(bo binary.ByteOrder, nanos bool, frames []testPcapFrame) []byte {
+	hdr := make([]byte, pcapHeaderLen)
+	tsUnit := time.Microsecond
+	if nanos {
+		bo.PutUint32(hdr, pcapMagicNanos)
+		tsUnit = time.Nanosecond
+	} else {
+		bo.PutUint32(hdr, pcapMagicMicros)
+	}
+	bo.PutUint16(hdr[4:], 2)
+	bo.PutUint16(hdr[6:], 4)
+	bo.PutUint32(hdr[16:], 65535)
+	bo.PutUint32(hdr[20:], linkTypeEthernet)
+	b := hdr
+	for _, f := range frames {
+		data := testEthernetFrame(f)
+		rec := make([]byte, pcapRecordLen)
+		bo.PutUint32(rec, uint32(f.t/time.Second))
+		bo.PutUint32(rec[4:], uint32(f.t%time.Second/tsUnit))
+		bo.PutUint32(rec[8:], uint32(len(data)))
+		bo.PutUint32(rec[12:], uint32(len(data)))
+		b = append(b, rec...)
+		b = append(b, data...)
+	}
+	return b
+}
+
+// TestReadPcapTrace tests that only the first UDP flow in a pcap trace is
+// read, in each byte order and timestamp resolution.
+func TestReadPcapTrace(t *testing.T) {
+	frames := []testPcapFrame{
+		{time.Second, "10.0.0.1", "10.0.0.2", 3074, 3074, 100},
+		{time.Second + 10*time.Millisecond, "10.0.0.2", "10.0.0.1", 3074, 3074,
+			500},
+		{time.Second + 20*time.Millisecond, "10.0.0.1", "10.0.0.2", 3074, 3074,
+			120},
+		{time.Second + 25*time.Millisecond, "10.0.0.1", "10.0.0.2", 53, 53, 40},
+		{time.Second + 30*time.Millisecond, "2001:db8::1", "2001:db8::2", 3074,
+			3074, 60},
+		{time.Second + 40*time.Millisecond, "10.0.0.1", "10.0.0.2", 3074, 3074,
+			0},
+	}
+	expect := []TracePacket{
+		{time.Second, 100},
+		{time.Second + 20*time.Millisecond, 120},
+		{time.Second + 40*time.Millisecond, 0},
+	}
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian,
+		binary.BigEndian} {
+		for _, nanos := range []bool{false, true} {
+			b := testPcap(bo, nanos, frames)
+			if !isPcap(b) {
+				t.Errorf("%s nanos=%t: not detected as pcap", bo, nanos)
+				continue
+			}
+			pkts, err := readPcapTrace(bytes.NewReader(b))
+			if err != nil {
+				t.Errorf("%s nanos=%t: %s", bo, nanos, err)
+				continue
+			}
+			if len(pkts) != len(expect) {
+				t.Errorf("%s nanos=%t: read %d packets, expected %d", bo, nanos,
+					len(pkts), len(expect))
+				continue
+			}
+			for i, p := range pkts {
+				if p != expect[i] {
+					t.Errorf("%s nanos=%t: packet %d is %+v, expected %+v", bo,
+						nanos, i, p, expect[i])
+				}
+			}
+		}
+	}
+}
+
+// TestReadPcapTraceIPv6 tests that the first flow may be IPv6.
+func TestReadPcapTraceIPv6(t *testing.T) {
+	frames := []testPcapFrame{
+		{0, "2001:db8::1", "2001:db8::2", 5000, 6000, 80},
+		{time.Millisecond, "2001:db8::2", "2001:db8::1", 6000, 5000, 80},
+		{2 * time.Millisecond, "2001:db8::1", "2001:db8::2", 5000, 6000, 90},
+		{3 * time.Millisecond, "2001:db8::1", "2001:db8::3", 5000, 6000, 70},
+	}
+	pkts, err := readPcapTrace(bytes.NewReader(testPcap(binary.LittleEndian,
+		false, frames)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 2 || pkts[0].Length != 80 || pkts[1].Length != 90 {
+		t.Errorf("unexpected packets %+v", pkts)
+	}
+}
+
+// TestReadPcapTraceTruncated tests that a truncated pcap record is an error.
+func TestReadPcapTraceTruncated(t *testing.T) {
+	b := testPcap(binary.LittleEndian, false, []testPcapFrame{
+		{0, "10.0.0.1", "10.0.0.2", 1, 2, 100},
+	})
+	for _, n := range []int{pcapHeaderLen + 8, len(b) - 1} {
+		_, err := readPcapTrace(bytes.NewReader(b[:n]))
+		if !isErrorCode(InvalidTrace, err) {
+			t.Errorf("truncated at %d: expected InvalidTrace, got %v", n, err)
+		}
+	}
+}
+
+// TestReadPcapTraceLength tests that a pcap record longer than the snaplen, or
+// the max snaplen if the header's is larger, is an error.
+func TestReadPcapTraceLength(t *testing.T) {
+	tests := []struct {
+		snaplen uint32
+		n       uint32
+	}{
+		{1500, 1501},
+		{0, pcapMaxSnaplen + 1},
+		{0xffffffff, 0xffffffff},
+	}
+	for _, tc := range tests {
+		b := testPcap(binary.LittleEndian, false, nil)
+		binary.LittleEndian.PutUint32(b[16:], tc.snaplen)
+		rec := make([]byte, pcapRecordLen)
+		binary.LittleEndian.PutUint32(rec[8:], tc.n)
+		binary.LittleEndian.PutUint32(rec[12:], tc.n)
+		b = append(b, rec...)
+		_, err := readPcapTrace(bytes.NewReader(b))
+		if !isErrorCode(InvalidTrace, err) {
+			t.Errorf("snaplen %d length %d: expected InvalidTrace, got %v",
+				tc.snaplen, tc.n, err)
+		}
+	}
+}
+
+// TestReadCSVTrace tests reading CSV traces, with headers, comments and
+// invalid lines.
+func TestReadCSVTrace(t *testing.T) {
+	tests := []struct {
+		csv    string
+		expect []TracePacket
+		err    bool
+	}{
+		{"0.5,100\n1.0,200\n", []TracePacket{
+			{500 * time.Millisecond, 100}, {time.Second, 200}}, false},
+		{"time,length\n# comment\n0, 10, extra\n 0.001 , 20\n", []TracePacket{
+			{0, 10}, {time.Millisecond, 20}}, false},
+		{"", nil, false},
+		{"0.1\n", nil, true},
+		{"0.1,100\nbad,100\n", nil, true},
+		{"0.1,-1\n", nil, true},
+		{"0.1,x\n", nil, true},
+	}
+	for _, tc := range tests {
+		pkts, err := readCSVTrace(strings.NewReader(tc.csv))
+		if tc.err {
+			if !isErrorCode(InvalidTrace, err) {
+				t.Errorf("%q: expected InvalidTrace, got %v", tc.csv, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.csv, err)
+			continue
+		}
+		if len(pkts) != len(tc.expect) {
+			t.Errorf("%q: read %+v, expected %+v", tc.csv, pkts, tc.expect)
+			continue
+		}
+		for i, p := range pkts {
+			if p != tc.expect[i] {
+				t.Errorf("%q: packet %d is %+v, expected %+v", tc.csv, i, p,
+					tc.expect[i])
+			}
+		}
+	}
+}
+
+// TestLoadTraceScheduler tests that trace packets are sorted and made relative
+// to the first packet, and that the schedule ends after the last packet.
+func TestLoadTraceScheduler(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "trace.csv")
+	if err := os.WriteFile(file, []byte("2.0,300\n1.5,100\n1.75,200\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := LoadTraceScheduler(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []TracePacket{
+		{0, 100}, {250 * time.Millisecond, 200}, {500 * time.Millisecond, 300},
+	}
+	params := &Params{Length: 1000}
+	for i, e := range expect {
+		at, l := ts.Next(Seqno(i), params, 0, 0)
+		if at != e.Time || l != e.Length {
+			t.Errorf("seqno %d scheduled at %s with length %d, expected %s "+
+				"with length %d", i, at, l, e.Time, e.Length)
+		}
+	}
+	if at, _ := ts.Next(Seqno(len(expect)), params, 0, 0); at != ScheduleEnd {
+		t.Errorf("expected ScheduleEnd after last packet, got %s", at)
+	}
+	if ts.MaxLength() != 300 {
+		t.Errorf("max length %d, expected 300", ts.MaxLength())
+	}
+	if ts.MeanInterval() != 250*time.Millisecond {
+		t.Errorf("mean interval %s, expected 250ms", ts.MeanInterval())
+	}
+
+	// an empty trace is an error
+	if err := os.WriteFile(file, []byte("time,length\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTraceScheduler(file); !isErrorCode(InvalidTrace, err) {
+		t.Errorf("empty trace: expected InvalidTrace, got %v", err)
+	}
+}
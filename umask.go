@@ -0,0 +1,10 @@
+// +build !windows,!nacl,!plan9
+
+package irtt
+
+import "syscall"
+
+// setUmask sets the process umask and returns the previous one.
+func setUmask(mask int) int {
+	return syscall.Umask(mask)
+}
@@ -0,0 +1,8 @@
+// +build windows nacl plan9
+
+package irtt
+
+// setUmask does nothing on platforms without a umask, and returns 0.
+func setUmask(mask int) int {
+	return 0
+}
@@ -0,0 +1,426 @@
+package irtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// environment variable with the names of the files passed to a new process
+// during an upgrade, starting at listenFDsStart
+const upgradeEnv = "IRTT_UPGRADE_FDNAMES"
+
+// names of files passed during an upgrade
+const (
+	upgradeFDUDP     = "udp"
+	upgradeFDMetrics = "metrics"
+	upgradeFDCtl     = "ctl"
+	upgradeFDState   = "state"
+	upgradeFDReady   = "ready"
+)
+
+// upgradeState is the state handed off to the new process during an upgrade.
+type upgradeState struct {
+	PID       int             `json:"pid"`
+	Activated bool            `json:"activated,omitempty"`
+	Listeners []listenerState `json:"listeners"`
+}
+
+// listenerState is the state of a listener, identified by its address.
+type listenerState struct {
+	Addr   string       `json:"addr"`
+	Sconns []sconnState `json:"sconns"`
+}
+
+// sconnState is the state of an sconn.
+type sconnState struct {
+	Token          ctoken         `json:"token"`
+	RemoteAddr     string         `json:"remote_addr"`
+	SrcIP          net.IP         `json:"src_ip,omitempty"`
+	HMACKey        []byte         `json:"hmac_key,omitempty"`
+	Params         []byte         `json:"params"`
+	Created        time.Time      `json:"created"`
+	FirstUsed      time.Time      `json:"first_used"`
+	LastUsed       time.Time      `json:"last_used"`
+	PacketBucket   float64        `json:"packet_bucket"`
+	LastSeqno      Seqno          `json:"last_seqno"`
+	ReceivedCount  ReceivedCount  `json:"received_count"`
+	ReceivedWindow ReceivedWindow `json:"received_window"`
+	RwinValid      bool           `json:"rwin_valid"`
+	Bytes          uint64         `json:"bytes"`
+}
+
+// Upgrade starts a new server process from the same executable and arguments,
+// and hands off the listener sockets, metrics and control sockets and all
+// connections to it, so that tests in progress continue against the new
+// process. No requests are handled during the handoff, but since the sockets
+// are shared, requests are queued and not lost. If the new process doesn't
+// start successfully, an error is returned and the Server continues serving.
+// Otherwise, the Server stops without closing connections.
+func (s *Server) Upgrade() (err error) {
+	s.changeMtx.Lock()
+	defer s.changeMtx.Unlock()
+	if s.errC == nil || s.isShutdown() {
+		return Errorf(UpgradeFailed, "server not running")
+	}
+
+	// listeners closing after a reload are not handed off
+	var ls []*listener
+	for _, l := range s.getListeners() {
+		if !l.isClosing() {
+			ls = append(ls, l)
+		}
+	}
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return Errorf(UpgradeFailed, "unable to find executable (%s)", err)
+	}
+
+	// get files to pass to the new process
+	var files []*os.File
+	var names []string
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+		files = nil
+	}
+	defer closeFiles()
+	addFile := func(name string, fn func() (*os.File, error)) {
+		if err != nil {
+			return
+		}
+		var f *os.File
+		if f, err = fn(); err == nil {
+			files = append(files, f)
+			names = append(names, name)
+		}
+	}
+	for _, l := range ls {
+		addFile(upgradeFDUDP, l.conn.conn.File)
+	}
+	if s.ms != nil {
+		addFile(upgradeFDMetrics, s.ms.ln.(*net.TCPListener).File)
+	}
+	if s.cs != nil {
+		addFile(upgradeFDCtl, s.cs.ln.(*net.UnixListener).File)
+	}
+	var sw, rr *os.File
+	addFile(upgradeFDState, func() (r *os.File, err error) {
+		r, sw, err = os.Pipe()
+		return
+	})
+	addFile(upgradeFDReady, func() (w *os.File, err error) {
+		rr, w, err = os.Pipe()
+		return
+	})
+	if sw != nil {
+		defer sw.Close()
+	}
+	if rr != nil {
+		defer rr.Close()
+	}
+	if err != nil {
+		return Errorf(UpgradeFailed, "unable to get files for upgrade (%s)", err)
+	}
+
+	// pause and lock listeners, so no requests are handled during the handoff
+	var paused []*listener
+	defer func() {
+		for _, l := range paused {
+			l.resume()
+		}
+	}()
+	for _, l := range ls {
+		if err = l.pause(); err != nil {
+			return
+		}
+		paused = append(paused, l)
+	}
+	st := s.lockedUpgradeState(ls)
+
+	// start new process, and close our copies of its files
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(names, ":"))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if s.Handler != nil {
+		n := 0
+		for _, ls := range st.Listeners {
+			n += len(ls.Sconns)
+		}
+		s.Handler.OnEvent(Eventf(UpgradeStart, nil, nil,
+			"upgrading, starting %s and handing off %d connection(s)", path, n))
+	}
+	if err = cmd.Start(); err != nil {
+		return Errorf(UpgradeFailed, "unable to start new process (%s)", err)
+	}
+	closeFiles()
+
+	// send state and wait until the new process is ready, or exits
+	go func() {
+		json.NewEncoder(sw).Encode(st)
+		sw.Close()
+	}()
+	readyC := make(chan error, 1)
+	go func() {
+		_, rerr := rr.Read(make([]byte, 1))
+		readyC <- rerr
+	}()
+	select {
+	case err = <-readyC:
+	case <-time.After(upgradeTimeout):
+		err = Errorf(UpgradeFailed, "timeout after %s", upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return Errorf(UpgradeFailed, "new process not ready (%s)", err)
+	}
+
+	// stop without closing conns, leaving the control socket in place
+	for _, l := range s.getListeners() {
+		l.shutdown()
+	}
+	if s.cs != nil {
+		s.cs.ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	}
+	s.shutdownMtx.Lock()
+	s.handoff = true
+	s.shutdownMtx.Unlock()
+	s.Shutdown()
+	return nil
+}
+
+// lockedUpgradeState returns the state of the given listeners, locking each
+// while its state is read.
+func (s *Server) lockedUpgradeState(ls []*listener) *upgradeState {
+	st := &upgradeState{PID: os.Getpid(), Activated: s.activated}
+	for _, l := range ls {
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		ls := listenerState{Addr: l.conn.localAddr().String()}
+		for ct, sc := range l.cmgr.sconns {
+			if sc.expired() {
+				continue
+			}
+			ls.Sconns = append(ls.Sconns, sconnState{
+				Token:          ct,
+				RemoteAddr:     sc.raddr.String(),
+				SrcIP:          sc.srcIP,
+				HMACKey:        sc.hmacKey,
+				Params:         sc.params.bytes(),
+				Created:        sc.created,
+				FirstUsed:      sc.firstUsed,
+				LastUsed:       sc.lastUsed,
+				PacketBucket:   sc.packetBucket,
+				LastSeqno:      sc.lastSeqno,
+				ReceivedCount:  sc.receivedCount,
+				ReceivedWindow: sc.receivedWindow,
+				RwinValid:      sc.rwinValid,
+				Bytes:          sc.bytes,
+			})
+		}
+		st.Listeners = append(st.Listeners, ls)
+	}
+	return st
+}
+
+// pause stops the listener from reading requests, and waits until it's
+// finished handling any request in progress.
+func (l *listener) pause() error {
+	l.paused.Store(true)
+	if err := l.conn.conn.SetReadDeadline(time.Now()); err != nil {
+		l.paused.Store(false)
+		return Errorf(UpgradeFailed, "unable to pause listener (%s)", err)
+	}
+	select {
+	case <-l.parkedC:
+		return nil
+	case <-time.After(upgradeTimeout):
+		l.paused.Store(false)
+		l.conn.conn.SetReadDeadline(time.Time{})
+		return Errorf(UpgradeFailed, "timeout pausing listener on %s",
+			l.conn.localAddr())
+	}
+}
+
+// resume resumes reading requests after pause. If the listener was shut down,
+// it exits instead.
+func (l *listener) resume() {
+	if !l.isClosed() {
+		l.paused.Store(false)
+		l.conn.conn.SetReadDeadline(time.Time{})
+	}
+	l.resumeC <- struct{}{}
+}
+
+// isTimeout returns true if err is a network timeout.
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// isHandoff returns true if the Server stopped after an upgrade.
+func (s *Server) isHandoff() bool {
+	s.shutdownMtx.Lock()
+	defer s.shutdownMtx.Unlock()
+	return s.handoff
+}
+
+// inherited holds the files and state inherited from the previous process
+// during an upgrade.
+type inherited struct {
+	conns     []*net.UDPConn
+	metricsLn net.Listener
+	ctlLn     net.Listener
+	state     *upgradeState
+	ready     *os.File
+}
+
+// inherit returns the files and state passed from the previous process during
+// an upgrade, or nil if this process was not started for an upgrade.
+func inherit() (in *inherited, err error) {
+	env := os.Getenv(upgradeEnv)
+	if env == "" {
+		return
+	}
+	os.Unsetenv(upgradeEnv)
+	in = &inherited{}
+	defer func() {
+		if err != nil {
+			in.close()
+			in = nil
+		}
+	}()
+	var sr *os.File
+	for i, name := range strings.Split(env, ":") {
+		fd := uintptr(listenFDsStart + i)
+		switch name {
+		case upgradeFDUDP:
+			var c *net.UDPConn
+			if c, err = fileUDPConn(fd, name+strconv.Itoa(i)); err != nil {
+				return
+			}
+			in.conns = append(in.conns, c)
+		case upgradeFDMetrics, upgradeFDCtl:
+			f := os.NewFile(fd, name)
+			var ln net.Listener
+			ln, err = net.FileListener(f)
+			f.Close()
+			if err != nil {
+				err = Errorf(UpgradeFailed, "invalid %s socket (%s)", name, err)
+				return
+			}
+			if name == upgradeFDMetrics {
+				in.metricsLn = ln
+			} else {
+				ln.(*net.UnixListener).SetUnlinkOnClose(true)
+				in.ctlLn = ln
+			}
+		case upgradeFDState:
+			sr = os.NewFile(fd, name)
+		case upgradeFDReady:
+			in.ready = os.NewFile(fd, name)
+		default:
+			err = Errorf(UpgradeFailed, "unknown inherited file %s", name)
+			return
+		}
+	}
+	if sr == nil || in.ready == nil {
+		err = Errorf(UpgradeFailed, "missing state or ready file")
+		return
+	}
+	defer sr.Close()
+	in.state = &upgradeState{}
+	if err = json.NewDecoder(sr).Decode(in.state); err != nil {
+		err = Errorf(UpgradeFailed, "invalid upgrade state (%s)", err)
+	}
+	return
+}
+
+// restore restores the sconns for each listener, and returns the number of
+// sconns restored.
+func (in *inherited) restore(ls []*listener) (n int) {
+	for _, lst := range in.state.Listeners {
+		for _, l := range ls {
+			if l.conn.localAddr().String() != lst.Addr {
+				continue
+			}
+			for _, scs := range lst.Sconns {
+				if l.restoreSconn(&scs) == nil {
+					n++
+				}
+			}
+		}
+	}
+	return
+}
+
+// signalReady tells the previous process that this process is ready.
+func (in *inherited) signalReady() error {
+	defer in.ready.Close()
+	_, err := in.ready.Write([]byte{1})
+	return err
+}
+
+// close closes any inherited files that weren't used.
+func (in *inherited) close() {
+	for _, c := range in.conns {
+		c.Close()
+	}
+	if in.metricsLn != nil {
+		in.metricsLn.Close()
+	}
+	if in.ctlLn != nil {
+		in.ctlLn.Close()
+	}
+	if in.ready != nil {
+		in.ready.Close()
+	}
+}
+
+// restoreSconn adds an sconn from its state.
+func (l *listener) restoreSconn(scs *sconnState) error {
+	raddr, err := net.ResolveUDPAddr("udp", scs.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	params, err := parseParams(scs.Params)
+	if err != nil {
+		return err
+	}
+	sc := newSconn(l, raddr)
+	sc.ctoken = scs.Token
+	sc.srcIP = scs.SrcIP
+	sc.hmacKey = scs.HMACKey
+	if !bytes.Equal(sc.hmacKey, l.HMACKey) && !l.hasPrevKey(sc.hmacKey) {
+		l.prevKeys = append(l.prevKeys, sc.hmacKey)
+	}
+	sc.params = params
+	if len(params.ServerFill) > 0 &&
+		params.ServerFill != DefaultServerFiller.String() {
+		if f, ferr := NewFiller(params.ServerFill); ferr == nil {
+			sc.filler = f
+		}
+	}
+	sc.created = scs.Created
+	sc.firstUsed = scs.FirstUsed
+	sc.lastUsed = scs.LastUsed
+	sc.packetBucket = scs.PacketBucket
+	sc.lastSeqno = scs.LastSeqno
+	sc.receivedCount = scs.ReceivedCount
+	sc.receivedWindow = scs.ReceivedWindow
+	sc.rwinValid = scs.RwinValid
+	sc.bytes = scs.Bytes
+	sc.reserveBitrate(false)
+	l.cmgr.restore(sc)
+	return nil
+}
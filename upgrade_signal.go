@@ -0,0 +1,14 @@
+// +build !windows,!nacl,!plan9
+
+package irtt
+
+import (
+	"os"
+	"syscall"
+)
+
+// signals that upgrade the server
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// signals that reload the server config file
+var reloadSignals = []os.Signal{syscall.SIGHUP}
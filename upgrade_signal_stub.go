@@ -0,0 +1,11 @@
+// +build windows nacl plan9
+
+package irtt
+
+import "os"
+
+// signals that upgrade the server (none on this platform)
+var upgradeSignals []os.Signal
+
+// signals that reload the server config file (none on this platform)
+var reloadSignals []os.Signal
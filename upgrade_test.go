@@ -0,0 +1,133 @@
+package irtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// testListener returns a listener for a new Server on a loopback socket.
+func testListener(t *testing.T, lc *lconn) *listener {
+	if lc == nil {
+		var err error
+		lc, err = listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, false,
+			DefaultTimeSource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { lc.close() })
+	}
+	cfg := NewServerConfig()
+	cfg.HMACKey = []byte("new key")
+	return newListener(NewServer(cfg), lc)
+}
+
+// TestUpgradeState tests that sconn state handed off during an upgrade is
+// the same after it's marshaled, unmarshaled and restored.
+func TestUpgradeState(t *testing.T) {
+	l := testListener(t, nil)
+	now := time.Now().Round(0)
+	params := &Params{
+		ProtocolVersion: ProtocolVersion,
+		Duration:        time.Hour,
+		Interval:        10 * time.Millisecond,
+		Length:          172,
+		ReceivedStats:   ReceivedStatsBoth,
+		StampAt:         AtBoth,
+		Clock:           BothClocks,
+		DSCP:            0xb8,
+		ServerFill:      "rand",
+		ReceivedTOS:     true,
+	}
+	scs := []*sconn{newSconn(l, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1),
+		Port: 5000}), newSconn(l, &net.UDPAddr{
+		IP: net.ParseIP("2001:db8::1"), Port: 6000})}
+	scs[0].ctoken = 0x886bc9a722b33eea
+	scs[0].srcIP = net.IPv4(127, 0, 0, 1)
+	scs[0].hmacKey = []byte("old key")
+	scs[0].params = params
+	scs[0].created = now.Add(-time.Minute)
+	scs[0].firstUsed = now.Add(-50 * time.Second)
+	scs[0].lastUsed = now.Add(-time.Second)
+	scs[0].packetBucket = 3.25
+	scs[0].lastSeqno = 4999
+	scs[0].receivedCount = 4990
+	scs[0].receivedWindow = 0xfffffffffffffffe
+	scs[0].rwinValid = true
+	scs[0].bytes = 860000
+	scs[1].ctoken = 1
+	scs[1].params = &Params{ProtocolVersion: ProtocolVersion,
+		Interval: time.Second}
+	scs[1].created = now
+	for _, sc := range scs {
+		l.cmgr.restore(sc)
+	}
+
+	// marshal and unmarshal state
+	s := &Server{ServerConfig: l.ServerConfig}
+	st := s.lockedUpgradeState([]*listener{l})
+	b, err := json.Marshal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ust upgradeState
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&ust); err != nil {
+		t.Fatal(err)
+	}
+	if ust.PID != st.PID || len(ust.Listeners) != 1 ||
+		ust.Listeners[0].Addr != l.conn.localAddr().String() ||
+		len(ust.Listeners[0].Sconns) != len(scs) {
+		t.Fatalf("unmarshaled state %+v, expected %+v", ust, *st)
+	}
+
+	// restore into a new listener on the same socket
+	nl := testListener(t, l.conn)
+	in := &inherited{state: &ust}
+	if n := in.restore([]*listener{nl}); n != len(scs) {
+		t.Fatalf("restored %d sconns, expected %d", n, len(scs))
+	}
+	for _, sc := range scs {
+		rsc := nl.cmgr.sconns[sc.ctoken]
+		if rsc == nil {
+			t.Errorf("sconn %016x not restored", sc.ctoken)
+			continue
+		}
+		if rsc.raddr.String() != sc.raddr.String() ||
+			!rsc.srcIP.Equal(sc.srcIP) ||
+			!bytes.Equal(rsc.hmacKey, sc.hmacKey) ||
+			*rsc.params != *sc.params ||
+			!rsc.created.Equal(sc.created) ||
+			!rsc.firstUsed.Equal(sc.firstUsed) ||
+			!rsc.lastUsed.Equal(sc.lastUsed) ||
+			rsc.packetBucket != sc.packetBucket ||
+			rsc.lastSeqno != sc.lastSeqno ||
+			rsc.receivedCount != sc.receivedCount ||
+			rsc.receivedWindow != sc.receivedWindow ||
+			rsc.rwinValid != sc.rwinValid ||
+			rsc.bytes != sc.bytes {
+			t.Errorf("sconn %016x restored as %+v, expected %+v", sc.ctoken,
+				*rsc, *sc)
+		}
+		if sc.params.ServerFill != "" && rsc.filler == nil {
+			t.Errorf("sconn %016x restored without filler", sc.ctoken)
+		}
+		if rsc.bitrate != replyBitrate(rsc.params) {
+			t.Errorf("sconn %016x restored with bitrate %g, expected %g",
+				sc.ctoken, rsc.bitrate, replyBitrate(rsc.params))
+		}
+	}
+
+	// the old HMAC key is kept, and used and unused sconns are kept apart
+	if !nl.hasPrevKey([]byte("old key")) {
+		t.Error("old HMAC key not kept")
+	}
+	if nl.cmgr.used.Len() != 1 || nl.cmgr.unused.Len() != 1 {
+		t.Errorf("%d used and %d unused sconns, expected 1 and 1",
+			nl.cmgr.used.Len(), nl.cmgr.unused.Len())
+	}
+	if c := nl.metrics.conns.Load(); c != int64(len(scs)) {
+		t.Errorf("conns metric is %d, expected %d", c, len(scs))
+	}
+}